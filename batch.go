@@ -0,0 +1,221 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File batch.go contains the methods of Collection which save, find or
+// delete many models at once.
+
+package zoom
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// forEachBatch splits the range [0, n) into consecutive batches of at most
+// PoolOptions.BatchSize elements and calls f for each of them, stopping at the
+// first error.
+func (c *Collection) forEachBatch(n int, f func(start, end int) error) error {
+	size := c.pool.options.BatchSize
+	if size <= 0 {
+		size = n
+	}
+	for start := 0; start < n; start += size {
+		end := start + size
+		if end > n {
+			end = n
+		}
+		if err := f(start, end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachIdBatch stores the ids of all the models in the collection, including
+// the soft deleted ones, in a temporary list and calls f for each batch of at
+// most PoolOptions.BatchSize ids in the list, stopping at the first error. The
+// list is a snapshot, so the models which are saved while f is called do not
+// change the batches. name is used in the key of the list (see
+// modelSpec.tmpKey), which is deleted at the end. Like the snapshot of an
+// Iterator, the list expires iteratorSnapshotTTL after the last batch was
+// fetched, in case the process stops before it can be deleted.
+func (c *Collection) forEachIdBatch(ctx context.Context, name string, f func(ids []string) error) error {
+	snapshotKey := c.spec.tmpKey(name)
+	q := newQuery(c)
+	if c.spec.softDeleteField != nil {
+		q.WithDeleted()
+	}
+	numIds := 0
+	tx := c.pool.NewTransactionContext(ctx)
+	newTransactionalQuery(q, tx).StoreIds(snapshotKey)
+	tx.Command("PEXPIRE", Args{snapshotKey, int64(iteratorSnapshotTTL / time.Millisecond)}, nil)
+	tx.Command("LLEN", Args{snapshotKey}, NewScanIntHandler(&numIds))
+	if err := tx.Exec(); err != nil {
+		return err
+	}
+	err := c.forEachBatch(numIds, func(start, end int) error {
+		ids := []string{}
+		tx := c.pool.NewTransactionContext(ctx)
+		tx.Command("LRANGE", Args{snapshotKey, start, end - 1}, NewScanStringsHandler(&ids))
+		tx.Command("PEXPIRE", Args{snapshotKey, int64(iteratorSnapshotTTL / time.Millisecond)}, nil)
+		if err := tx.Exec(); err != nil {
+			return err
+		}
+		return f(ids)
+	})
+	tx = c.pool.NewTransactionContext(ctx)
+	tx.Command("DEL", Args{snapshotKey}, nil)
+	if delErr := tx.Exec(); err == nil {
+		err = delErr
+	}
+	return err
+}
+
+// SaveMany saves all the models in models, which must be a slice of models
+// with a type corresponding to the Collection. The models are saved in
+// batches of at most PoolOptions.BatchSize models. Each batch is saved in its
+// own transaction, so if SaveMany returns an error, the models in the earlier
+// batches may have been saved.
+func (c *Collection) SaveMany(models interface{}) error {
+	return c.SaveManyContext(context.Background(), models)
+}
+
+// SaveManyContext is like SaveMany but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) SaveManyContext(ctx context.Context, models interface{}) error {
+	if c == nil {
+		return newNilCollectionError("SaveMany")
+	}
+	typ := reflect.TypeOf(models)
+	if typ == nil || typ.Kind() != reflect.Slice || typ.Elem() != c.spec.typ {
+		return fmt.Errorf("zoom: Error in SaveMany: models should be a slice of %s but got %T", c.spec.typ.String(), models)
+	}
+	all := Models(models)
+	return c.forEachBatch(len(all), func(start, end int) error {
+		t := c.pool.NewTransactionContext(ctx)
+		for _, model := range all[start:end] {
+			t.Save(c, model)
+		}
+		return t.Exec()
+	})
+}
+
+// FindMany finds the models with the given ids and scans their values into
+// models, which must be a pointer to a slice of models with a type
+// corresponding to the Collection. FindMany sets models to a new slice which
+// holds the models that were found, in the same order as ids. Unlike Find, it
+// does not return an error for the models which do not exist. Instead, it
+// returns their ids. The models are found in batches of at most
+// PoolOptions.BatchSize models, and all the commands for a batch are sent at
+// once.
+func (c *Collection) FindMany(ids []string, models interface{}) (missing []string, err error) {
+	return c.FindManyContext(context.Background(), ids, models)
+}
+
+// FindManyContext is like FindMany but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) FindManyContext(ctx context.Context, ids []string, models interface{}) (missing []string, err error) {
+	if c == nil {
+		return nil, newNilCollectionError("FindMany")
+	}
+	if err := c.checkModelsType(models); err != nil {
+		return nil, fmt.Errorf("zoom: Error in FindMany: %s", err.Error())
+	}
+	modelsVal := reflect.ValueOf(models).Elem()
+	if modelsVal.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("zoom: Error in FindMany: models should be a pointer to a slice but got %T", models)
+	}
+	found := make([]Model, len(ids))
+	exists := make([]bool, len(ids))
+	fieldNames := c.spec.fieldNames()
+	redisNames := c.spec.fieldRedisNames()
+	if err := c.forEachBatch(len(ids), func(start, end int) error {
+		t := c.pool.newReadTransaction(ctx)
+		for i := start; i < end; i++ {
+			if ids[i] == "" {
+				continue
+			}
+			model := reflect.New(c.spec.typ.Elem()).Interface().(Model)
+			model.SetModelId(ids[i])
+			mr := &modelRef{
+				collection: c,
+				model:      model,
+				spec:       c.spec,
+			}
+			found[i] = model
+			// Soft deleted models are treated as missing.
+			t.Exists(c, ids[i], &exists[i])
+			args := Args{mr.key()}
+			for _, name := range redisNames {
+				args = append(args, name)
+			}
+			scan := newScanModelRefHandler(fieldNames, mr)
+			modelExists := &exists[i]
+			t.Command("HMGET", args, func(reply interface{}) error {
+				if !*modelExists {
+					// The model does not exist, so there is nothing to scan.
+					return nil
+				}
+				return scan(reply)
+			})
+		}
+		if len(t.actions) == 0 {
+			return nil
+		}
+		return t.Exec()
+	}); err != nil {
+		return nil, err
+	}
+	results := reflect.MakeSlice(modelsVal.Type(), 0, len(ids))
+	for i, id := range ids {
+		if !exists[i] {
+			missing = append(missing, id)
+			continue
+		}
+		results = reflect.Append(results, reflect.ValueOf(found[i]))
+	}
+	modelsVal.Set(results)
+	if c.spec.typ.Implements(afterFinderType) {
+		if err := callAfterFind(results); err != nil {
+			return missing, err
+		}
+	}
+	return missing, nil
+}
+
+// DeleteMany deletes the models with the given ids. It returns a slice with
+// the same length as ids, where deleted[i] is true iff the model with id ids[i]
+// existed and was deleted. Like Delete, it does not return an error for the
+// models which do not exist. The models are deleted in batches of at most
+// PoolOptions.BatchSize models. Each batch is deleted in its own transaction,
+// so if DeleteMany returns an error, the models in the earlier batches may have
+// been deleted (as reported by deleted).
+func (c *Collection) DeleteMany(ids []string) (deleted []bool, err error) {
+	return c.DeleteManyContext(context.Background(), ids)
+}
+
+// DeleteManyContext is like DeleteMany but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) DeleteManyContext(ctx context.Context, ids []string) (deleted []bool, err error) {
+	if c == nil {
+		return nil, newNilCollectionError("DeleteMany")
+	}
+	deleted = make([]bool, len(ids))
+	err = c.forEachBatch(len(ids), func(start, end int) error {
+		t := c.pool.NewTransactionContext(ctx)
+		for i := start; i < end; i++ {
+			if ids[i] == "" {
+				continue
+			}
+			t.Delete(c, ids[i], &deleted[i])
+		}
+		if len(t.actions) == 0 {
+			return nil
+		}
+		return t.Exec()
+	})
+	return deleted, err
+}
@@ -0,0 +1,138 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File batch_test.go tests the code in batch.go
+
+package zoom
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newBatchTestCollection returns a collection of indexedTestModels which
+// belongs to a new pool with a small BatchSize, so that the tests use more
+// than one batch.
+func newBatchTestCollection(t *testing.T) *Collection {
+	pool := NewPoolWithOptions(testPool.options.WithBatchSize(3))
+	t.Cleanup(func() {
+		pool.Close()
+	})
+	col, err := pool.NewCollectionWithOptions(&indexedTestModel{}, DefaultCollectionOptions.WithIndex(true))
+	require.NoError(t, err)
+	return col
+}
+
+func TestSaveMany(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	col := newBatchTestCollection(t)
+	models := createIndexedTestModels(7)
+	require.NoError(t, col.SaveMany(models))
+	for _, model := range models {
+		expectModelExists(t, col, model)
+		expectIndexExists(t, col, model, "Int")
+	}
+	count, err := col.Count()
+	require.NoError(t, err)
+	assert.Equal(t, len(models), count)
+
+	// Saving no models should be a no-op.
+	assert.NoError(t, col.SaveMany([]*indexedTestModel{}))
+
+	// models must be a slice of the right type.
+	assert.Error(t, col.SaveMany(createTestModels(1)))
+	assert.Error(t, col.SaveMany(models[0]))
+}
+
+func TestFindMany(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	col := newBatchTestCollection(t)
+	models := createIndexedTestModels(5)
+	require.NoError(t, col.SaveMany(models))
+
+	ids := []string{models[3].Id, "missing1", models[0].Id, models[4].Id, "", models[1].Id, "missing2", models[2].Id}
+	// Any existing models in the slice should be replaced.
+	found := []*indexedTestModel{{Int: 42}}
+	missing, err := col.FindMany(ids, &found)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"missing1", "", "missing2"}, missing)
+	assert.Equal(t, []*indexedTestModel{models[3], models[0], models[4], models[1], models[2]}, found)
+
+	missing, err = col.FindMany(nil, &found)
+	require.NoError(t, err)
+	assert.Empty(t, missing)
+	assert.Empty(t, found)
+
+	// models must be a pointer to a slice of the right type.
+	_, err = col.FindMany(ids, found)
+	assert.Error(t, err)
+	_, err = col.FindMany(ids, &[]*testModel{})
+	assert.Error(t, err)
+}
+
+func TestDeleteMany(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	col := newBatchTestCollection(t)
+	models := createIndexedTestModels(5)
+	require.NoError(t, col.SaveMany(models))
+
+	ids := []string{models[0].Id, "missing", models[1].Id, models[2].Id, models[3].Id, ""}
+	deleted, err := col.DeleteMany(ids)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, false, true, true, true, false}, deleted)
+	for _, model := range models[:4] {
+		expectModelDoesNotExist(t, col, model)
+		expectIndexDoesNotExist(t, col, model, "Int")
+	}
+	expectModelExists(t, col, models[4])
+	count, err := col.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestForEachIdBatch(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	col := newBatchTestCollection(t)
+	models := createIndexedTestModels(7)
+	require.NoError(t, col.SaveMany(models))
+	conn := col.pool.NewConn()
+	defer conn.Close()
+	pattern := col.spec.keyPrefix + "tmp:*test*"
+
+	ids := []string{}
+	require.NoError(t, col.forEachIdBatch(context.Background(), "test", func(batch []string) error {
+		assert.True(t, len(batch) <= 3, "Expected at most 3 ids in a batch but got %d", len(batch))
+		ids = append(ids, batch...)
+		// The snapshot should expire in case it is never deleted.
+		keys, err := redis.Strings(conn.Do("KEYS", pattern))
+		require.NoError(t, err)
+		require.Len(t, keys, 1)
+		ttl, err := redis.Int64(conn.Do("PTTL", keys[0]))
+		require.NoError(t, err)
+		assert.True(t, ttl > 0 && ttl <= int64(iteratorSnapshotTTL/time.Millisecond), "Expected the snapshot to expire but its TTL was %d", ttl)
+		return nil
+	}))
+	expected := []string{}
+	for _, model := range models {
+		expected = append(expected, model.Id)
+	}
+	assert.ElementsMatch(t, expected, ids)
+	keys, err := redis.Strings(conn.Do("KEYS", pattern))
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
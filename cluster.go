@@ -0,0 +1,274 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File cluster.go contains code related to Redis Cluster, including
+// computing hash slots, discovering which node serves each slot and
+// keeping a connection pool for every node.
+
+package zoom
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// clusterSlots is the number of hash slots in a Redis Cluster.
+const clusterSlots = 16384
+
+// cluster keeps track of which node serves each hash slot for a pool
+// configured with cluster addresses and maintains a redis.Pool for each node.
+type cluster struct {
+	options PoolOptions
+	// dialErrors is shared with the driver and is used to count dial errors.
+	dialErrors *int64
+	mu         sync.RWMutex
+	// seeds are the addresses the cluster was configured with. They are used
+	// to discover the rest of the cluster.
+	seeds []string
+	// slots maps each hash slot to the address of the master which serves it.
+	// An empty string means the slot is not known (yet).
+	slots [clusterSlots]string
+	// pools maps the address of a node to a pool of connections to that node.
+	pools  map[string]*redis.Pool
+	closed bool
+}
+
+// newCluster returns a new cluster for the given options. It does not connect
+// to any nodes. The slots are discovered the first time a connection is needed.
+func newCluster(options PoolOptions, dialErrors *int64) *cluster {
+	seeds := make([]string, len(options.ClusterAddresses))
+	copy(seeds, options.ClusterAddresses)
+	return &cluster{
+		options:    options,
+		dialErrors: dialErrors,
+		seeds:      seeds,
+		pools:      map[string]*redis.Pool{},
+	}
+}
+
+// pool returns the pool for the node which serves the slot of key. If key is
+// empty, or if the node for the slot cannot be determined, it returns the pool
+// for one of the seed nodes. Redis will reply with a MOVED error if the wrong
+// node was chosen.
+func (c *cluster) pool(key string) *redis.Pool {
+	address := ""
+	if key != "" {
+		slot := keySlot(key)
+		address = c.slotAddress(slot)
+		if address == "" {
+			if err := c.refresh(); err == nil {
+				address = c.slotAddress(slot)
+			}
+		}
+	}
+	if address == "" {
+		address = c.seeds[0]
+	}
+	return c.nodePool(address)
+}
+
+// slotAddress returns the address of the node which serves slot, or an empty
+// string if it is not known.
+func (c *cluster) slotAddress(slot int) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.slots[slot]
+}
+
+// nodePool returns the pool for the node with the given address, creating it
+// if needed.
+func (c *cluster) nodePool(address string) *redis.Pool {
+	c.mu.RLock()
+	p, found := c.pools[address]
+	c.mu.RUnlock()
+	if found {
+		return p
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, found := c.pools[address]; found {
+		return p
+	}
+	options := c.options
+	options.Network = "tcp"
+	options.Address = address
+	// Redis Cluster only supports database 0.
+	options.Database = 0
+	p = options.newRedisPool(c.dialErrors, options.dial, nil)
+	if c.closed {
+		// Closing the new pool right away causes Get to return an error.
+		p.Close()
+	}
+	c.pools[address] = p
+	return p
+}
+
+// nodePools returns the pools for all the nodes that are currently known.
+func (c *cluster) nodePools() []*redis.Pool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	pools := make([]*redis.Pool, 0, len(c.pools))
+	for _, p := range c.pools {
+		pools = append(pools, p)
+	}
+	return pools
+}
+
+// refresh asks the known nodes for the current slot layout using the CLUSTER
+// SLOTS command and updates the slot table with the first answer it gets.
+func (c *cluster) refresh() error {
+	c.mu.RLock()
+	addresses := append([]string{}, c.seeds...)
+	for address := range c.pools {
+		if !stringSliceContains(addresses, address) {
+			addresses = append(addresses, address)
+		}
+	}
+	c.mu.RUnlock()
+	var lastErr error
+	for _, address := range addresses {
+		slots, err := c.querySlots(address)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c.mu.Lock()
+		c.slots = slots
+		c.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("zoom: could not discover cluster slots: %s", lastErr)
+}
+
+// querySlots sends the CLUSTER SLOTS command to the node at address and
+// returns the resulting slot table.
+func (c *cluster) querySlots(address string) ([clusterSlots]string, error) {
+	var slots [clusterSlots]string
+	conn := c.nodePool(address).Get()
+	defer conn.Close()
+	ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return slots, err
+	}
+	for _, r := range ranges {
+		fields, err := redis.Values(r, nil)
+		if err != nil {
+			return slots, err
+		}
+		if len(fields) < 3 {
+			return slots, fmt.Errorf("zoom: unexpected reply from CLUSTER SLOTS: %v", fields)
+		}
+		start, err := redis.Int(fields[0], nil)
+		if err != nil {
+			return slots, err
+		}
+		end, err := redis.Int(fields[1], nil)
+		if err != nil {
+			return slots, err
+		}
+		master, err := redis.Values(fields[2], nil)
+		if err != nil || len(master) < 2 {
+			return slots, fmt.Errorf("zoom: unexpected reply from CLUSTER SLOTS: %v", fields)
+		}
+		host, err := redis.String(master[0], nil)
+		if err != nil {
+			return slots, err
+		}
+		port, err := redis.Int(master[1], nil)
+		if err != nil {
+			return slots, err
+		}
+		if host == "" {
+			// An empty host means the node is the one we asked.
+			host, _, _ = net.SplitHostPort(address)
+		}
+		nodeAddress := net.JoinHostPort(host, strconv.Itoa(port))
+		for slot := start; slot <= end && slot < clusterSlots; slot++ {
+			slots[slot] = nodeAddress
+		}
+	}
+	return slots, nil
+}
+
+// handleError checks if err is a MOVED error. If it is, the slot table is
+// refreshed and handleError returns true to indicate that the command can be
+// retried.
+func (c *cluster) handleError(err error) bool {
+	slot, address, ok := parseMovedError(err)
+	if !ok {
+		return false
+	}
+	if err := c.refresh(); err != nil || c.slotAddress(slot) == "" {
+		c.mu.Lock()
+		c.slots[slot] = address
+		c.mu.Unlock()
+	}
+	return true
+}
+
+// parseMovedError returns the slot and address from a MOVED error, e.g.
+// "MOVED 3999 127.0.0.1:6381". ok is false if err is not a MOVED error.
+func parseMovedError(err error) (slot int, address string, ok bool) {
+	redisErr, isRedisErr := err.(redis.Error)
+	if !isRedisErr {
+		return 0, "", false
+	}
+	fields := strings.Fields(string(redisErr))
+	if len(fields) != 3 || fields[0] != "MOVED" {
+		return 0, "", false
+	}
+	slot, convErr := strconv.Atoi(fields[1])
+	if convErr != nil || slot < 0 || slot >= clusterSlots {
+		return 0, "", false
+	}
+	return slot, fields[2], true
+}
+
+// close closes the pools for all the nodes in the cluster.
+func (c *cluster) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	var firstErr error
+	for _, p := range c.pools {
+		if err := p.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// keySlot returns the hash slot for key. If key contains a hash tag, i.e. a
+// non-empty substring between the first occurrence of "{" and the next
+// occurrence of "}", only the hash tag is hashed. This is the same algorithm
+// used by Redis Cluster.
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start != -1 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// crc16 returns the CRC16 checksum (XMODEM variant) of s.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
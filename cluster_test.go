@@ -0,0 +1,92 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File cluster_test.go tests the code in cluster.go
+
+package zoom
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeySlot(t *testing.T) {
+	// The expected values were obtained with the CLUSTER KEYSLOT command.
+	assert.Equal(t, 12182, keySlot("foo"))
+	assert.Equal(t, 5061, keySlot("bar"))
+	assert.Equal(t, 866, keySlot("hello"))
+	// Only the hash tag should be hashed.
+	assert.Equal(t, keySlot("user1000"), keySlot("{user1000}.following"))
+	assert.Equal(t, keySlot("{user1000}.following"), keySlot("{user1000}.followers"))
+	// Only the first hash tag counts.
+	assert.Equal(t, keySlot("bar"), keySlot("foo{bar}{zap}"))
+	// Empty hash tags are ignored and the whole key is hashed.
+	assert.Equal(t, int(crc16("foo{}{bar}")%clusterSlots), keySlot("foo{}{bar}"))
+	assert.Equal(t, keySlot("{bar"), keySlot("foo{{bar}}zap"))
+}
+
+func TestParseMovedError(t *testing.T) {
+	slot, address, ok := parseMovedError(redis.Error("MOVED 3999 127.0.0.1:6381"))
+	require.True(t, ok)
+	assert.Equal(t, 3999, slot)
+	assert.Equal(t, "127.0.0.1:6381", address)
+	_, _, ok = parseMovedError(redis.Error("ASK 3999 127.0.0.1:6381"))
+	assert.False(t, ok)
+	_, _, ok = parseMovedError(redis.Error("ERR unknown command"))
+	assert.False(t, ok)
+}
+
+func TestClusterKeyLayout(t *testing.T) {
+	// Make sure the testing types are registered with testPool first, since
+	// the first collection registered for each type is used by Watch.
+	testingSetUp()
+	pool := NewPoolWithOptions(DefaultPoolOptions.WithClusterAddresses("localhost:7000"))
+	defer pool.Close()
+	col, err := pool.NewCollectionWithOptions(&indexedTestModel{}, DefaultCollectionOptions.WithIndex(true))
+	require.NoError(t, err)
+	assert.Equal(t, "{indexedTestModel}:foo", col.ModelKey("foo"))
+	assert.Equal(t, "{indexedTestModel}:all", col.IndexKey())
+	fieldKey, err := col.FieldIndexKey("Int")
+	require.NoError(t, err)
+	assert.Equal(t, "{indexedTestModel}:Int", fieldKey)
+	tmpKey := col.spec.tmpKey("filter:all")
+	assert.True(t, strings.HasPrefix(tmpKey, "tmp:{indexedTestModel}:filter:all"), "Wrong tmp key: %s", tmpKey)
+	assert.Equal(t, keySlot(col.IndexKey()), keySlot(tmpKey))
+
+	// Names with curly braces would break the hash tag.
+	_, err = pool.NewCollectionWithOptions(&testModel{}, DefaultCollectionOptions.WithName("{test}"))
+	assert.Error(t, err)
+}
+
+func TestClusterRoutingKey(t *testing.T) {
+	// Make sure the testing types are registered with testPool first, since
+	// the first collection registered for each type is used by Watch.
+	testingSetUp()
+	pool := NewPoolWithOptions(DefaultPoolOptions.WithClusterAddresses("localhost:7000"))
+	defer pool.Close()
+	indexedCol, err := pool.NewCollectionWithOptions(&indexedTestModel{}, DefaultCollectionOptions.WithIndex(true))
+	require.NoError(t, err)
+	col, err := pool.NewCollectionWithOptions(&testModel{}, DefaultCollectionOptions.WithIndex(true))
+	require.NoError(t, err)
+
+	// All the actions for a single collection should be routed by the same
+	// hash tag.
+	tx := pool.NewTransaction()
+	model := createIndexedTestModels(1)[0]
+	tx.Save(indexedCol, model)
+	tx.DeleteModelsBySetIds(indexedCol.IndexKey(), indexedCol.Name(), nil)
+	key, err := tx.routingKey()
+	require.NoError(t, err)
+	assert.Equal(t, keySlot(indexedCol.IndexKey()), keySlot(key))
+
+	// Using two collections in the same transaction is not allowed in cluster
+	// mode.
+	tx.Save(col, createTestModels(1)[0])
+	_, err = tx.routingKey()
+	assert.Error(t, err)
+}
@@ -10,9 +10,12 @@ package zoom
 
 import (
 	"container/list"
+	"context"
 	"fmt"
 	"reflect"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -26,10 +29,20 @@ type Collection struct {
 	spec  *modelSpec
 	pool  *Pool
 	index bool
+	ttl   time.Duration
+	alias bool
 }
 
 // CollectionOptions contains various options for a pool.
 type CollectionOptions struct {
+	// If Alias is true, the collection can be switched to another name with
+	// Collection.SwitchTo. Every transaction created by the pool then reads the
+	// aliases of such collections from Redis and watches them before any
+	// commands are added to it, so that every process switches to the new
+	// name at the same time. As a result, the transactions of the pool are
+	// always sent to the primary and cost one more round trip. Alias cannot be
+	// used in cluster mode.
+	Alias bool
 	// FallbackMarshalerUnmarshaler is used to marshal/unmarshal any type into a
 	// slice of bytes which is suitable for storing in the database. If Zoom does
 	// not know how to directly encode a certain type into bytes, it will use the
@@ -39,9 +52,12 @@ type CollectionOptions struct {
 	FallbackMarshalerUnmarshaler MarshalerUnmarshaler
 	// If Index is true, any model in the collection that is saved will be added
 	// to a set in Redis which acts as an index on all models in the collection.
-	// The key for the set is exposed via the IndexKey method. Queries and the
-	// FindAll, Count, and DeleteAll methods will not work for unindexed
-	// collections. This may change in future versions.
+	// The key for the set is exposed via the IndexKey method. For unindexed
+	// collections, queries and the FindAll, Count, DeleteAll and Iter methods
+	// find the models with SCAN, which takes time proportional to the number
+	// of keys in the database (O(keyspace)) rather than the number of models in
+	// the collection. It is meant for occasional maintenance of collections
+	// which are written to often.
 	Index bool
 	// Name is a unique string identifier to use for the collection in Redis. All
 	// models in this collection that are saved in the database will use the
@@ -51,13 +67,37 @@ type CollectionOptions struct {
 	// name corresponding to *models.User would be "User". If a custom name is
 	// provided, it cannot contain a colon.
 	Name string
+	// SweepInterval is the interval at which a background goroutine removes
+	// the models in the collection which have expired from the collection
+	// index and the field indexes (see Collection.SweepExpired). The goroutine
+	// is stopped when the pool is closed. A value of 0 means there is no
+	// background goroutine.
+	SweepInterval time.Duration
+	// TTL is the amount of time after which a model in the collection expires
+	// and is deleted by Redis. The expiration time is reset every time the
+	// model is saved. Models which have expired (with or without a TTL) are
+	// removed from the collection index and the field indexes lazily whenever
+	// the collection is read by FindAll, Count or a query. A value of 0 means
+	// models do not expire unless Collection.Expire or Collection.ExpireAt is
+	// called.
+	TTL time.Duration
 }
 
 // DefaultCollectionOptions is the default set of options for a collection.
 var DefaultCollectionOptions = CollectionOptions{
+	Alias: false,
 	FallbackMarshalerUnmarshaler: GobMarshalerUnmarshaler,
 	Index: false,
 	Name:  "",
+	SweepInterval: 0,
+	TTL:           0,
+}
+
+// WithAlias returns a new copy of the options with the Alias property set to
+// the given value. It does not mutate the original options.
+func (options CollectionOptions) WithAlias(alias bool) CollectionOptions {
+	options.Alias = alias
+	return options
 }
 
 // WithFallbackMarshalerUnmarshaler returns a new copy of the options with the
@@ -82,6 +122,20 @@ func (options CollectionOptions) WithName(name string) CollectionOptions {
 	return options
 }
 
+// WithSweepInterval returns a new copy of the options with the SweepInterval
+// property set to the given value. It does not mutate the original options.
+func (options CollectionOptions) WithSweepInterval(interval time.Duration) CollectionOptions {
+	options.SweepInterval = interval
+	return options
+}
+
+// WithTTL returns a new copy of the options with the TTL property set to the
+// given value. It does not mutate the original options.
+func (options CollectionOptions) WithTTL(ttl time.Duration) CollectionOptions {
+	options.TTL = ttl
+	return options
+}
+
 // NewCollection registers and returns a new collection of the given model type.
 // You must create a collection for each model type you want to save. The type
 // of model must be unique, i.e., not already registered, and must be a pointer
@@ -102,6 +156,14 @@ func (p *Pool) NewCollectionWithOptions(model Model, options CollectionOptions)
 		options.Name = getDefaultModelSpecName(typ)
 	} else if strings.Contains(options.Name, ":") {
 		return nil, fmt.Errorf("zoom: CollectionOptions.Name cannot contain a colon. Got: %s", options.Name)
+	} else if p.driver.Cluster() && strings.ContainsAny(options.Name, "{}") {
+		return nil, fmt.Errorf("zoom: CollectionOptions.Name cannot contain curly braces in cluster mode. Got: %s", options.Name)
+	}
+	if options.TTL < 0 {
+		return nil, fmt.Errorf("zoom: CollectionOptions.TTL cannot be negative. Got: %s", options.TTL)
+	}
+	if options.Alias && p.driver.Cluster() {
+		return nil, fmt.Errorf("zoom: CollectionOptions.Alias cannot be used in cluster mode")
 	}
 
 	// Make sure the name and type have not been previously registered
@@ -121,25 +183,46 @@ func (p *Pool) NewCollectionWithOptions(model Model, options CollectionOptions)
 	}
 	spec.name = options.Name
 	spec.fallback = options.FallbackMarshalerUnmarshaler
+	// In cluster mode, wrap the name in a hash tag so that all the keys for
+	// the collection hash to the same slot.
+	spec.hashTag = p.driver.Cluster()
+	spec.keyPrefix = p.options.KeyPrefix
+	spec.target = &atomic.Value{}
 	p.modelTypeToSpec[typ] = spec
 	p.modelNameToSpec[options.Name] = spec
+	if options.Alias {
+		p.aliased = append(p.aliased, spec)
+	}
 
 	collection := &Collection{
 		spec:  spec,
 		pool:  p,
 		index: options.Index,
+		ttl:   options.TTL,
+		alias: options.Alias,
 	}
 	addCollection(collection)
+	if options.SweepInterval > 0 {
+		p.startSweeper(collection, options.SweepInterval)
+	}
 	return collection, nil
 }
 
 // Name returns the name for the given collection. The name is a unique string
 // identifier to use for the collection in redis. All models in this collection
-// that are saved in the database will use the collection name as a prefix.
+// that are saved in the database will use the collection name as a prefix,
+// unless the collection has been switched to another name (see SwitchTo).
 func (c *Collection) Name() string {
 	return c.spec.name
 }
 
+// KeyName returns the name which is used as a prefix for the keys of the
+// collection. It is the same as Name unless the collection has been switched
+// to another name with SwitchTo or LoadAlias.
+func (c *Collection) KeyName() string {
+	return c.spec.keyName()
+}
+
 // addCollection adds the given spec to the list of collections iff it has not
 // already been added.
 func addCollection(collection *Collection) {
@@ -179,7 +262,8 @@ func (p *Pool) nameIsRegistered(name string) bool {
 
 // ModelKey returns the key that identifies a hash in the database
 // which contains all the fields of the model corresponding to the given
-// id. If id is an empty string, it will return an empty string.
+// id. If id is an empty string, it will return an empty string. Like all keys
+// used by Zoom, it starts with PoolOptions.KeyPrefix.
 func (c *Collection) ModelKey(id string) string {
 	if id == "" {
 		return ""
@@ -192,7 +276,8 @@ func (c *Collection) ModelKey(id string) string {
 }
 
 // IndexKey returns the key that identifies a set in the database that
-// stores all the ids for models in the given collection.
+// stores all the ids for models in the given collection. Like all keys used by
+// Zoom, it starts with PoolOptions.KeyPrefix.
 func (c *Collection) IndexKey() string {
 	return c.spec.indexKey()
 }
@@ -226,19 +311,32 @@ func newNilCollectionError(methodName string) error {
 	return fmt.Errorf("zoom: Called %s on nil collection. You must initialize the collection with Pool.NewCollection", methodName)
 }
 
-// newUnindexedCollectionError returns an error with a message describing that
-// methodName was called on a collection that was not indexed. Certain methods
-// can only be called on indexed collections.
-func newUnindexedCollectionError(methodName string) error {
-	return fmt.Errorf("zoom: %s only works for indexed collections. To index the collection, set the Index property to true in CollectionOptions when calling Pool.NewCollection", methodName)
-}
-
 // Save writes a model (a struct which satisfies the Model interface) to the
 // redis database. Save returns an error if the type of model does not match the
 // registered Collection. To make a struct satisfy the Model interface, you can
 // embed zoom.RandomId, which will generate pseudo-random ids for each model.
+//
+// If the model has an integer field with the `zoom:"version"` struct tag, Save
+// only succeeds if the stored version matches the version of model, and it
+// increments the version. Otherwise it returns a VersionConflictError. If the
+// model has a time.Time field with the `zoom:"updated"` struct tag, Save sets
+// it to the current time. If it has a time.Time field with the
+// `zoom:"created"` struct tag, Save sets it to the current time the first time
+// the model is written and to the stored created time afterwards.
+//
+// If the model has fields with the `zoom:"unique"` struct tag, Save only
+// succeeds if no other model has the same value for any of them. Otherwise it
+// returns a UniqueConstraintError. Nil pointers do not count as values, and
+// the values of soft deleted models stay taken until they are deleted. The
+// values are released when the model is deleted or saved with a new value.
 func (c *Collection) Save(model Model) error {
-	t := c.pool.NewTransaction()
+	return c.SaveContext(context.Background(), model)
+}
+
+// SaveContext is like Save but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) SaveContext(ctx context.Context, model Model) error {
+	t := c.pool.NewTransactionContext(ctx)
 	t.Save(c, model)
 	if err := t.Exec(); err != nil {
 		return err
@@ -263,18 +361,33 @@ func (t *Transaction) Save(c *Collection, model Model) {
 		t.setError(fmt.Errorf("zoom: Error in Save or Transaction.Save: %s", err.Error()))
 		return
 	}
+	if c.spec.savesWithScript() {
+		// The version must be checked and incremented atomically, soft deleted
+		// models must not be added back to the index, the created time must
+		// only be set if it does not exist and unique values must be checked
+		// before they are taken, which requires a script.
+		t.conditionalSave(c, model, nil, "save", "Save")
+		return
+	}
+	if !t.beforeSave(model) || !t.validate(c, model, c.spec.fieldNames()) {
+		return
+	}
 	// Create a modelRef and start a transaction
 	mr := &modelRef{
 		collection: c,
 		model:      model,
 		spec:       c.spec,
 	}
+	// The updated field of the model is only set once the hash is saved
+	updated := unixMicroToTime(timeToUnixMicro(time.Now()))
+	restoreUpdated := mr.stageUpdated(updated)
 	// Save indexes
 	// This must happen first, because it relies on reading the old field values
 	// from the hash for string indexes (if any)
 	t.saveFieldIndexes(mr)
 	// Save the model fields in a hash in the database
 	hashArgs, err := mr.mainHashArgs()
+	restoreUpdated()
 	if err != nil {
 		t.setError(err)
 	}
@@ -283,11 +396,18 @@ func (t *Transaction) Save(c *Collection, model Model) {
 		// The first element in hashArgs is the model key,
 		// so there are fields if the length is greater than
 		// 1.
-		t.Command("HMSET", hashArgs, nil)
+		t.Command("HMSET", hashArgs, func(interface{}) error {
+			mr.setUpdated(updated)
+			return nil
+		})
 	}
 	// Add the model id to the set of all models for this collection
 	if c.index {
-		t.Command("SADD", redis.Args{c.IndexKey(), model.ModelId()}, nil)
+		t.Command("SADD", Args{c.IndexKey(), model.ModelId()}, nil)
+	}
+	// Reset the expiration time (if any)
+	if c.ttl > 0 {
+		t.expireModel(c, model.ModelId(), time.Now().Add(c.ttl), nil)
 	}
 }
 
@@ -330,7 +450,7 @@ func (t *Transaction) saveNumericIndex(mr *modelRef, fs *fieldSpec) {
 	if err != nil {
 		t.setError(err)
 	}
-	t.Command("ZADD", redis.Args{indexKey, score, mr.model.ModelId()}, nil)
+	t.Command("ZADD", Args{indexKey, score, mr.model.ModelId()}, nil)
 }
 
 // saveBooleanIndex adds commands to the transaction for saving a boolean
@@ -345,14 +465,14 @@ func (t *Transaction) saveBooleanIndex(mr *modelRef, fs *fieldSpec) {
 	if err != nil {
 		t.setError(err)
 	}
-	t.Command("ZADD", redis.Args{indexKey, score, mr.model.ModelId()}, nil)
+	t.Command("ZADD", Args{indexKey, score, mr.model.ModelId()}, nil)
 }
 
 // saveStringIndex adds commands to the transaction for saving a string
 // index on the given field. This includes removing the old index (if any).
 func (t *Transaction) saveStringIndex(mr *modelRef, fs *fieldSpec) {
 	// Remove the old index (if any)
-	t.deleteStringIndex(mr.spec.name, mr.model.ModelId(), fs.redisName)
+	t.deleteStringIndex(mr.spec, mr.model.ModelId(), fs.name)
 	fieldValue := mr.fieldValue(fs.name)
 	for fieldValue.Kind() == reflect.Ptr {
 		if fieldValue.IsNil() {
@@ -365,7 +485,239 @@ func (t *Transaction) saveStringIndex(mr *modelRef, fs *fieldSpec) {
 	if err != nil {
 		t.setError(err)
 	}
-	t.Command("ZADD", redis.Args{indexKey, 0, member}, nil)
+	t.Command("ZADD", Args{indexKey, 0, member}, nil)
+	t.Command("HSET", Args{mr.spec.stringValuesKey(), stringValueField(fs.redisName, mr.model.ModelId()), fieldValue.String()}, nil)
+}
+
+// Create is like Save, but it only saves the model if a model with the same id
+// does not already exist. Otherwise, it returns a ModelExistsError. The check
+// and the save (including the field indexes) happen atomically in Redis, so
+// Create never overwrites a model which was saved concurrently.
+func (c *Collection) Create(model Model) error {
+	return c.CreateContext(context.Background(), model)
+}
+
+// CreateContext is like Create but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) CreateContext(ctx context.Context, model Model) error {
+	t := c.pool.NewTransactionContext(ctx)
+	t.Create(c, model)
+	return t.Exec()
+}
+
+// Create is like Save, but the model is only saved if a model with the same id
+// does not already exist when the transaction is executed. Otherwise, Exec
+// returns a ModelExistsError. The other actions in the transaction are still
+// executed.
+func (t *Transaction) Create(c *Collection, model Model) {
+	t.conditionalSave(c, model, nil, "create", "Create")
+}
+
+// Update is like Save, but it only saves the model if a model with the same id
+// already exists. Otherwise, it returns a ModelNotFoundError. The check and the
+// save (including the field indexes) happen atomically in Redis, so Update
+// never brings back a model which was deleted concurrently.
+func (c *Collection) Update(model Model) error {
+	return c.UpdateContext(context.Background(), model)
+}
+
+// UpdateContext is like Update but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) UpdateContext(ctx context.Context, model Model) error {
+	t := c.pool.NewTransactionContext(ctx)
+	t.Update(c, model)
+	return t.Exec()
+}
+
+// Update is like Save, but the model is only saved if a model with the same id
+// already exists when the transaction is executed. Otherwise, Exec returns a
+// ModelNotFoundError. The other actions in the transaction are still executed.
+func (t *Transaction) Update(c *Collection, model Model) {
+	t.conditionalSave(c, model, nil, "update", "Update")
+}
+
+// conditionalSave adds a script to the transaction which saves the given
+// fields of the model and their field indexes in the same way as Save (or all
+// the fields if fieldNames is nil), but only if the model does not exist (if
+// mode is "create") or exists (if mode is "update"). If mode is "save", the
+// model is saved whether or not it exists. If the model has a version field,
+// the script also checks that the stored version matches the version of the
+// model and increments it. The soft delete field (if any) is never saved, and
+// soft deleted models are not added back to the collection index. The created
+// field (if any) is only set if the model does not already have a created time.
+// If the value of a unique field belongs to another model, nothing is saved.
+// NOTE: this invokes a lua script which is defined in scripts/conditional_save.lua
+func (t *Transaction) conditionalSave(c *Collection, model Model, fieldNames []string, mode string, methodName string) {
+	if c == nil {
+		t.setError(newNilCollectionError(methodName))
+		return
+	}
+	if err := c.checkModelType(model); err != nil {
+		t.setError(fmt.Errorf("zoom: Error in %s or Transaction.%s: %s", methodName, methodName, err.Error()))
+		return
+	}
+	if !t.beforeSave(model) {
+		return
+	}
+	if fieldNames == nil {
+		fieldNames = c.spec.fieldNames()
+	}
+	if !t.validate(c, model, fieldNames) {
+		return
+	}
+	fieldNames = c.spec.fieldNamesToSave(fieldNames)
+	mr := &modelRef{
+		collection: c,
+		model:      model,
+		spec:       c.spec,
+	}
+	now := timeToUnixMicro(time.Now())
+	// The updated field of the model is only set if the script saves it
+	restoreUpdated := mr.stageUpdated(unixMicroToTime(now))
+	defer restoreUpdated()
+	hashArgs, err := mr.mainHashArgsForFields(fieldNames)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	addToIndex := 0
+	if c.index {
+		addToIndex = 1
+	}
+	versionField := ""
+	if c.spec.versionField != nil {
+		versionField = c.spec.versionField.redisName
+	}
+	expectedVersion := mr.version()
+	expireAt := int64(0)
+	if c.ttl > 0 {
+		expireAt = unixMilli(time.Now().Add(c.ttl))
+	}
+	keys := Args{mr.key(), c.IndexKey(), c.spec.expirationsKey(), c.spec.deletedKey(), c.spec.stringValuesKey()}
+	createdField, createdIndexed := "", 0
+	if fs := c.spec.createdField; fs != nil {
+		createdField = fs.redisName
+		if fs.indexKind != noIndex {
+			createdIndexKey, err := c.spec.fieldIndexKey(fs.name)
+			if err != nil {
+				t.setError(err)
+				return
+			}
+			keys = append(keys, createdIndexKey)
+			createdIndexed = 1
+		}
+	}
+	indexArgs, err := mr.conditionalSaveIndexArgs(fieldNames)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	indexKeys, indexArgs := splitIndexArgs(indexArgs)
+	// The first element in hashArgs is the model key, and the rest are pairs of
+	// field names and values.
+	args := variadicScriptArgs(append(keys, indexKeys...), mode, model.ModelId(), addToIndex, versionField, expectedVersion, expireAt, createdField, now, createdIndexed, (len(hashArgs)-1)/2)
+	args = append(args, hashArgs[1:]...)
+	args = append(args, indexArgs...)
+	t.Script(conditionalSaveScript, args, func(reply interface{}) error {
+		// The reply consists of a status, a version and a created time, followed
+		// by the name of a unique field and the id of the model which has the
+		// same value if the status is -2. See the script for details.
+		values, err := redis.Values(reply, nil)
+		if err != nil {
+			return err
+		}
+		if len(values) < 3 {
+			return fmt.Errorf("zoom: Error in %s: Unexpected reply from Redis: %v", methodName, values)
+		}
+		if status, _ := redis.Int64(values[0], nil); status == -2 {
+			var redisName, otherId string
+			if _, err := redis.Scan(values[3:], &redisName, &otherId); err != nil {
+				return err
+			}
+			return newUniqueConstraintError(c, c.spec.fieldNameForRedisName(redisName), otherId)
+		}
+		ints, err := redis.Int64s(values, nil)
+		if err != nil {
+			return err
+		}
+		switch status, version := ints[0], ints[1]; status {
+		case 1:
+			mr.setVersion(version)
+			mr.setCreated(ints[2])
+			mr.setUpdated(unixMicroToTime(now))
+			return nil
+		case -1:
+			return newVersionConflictError(mr, expectedVersion, version)
+		}
+		if mode == "create" {
+			return newModelExistsError(mr)
+		}
+		return newModelNotFoundError(mr)
+	})
+}
+
+// conditionalSaveIndexArgs returns the arguments which describe the field
+// indexes and unique fields for the given fields of the model to the
+// conditional_save script. There are four arguments for each index: its kind,
+// its key, the name of the field in Redis and either the score or the value of
+// the field. Use splitIndexArgs to separate the keys from the other arguments.
+func (mr *modelRef) conditionalSaveIndexArgs(fieldNames []string) (Args, error) {
+	args := Args{}
+	for _, fs := range mr.spec.fields {
+		if !stringSliceContains(fieldNames, fs.name) {
+			continue
+		}
+		if fs.unique {
+			uniqueArgs, err := mr.uniqueArgs(fs)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, uniqueArgs...)
+		}
+		if fs.indexKind == noIndex {
+			continue
+		}
+		indexKey, err := mr.spec.fieldIndexKey(fs.name)
+		if err != nil {
+			return nil, err
+		}
+		fieldValue := mr.fieldValue(fs.name)
+		switch fs.indexKind {
+		case numericIndex:
+			if fieldValue.Kind() == reflect.Ptr && fieldValue.IsNil() {
+				continue
+			}
+			args = args.Add("score", indexKey, fs.redisName, numericScore(fieldValue))
+		case booleanIndex:
+			if fieldValue.Kind() == reflect.Ptr && fieldValue.IsNil() {
+				continue
+			}
+			args = args.Add("score", indexKey, fs.redisName, boolScore(fieldValue))
+		case stringIndex:
+			for fieldValue.Kind() == reflect.Ptr && !fieldValue.IsNil() {
+				fieldValue = fieldValue.Elem()
+			}
+			if fieldValue.Kind() == reflect.Ptr {
+				args = args.Add("nullstring", indexKey, fs.redisName, "")
+			} else {
+				args = args.Add("string", indexKey, fs.redisName, fieldValue.String())
+			}
+		}
+	}
+	return args, nil
+}
+
+// splitIndexArgs splits indexArgs, which consist of groups of four arguments
+// describing indexes (see conditionalSaveIndexArgs), into the keys of the
+// indexes and the remaining groups of three arguments, so that the keys can be
+// passed to a script in KEYS.
+func splitIndexArgs(indexArgs Args) (keys Args, args Args) {
+	keys, args = Args{}, Args{}
+	for i := 0; i+3 < len(indexArgs); i += 4 {
+		keys = append(keys, indexArgs[i+1])
+		args = append(args, indexArgs[i], indexArgs[i+2], indexArgs[i+3])
+	}
+	return keys, args
 }
 
 // SaveFields saves only the given fields of the model. SaveFields uses
@@ -377,7 +729,13 @@ func (t *Transaction) saveStringIndex(mr *modelRef, fs *fieldSpec) {
 // return an error. Instead, only the given fields will be saved in the
 // database.
 func (c *Collection) SaveFields(fieldNames []string, model Model) error {
-	t := c.pool.NewTransaction()
+	return c.SaveFieldsContext(context.Background(), fieldNames, model)
+}
+
+// SaveFieldsContext is like SaveFields but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) SaveFieldsContext(ctx context.Context, fieldNames []string, model Model) error {
+	t := c.pool.NewTransactionContext(ctx)
 	t.SaveFields(c, fieldNames, model)
 	if err := t.Exec(); err != nil {
 		return err
@@ -407,18 +765,35 @@ func (t *Transaction) SaveFields(c *Collection, fieldNames []string, model Model
 			return
 		}
 	}
+	if c.spec.savesWithScript() {
+		// The version must be checked and incremented atomically, soft deleted
+		// models must not be added back to the index, the created time must
+		// only be set if it does not exist and unique values must be checked
+		// before they are taken, which requires a script.
+		t.conditionalSave(c, model, fieldNames, "save", "SaveFields")
+		return
+	}
+	if !t.beforeSave(model) || !t.validate(c, model, fieldNames) {
+		return
+	}
 	// Create a modelRef and start a transaction
 	mr := &modelRef{
 		collection: c,
 		model:      model,
 		spec:       c.spec,
 	}
+	// The updated field (if any) is always saved
+	fieldNames = c.spec.fieldNamesToSave(fieldNames)
+	// The updated field of the model is only set once the hash is saved
+	updated := unixMicroToTime(timeToUnixMicro(time.Now()))
+	restoreUpdated := mr.stageUpdated(updated)
 	// Update indexes
 	// This must happen first, because it relies on reading the old field values
 	// from the hash for string indexes (if any)
 	t.saveFieldIndexesForFields(fieldNames, mr)
 	// Get the main hash args.
 	hashArgs, err := mr.mainHashArgsForFields(fieldNames)
+	restoreUpdated()
 	if err != nil {
 		t.setError(err)
 	}
@@ -428,11 +803,18 @@ func (t *Transaction) SaveFields(c *Collection, fieldNames []string, model Model
 		// The first element in hashArgs is the model key,
 		// so there are fields if the length is greater than
 		// 1.
-		t.Command("HMSET", hashArgs, nil)
+		t.Command("HMSET", hashArgs, func(interface{}) error {
+			mr.setUpdated(updated)
+			return nil
+		})
 	}
 	// Add the model id to the set of all models for this collection
 	if c.index {
-		t.Command("SADD", redis.Args{c.IndexKey(), model.ModelId()}, nil)
+		t.Command("SADD", Args{c.IndexKey(), model.ModelId()}, nil)
+	}
+	// Reset the expiration time (if any)
+	if c.ttl > 0 {
+		t.expireModel(c, model.ModelId(), time.Now().Add(c.ttl), nil)
 	}
 }
 
@@ -443,7 +825,13 @@ func (t *Transaction) SaveFields(c *Collection, fieldNames []string, model Model
 // with the given id does not exist, if the given model was the wrong type, or
 // if there was a problem connecting to the database.
 func (c *Collection) Find(id string, model Model) error {
-	t := c.pool.NewTransaction()
+	return c.FindContext(context.Background(), id, model)
+}
+
+// FindContext is like Find but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) FindContext(ctx context.Context, id string, model Model) error {
+	t := c.pool.newReadTransaction(ctx)
 	t.Find(c, id, model)
 	if err := t.Exec(); err != nil {
 		return err
@@ -473,13 +861,15 @@ func (t *Transaction) Find(c *Collection, id string, model Model) {
 		spec:       c.spec,
 	}
 	// Check if the model actually exists
-	t.Command("EXISTS", redis.Args{mr.key()}, newModelExistsHandler(c, id))
+	t.Command("EXISTS", Args{mr.key()}, newModelExistsHandler(c, id))
+	t.checkNotSoftDeleted(c, id)
 	// Get the fields from the main hash for this model
-	args := redis.Args{mr.key()}
+	args := Args{mr.key()}
 	for _, fieldName := range mr.spec.fieldRedisNames() {
 		args = append(args, fieldName)
 	}
 	t.Command("HMGET", args, newScanModelRefHandler(mr.spec.fieldNames(), mr))
+	t.afterFind(model)
 }
 
 // FindFields is like Find but finds and sets only the specified fields. Any
@@ -487,7 +877,13 @@ func (t *Transaction) Find(c *Collection, id string, model Model) {
 // FindFields will return an error if any of the given fieldNames are not found
 // in the model type.
 func (c *Collection) FindFields(id string, fieldNames []string, model Model) error {
-	t := c.pool.NewTransaction()
+	return c.FindFieldsContext(context.Background(), id, fieldNames, model)
+}
+
+// FindFieldsContext is like FindFields but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) FindFieldsContext(ctx context.Context, id string, fieldNames []string, model Model) error {
+	t := c.pool.newReadTransaction(ctx)
 	t.FindFields(c, id, fieldNames, model)
 	if err := t.Exec(); err != nil {
 		return err
@@ -513,7 +909,7 @@ func (t *Transaction) FindFields(c *Collection, id string, fieldNames []string,
 	}
 	// Check the given field names and append the corresponding redis field names
 	// to args.
-	args := redis.Args{mr.key()}
+	args := Args{mr.key()}
 	for _, fieldName := range fieldNames {
 		if !stringSliceContains(c.spec.fieldNames(), fieldName) {
 			t.setError(fmt.Errorf("zoom: Error in FindFields or Transaction.FindFields: Collection %s does not have field named %s", c.Name(), fieldName))
@@ -525,9 +921,11 @@ func (t *Transaction) FindFields(c *Collection, id string, fieldNames []string,
 		args = append(args, c.spec.fieldsByName[fieldName].redisName)
 	}
 	// Check if the model actually exists.
-	t.Command("EXISTS", redis.Args{mr.key()}, newModelExistsHandler(c, id))
+	t.Command("EXISTS", Args{mr.key()}, newModelExistsHandler(c, id))
+	t.checkNotSoftDeleted(c, id)
 	// Get the fields from the main hash for this model
 	t.Command("HMGET", args, newScanModelRefHandler(fieldNames, mr))
+	t.afterFind(model)
 }
 
 // FindAll finds all the models of the given type. It executes the commands needed
@@ -536,11 +934,18 @@ func (t *Transaction) FindFields(c *Collection, id string, fieldNames []string,
 // FindAll will grow or shrink the models slice as needed and if any of the models in the
 // models slice are nil, FindAll will use reflection to allocate memory for them.
 // FindAll returns an error if models is the wrong type or if there was a problem connecting
-// to the database.
+// to the database. If the collection is not indexed, the models are found by scanning
+// the database, which is much slower (see CollectionOptions.Index).
 func (c *Collection) FindAll(models interface{}) error {
+	return c.FindAllContext(context.Background(), models)
+}
+
+// FindAllContext is like FindAll but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) FindAllContext(ctx context.Context, models interface{}) error {
 	// Since this is somewhat type-unsafe, we need to verify that
 	// models is the correct type
-	t := c.pool.NewTransaction()
+	t := c.pool.newReadTransaction(ctx)
 	t.FindAll(c, models)
 	if err := t.Exec(); err != nil {
 		return err
@@ -560,25 +965,36 @@ func (t *Transaction) FindAll(c *Collection, models interface{}) {
 		t.setError(newNilCollectionError("FindAll"))
 		return
 	}
-	if !c.index {
-		t.setError(newUnindexedCollectionError("FindAll"))
-		return
-	}
 	// Since this is somewhat type-unsafe, we need to verify that
 	// models is the correct type
 	if err := c.checkModelsType(models); err != nil {
 		t.setError(fmt.Errorf("zoom: Error in FindAll or Transaction.FindAll: %s", err.Error()))
 		return
 	}
+	if !c.index {
+		// The models in an unindexed collection are found by scanning the
+		// keyspace, which is also how queries work for such collections.
+		newTransactionalQuery(newQuery(c), t).Run(models)
+		return
+	}
+	t.sweepExpiredLazily(c)
 	sortArgs := c.spec.sortArgs(c.spec.indexKey(), c.spec.fieldRedisNames(), 0, 0, false)
 	fieldNames := append(c.spec.fieldNames(), "-")
 	t.Command("SORT", sortArgs, newScanModelsHandler(c.spec, fieldNames, models))
+	t.afterFindAll(c, models)
 }
 
-// Exists returns true if the collection has a model with the given id. It
-// returns an error if there was a problem connecting to the database.
+// Exists returns true if the collection has a model with the given id which
+// has not been soft deleted. It returns an error if there was a problem
+// connecting to the database.
 func (c *Collection) Exists(id string) (bool, error) {
-	t := c.pool.NewTransaction()
+	return c.ExistsContext(context.Background(), id)
+}
+
+// ExistsContext is like Exists but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) ExistsContext(ctx context.Context, id string) (bool, error) {
+	t := c.pool.newReadTransaction(ctx)
 	exists := false
 	t.Exists(c, id, &exists)
 	if err := t.Exec(); err != nil {
@@ -596,13 +1012,33 @@ func (t *Transaction) Exists(c *Collection, id string, exists *bool) {
 		t.setError(newNilCollectionError("Exists"))
 		return
 	}
-	t.Command("EXISTS", redis.Args{c.ModelKey(id)}, NewScanBoolHandler(exists))
+	t.Command("EXISTS", Args{c.ModelKey(id)}, NewScanBoolHandler(exists))
+	if c.spec.softDeleteField != nil {
+		t.Command("SISMEMBER", Args{c.spec.deletedKey(), id}, func(reply interface{}) error {
+			deleted, err := redis.Bool(reply, nil)
+			if err != nil {
+				return err
+			}
+			if deleted {
+				*exists = false
+			}
+			return nil
+		})
+	}
 }
 
 // Count returns the number of models of the given type that exist in the database.
-// It returns an error if there was a problem connecting to the database.
+// It returns an error if there was a problem connecting to the database. If the
+// collection is not indexed, the models are counted by scanning the database, which
+// is much slower (see CollectionOptions.Index).
 func (c *Collection) Count() (int, error) {
-	t := c.pool.NewTransaction()
+	return c.CountContext(context.Background())
+}
+
+// CountContext is like Count but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) CountContext(ctx context.Context) (int, error) {
+	t := c.pool.newReadTransaction(ctx)
 	count := 0
 	t.Count(c, &count)
 	if err := t.Exec(); err != nil {
@@ -621,10 +1057,11 @@ func (t *Transaction) Count(c *Collection, count *int) {
 		return
 	}
 	if !c.index {
-		t.setError(newUnindexedCollectionError("Count"))
+		newTransactionalQuery(newQuery(c), t).Count(count)
 		return
 	}
-	t.Command("SCARD", redis.Args{c.IndexKey()}, NewScanIntHandler(count))
+	t.sweepExpiredLazily(c)
+	t.Command("SCARD", Args{c.IndexKey()}, NewScanIntHandler(count))
 }
 
 // Delete removes the model with the given type and id from the database. It will
@@ -633,7 +1070,13 @@ func (t *Transaction) Count(c *Collection, count *int) {
 // or not the model was found and deleted, and will only return an error
 // if there was a problem connecting to the database.
 func (c *Collection) Delete(id string) (bool, error) {
-	t := c.pool.NewTransaction()
+	return c.DeleteContext(context.Background(), id)
+}
+
+// DeleteContext is like Delete but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) DeleteContext(ctx context.Context, id string) (bool, error) {
+	t := c.pool.NewTransactionContext(ctx)
 	deleted := false
 	t.Delete(c, id, &deleted)
 	if err := t.Exec(); err != nil {
@@ -654,20 +1097,30 @@ func (t *Transaction) Delete(c *Collection, id string, deleted *bool) {
 		t.setError(newNilCollectionError("Delete"))
 		return
 	}
+	if deleted == nil {
+		// The AfterDelete method of the model (if any) is only called if the
+		// model was deleted.
+		deleted = new(bool)
+	}
+	if !t.beforeDelete(c, id, deleted) {
+		return
+	}
 	// Delete any field indexes
 	// This must happen first, because it relies on reading the old field values
 	// from the hash for string indexes (if any)
 	t.deleteFieldIndexes(c, id)
-	var handler ReplyHandler
-	if deleted == nil {
-		handler = nil
-	} else {
-		handler = NewScanBoolHandler(deleted)
-	}
+	// Release the values of any unique fields. This must also happen before the
+	// main hash is deleted.
+	t.deleteUniqueValues(c, id)
 	// Delete the main hash
-	t.Command("DEL", redis.Args{c.Name() + ":" + id}, handler)
+	t.Command("DEL", Args{c.ModelKey(id)}, NewScanBoolHandler(deleted))
 	// Remvoe the id from the index of all models for the given type
-	t.Command("SREM", redis.Args{c.IndexKey(), id}, nil)
+	t.Command("SREM", Args{c.IndexKey(), id}, nil)
+	// Forget the expiration time (if any)
+	t.Command("ZREM", Args{c.spec.expirationsKey(), id}, nil)
+	if c.spec.softDeleteField != nil {
+		t.Command("SREM", Args{c.spec.deletedKey(), id}, nil)
+	}
 }
 
 // deleteFieldIndexes adds commands to the transaction for deleting the field
@@ -681,7 +1134,7 @@ func (t *Transaction) deleteFieldIndexes(c *Collection, id string) {
 			t.deleteNumericOrBooleanIndex(fs, c.spec, id)
 		case stringIndex:
 			// NOTE: this invokes a lua script which is defined in scripts/delete_string_index.lua
-			t.deleteStringIndex(c.Name(), id, fs.redisName)
+			t.deleteStringIndex(c.spec, id, fs.name)
 		}
 	}
 }
@@ -693,43 +1146,89 @@ func (t *Transaction) deleteNumericOrBooleanIndex(fs *fieldSpec, ms *modelSpec,
 	if err != nil {
 		t.setError(err)
 	}
-	t.Command("ZREM", redis.Args{indexKey, modelId}, nil)
+	t.Command("ZREM", Args{indexKey, modelId}, nil)
 }
 
 // DeleteAll deletes all the models of the given type in a single transaction. See
 // http://redis.io/topics/transactions. It returns the number of models deleted
-// and an error if there was a problem connecting to the database.
+// and an error if there was a problem connecting to the database. If the collection
+// is not indexed, the models are found by scanning the database right before the
+// transaction is executed, which is much slower (see CollectionOptions.Index).
 func (c *Collection) DeleteAll() (int, error) {
-	t := c.pool.NewTransaction()
-	count := 0
-	t.DeleteAll(c, &count)
-	if err := t.Exec(); err != nil {
-		return count, err
+	return c.DeleteAllContext(context.Background())
+}
+
+// DeleteAllContext is like DeleteAll but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) DeleteAllContext(ctx context.Context) (int, error) {
+	for attempt := 0; attempt < maxDeleteAllAttempts; attempt++ {
+		t := c.pool.NewTransactionContext(ctx)
+		count := 0
+		t.DeleteAll(c, &count)
+		err := t.Exec()
+		if _, ok := err.(WatchError); !ok {
+			return count, err
+		}
 	}
-	return count, nil
+	return 0, fmt.Errorf("zoom: Error in DeleteAll: The models in collection %s kept changing while they were deleted", c.Name())
 }
 
-// DeleteAll delets all models for the given model type in an existing transaction.
-// The value of count will be set to the number of models that were successfully deleted
-// when the transaction is executed. Any errors encountered will be added to the transaction
-// and returned as an error when the transaction is executed. You may pass in nil
-// for count if you do not care about the number of models that were deleted.
+// maxDeleteAllAttempts is the number of times DeleteAll reads the ids of the
+// models and tries to delete them before giving up if models keep being saved
+// concurrently.
+const maxDeleteAllAttempts = 10
+
+// DeleteAll delets all models for the given model type in an existing transaction,
+// including any models which have been soft deleted. The value of count will be set
+// to the number of models that were successfully deleted when the transaction is
+// executed. Any errors encountered will be added to the transaction and returned
+// as an error when the transaction is executed. You may pass in nil for count if
+// you do not care about the number of models that were deleted. If a model is
+// added to or removed from the collection concurrently, Exec returns a
+// WatchError (see DeleteModelsBySetIds).
 func (t *Transaction) DeleteAll(c *Collection, count *int) {
 	if c == nil {
 		t.setError(newNilCollectionError("DeleteAll"))
 		return
 	}
-	if !c.index {
-		t.setError(newUnindexedCollectionError("DeleteAll"))
-		return
-	}
 	var handler ReplyHandler
 	if count == nil {
 		handler = nil
 	} else {
 		handler = NewScanIntHandler(count)
 	}
-	t.DeleteModelsBySetIds(c.IndexKey(), c.Name(), handler)
+	if c.index {
+		t.DeleteModelsBySetIds(c.IndexKey(), c.Name(), handler)
+	} else {
+		// The ids of all the models, including the soft deleted ones, are
+		// found by scanning the keyspace.
+		idsKey := t.scanIds(c)
+		t.DeleteModelsBySetIds(idsKey, c.Name(), handler)
+		t.Command("DEL", Args{idsKey}, nil)
+	}
+	t.Command("DEL", Args{c.spec.expirationsKey()}, nil)
+	t.Command("DEL", Args{c.spec.stringValuesKey()}, nil)
+	for _, fs := range c.spec.fields {
+		if fs.unique {
+			uniqueKey, _ := c.spec.uniqueKey(fs.name)
+			t.Command("DEL", Args{uniqueKey}, nil)
+		}
+	}
+	if c.spec.softDeleteField != nil {
+		var deletedHandler ReplyHandler
+		if count != nil {
+			deletedHandler = func(reply interface{}) error {
+				deletedCount, err := redis.Int(reply, nil)
+				if err != nil {
+					return err
+				}
+				(*count) += deletedCount
+				return nil
+			}
+		}
+		t.DeleteModelsBySetIds(c.spec.deletedKey(), c.Name(), deletedHandler)
+		t.Command("DEL", Args{c.spec.deletedKey()}, nil)
+	}
 }
 
 // checkModelType returns an error iff model is not of the registered type that
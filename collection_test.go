@@ -10,6 +10,7 @@ package zoom
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 // collectionTestModel is a model type that is only used for testing
@@ -194,6 +195,243 @@ func TestSaveFieldsOverwrite(t *testing.T) {
 	expectFieldEquals(t, key, "Bool", mu, model.Bool)
 }
 
+func TestCreate(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Create a new model
+	model := createIndexedTestModels(1)[0]
+	if err := indexedTestModels.Create(model); err != nil {
+		t.Errorf("Unexpected error in indexedTestModels.Create: %s", err.Error())
+	}
+	expectModelExists(t, indexedTestModels, model)
+	for _, fieldName := range []string{"Int", "String", "Bool"} {
+		expectIndexExists(t, indexedTestModels, model, fieldName)
+	}
+
+	// Creating a model with the same id should fail and should not change the
+	// existing model or its indexes.
+	other := createIndexedTestModels(1)[0]
+	other.SetModelId(model.ModelId())
+	err := indexedTestModels.Create(other)
+	if err == nil {
+		t.Fatal("Expected an error when creating a model that already exists but got none")
+	}
+	if _, ok := err.(ModelExistsError); !ok {
+		t.Errorf("Expected a ModelExistsError but got: %T: %s", err, err.Error())
+	}
+	key := indexedTestModels.ModelKey(model.ModelId())
+	mu := indexedTestModels.spec.fallback
+	expectFieldEquals(t, key, "Int", mu, model.Int)
+	expectFieldEquals(t, key, "String", mu, model.String)
+	expectIndexExists(t, indexedTestModels, model, "String")
+}
+
+func TestUpdate(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Updating a model which does not exist should fail and should not save
+	// anything.
+	model := createIndexedTestModels(1)[0]
+	err := indexedTestModels.Update(model)
+	if err == nil {
+		t.Fatal("Expected an error when updating a model that does not exist but got none")
+	}
+	if _, ok := err.(ModelNotFoundError); !ok {
+		t.Errorf("Expected a ModelNotFoundError but got: %T: %s", err, err.Error())
+	}
+	expectModelDoesNotExist(t, indexedTestModels, model)
+	expectSetDoesNotContain(t, indexedTestModels.IndexKey(), model.ModelId())
+
+	// Updating an existing model should save the new fields and replace the old
+	// indexes.
+	model.Int = 1000
+	if err := indexedTestModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in indexedTestModels.Save: %s", err.Error())
+	}
+	old := *model
+	model.Int = 2000
+	model.String = "updated" + model.String
+	model.Bool = !model.Bool
+	if err := indexedTestModels.Update(model); err != nil {
+		t.Errorf("Unexpected error in indexedTestModels.Update: %s", err.Error())
+	}
+	key := indexedTestModels.ModelKey(model.ModelId())
+	mu := indexedTestModels.spec.fallback
+	expectFieldEquals(t, key, "Int", mu, model.Int)
+	expectFieldEquals(t, key, "String", mu, model.String)
+	expectFieldEquals(t, key, "Bool", mu, model.Bool)
+	for _, fieldName := range []string{"Int", "String", "Bool"} {
+		expectIndexExists(t, indexedTestModels, model, fieldName)
+		expectIndexDoesNotExist(t, indexedTestModels, &old, fieldName)
+	}
+}
+
+func TestSaveVersioned(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Saving a new model should set its version to 1.
+	model := &versionedTestModel{String: "foo"}
+	if err := versionedTestModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in versionedTestModels.Save: %s", err.Error())
+	}
+	if model.Version != 1 {
+		t.Errorf("Expected Version to be 1 but got %d", model.Version)
+	}
+	key := versionedTestModels.ModelKey(model.ModelId())
+	mu := versionedTestModels.spec.fallback
+	expectFieldEquals(t, key, "Version", mu, 1)
+
+	// Saving it again should increment the version.
+	stale := *model
+	model.String = "bar"
+	if err := versionedTestModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in versionedTestModels.Save: %s", err.Error())
+	}
+	if model.Version != 2 {
+		t.Errorf("Expected Version to be 2 but got %d", model.Version)
+	}
+	found := &versionedTestModel{}
+	if err := versionedTestModels.Find(model.ModelId(), found); err != nil {
+		t.Fatalf("Unexpected error in versionedTestModels.Find: %s", err.Error())
+	}
+	if !reflect.DeepEqual(model, found) {
+		t.Errorf("Found model was incorrect.\nExpected: %+v\nBut got:  %+v", model, found)
+	}
+
+	// Saving a stale copy should fail without changing anything.
+	stale.String = "baz"
+	expectVersionConflict(t, versionedTestModels.Save(&stale), 1, 2)
+	expectVersionConflict(t, versionedTestModels.SaveFields([]string{"String"}, &stale), 1, 2)
+	expectVersionConflict(t, versionedTestModels.Update(&stale), 1, 2)
+	if stale.Version != 1 {
+		t.Errorf("Expected Version to be unchanged after a conflict but got %d", stale.Version)
+	}
+	expectFieldEquals(t, key, "String", mu, "bar")
+	expectFieldEquals(t, key, "Version", mu, 2)
+	expectIndexExists(t, versionedTestModels, model, "String")
+	expectIndexDoesNotExist(t, versionedTestModels, &stale, "String")
+
+	// SaveFields should also increment the version.
+	model.String = "qux"
+	if err := versionedTestModels.SaveFields([]string{"String"}, model); err != nil {
+		t.Fatalf("Unexpected error in versionedTestModels.SaveFields: %s", err.Error())
+	}
+	if model.Version != 3 {
+		t.Errorf("Expected Version to be 3 but got %d", model.Version)
+	}
+	expectFieldEquals(t, key, "Version", mu, 3)
+
+	// Saving a model which was deleted concurrently should fail.
+	if _, err := versionedTestModels.Delete(model.ModelId()); err != nil {
+		t.Fatalf("Unexpected error in versionedTestModels.Delete: %s", err.Error())
+	}
+	expectVersionConflict(t, versionedTestModels.Save(model), 3, 0)
+	expectModelDoesNotExist(t, versionedTestModels, model)
+}
+
+func TestSaveTimestamps(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Saving a new model should set both timestamps.
+	before := time.Now().Truncate(time.Microsecond)
+	model := &timestampedTestModel{Int: 1}
+	if err := timestampedTestModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in timestampedTestModels.Save: %s", err.Error())
+	}
+	if model.CreatedAt.Before(before) || model.UpdatedAt.Before(before) {
+		t.Errorf("Timestamps were not set. CreatedAt: %s, UpdatedAt: %s", model.CreatedAt, model.UpdatedAt)
+	}
+	if !model.CreatedAt.Equal(model.UpdatedAt) {
+		t.Errorf("Expected CreatedAt and UpdatedAt to be equal but got %s and %s", model.CreatedAt, model.UpdatedAt)
+	}
+	found := &timestampedTestModel{}
+	if err := timestampedTestModels.Find(model.ModelId(), found); err != nil {
+		t.Fatalf("Unexpected error in timestampedTestModels.Find: %s", err.Error())
+	}
+	if !reflect.DeepEqual(model, found) {
+		t.Errorf("Found model was incorrect.\nExpected: %+v\nBut got:  %+v", model, found)
+	}
+	expectIndexExists(t, timestampedTestModels, model, "CreatedAt")
+	expectIndexExists(t, timestampedTestModels, model, "UpdatedAt")
+
+	// Saving it again, even from a copy without a created time, should only
+	// change the updated time.
+	createdAt := model.CreatedAt
+	time.Sleep(2 * time.Millisecond)
+	other := &timestampedTestModel{Int: 2}
+	if err := timestampedTestModels.Save(other); err != nil {
+		t.Fatalf("Unexpected error in timestampedTestModels.Save: %s", err.Error())
+	}
+	time.Sleep(2 * time.Millisecond)
+	copied := &timestampedTestModel{Int: 3}
+	copied.SetModelId(model.ModelId())
+	if err := timestampedTestModels.SaveFields([]string{"Int"}, copied); err != nil {
+		t.Fatalf("Unexpected error in timestampedTestModels.SaveFields: %s", err.Error())
+	}
+	if !copied.CreatedAt.Equal(createdAt) {
+		t.Errorf("Expected CreatedAt to be unchanged (%s) but got %s", createdAt, copied.CreatedAt)
+	}
+	if !copied.UpdatedAt.After(other.UpdatedAt) {
+		t.Errorf("Expected UpdatedAt (%s) to be after %s", copied.UpdatedAt, other.UpdatedAt)
+	}
+	expectFieldEquals(t, timestampedTestModels.ModelKey(model.ModelId()), "Int", timestampedTestModels.spec.fallback, 3)
+	expectIndexExists(t, timestampedTestModels, copied, "UpdatedAt")
+	expectIndexDoesNotExist(t, timestampedTestModels, model, "UpdatedAt")
+
+	// A failed save should not change the updated time of the model.
+	updatedAt := copied.UpdatedAt
+	if err := timestampedTestModels.Create(copied); err == nil {
+		t.Error("Expected an error in timestampedTestModels.Create but got none")
+	}
+	if !copied.UpdatedAt.Equal(updatedAt) {
+		t.Errorf("Expected UpdatedAt to be unchanged (%s) but got %s", updatedAt, copied.UpdatedAt)
+	}
+	missing := &timestampedTestModel{Int: 4}
+	if err := timestampedTestModels.Update(missing); err == nil {
+		t.Error("Expected an error in timestampedTestModels.Update but got none")
+	}
+	if !missing.UpdatedAt.IsZero() {
+		t.Errorf("Expected UpdatedAt to be zero but got %s", missing.UpdatedAt)
+	}
+
+	// The timestamps should be usable in queries.
+	ids, err := timestampedTestModels.NewQuery().Order("-UpdatedAt").Ids()
+	if err != nil {
+		t.Fatalf("Unexpected error in Query.Ids: %s", err.Error())
+	}
+	if expected := []string{model.ModelId(), other.ModelId()}; !reflect.DeepEqual(expected, ids) {
+		t.Errorf("Expected ids ordered by UpdatedAt to be %v but got %v", expected, ids)
+	}
+	ids, err = timestampedTestModels.NewQuery().Filter("CreatedAt >", createdAt).Ids()
+	if err != nil {
+		t.Fatalf("Unexpected error in Query.Ids: %s", err.Error())
+	}
+	if expected := []string{other.ModelId()}; !reflect.DeepEqual(expected, ids) {
+		t.Errorf("Expected ids filtered by CreatedAt to be %v but got %v", expected, ids)
+	}
+}
+
+// expectVersionConflict reports an error if err is not a VersionConflictError
+// with the given expected and actual versions.
+func expectVersionConflict(t *testing.T, err error, expected, actual int64) {
+	if err == nil {
+		t.Error("Expected a VersionConflictError but got no error")
+		return
+	}
+	conflict, ok := err.(VersionConflictError)
+	if !ok {
+		t.Errorf("Expected a VersionConflictError but got: %T: %s", err, err.Error())
+		return
+	}
+	if conflict.Expected != expected || conflict.Actual != actual {
+		t.Errorf("Expected a VersionConflictError with versions %d and %d but got %d and %d", expected, actual, conflict.Expected, conflict.Actual)
+	}
+}
+
 func TestFind(t *testing.T) {
 	testingSetUp()
 	defer testingTearDown()
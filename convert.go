@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"reflect"
 	"strconv"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -56,6 +57,10 @@ func scanModel(fieldNames []string, fieldValues []interface{}, mr *modelRef) err
 			if err := scanPointerVal(replyBytes, fieldVal); err != nil {
 				return err
 			}
+		case timeField:
+			if err := scanTimeVal(replyBytes, fieldVal); err != nil {
+				return err
+			}
 		default:
 			if err := scanInconvertibleVal(mr.spec.fallback, replyBytes, fieldVal); err != nil {
 				return err
@@ -132,3 +137,37 @@ func scanInconvertibleVal(marshalerUnmarshaler MarshalerUnmarshaler, src []byte,
 	}
 	return nil
 }
+
+// scanTimeVal converts src, which should be a Unix timestamp in microseconds,
+// to a time.Time and sets dest to that value
+func scanTimeVal(src []byte, dest reflect.Value) error {
+	if len(src) == 0 {
+		return nil // skip blanks
+	}
+	micros, err := strconv.ParseInt(string(src), 10, 64)
+	if err != nil {
+		return fmt.Errorf("zoom: could not convert %s to time.", string(src))
+	}
+	dest.Set(reflect.ValueOf(unixMicroToTime(micros)))
+	return nil
+}
+
+// timeToUnixMicro converts t to a Unix timestamp in microseconds, which is how
+// fields of kind timeField are stored. Unlike nanoseconds, microseconds can be
+// represented exactly by the float64 scores of a sorted set, so the values can
+// be indexed. The zero time is converted to 0.
+func timeToUnixMicro(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()*int64(time.Second/time.Microsecond) + int64(t.Nanosecond())/int64(time.Microsecond)
+}
+
+// unixMicroToTime is the inverse of timeToUnixMicro.
+func unixMicroToTime(micros int64) time.Time {
+	if micros == 0 {
+		return time.Time{}
+	}
+	perSecond := int64(time.Second / time.Microsecond)
+	return time.Unix(micros/perSecond, (micros%perSecond)*int64(time.Microsecond))
+}
@@ -0,0 +1,191 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File driver.go contains the interfaces which connect zoom to a Redis client
+// library, as well as the types zoom uses for command arguments and Lua
+// scripts.
+
+package zoom
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// Conn is a single connection to Redis. It has the same methods as redis.Conn
+// from the redigo library (github.com/garyburd/redigo/redis), which satisfies
+// it.
+//
+// Replies must use the same types as redigo: int64 for integers, []byte for
+// bulk strings, string for simple strings (e.g. "OK"), []interface{} for
+// arrays, nil for nil replies and an error value for error replies. Errors
+// inside of an array (e.g. the reply to EXEC) must be part of the array
+// instead of being returned as the error. Do returns the reply to the given
+// command and the first error from any of the replies it had to read,
+// including the replies to commands buffered by Send.
+type Conn interface {
+	// Close closes the connection or returns it to the pool it came from.
+	Close() error
+	// Err returns a non-nil value when the connection is not usable.
+	Err() error
+	// Do sends a command to the server and returns the received reply.
+	Do(commandName string, args ...interface{}) (reply interface{}, err error)
+	// Send writes the command to the client's output buffer.
+	Send(commandName string, args ...interface{}) error
+	// Flush flushes the output buffer to the Redis server.
+	Flush() error
+	// Receive receives a single reply from the Redis server.
+	Receive() (reply interface{}, err error)
+}
+
+// ConnWithTimeout is a Conn which supports a read timeout for individual
+// commands. If a Conn returned by a Driver implements ConnWithTimeout, it is
+// used to make sure transactions bound to a context with a deadline do not read
+// past the deadline.
+type ConnWithTimeout interface {
+	Conn
+	// DoWithTimeout is like Do but uses the given read timeout.
+	DoWithTimeout(timeout time.Duration, commandName string, args ...interface{}) (reply interface{}, err error)
+}
+
+// Driver is the interface between a Pool and a Redis client library. Zoom uses
+// a driver built on redigo by default. Use NewPoolWithDriver to build a pool on
+// a different driver, e.g. the one provided by the goredis package or a fake
+// for testing.
+type Driver interface {
+	// Conn returns a connection which can be used to send commands involving
+	// key, waiting for one to become available if needed. key may be empty. It
+	// must return an error if ctx is done before a connection is available.
+	Conn(ctx context.Context, key string) (Conn, error)
+	// ReplicaConn is like Conn but returns a connection to a replica which
+	// can be used for commands which only read from the database. A driver
+	// which does not support replicas should return a connection to the
+	// primary.
+	ReplicaConn(ctx context.Context) (Conn, error)
+	// Cluster returns true iff the driver sends commands to a Redis Cluster.
+	// In cluster mode, Zoom uses a hash tag for the keys of each collection and
+	// makes sure all the keys in a transaction hash to the same slot.
+	Cluster() bool
+	// HandleError is called with any error returned by Redis while executing a
+	// transaction. If it returns true and nothing was being watched, the
+	// transaction is sent again. It can be used to update internal state, e.g.
+	// after a MOVED error in cluster mode or a READONLY error after a
+	// failover.
+	HandleError(err error) bool
+	// Stats returns statistics about the connections managed by the driver.
+	Stats() DriverStats
+	// Close closes all the connections managed by the driver.
+	Close() error
+}
+
+// DriverStats contains statistics about the connections managed by a Driver.
+// See PoolStats for a description of each field.
+type DriverStats struct {
+	ActiveCount int
+	IdleCount   int
+	DialErrors  int64
+}
+
+// Args is a list of arguments for a Redis command or a Lua script.
+type Args []interface{}
+
+// Add returns the result of appending values to args.
+func (args Args) Add(values ...interface{}) Args {
+	return append(args, values...)
+}
+
+// Script is a Lua script which can be added to a transaction with
+// Transaction.Script. Scripts are sent with EVALSHA if possible, falling back
+// to EVAL if the script has not been loaded by Redis yet.
+type Script struct {
+	name     string
+	keyCount int
+	src      string
+	hash     string
+}
+
+// NewScript returns a new script. keyCount is the number of arguments which
+// are keys. They must come before any other arguments and will be available in
+// the script as KEYS. The other arguments will be available as ARGV. If
+// keyCount is negative, the number of keys varies and the first argument must
+// be the number of keys, followed by the keys and the other arguments.
+func NewScript(keyCount int, src string) *Script {
+	return NewNamedScript("", keyCount, src)
+}
+
+// NewNamedScript is like NewScript but also gives the script a name, which is
+// reported to hooks (see Hook) to identify the script.
+func NewNamedScript(name string, keyCount int, src string) *Script {
+	hash := sha1.Sum([]byte(src))
+	return &Script{
+		name:     name,
+		keyCount: keyCount,
+		src:      src,
+		hash:     hex.EncodeToString(hash[:]),
+	}
+}
+
+// Name returns the name of the script, or an empty string if it was created
+// with NewScript.
+func (s *Script) Name() string {
+	return s.name
+}
+
+// Hash returns the SHA1 hash of the script source, which is what Redis uses
+// to identify the script in EVALSHA.
+func (s *Script) Hash() string {
+	return s.hash
+}
+
+// args returns the arguments for EVAL or EVALSHA, where spec is either the
+// source or the hash of the script.
+func (s *Script) args(spec string, args Args) []interface{} {
+	if s.keyCount < 0 {
+		return append([]interface{}{spec}, args...)
+	}
+	return append([]interface{}{spec, s.keyCount}, args...)
+}
+
+// firstKey returns the first key in args, which are arguments for the script,
+// or an empty string if there are no keys.
+func (s *Script) firstKey(args Args) string {
+	if s.keyCount < 0 {
+		if len(args) < 2 || args[0] == 0 {
+			return ""
+		}
+		return keyString(args[1])
+	}
+	if s.keyCount == 0 || len(args) == 0 {
+		return ""
+	}
+	return keyString(args[0])
+}
+
+// variadicScriptArgs returns the arguments for a script with a variable number
+// of keys (see NewScript), which consist of the number of keys, the keys and
+// then args.
+func variadicScriptArgs(keys Args, args ...interface{}) Args {
+	result := append(Args{len(keys)}, keys...)
+	return append(result, args...)
+}
+
+// send writes the script to the output buffer of conn using EVAL. EVAL is used
+// because Send does not give us a chance to fall back if the script has not
+// been loaded.
+func (s *Script) send(conn Conn, args Args) error {
+	return conn.Send("EVAL", s.args(s.src, args)...)
+}
+
+// do runs the script using EVALSHA, falling back to EVAL if Redis replies that
+// the script has not been loaded.
+func (s *Script) do(conn Conn, args Args) (interface{}, error) {
+	reply, err := conn.Do("EVALSHA", s.args(s.hash, args)...)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT ") {
+		reply, err = conn.Do("EVAL", s.args(s.src, args)...)
+	}
+	return reply, err
+}
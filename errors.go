@@ -7,7 +7,18 @@
 
 package zoom
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrPoolShutdown is returned by Exec (and by anything that uses a
+// transaction) after Pool.Shutdown has been called.
+var ErrPoolShutdown = errors.New("zoom: pool is shutting down")
+
+// ErrMigrationsLocked is returned by RunMigrations and DryRunMigrations if
+// another process is running migrations.
+var ErrMigrationsLocked = errors.New("zoom: migrations are being run by another process")
 
 // ModelNotFoundError is returned from Find and Query methods if a model
 // that fits the given criteria is not found.
@@ -33,6 +44,74 @@ func newModelNotFoundError(mr *modelRef) error {
 	}
 }
 
+// ModelExistsError is returned by Create if a model with the same id already
+// exists.
+type ModelExistsError struct {
+	Collection *Collection
+	Msg        string
+}
+
+func (e ModelExistsError) Error() string {
+	return "zoom: ModelExistsError: " + e.Msg
+}
+
+func newModelExistsError(mr *modelRef) error {
+	return ModelExistsError{
+		Collection: mr.collection,
+		Msg:        fmt.Sprintf("A %s with id = %s already exists", mr.spec.name, mr.model.ModelId()),
+	}
+}
+
+// VersionConflictError is returned when saving a model with a version field
+// (see Collection.Save) if the version stored in the database does not match
+// the version of the model, which means that the model was saved (or deleted)
+// by someone else since it was found.
+type VersionConflictError struct {
+	Collection *Collection
+	Id         string
+	// Expected is the version of the model which was being saved.
+	Expected int64
+	// Actual is the version stored in the database. It is 0 if the model does
+	// not exist.
+	Actual int64
+}
+
+func (e VersionConflictError) Error() string {
+	return fmt.Sprintf("zoom: VersionConflictError: Expected %s with id = %s to have version %d but it has version %d", e.Collection.Name(), e.Id, e.Expected, e.Actual)
+}
+
+func newVersionConflictError(mr *modelRef, expected, actual int64) error {
+	return VersionConflictError{
+		Collection: mr.collection,
+		Id:         mr.model.ModelId(),
+		Expected:   expected,
+		Actual:     actual,
+	}
+}
+
+// UniqueConstraintError is returned when saving or updating a model if the
+// value of one of its unique fields (see Collection.Save) already belongs to
+// another model.
+type UniqueConstraintError struct {
+	Collection *Collection
+	// Field is the name of the unique field in the struct.
+	Field string
+	// OtherId is the id of the model which already has the same value.
+	OtherId string
+}
+
+func (e UniqueConstraintError) Error() string {
+	return fmt.Sprintf("zoom: UniqueConstraintError: The %s with id = %s already has the same value for the unique field %s", e.Collection.Name(), e.OtherId, e.Field)
+}
+
+func newUniqueConstraintError(c *Collection, fieldName, otherId string) error {
+	return UniqueConstraintError{
+		Collection: c,
+		Field:      fieldName,
+		OtherId:    otherId,
+	}
+}
+
 type WatchError struct {
 	keys []string
 }
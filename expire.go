@@ -0,0 +1,240 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File expire.go contains code related to expiring models, including the
+// Expire, ExpireAt and SweepExpired methods and the background sweeper.
+
+package zoom
+
+import (
+	"context"
+	"time"
+)
+
+// unixMilli returns t as a Unix timestamp in milliseconds, which is the
+// format used for expiration times in Redis.
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Expire sets the model with the given id to expire after the given duration.
+// Once it has expired, the model is deleted by Redis, and it is removed from
+// the collection index and the field indexes as described in SweepExpired.
+// Saving the model again does not remove the expiration time, but it resets it
+// if the collection has a TTL (see CollectionOptions.TTL). Expire returns true
+// iff the model exists.
+func (c *Collection) Expire(id string, d time.Duration) (bool, error) {
+	return c.ExpireAtContext(context.Background(), id, time.Now().Add(d))
+}
+
+// ExpireContext is like Expire but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) ExpireContext(ctx context.Context, id string, d time.Duration) (bool, error) {
+	return c.ExpireAtContext(ctx, id, time.Now().Add(d))
+}
+
+// ExpireAt is like Expire but sets the model to expire at the given time.
+func (c *Collection) ExpireAt(id string, at time.Time) (bool, error) {
+	return c.ExpireAtContext(context.Background(), id, at)
+}
+
+// ExpireAtContext is like ExpireAt but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) ExpireAtContext(ctx context.Context, id string, at time.Time) (bool, error) {
+	t := c.pool.NewTransactionContext(ctx)
+	exists := false
+	t.ExpireAt(c, id, at, &exists)
+	if err := t.Exec(); err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+// Expire sets the model with the given id to expire after the given duration
+// in an existing transaction. exists will be set to true iff the model exists
+// when the transaction is executed. You may pass in nil for exists if you do
+// not care whether or not the model exists. Any errors encountered will be
+// added to the transaction and returned as an error when the transaction is
+// executed.
+func (t *Transaction) Expire(c *Collection, id string, d time.Duration, exists *bool) {
+	t.ExpireAt(c, id, time.Now().Add(d), exists)
+}
+
+// ExpireAt is like Expire but sets the model to expire at the given time.
+func (t *Transaction) ExpireAt(c *Collection, id string, at time.Time, exists *bool) {
+	if c == nil {
+		t.setError(newNilCollectionError("ExpireAt"))
+		return
+	}
+	var handler ReplyHandler
+	if exists != nil {
+		handler = NewScanBoolHandler(exists)
+	}
+	t.expireModel(c, id, at, handler)
+}
+
+// expireModel adds a script to the transaction which sets the expiration time
+// of the model with the given id and records it so that the model can later be
+// removed from the indexes. The reply is 1 if the model exists and 0
+// otherwise.
+// NOTE: this invokes a lua script which is defined in scripts/expire_model.lua
+func (t *Transaction) expireModel(c *Collection, id string, at time.Time, handler ReplyHandler) {
+	modelKey, err := c.spec.modelKey(id)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	t.Script(expireModelScript, Args{modelKey, c.spec.expirationsKey(), id, unixMilli(at)}, handler)
+}
+
+// SweepExpired removes the models in the collection which have expired from
+// the collection index and the field indexes. Redis deletes the main hash for
+// a model when it expires, but it does not know about the indexes, so expired
+// models would otherwise still be returned by queries and counted by Count.
+// SweepExpired is called lazily by FindAll, Count and queries, and
+// periodically if CollectionOptions.SweepInterval is set, so you only need to
+// call it yourself to remove expired models before the collection is read
+// again. It returns the number of expired models that were removed.
+func (c *Collection) SweepExpired() (int, error) {
+	return c.SweepExpiredContext(context.Background())
+}
+
+// SweepExpiredContext is like SweepExpired but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) SweepExpiredContext(ctx context.Context) (int, error) {
+	t := c.pool.NewTransactionContext(ctx)
+	count := 0
+	t.SweepExpired(c, &count)
+	if err := t.Exec(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// SweepExpired removes the models in the collection which have expired from
+// the collection index and the field indexes in an existing transaction. The
+// value of count will be set to the number of expired models that were
+// removed. You may pass in nil for count if you do not care about the number of
+// models. Any errors encountered will be added to the transaction and returned
+// as an error when the transaction is executed.
+func (t *Transaction) SweepExpired(c *Collection, count *int) {
+	if c == nil {
+		t.setError(newNilCollectionError("SweepExpired"))
+		return
+	}
+	var handler ReplyHandler
+	if count != nil {
+		handler = NewScanIntHandler(count)
+	}
+	t.sweepExpired(c, handler, false)
+}
+
+// sweepExpiredLazily adds a script to the transaction which removes the
+// expired models from the indexes before they are read. This is needed even if
+// the collection does not have a TTL, since models can be expired with Expire
+// or ExpireAt. If no model is due to expire, nothing is written. If the
+// transaction is sent to a replica, which cannot be written to, the script is
+// sent to the primary first.
+func (t *Transaction) sweepExpiredLazily(c *Collection) {
+	t.sweepExpired(c, nil, true)
+}
+
+// sweepExpired adds an action to the transaction which runs the sweep_expired
+// script. The ids of the models which are due to expire are read right before
+// the transaction is executed, so that the keys of their main hashes can be
+// passed to the script. If there are none, the action is removed from the
+// transaction and handler (if any) is called with 0.
+// NOTE: this invokes a lua script which is defined in scripts/sweep_expired.lua
+func (t *Transaction) sweepExpired(c *Collection, handler ReplyHandler, optionalWrite bool) {
+	action := &Action{
+		kind:          scriptAction,
+		script:        sweepExpiredScript,
+		handler:       handler,
+		optionalWrite: optionalWrite,
+	}
+	t.actions = append(t.actions, action)
+	t.beforeExec = append(t.beforeExec, func() error {
+		now := unixMilli(time.Now())
+		ids := []string{}
+		tx := t.pool.NewTransactionContext(t.ctx)
+		tx.Command("ZRANGEBYSCORE", Args{c.spec.expirationsKey(), "-inf", now}, NewScanStringsHandler(&ids))
+		if err := tx.Exec(); err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			t.removeAction(action)
+			if handler != nil {
+				return handler(int64(0))
+			}
+			return nil
+		}
+		args, err := c.sweepExpiredArgs(now, ids)
+		if err != nil {
+			return err
+		}
+		action.args = args
+		return nil
+	})
+}
+
+// sweepExpiredArgs returns the arguments for the sweep_expired script for the
+// models with the given ids.
+func (c *Collection) sweepExpiredArgs(now int64, ids []string) (Args, error) {
+	keys := Args{c.spec.expirationsKey(), c.spec.indexKey(), c.spec.deletedKey(), c.spec.stringValuesKey()}
+	indexArgs := Args{}
+	for _, fs := range c.spec.fields {
+		if fs.unique {
+			uniqueKey, err := c.spec.uniqueKey(fs.name)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, uniqueKey)
+			indexArgs = append(indexArgs, "unique", fs.redisName)
+		}
+		if fs.indexKind == noIndex {
+			continue
+		}
+		indexKey, err := c.spec.fieldIndexKey(fs.name)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, indexKey)
+		if fs.indexKind == stringIndex {
+			indexArgs = append(indexArgs, "string", fs.redisName)
+		} else {
+			indexArgs = append(indexArgs, "score", fs.redisName)
+		}
+	}
+	args := append(Args{now, len(indexArgs) / 2}, indexArgs...)
+	for _, id := range ids {
+		modelKey, err := c.spec.modelKey(id)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, modelKey)
+		args = append(args, id)
+	}
+	return variadicScriptArgs(keys, args...), nil
+}
+
+// startSweeper starts a goroutine which calls SweepExpired for the collection
+// at the given interval until the pool is closed. Errors are not reported,
+// except to the hooks for the pool (see PoolOptions.Hooks), because the next
+// sweep will try again.
+func (p *Pool) startSweeper(c *Collection, interval time.Duration) {
+	p.sweepers.Add(1)
+	go func() {
+		defer p.sweepers.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.closing:
+				return
+			case <-ticker.C:
+				c.SweepExpired()
+			}
+		}
+	}()
+}
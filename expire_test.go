@@ -0,0 +1,220 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File expire_test.go tests the code in expire.go
+
+package zoom
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newExpireTestCollection returns a collection of indexedTestModels with the
+// given options which belongs to a new pool, so that the options do not affect
+// the other tests.
+func newExpireTestCollection(t *testing.T, options CollectionOptions) *Collection {
+	pool := NewPoolWithOptions(testPool.options)
+	t.Cleanup(func() {
+		pool.Close()
+	})
+	col, err := pool.NewCollectionWithOptions(&indexedTestModel{}, options.WithIndex(true))
+	require.NoError(t, err)
+	return col
+}
+
+// modelTTL returns the time to live of the model in milliseconds, which is -1
+// if the model does not have an expiration time.
+func modelTTL(t *testing.T, col *Collection, model Model) int64 {
+	conn := testPool.NewConn()
+	defer conn.Close()
+	ttl, err := redis.Int64(conn.Do("PTTL", col.ModelKey(model.ModelId())))
+	require.NoError(t, err)
+	return ttl
+}
+
+func TestExpire(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	col := newExpireTestCollection(t, DefaultCollectionOptions)
+	models := createIndexedTestModels(3)
+	require.NoError(t, col.SaveMany(models))
+	assert.Equal(t, int64(-1), modelTTL(t, col, models[0]))
+
+	exists, err := col.Expire(models[0].Id, 20*time.Millisecond)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = col.ExpireAt(models[1].Id, time.Now().Add(20*time.Millisecond))
+	require.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = col.Expire("missing", 20*time.Millisecond)
+	require.NoError(t, err)
+	assert.False(t, exists)
+	ttl := modelTTL(t, col, models[0])
+	assert.True(t, ttl > 0 && ttl <= 20, "Unexpected TTL: %d", ttl)
+
+	time.Sleep(40 * time.Millisecond)
+	count, err := col.SweepExpired()
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	for _, model := range models[:2] {
+		expectModelDoesNotExist(t, col, model)
+		for _, fieldName := range []string{"Int", "String", "Bool"} {
+			expectIndexDoesNotExist(t, col, model, fieldName)
+		}
+	}
+	expectModelExists(t, col, models[2])
+	expectIndexExists(t, col, models[2], "String")
+	count, err = col.SweepExpired()
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// A model which was saved again after its expiration time was set should
+	// not be removed by mistake.
+	_, err = col.Expire(models[2].Id, 20*time.Millisecond)
+	require.NoError(t, err)
+	conn := testPool.NewConn()
+	_, err = conn.Do("DEL", col.ModelKey(models[2].Id))
+	conn.Close()
+	require.NoError(t, err)
+	require.NoError(t, col.Save(models[2]))
+	time.Sleep(40 * time.Millisecond)
+	count, err = col.SweepExpired()
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+	expectModelExists(t, col, models[2])
+	assert.Equal(t, int64(-1), modelTTL(t, col, models[2]))
+}
+
+func TestCollectionTTL(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	ttl := 200 * time.Millisecond
+	col := newExpireTestCollection(t, DefaultCollectionOptions.WithTTL(ttl))
+	models := createIndexedTestModels(3)
+	for i, model := range models {
+		model.Int = i + 1
+	}
+	require.NoError(t, col.SaveMany(models[:2]))
+	require.NoError(t, col.Create(models[2]))
+	for _, model := range models {
+		remaining := modelTTL(t, col, model)
+		assert.True(t, remaining > 0 && remaining <= 200, "Unexpected TTL: %d", remaining)
+	}
+
+	// Saving a model should reset its expiration time.
+	time.Sleep(120 * time.Millisecond)
+	require.NoError(t, col.SaveFields([]string{"Int"}, models[0]))
+	time.Sleep(120 * time.Millisecond)
+
+	// The expired models should be removed lazily when the collection is read.
+	count, err := col.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	expectModelExists(t, col, models[0])
+	for _, model := range models[1:] {
+		expectModelDoesNotExist(t, col, model)
+		expectIndexDoesNotExist(t, col, model, "String")
+	}
+	ids, err := col.NewQuery().Filter("Int >=", 1).Ids()
+	require.NoError(t, err)
+	assert.Equal(t, []string{models[0].Id}, ids)
+
+	// The lazy sweep should not prevent reads from being sent to a replica.
+	tx := col.pool.newReadTransaction(context.Background())
+	tx.Count(col, &count)
+	assert.True(t, tx.useReplica())
+
+	pool := NewPoolWithOptions(testPool.options)
+	defer pool.Close()
+	_, err = pool.NewCollectionWithOptions(&indexedTestModel{}, DefaultCollectionOptions.WithTTL(-time.Second))
+	assert.Error(t, err)
+}
+
+func TestExpireWithoutTTL(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	col := newExpireTestCollection(t, DefaultCollectionOptions)
+	models := createIndexedTestModels(3)
+	for i, model := range models {
+		model.Int = i + 1
+	}
+	require.NoError(t, col.SaveMany(models))
+	_, err := col.Expire(models[0].Id, 10*time.Millisecond)
+	require.NoError(t, err)
+	time.Sleep(30 * time.Millisecond)
+
+	// The expired model should be removed lazily when the collection is read,
+	// even though the collection does not have a TTL.
+	count, err := col.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	ids, err := col.NewQuery().Filter("Int >=", 1).Order("Int").Ids()
+	require.NoError(t, err)
+	assert.Equal(t, []string{models[1].Id, models[2].Id}, ids)
+	expectIndexDoesNotExist(t, col, models[0], "String")
+}
+
+func TestExpireChangedStringIndex(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	col := newExpireTestCollection(t, DefaultCollectionOptions)
+	models := createIndexedTestModels(2)
+	require.NoError(t, col.SaveMany(models))
+	// The string index should be cleaned up with the value the model had when
+	// it expired, not the one it had when its expiration time was set.
+	_, err := col.Expire(models[0].Id, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.NoError(t, col.SetField(models[0].Id, "String", "changed"))
+	models[0].String = "changed"
+	time.Sleep(30 * time.Millisecond)
+
+	count, err := col.SweepExpired()
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	expectIndexDoesNotExist(t, col, models[0], "String")
+	expectIndexExists(t, col, models[1], "String")
+	conn := testPool.NewConn()
+	defer conn.Close()
+	values, err := redis.StringMap(conn.Do("HGETALL", col.spec.stringValuesKey()))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{stringValueField("String", models[1].Id): models[1].String}, values)
+}
+
+func TestSweepInterval(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	col := newExpireTestCollection(t, DefaultCollectionOptions.WithSweepInterval(10*time.Millisecond))
+	model := createIndexedTestModels(1)[0]
+	require.NoError(t, col.Save(model))
+	_, err := col.Expire(model.Id, 10*time.Millisecond)
+	require.NoError(t, err)
+
+	conn := testPool.NewConn()
+	defer conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		size, err := redis.Int(conn.Do("SCARD", col.IndexKey()))
+		require.NoError(t, err)
+		if size == 0 {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "The sweeper did not remove the expired model")
+		time.Sleep(10 * time.Millisecond)
+	}
+	expectIndexDoesNotExist(t, col, model, "Int")
+
+	// Closing the pool should stop the sweeper.
+	require.NoError(t, col.pool.Close())
+}
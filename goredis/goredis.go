@@ -0,0 +1,299 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// Package goredis provides a zoom.Driver which is built on the go-redis library
+// (github.com/go-redis/redis). It can be used to share a single redis.Client
+// between Zoom and the rest of an application:
+//
+//	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+//	pool := zoom.NewPoolWithDriver(goredis.NewDriver(client), zoom.DefaultPoolOptions)
+//
+// The driver does not support Redis Cluster or replicas. Clients created with
+// redis.NewFailoverClient (i.e. using Redis Sentinel) are supported.
+package goredis
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/albrow/zoom"
+	"github.com/go-redis/redis"
+)
+
+// Driver is a zoom.Driver which uses a redis.Client to connect to Redis.
+type Driver struct {
+	client *redis.Client
+}
+
+// NewDriver returns a new driver which uses client to connect to Redis.
+// Closing the driver (e.g. via zoom.Pool.Close) closes client.
+func NewDriver(client *redis.Client) *Driver {
+	return &Driver{client: client}
+}
+
+// Conn satisfies zoom.Driver. go-redis does not give direct access to its
+// connections, so the connection is only taken from the client's pool when
+// commands are sent. Commands which are buffered with Send are sent in a single
+// pipeline, which means MULTI and EXEC will always use the same connection.
+// Once a WATCH command has been sent, every command sent on the returned
+// connection uses the same underlying connection until it is closed.
+func (d *Driver) Conn(ctx context.Context, key string) (zoom.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &conn{client: d.client.WithContext(ctx)}, nil
+}
+
+// ReplicaConn satisfies zoom.Driver. Replicas are not supported, so it returns
+// a connection to the primary.
+func (d *Driver) ReplicaConn(ctx context.Context) (zoom.Conn, error) {
+	return d.Conn(ctx, "")
+}
+
+// Cluster satisfies zoom.Driver. It always returns false.
+func (d *Driver) Cluster() bool {
+	return false
+}
+
+// HandleError satisfies zoom.Driver. It always returns false.
+func (d *Driver) HandleError(err error) bool {
+	return false
+}
+
+// Stats satisfies zoom.Driver. go-redis does not count dial errors, so
+// DialErrors is always 0.
+func (d *Driver) Stats() zoom.DriverStats {
+	stats := d.client.PoolStats()
+	return zoom.DriverStats{
+		ActiveCount: int(stats.TotalConns),
+		IdleCount:   int(stats.IdleConns),
+	}
+}
+
+// Close satisfies zoom.Driver. It closes the underlying client.
+func (d *Driver) Close() error {
+	return d.client.Close()
+}
+
+var (
+	// errConnClosed is returned by the methods of a conn after it is closed.
+	errConnClosed = errors.New("goredis: connection has been closed")
+	// errNoPendingReplies is returned by Receive if no commands were sent.
+	errNoPendingReplies = errors.New("goredis: no pending replies")
+)
+
+// redisErrorType is the type of the errors go-redis uses for error replies
+// from Redis. The type itself is internal to go-redis, but Nil has the same
+// type.
+var redisErrorType = reflect.TypeOf(redis.Nil)
+
+// conn is a zoom.Conn which sends commands using a redis.Client.
+type conn struct {
+	client *redis.Client
+	// pending holds the commands buffered by Send which have not been sent yet.
+	pending [][]interface{}
+	// replies holds the replies which have been received but not returned by
+	// Receive yet.
+	replies []interface{}
+	// session is used to send commands on a dedicated connection. It is nil
+	// until a WATCH command is sent.
+	session *session
+	err     error
+}
+
+// Close satisfies zoom.Conn.
+func (c *conn) Close() error {
+	if c.err == errConnClosed {
+		return nil
+	}
+	c.err = errConnClosed
+	if c.session != nil {
+		c.session.close()
+	}
+	return nil
+}
+
+// Err satisfies zoom.Conn.
+func (c *conn) Err() error {
+	return c.err
+}
+
+// Send satisfies zoom.Conn.
+func (c *conn) Send(commandName string, args ...interface{}) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.pending = append(c.pending, append([]interface{}{commandName}, args...))
+	return nil
+}
+
+// Flush satisfies zoom.Conn.
+func (c *conn) Flush() error {
+	if c.err != nil {
+		return c.err
+	}
+	if len(c.pending) == 0 {
+		return nil
+	}
+	replies, err := c.send(c.pending)
+	c.pending = nil
+	if err != nil {
+		return err
+	}
+	c.replies = append(c.replies, replies...)
+	return nil
+}
+
+// Receive satisfies zoom.Conn.
+func (c *conn) Receive() (interface{}, error) {
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+	if len(c.replies) == 0 {
+		return nil, errNoPendingReplies
+	}
+	reply := c.replies[0]
+	c.replies = c.replies[1:]
+	if err, ok := reply.(error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Do satisfies zoom.Conn. Like redigo, it returns the reply to the given
+// command along with the first error reply, if any, to the commands that were
+// buffered by Send. If commandName is empty, Do sends the buffered commands
+// and returns the last reply.
+func (c *conn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if commandName != "" {
+		if err := c.Send(commandName, args...); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+	replies := c.replies
+	c.replies = nil
+	var reply interface{}
+	var firstErr error
+	for _, reply = range replies {
+		if err, ok := reply.(error); ok && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return reply, firstErr
+}
+
+// send sends cmds to Redis and returns the replies. Error replies are returned
+// as error values in replies. err is only non-nil if the connection failed, in
+// which case it can no longer be used.
+func (c *conn) send(cmds [][]interface{}) (replies []interface{}, err error) {
+	if c.session == nil && containsWatch(cmds) {
+		c.session = newSession(c.client)
+	}
+	var results []*redis.Cmd
+	if c.session != nil {
+		results = c.session.send(cmds)
+	} else {
+		pipe := c.client.Pipeline()
+		for _, args := range cmds {
+			results = append(results, pipe.Do(args...))
+		}
+		pipe.Exec()
+		pipe.Close()
+	}
+	replies = make([]interface{}, len(results))
+	for i, result := range results {
+		value, err := result.Result()
+		switch {
+		case err == redis.Nil:
+			replies[i] = nil
+		case err != nil && reflect.TypeOf(err) == redisErrorType:
+			replies[i] = err
+		case err != nil:
+			c.err = err
+			return nil, err
+		default:
+			replies[i] = convertReply(value)
+		}
+	}
+	return replies, nil
+}
+
+// containsWatch returns true iff one of cmds is the WATCH command.
+func containsWatch(cmds [][]interface{}) bool {
+	for _, args := range cmds {
+		if name, ok := args[0].(string); ok && strings.EqualFold(name, "WATCH") {
+			return true
+		}
+	}
+	return false
+}
+
+// convertReply converts a reply from go-redis to the type redigo would use for
+// the same reply, which is what zoom expects. go-redis uses strings for both
+// bulk strings and simple strings, so they are all converted to []byte.
+func convertReply(reply interface{}) interface{} {
+	switch reply := reply.(type) {
+	case string:
+		return []byte(reply)
+	case []interface{}:
+		converted := make([]interface{}, len(reply))
+		for i, value := range reply {
+			converted[i] = convertReply(value)
+		}
+		return converted
+	}
+	return reply
+}
+
+// session sends commands on a single dedicated connection. go-redis only gives
+// access to a dedicated connection inside of the function passed to
+// Client.Watch, so a session runs that function in a separate goroutine which
+// serves requests until the session is closed.
+type session struct {
+	requests chan [][]interface{}
+	results  chan []*redis.Cmd
+	done     chan struct{}
+}
+
+// newSession starts a new session which uses a connection from client.
+func newSession(client *redis.Client) *session {
+	s := &session{
+		requests: make(chan [][]interface{}),
+		results:  make(chan []*redis.Cmd),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		client.Watch(func(tx *redis.Tx) error {
+			for cmds := range s.requests {
+				results := make([]*redis.Cmd, len(cmds))
+				for i, args := range cmds {
+					results[i] = tx.Do(args...)
+				}
+				s.results <- results
+			}
+			return nil
+		})
+	}()
+	return s
+}
+
+// send sends cmds one at a time on the dedicated connection and returns the
+// results.
+func (s *session) send(cmds [][]interface{}) []*redis.Cmd {
+	s.requests <- cmds
+	return <-s.results
+}
+
+// close ends the session and waits for the connection to be returned to the
+// client's pool.
+func (s *session) close() {
+	close(s.requests)
+	<-s.done
+}
@@ -0,0 +1,126 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File goredis_test.go tests the code in goredis.go
+
+package goredis
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/albrow/zoom"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The tests for the zoom package use database 9 by default, and packages can
+// be tested in parallel, so use a different one here. The address flag is
+// defined by the zoom package.
+var database = flag.Int("goredis.database", 10, "the redis database number to use for testing the goredis package")
+
+type person struct {
+	Name string `zoom:"index"`
+	Age  int    `zoom:"index"`
+	zoom.RandomId
+}
+
+// newTestPool returns a pool which uses a Driver and a collection of persons.
+// The database is flushed when the test finishes.
+func newTestPool(t *testing.T) (*zoom.Pool, *zoom.Collection) {
+	client := redis.NewClient(&redis.Options{
+		Addr: flag.Lookup("address").Value.String(),
+		DB:   *database,
+	})
+	pool := zoom.NewPoolWithDriver(NewDriver(client), zoom.DefaultPoolOptions)
+	t.Cleanup(func() {
+		client.FlushDB()
+		pool.Close()
+	})
+	people, err := pool.NewCollectionWithOptions(&person{}, zoom.DefaultCollectionOptions.WithIndex(true))
+	require.NoError(t, err)
+	return pool, people
+}
+
+func TestDriver(t *testing.T) {
+	pool, people := newTestPool(t)
+	require.NoError(t, pool.Ping())
+
+	alice := &person{Name: "Alice", Age: 32}
+	bob := &person{Name: "Bob", Age: 27}
+	tx := pool.NewTransaction()
+	tx.Save(people, alice)
+	tx.Save(people, bob)
+	require.NoError(t, tx.Exec())
+
+	other := &person{}
+	require.NoError(t, people.Find(alice.Id, other))
+	assert.Equal(t, alice, other)
+	count, err := people.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// Error replies should be returned as errors.
+	tx = pool.NewTransaction()
+	tx.Command("INCR", zoom.Args{people.ModelKey(alice.Id)}, nil)
+	assert.Error(t, tx.Exec())
+
+	// Scripts should work whether or not they have been loaded.
+	conn := pool.NewConn()
+	_, err = conn.Do("SCRIPT", "FLUSH")
+	require.NoError(t, err)
+	conn.Close()
+	deleted, err := people.DeleteAll()
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+
+	stats := pool.Stats()
+	assert.Equal(t, 0, stats.InFlight)
+	assert.True(t, stats.IdleCount > 0)
+}
+
+func TestDriverWatch(t *testing.T) {
+	pool, people := newTestPool(t)
+	model := &person{Name: "Alice", Age: 32}
+	require.NoError(t, people.Save(model))
+
+	tx := pool.NewTransaction()
+	require.NoError(t, tx.Watch(model))
+	model.Age = 33
+	require.NoError(t, people.Save(model))
+	tx.Command("HSET", zoom.Args{people.ModelKey(model.Id), "Age", 34}, nil)
+	err := tx.Exec()
+	assert.IsType(t, zoom.WatchError{}, err)
+
+	other := &person{}
+	require.NoError(t, people.Find(model.Id, other))
+	assert.Equal(t, 33, other.Age)
+
+	// The connection should be usable by other transactions once the
+	// transaction is done.
+	assert.NoError(t, pool.Ping())
+	assert.Equal(t, 0, pool.Stats().InFlight)
+}
+
+func TestConnReceive(t *testing.T) {
+	pool, _ := newTestPool(t)
+	conn := pool.NewConn()
+	defer conn.Close()
+	require.NoError(t, conn.Send("SET", "foo", "bar"))
+	require.NoError(t, conn.Send("GET", "foo"))
+	require.NoError(t, conn.Send("GET", "missing"))
+	require.NoError(t, conn.Flush())
+	reply, err := conn.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("OK"), reply)
+	reply, err = conn.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("bar"), reply)
+	reply, err = conn.Receive()
+	require.NoError(t, err)
+	assert.Nil(t, reply)
+	_, err = conn.Receive()
+	assert.Equal(t, errNoPendingReplies, err)
+}
@@ -39,6 +39,25 @@ func newModelExistsHandler(collection *Collection, modelId string) ReplyHandler
 	}
 }
 
+// newModelNotSoftDeletedHandler returns a ReplyHandler which expects the reply
+// to SISMEMBER on the set of soft deleted ids and returns a ModelNotFoundError
+// if the model with the given id has been soft deleted.
+func newModelNotSoftDeletedHandler(collection *Collection, modelId string) ReplyHandler {
+	return func(reply interface{}) error {
+		deleted, err := redis.Bool(reply, nil)
+		if err != nil {
+			return err
+		}
+		if deleted {
+			return ModelNotFoundError{
+				Collection: collection,
+				Msg:        fmt.Sprintf("Could not find %s with id = %s (it has been soft deleted)", collection.spec.name, modelId),
+			}
+		}
+		return nil
+	}
+}
+
 // NewScanIntHandler returns a ReplyHandler which will convert the reply to an
 // integer and set the value of i to the converted integer. The ReplyHandler
 // will return an error if there was a problem converting the reply.
@@ -0,0 +1,195 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File hooks.go contains code related to hooks, which can be used to observe
+// the transactions and actions that are sent to Redis.
+
+package zoom
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hook is notified before and after each transaction is executed and each
+// action in it is sent to Redis. Hooks are set with PoolOptions.Hooks and
+// can be used for logging, metrics or tracing (see the tracing package). Hooks
+// are called synchronously from Transaction.Exec, possibly from many
+// goroutines at once, so they should be fast and safe for concurrent use.
+type Hook interface {
+	// BeforeExec is called at the start of Transaction.Exec. The context it
+	// returns is passed to the other methods for the same transaction, which
+	// makes it a good place to store e.g. a span.
+	BeforeExec(ctx context.Context, info *ExecInfo) context.Context
+	// AfterExec is called when Transaction.Exec returns. info.Duration and
+	// info.Err have been set.
+	AfterExec(ctx context.Context, info *ExecInfo)
+	// BeforeAction is called before an action is sent to Redis.
+	BeforeAction(ctx context.Context, info *ActionInfo)
+	// AfterAction is called after the reply to an action has been received,
+	// or once it is clear that there will be no reply (e.g. because the
+	// connection failed), in which case info.Err is set. info.ReplySize and
+	// info.Duration have been set.
+	AfterAction(ctx context.Context, info *ActionInfo)
+}
+
+// ExecInfo describes a call to Transaction.Exec.
+type ExecInfo struct {
+	// ActionCount is the number of actions in the transaction.
+	ActionCount int
+	// Watched holds the keys watched by the transaction, if any.
+	Watched []string
+	// Duration is the time it took to execute the transaction, including the
+	// time spent in the reply handlers. It is only set in AfterExec.
+	Duration time.Duration
+	// Err is the error returned by Exec. It is only set in AfterExec.
+	Err error
+}
+
+// ActionInfo describes a single action in a transaction.
+type ActionInfo struct {
+	// Command is the name of the command, e.g. "HMSET". It is "EVALSHA" for
+	// scripts, which are sent with EVAL or EVALSHA.
+	Command string
+	// Script is the name of the script for script actions (see
+	// NewNamedScript). It is empty for commands.
+	Script string
+	// ArgCount is the number of arguments, not counting the command name (or
+	// the script itself).
+	ArgCount int
+	// Collection is the name of the collection which owns the keys the action
+	// touches, or an empty string if they do not belong to a collection.
+	Collection string
+	// ReplySize is the approximate size of the reply in bytes, i.e. the total
+	// length of all the strings and integers it contains. It is only set in
+	// AfterAction.
+	ReplySize int
+	// Duration is the time between sending the action and receiving its reply.
+	// Actions in the same transaction are sent together, so they all have the
+	// same duration. It is only set in AfterAction.
+	Duration time.Duration
+	// Err is the error reply to the action, or the error which prevented the
+	// transaction from getting a reply. It is only set in AfterAction.
+	Err error
+}
+
+// newActionInfo returns the information about a which is reported to hooks.
+func (p *Pool) newActionInfo(a *Action) *ActionInfo {
+	info := &ActionInfo{
+		ArgCount:   len(a.args),
+		Collection: p.collectionForArgs(a.args),
+	}
+	switch a.kind {
+	case commandAction:
+		info.Command = strings.ToUpper(a.name)
+	case scriptAction:
+		info.Command = "EVALSHA"
+		info.Script = a.script.name
+	}
+	return info
+}
+
+// collectionForArgs returns the name of the collection which owns the first
+// argument that is a key for one of the registered collections, or an empty
+// string if there is no such argument.
+func (p *Pool) collectionForArgs(args Args) string {
+	for _, arg := range args {
+		key := keyString(arg)
+		if key == "" {
+			continue
+		}
+		for name, spec := range p.modelNameToSpec {
+			if strings.HasPrefix(key, spec.keyspace()+":") {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// replySize returns the approximate size of reply in bytes. See
+// ActionInfo.ReplySize.
+func replySize(reply interface{}) int {
+	switch reply := reply.(type) {
+	case []byte:
+		return len(reply)
+	case string:
+		return len(reply)
+	case int64:
+		return len(strconv.FormatInt(reply, 10))
+	case []interface{}:
+		size := 0
+		for _, element := range reply {
+			size += replySize(element)
+		}
+		return size
+	}
+	return 0
+}
+
+// runExecHooks calls exec, surrounded by calls to BeforeExec and AfterExec for
+// each of the hooks. Exec uses it to make sure AfterExec is called no matter
+// where exec returns. AfterExec is called in the reverse order of BeforeExec.
+func (t *Transaction) runExecHooks(hooks []Hook, exec func(ctx context.Context) error) error {
+	info := &ExecInfo{
+		ActionCount: len(t.actions),
+		Watched:     t.watching,
+	}
+	ctx := t.ctx
+	for _, hook := range hooks {
+		ctx = hook.BeforeExec(ctx, info)
+	}
+	start := time.Now()
+	info.Err = exec(ctx)
+	info.Duration = time.Since(start)
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i].AfterExec(ctx, info)
+	}
+	return info.Err
+}
+
+// beforeActions calls BeforeAction for each of the hooks and each action in
+// the transaction. It returns the information about the actions, which should
+// be passed to afterActions. It returns nil if there are no hooks.
+func (t *Transaction) beforeActions(ctx context.Context) []*ActionInfo {
+	hooks := t.pool.options.Hooks
+	if len(hooks) == 0 {
+		return nil
+	}
+	infos := make([]*ActionInfo, len(t.actions))
+	for i, a := range t.actions {
+		infos[i] = t.pool.newActionInfo(a)
+		for _, hook := range hooks {
+			hook.BeforeAction(ctx, infos[i])
+		}
+	}
+	return infos
+}
+
+// afterActions fills in the information about the actions using the replies
+// from Redis (or err, if there are no replies) and calls AfterAction for each
+// of the hooks and each action. It does nothing if infos is nil.
+func (t *Transaction) afterActions(ctx context.Context, infos []*ActionInfo, start time.Time, replies []interface{}, err error) {
+	if infos == nil {
+		return
+	}
+	duration := time.Since(start)
+	hooks := t.pool.options.Hooks
+	for i, info := range infos {
+		info.Duration = duration
+		if err != nil {
+			info.Err = err
+		} else if i < len(replies) {
+			if replyErr, ok := replies[i].(error); ok {
+				info.Err = replyErr
+			}
+			info.ReplySize = replySize(replies[i])
+		}
+		for j := len(hooks) - 1; j >= 0; j-- {
+			hooks[j].AfterAction(ctx, info)
+		}
+	}
+}
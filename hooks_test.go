@@ -0,0 +1,158 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File hooks_test.go tests the code in hooks.go
+
+package zoom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// callLog records the calls made to one or more hooks.
+type callLog struct {
+	sync.Mutex
+	calls []string
+}
+
+func (l *callLog) record(call string) {
+	l.Lock()
+	defer l.Unlock()
+	l.calls = append(l.calls, call)
+}
+
+// recordingHook is a Hook which records every call made to it in log, along
+// with the info for each transaction and action.
+type recordingHook struct {
+	name    string
+	log     *callLog
+	execs   []ExecInfo
+	actions []ActionInfo
+}
+
+type hookNameKey struct{}
+
+func (h *recordingHook) record(call string) {
+	h.log.record(call)
+}
+
+func (h *recordingHook) BeforeExec(ctx context.Context, info *ExecInfo) context.Context {
+	h.record(h.name + ".BeforeExec")
+	return context.WithValue(ctx, hookNameKey{}, h.name)
+}
+
+func (h *recordingHook) AfterExec(ctx context.Context, info *ExecInfo) {
+	h.record(fmt.Sprintf("%s.AfterExec(%v)", h.name, ctx.Value(hookNameKey{})))
+	h.execs = append(h.execs, *info)
+}
+
+func (h *recordingHook) BeforeAction(ctx context.Context, info *ActionInfo) {
+	h.record(h.name + ".BeforeAction " + info.Command)
+}
+
+func (h *recordingHook) AfterAction(ctx context.Context, info *ActionInfo) {
+	h.record(h.name + ".AfterAction " + info.Command)
+	h.actions = append(h.actions, *info)
+}
+
+func TestHooks(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	log := &callLog{}
+	first := &recordingHook{name: "first", log: log}
+	second := &recordingHook{name: "second", log: log}
+	pool := NewPoolWithOptions(testPool.options.WithHooks(first, second))
+	defer pool.Close()
+	col, err := pool.NewCollectionWithOptions(&indexedTestModel{}, DefaultCollectionOptions.WithIndex(true))
+	require.NoError(t, err)
+
+	model := createIndexedTestModels(1)[0]
+	tx := pool.NewTransaction()
+	tx.Command("HSET", Args{col.ModelKey(model.ModelId()), "String", "foo"}, nil)
+	tx.Command("HGET", Args{col.ModelKey(model.ModelId()), "String"}, nil)
+	require.NoError(t, tx.Exec())
+
+	// The Before methods should be called in order, and the After methods in
+	// reverse order, with the context returned by the last BeforeExec.
+	assert.Equal(t, []string{
+		"first.BeforeExec",
+		"second.BeforeExec",
+		"first.BeforeAction HSET",
+		"second.BeforeAction HSET",
+		"first.BeforeAction HGET",
+		"second.BeforeAction HGET",
+		"second.AfterAction HSET",
+		"first.AfterAction HSET",
+		"second.AfterAction HGET",
+		"first.AfterAction HGET",
+		"second.AfterExec(second)",
+		"first.AfterExec(second)",
+	}, log.calls)
+
+	require.Len(t, first.execs, 1)
+	assert.Equal(t, 2, first.execs[0].ActionCount)
+	assert.NoError(t, first.execs[0].Err)
+	assert.True(t, first.execs[0].Duration > 0)
+	require.Len(t, first.actions, 2)
+	for _, action := range first.actions {
+		assert.Equal(t, col.Name(), action.Collection)
+		assert.True(t, action.Duration > 0)
+		assert.NoError(t, action.Err)
+	}
+	assert.Equal(t, 3, first.actions[0].ArgCount)
+	assert.Equal(t, 1, first.actions[0].ReplySize)
+	assert.Equal(t, 2, first.actions[1].ArgCount)
+	assert.Equal(t, len("foo"), first.actions[1].ReplySize)
+
+	// Scripts should be reported by name, and errors should be reported.
+	log.calls, first.actions, first.execs = nil, nil, nil
+	tx = pool.NewTransaction()
+	tx.Command("INCR", Args{col.ModelKey(model.ModelId())}, nil)
+	tx.DeleteModelsBySetIds(col.IndexKey(), col.Name(), nil)
+	assert.Error(t, tx.Exec())
+	require.Len(t, first.actions, 2)
+	assert.Error(t, first.actions[0].Err)
+	assert.Equal(t, "EVALSHA", first.actions[1].Command)
+	assert.Equal(t, "delete_models_by_set_ids", first.actions[1].Script)
+	require.Len(t, first.execs, 1)
+	assert.Error(t, first.execs[0].Err)
+
+	// Hooks should be called for errors which happen before anything is sent,
+	// but not for the actions.
+	log.calls, first.actions, first.execs = nil, nil, nil
+	tx = pool.NewTransaction()
+	tx.setError(errors.New("test error"))
+	tx.Command("PING", nil, nil)
+	assert.Error(t, tx.Exec())
+	assert.Equal(t, []string{
+		"first.BeforeExec",
+		"second.BeforeExec",
+		"second.AfterExec(second)",
+		"first.AfterExec(second)",
+	}, log.calls)
+}
+
+func TestReplySize(t *testing.T) {
+	testCases := []struct {
+		reply    interface{}
+		expected int
+	}{
+		{nil, 0},
+		{"OK", 2},
+		{[]byte("foo"), 3},
+		{int64(-12), 3},
+		{[]interface{}{[]byte("a"), int64(10), []interface{}{[]byte("bc")}}, 5},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, replySize(tc.reply), "%v", tc.reply)
+	}
+}
@@ -11,8 +11,7 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
-
-	"github.com/garyburd/redigo/redis"
+	"time"
 )
 
 // query represents a query which will retrieve some models from
@@ -28,29 +27,25 @@ type query struct {
 	limit      uint
 	offset     uint
 	filters    []filter
+	scope      deletedScope
 	err        error
 }
 
-// newQuery creates and returns a new query with the given collection. It will
-// add an error to the query if the collection is not indexed.
+// newQuery creates and returns a new query with the given collection.
 func newQuery(collection *Collection) *query {
-	q := &query{
+	return &query{
 		collection: collection,
 		pool:       collection.pool,
 	}
-	// For now, only indexed collections are queryable. This might change in
-	// future versions.
-	if !collection.index {
-		q.setError(fmt.Errorf("zoom: error in NewQuery: Only indexed collections are queryable."))
-		return q
-	}
-	return q
 }
 
 // String satisfies fmt.Stringer and prints out the query in a format that
 // matches the go code used to declare it.
 func (q *query) String() string {
 	result := fmt.Sprintf("%s.NewQuery()", q.collection.Name())
+	if q.scope != excludeDeleted {
+		result += fmt.Sprintf(".%s", q.scope)
+	}
 	for _, filter := range q.filters {
 		result += fmt.Sprintf(".%s", filter)
 	}
@@ -102,6 +97,26 @@ func (ok orderKind) String() string {
 	return ""
 }
 
+// deletedScope determines which models a query considers in collections with a
+// soft delete field.
+type deletedScope int
+
+const (
+	excludeDeleted deletedScope = iota // only models which have not been soft deleted
+	includeDeleted                     // all models
+	onlyDeleted                        // only models which have been soft deleted
+)
+
+func (ds deletedScope) String() string {
+	switch ds {
+	case includeDeleted:
+		return "WithDeleted()"
+	case onlyDeleted:
+		return "OnlyDeleted()"
+	}
+	return ""
+}
+
 type filter struct {
 	fieldSpec *fieldSpec
 	op        filterOp
@@ -249,6 +264,39 @@ func (q *query) Exclude(fields ...string) {
 	q.excludes = append(q.excludes, fields...)
 }
 
+// WithDeleted causes the query to consider models which have been soft deleted
+// in addition to the models which have not. By default, queries exclude soft
+// deleted models. WithDeleted will set an error on the query if the collection
+// does not have a soft delete field or if OnlyDeleted was already used. The
+// error, same as any other error that occurs during the lifetime of the query,
+// is not returned until the query is executed.
+func (q *query) WithDeleted() {
+	q.setScope(includeDeleted, "WithDeleted")
+}
+
+// OnlyDeleted causes the query to consider only models which have been soft
+// deleted. OnlyDeleted will set an error on the query if the collection does
+// not have a soft delete field or if WithDeleted was already used. The error,
+// same as any other error that occurs during the lifetime of the query, is not
+// returned until the query is executed.
+func (q *query) OnlyDeleted() {
+	q.setScope(onlyDeleted, "OnlyDeleted")
+}
+
+// setScope sets the deleted scope of the query, or sets an error if that is
+// not possible. methodName is used in the error message.
+func (q *query) setScope(scope deletedScope, methodName string) {
+	if q.collection.spec.softDeleteField == nil {
+		q.setError(fmt.Errorf("zoom: error in Query.%s: %s does not have a soft delete field. You can add one with the `zoom:\"softdelete\"` struct tag.", methodName, q.collection.spec.typ.String()))
+		return
+	}
+	if q.scope != excludeDeleted && q.scope != scope {
+		q.setError(errors.New("zoom: cannot use both WithDeleted and OnlyDeleted modifiers on a query"))
+		return
+	}
+	q.scope = scope
+}
+
 // Filter applies a filter to the query, which will cause the query to only
 // return models with attributes matching the expression. filterString should be
 // an expression which includes a fieldName, a space, and an operator in that
@@ -342,9 +390,9 @@ func (filter filter) checkValType(value interface{}) error {
 // during the process of creating the set of ids. Note that tmpKeys may contain idsKey itself,
 // so the temporary keys should not be deleted until after the ids have been read from idsKey.
 func generateIdsSet(q *query, tx *Transaction) (idsKey string, tmpKeys []interface{}, err error) {
-	idsKey = q.collection.spec.indexKey()
-	tmpKeys = []interface{}{}
+	idsKey, tmpKeys = scopedIdsSet(q, tx)
 	if q.hasOrder() {
+		scopeKey := idsKey
 		fieldIndexKey, err := q.collection.spec.fieldIndexKey(q.order.fieldName)
 		if err != nil {
 			return "", nil, err
@@ -353,7 +401,7 @@ func generateIdsSet(q *query, tx *Transaction) (idsKey string, tmpKeys []interfa
 		if fieldSpec.indexKind == stringIndex {
 			// If the order is a string field, we need to extract the ids before
 			// we use ZRANGE. Create a temporary set to store the ordered ids
-			orderedIdsKey := generateRandomKey("tmp:order:" + q.order.fieldName)
+			orderedIdsKey := q.collection.spec.tmpKey("order:" + q.order.fieldName)
 			tmpKeys = append(tmpKeys, orderedIdsKey)
 			idsKey = orderedIdsKey
 			// TODO: as an optimization, if there is a filter on the same field,
@@ -362,9 +410,18 @@ func generateIdsSet(q *query, tx *Transaction) (idsKey string, tmpKeys []interfa
 		} else {
 			idsKey = fieldIndexKey
 		}
+		if q.collection.spec.softDeleteField != nil {
+			// The field indexes still contain the soft deleted models, so we need
+			// to intersect the ordered ids with the ids in scope. The weights
+			// preserve the order.
+			scopedOrderKey := q.collection.spec.tmpKey("order:scoped")
+			tmpKeys = append(tmpKeys, scopedOrderKey)
+			tx.Command("ZINTERSTORE", Args{scopedOrderKey, 2, idsKey, scopeKey, "WEIGHTS", 1, 0}, nil)
+			idsKey = scopedOrderKey
+		}
 	}
 	if q.hasFilters() {
-		filteredIdsKey := generateRandomKey("tmp:filter:all")
+		filteredIdsKey := q.collection.spec.tmpKey("filter:all")
 		tmpKeys = append(tmpKeys, filteredIdsKey)
 		for i, filter := range q.filters {
 			if i == 0 {
@@ -384,6 +441,43 @@ func generateIdsSet(q *query, tx *Transaction) (idsKey string, tmpKeys []interfa
 	return idsKey, tmpKeys, nil
 }
 
+// scopedIdsSet returns the key of the set which contains the ids of all the
+// models in the deleted scope of the query, along with any temporary keys which
+// were created.
+func scopedIdsSet(q *query, tx *Transaction) (idsKey string, tmpKeys []interface{}) {
+	tmpKeys = []interface{}{}
+	if !q.collection.index && q.scope != onlyDeleted {
+		return scannedIdsSet(q, tx)
+	}
+	switch q.scope {
+	case includeDeleted:
+		allIdsKey := q.collection.spec.tmpKey("scope:all")
+		tmpKeys = append(tmpKeys, allIdsKey)
+		tx.Command("SUNIONSTORE", Args{allIdsKey, q.collection.spec.indexKey(), q.collection.spec.deletedKey()}, nil)
+		return allIdsKey, tmpKeys
+	case onlyDeleted:
+		return q.collection.spec.deletedKey(), tmpKeys
+	}
+	return q.collection.spec.indexKey(), tmpKeys
+}
+
+// scannedIdsSet is like scopedIdsSet for collections which are not indexed. The
+// ids of the models are found by scanning the keyspace of the collection (see
+// Transaction.scanIds). The set of soft deleted models is still maintained, so
+// the soft deleted models are removed from the scanned ids unless the query
+// includes them.
+func scannedIdsSet(q *query, tx *Transaction) (idsKey string, tmpKeys []interface{}) {
+	allIdsKey := tx.scanIds(q.collection)
+	tmpKeys = []interface{}{allIdsKey}
+	if q.scope == includeDeleted || q.collection.spec.softDeleteField == nil {
+		return allIdsKey, tmpKeys
+	}
+	scopedIdsKey := q.collection.spec.tmpKey("scope:scanned")
+	tmpKeys = append(tmpKeys, scopedIdsKey)
+	tx.Command("SDIFFSTORE", Args{scopedIdsKey, allIdsKey, q.collection.spec.deletedKey()}, nil)
+	return scopedIdsKey, tmpKeys
+}
+
 // intersectFilter adds commands to the query transaction which, when run, will create a
 // temporary set which contains all the ids that fit the given filter criteria. Then it will
 // intersect them with origKey and stores the result in destKey. The function will automatically
@@ -410,44 +504,49 @@ func intersectNumericFilter(q *query, tx *Transaction, filter filter, origKey st
 	if err != nil {
 		return err
 	}
+	value := filter.value.Interface()
+	if filter.fieldSpec.kind == timeField {
+		// Times are indexed by their Unix timestamps in microseconds
+		value = timeToUnixMicro(reflect.Indirect(filter.value).Interface().(time.Time))
+	}
 	if filter.op == notEqualOp {
 		// Special case for not equal. We need to use two separate commands
-		valueExclusive := fmt.Sprintf("(%v", filter.value.Interface())
-		filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
+		valueExclusive := fmt.Sprintf("(%v", value)
+		filterKey := q.collection.spec.tmpKey("filter:" + fieldIndexKey)
 		// ZADD all ids greater than filter.value
 		tx.ExtractIdsFromFieldIndex(fieldIndexKey, filterKey, valueExclusive, "+inf")
 		// ZADD all ids less than filter.value
 		tx.ExtractIdsFromFieldIndex(fieldIndexKey, filterKey, "-inf", valueExclusive)
 		// Intersect filterKey with origKey and store result in destKey
-		tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
+		tx.Command("ZINTERSTORE", Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
 		// Delete the temporary key
-		tx.Command("DEL", redis.Args{filterKey}, nil)
+		tx.Command("DEL", Args{filterKey}, nil)
 	} else {
 		var min, max interface{}
 		switch filter.op {
 		case equalOp:
-			min, max = filter.value.Interface(), filter.value.Interface()
+			min, max = value, value
 		case lessOp:
 			min = "-inf"
 			// use "(" for exclusive
-			max = fmt.Sprintf("(%v", filter.value.Interface())
+			max = fmt.Sprintf("(%v", value)
 		case greaterOp:
-			min = fmt.Sprintf("(%v", filter.value.Interface())
+			min = fmt.Sprintf("(%v", value)
 			max = "+inf"
 		case lessOrEqualOp:
 			min = "-inf"
-			max = filter.value.Interface()
+			max = value
 		case greaterOrEqualOp:
-			min = filter.value.Interface()
+			min = value
 			max = "+inf"
 		}
 		// Get all the ids that fit the filter criteria and store them in a temporary key caled filterKey
-		filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
+		filterKey := q.collection.spec.tmpKey("filter:" + fieldIndexKey)
 		tx.ExtractIdsFromFieldIndex(fieldIndexKey, filterKey, min, max)
 		// Intersect filterKey with origKey and store result in destKey
-		tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
+		tx.Command("ZINTERSTORE", Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
 		// Delete the temporary key
-		tx.Command("DEL", redis.Args{filterKey}, nil)
+		tx.Command("DEL", Args{filterKey}, nil)
 	}
 	return nil
 }
@@ -511,12 +610,12 @@ func intersectBoolFilter(q *query, tx *Transaction, filter filter, origKey strin
 		}
 	}
 	// Get all the ids that fit the filter criteria and store them in a temporary key caled filterKey
-	filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
+	filterKey := q.collection.spec.tmpKey("filter:" + fieldIndexKey)
 	tx.ExtractIdsFromFieldIndex(fieldIndexKey, filterKey, min, max)
 	// Intersect filterKey with origKey and store result in destKey
-	tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
+	tx.Command("ZINTERSTORE", Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
 	// Delete the temporary key
-	tx.Command("DEL", redis.Args{filterKey}, nil)
+	tx.Command("DEL", Args{filterKey}, nil)
 	return nil
 }
 
@@ -532,7 +631,7 @@ func intersectStringFilter(q *query, tx *Transaction, filter filter, origKey str
 	valString := filter.value.String()
 	if filter.op == notEqualOp {
 		// Special case for not equal. We need to use two separate commands
-		filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
+		filterKey := q.collection.spec.tmpKey("filter:" + fieldIndexKey)
 		// ZADD all ids greater than filter.value
 		min := "(" + valString + nullString + delString
 		tx.ExtractIdsFromStringIndex(fieldIndexKey, filterKey, min, "+")
@@ -540,9 +639,9 @@ func intersectStringFilter(q *query, tx *Transaction, filter filter, origKey str
 		max := "(" + valString
 		tx.ExtractIdsFromStringIndex(fieldIndexKey, filterKey, "-", max)
 		// Intersect filterKey with origKey and store result in destKey
-		tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
+		tx.Command("ZINTERSTORE", Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
 		// Delete the temporary key
-		tx.Command("DEL", redis.Args{filterKey}, nil)
+		tx.Command("DEL", Args{filterKey}, nil)
 	} else {
 		var min, max string
 		switch filter.op {
@@ -563,12 +662,12 @@ func intersectStringFilter(q *query, tx *Transaction, filter filter, origKey str
 			max = "+"
 		}
 		// Get all the ids that fit the filter criteria and store them in a temporary key caled filterKey
-		filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
+		filterKey := q.collection.spec.tmpKey("filter:" + fieldIndexKey)
 		tx.ExtractIdsFromStringIndex(fieldIndexKey, filterKey, min, max)
 		// Intersect filterKey with origKey and store result in destKey
-		tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
+		tx.Command("ZINTERSTORE", Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
 		// Delete the temporary key
-		tx.Command("DEL", redis.Args{filterKey}, nil)
+		tx.Command("DEL", Args{filterKey}, nil)
 	}
 	return nil
 }
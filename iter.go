@@ -0,0 +1,228 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File iter.go contains code related to iterating over the models in a
+// collection or the results of a query in batches.
+
+package zoom
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// iteratorSnapshotTTL is how long the snapshot of ids for an Iterator is kept
+// after the last batch was fetched, in case Close is never called.
+const iteratorSnapshotTTL = 10 * time.Minute
+
+// Iterator iterates over the models in a collection or the results of a query
+// without reading all of them into memory at once. The ids of the models are
+// stored in a snapshot when Next is called for the first time, so models which
+// are created afterwards are not included, and the models are then fetched in
+// batches of PoolOptions.BatchSize (see WithBatchSize). Models which are deleted
+// after the snapshot was taken are skipped. The fields of the models are read
+// when their batch is fetched, so they may be more recent than the snapshot.
+// You must call Close when you are done with an Iterator. A typical loop looks
+// like this:
+//
+//	iter := People.Iter()
+//	defer iter.Close()
+//	for iter.Next() {
+//		person := iter.Model().(*Person)
+//		// do something with person
+//	}
+//	if err := iter.Err(); err != nil {
+//		// handle error
+//	}
+type Iterator struct {
+	query       *query
+	ctx         context.Context
+	batchSize   int
+	snapshotKey string
+	// offset is the index of the first id in the next batch
+	offset int
+	// batch holds the models in the current batch and index is the index of
+	// the current model in it
+	batch  reflect.Value
+	index  int
+	done   bool
+	closed bool
+	err    error
+}
+
+// Iter returns an Iterator over all the models in the collection (excluding
+// soft deleted models). It is like FindAll, but fetches the models in batches.
+// See Iterator for details.
+func (c *Collection) Iter() *Iterator {
+	return c.IterContext(context.Background())
+}
+
+// IterContext is like Iter but uses the given context for every batch. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) IterContext(ctx context.Context) *Iterator {
+	if c == nil {
+		return &Iterator{err: newNilCollectionError("Iter")}
+	}
+	return c.NewQuery().IterContext(ctx)
+}
+
+// Iter returns an Iterator over the models which match the query. It is like
+// Run, but fetches the models in batches. The order, limit, offset, includes
+// and excludes of the query are respected. See Iterator for details.
+func (q *Query) Iter() *Iterator {
+	return q.IterContext(context.Background())
+}
+
+// IterContext is like Iter but uses the given context for every batch. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (q *Query) IterContext(ctx context.Context) *Iterator {
+	return &Iterator{
+		query:     q.query,
+		ctx:       ctx,
+		batchSize: q.pool.options.BatchSize,
+		err:       q.err,
+	}
+}
+
+// WithBatchSize sets the maximum number of models which are fetched at once and
+// returns the Iterator. A size of 0 or less fetches all the models at once. It
+// must be called before the first call to Next.
+func (it *Iterator) WithBatchSize(size int) *Iterator {
+	it.batchSize = size
+	return it
+}
+
+// Next advances the Iterator to the next model, fetching the next batch if
+// needed. It returns false when there are no more models or if an error
+// occurred, in which case Err returns the error.
+func (it *Iterator) Next() bool {
+	if it.err != nil || it.closed {
+		return false
+	}
+	if it.snapshotKey == "" {
+		if it.err = it.takeSnapshot(); it.err != nil {
+			return false
+		}
+	}
+	it.index++
+	for it.index >= it.batch.Len() {
+		if it.done {
+			return false
+		}
+		if it.err = it.fetchBatch(); it.err != nil {
+			return false
+		}
+		it.index = 0
+	}
+	return true
+}
+
+// Model returns the current model. It should only be called after a call to
+// Next returned true. You can use a type assertion to convert the model to the
+// type of the collection.
+func (it *Iterator) Model() Model {
+	if it.batch.IsValid() && it.index >= 0 && it.index < it.batch.Len() {
+		return it.batch.Index(it.index).Interface().(Model)
+	}
+	return nil
+}
+
+// Err returns the first error that occurred while iterating (if any).
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close deletes the snapshot of ids and stops the iteration. It is safe to call
+// Close more than once. Close does not use the context of the iterator, which
+// may already be done, but its own context with a short timeout.
+func (it *Iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	if it.snapshotKey == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+	tx := it.query.pool.NewTransactionContext(ctx)
+	tx.Command("DEL", Args{it.snapshotKey}, nil)
+	return tx.Exec()
+}
+
+// takeSnapshot stores the ids of the models which match the query in a
+// temporary list.
+func (it *Iterator) takeSnapshot() error {
+	snapshotKey := it.query.collection.spec.tmpKey("iter")
+	tx := it.query.pool.NewTransactionContext(it.ctx)
+	newTransactionalQuery(it.query, tx).StoreIds(snapshotKey)
+	tx.Command("PEXPIRE", Args{snapshotKey, int64(iteratorSnapshotTTL / time.Millisecond)}, nil)
+	if err := tx.Exec(); err != nil {
+		return err
+	}
+	it.snapshotKey = snapshotKey
+	it.batch = reflect.MakeSlice(reflect.SliceOf(it.query.collection.spec.typ), 0, 0)
+	return nil
+}
+
+// fetchBatch replaces the current batch with the models for the next window of
+// ids in the snapshot.
+func (it *Iterator) fetchBatch() error {
+	spec := it.query.collection.spec
+	limit := it.batchSize
+	if limit <= 0 {
+		// In Redis, -1 means unlimited
+		limit = -1
+	}
+	fieldNames := append(it.query.fieldNames(), "-")
+	models := reflect.New(reflect.SliceOf(spec.typ))
+	numIds := 0
+	tx := it.query.pool.NewTransactionContext(it.ctx)
+	sortArgs := spec.sortArgs(it.snapshotKey, it.query.redisFieldNames(), limit, uint(it.offset), false)
+	tx.Command("SORT", sortArgs, func(reply interface{}) error {
+		values, err := redis.Values(reply, nil)
+		if err != nil {
+			return err
+		}
+		numIds = len(values) / len(fieldNames)
+		return newScanModelsHandler(spec, fieldNames, models.Interface())(skipMissingModels(values, len(fieldNames)))
+	})
+	tx.Command("PEXPIRE", Args{it.snapshotKey, int64(iteratorSnapshotTTL / time.Millisecond)}, nil)
+	if err := tx.Exec(); err != nil {
+		return err
+	}
+	if numIds == 0 || limit == -1 || numIds < limit {
+		it.done = true
+	}
+	it.offset += numIds
+	it.batch = models.Elem()
+	if spec.typ.Implements(afterFinderType) {
+		return callAfterFind(it.batch)
+	}
+	return nil
+}
+
+// skipMissingModels removes the values for models which no longer exist from
+// values, which is the reply of a SORT command with a GET for each of the
+// fields followed by a GET for the id. Models which no longer exist are the
+// ones for which every field is nil.
+func skipMissingModels(values []interface{}, numFields int) []interface{} {
+	result := []interface{}{}
+	for start := 0; start+numFields <= len(values); start += numFields {
+		missing := numFields > 1
+		for _, value := range values[start : start+numFields-1] {
+			if value != nil {
+				missing = false
+				break
+			}
+		}
+		if !missing {
+			result = append(result, values[start:start+numFields]...)
+		}
+	}
+	return result
+}
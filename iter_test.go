@@ -0,0 +1,116 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File iter_test.go tests the code in iter.go
+
+package zoom
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// collectIds iterates over all the models in iter and returns their ids.
+func collectIds(t *testing.T, iter *Iterator) []string {
+	ids := []string{}
+	for iter.Next() {
+		model, ok := iter.Model().(*indexedTestModel)
+		require.True(t, ok, "Wrong type of model: %T", iter.Model())
+		ids = append(ids, model.Id)
+	}
+	require.NoError(t, iter.Err())
+	require.NoError(t, iter.Close())
+	return ids
+}
+
+func TestCollectionIter(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(10)
+	require.NoError(t, err)
+	for _, batchSize := range []int{1, 3, 10, 0} {
+		ids := collectIds(t, indexedTestModels.Iter().WithBatchSize(batchSize))
+		assert.ElementsMatch(t, modelIds(Models(models)), ids, "batch size %d", batchSize)
+	}
+
+	// The fields of the models should be scanned.
+	iter := indexedTestModels.Iter().WithBatchSize(4)
+	found := map[string]*indexedTestModel{}
+	for iter.Next() {
+		model := iter.Model().(*indexedTestModel)
+		found[model.Id] = model
+	}
+	require.NoError(t, iter.Err())
+	require.NoError(t, iter.Close())
+	for _, model := range models {
+		assert.Equal(t, model, found[model.Id])
+	}
+
+	// Models which are created after the snapshot are not included, and models
+	// which are deleted after the snapshot are skipped.
+	iter = indexedTestModels.Iter().WithBatchSize(1)
+	require.True(t, iter.Next())
+	first := iter.Model().(*indexedTestModel)
+	newModels, err := createAndSaveIndexedTestModels(2)
+	require.NoError(t, err)
+	deleted := 0
+	for _, model := range models {
+		if model.Id != first.Id && deleted < 3 {
+			_, err := indexedTestModels.Delete(model.Id)
+			require.NoError(t, err)
+			deleted++
+		}
+	}
+	ids := append([]string{first.Id}, collectIds(t, iter)...)
+	assert.Len(t, ids, 7)
+	for _, model := range newModels {
+		assert.NotContains(t, ids, model.Id)
+	}
+	expectKeyDoesNotExist(t, iter.snapshotKey)
+
+	// Close should delete the snapshot even if the context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	iter = indexedTestModels.IterContext(ctx).WithBatchSize(1)
+	require.True(t, iter.Next())
+	cancel()
+	require.NoError(t, iter.Close())
+	expectKeyDoesNotExist(t, iter.snapshotKey)
+}
+
+func TestQueryIter(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	_, err := createAndSaveIndexedTestModels(10)
+	require.NoError(t, err)
+	queries := []*Query{
+		indexedTestModels.NewQuery().Order("Int"),
+		indexedTestModels.NewQuery().Order("-String").Offset(2).Limit(5),
+		indexedTestModels.NewQuery().Filter("Bool =", true).Order("Int"),
+	}
+	for _, q := range queries {
+		expected, err := q.Ids()
+		require.NoError(t, err)
+		ids := collectIds(t, q.Iter().WithBatchSize(3))
+		assert.Equal(t, expected, ids, q.String())
+	}
+
+	// Includes should be respected.
+	iter := indexedTestModels.NewQuery().Include("Int").Iter()
+	defer iter.Close()
+	require.True(t, iter.Next())
+	model := iter.Model().(*indexedTestModel)
+	assert.NotEmpty(t, model.Id)
+	assert.Empty(t, model.String)
+
+	// Errors in the query should be returned by Err.
+	iter = indexedTestModels.NewQuery().Order("Missing").Iter()
+	assert.False(t, iter.Next())
+	assert.Error(t, iter.Err())
+	assert.NoError(t, iter.Close())
+}
@@ -0,0 +1,147 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File lifecycle.go contains code related to the optional lifecycle methods
+// which models can implement, such as BeforeSave and AfterFind.
+
+package zoom
+
+import "reflect"
+
+// BeforeSaver is implemented by models which need to run code before they are
+// saved. BeforeSave is called by Save, SaveFields, Create, Update and SaveMany
+// (and the corresponding Transaction methods) when the model is added to the
+// transaction, so any changes it makes to the model are saved. If it returns
+// an error, the transaction is aborted before anything is sent to Redis and
+// Exec returns the error unchanged.
+type BeforeSaver interface {
+	BeforeSave() error
+}
+
+// AfterSaver is implemented by models which need to run code after they have
+// been saved. AfterSave is called by the same methods as BeforeSave, once the
+// transaction has been executed successfully. If it returns an error, Exec
+// returns the error, but the model has already been saved.
+type AfterSaver interface {
+	AfterSave() error
+}
+
+// AfterFinder is implemented by models which need to run code after they have
+// been found. AfterFind is called by Find, FindFields, FindAll, FindMany,
+// Query.Run and Query.RunOne (and the corresponding Transaction methods) for
+// each model that was found, once the transaction has been executed
+// successfully. If it returns an error, Exec returns the error.
+type AfterFinder interface {
+	AfterFind() error
+}
+
+// BeforeDeleter is implemented by models which need to run code before they
+// are deleted. Delete and DeleteMany (and Transaction.Delete) only have the id
+// of the model, so BeforeDelete is called on a new model which has nothing but
+// its id set. If it returns an error, the transaction is aborted before
+// anything is sent to Redis and Exec returns the error. DeleteAll does not call
+// BeforeDelete.
+type BeforeDeleter interface {
+	BeforeDelete() error
+}
+
+// AfterDeleter is implemented by models which need to run code after they have
+// been deleted. AfterDelete is called by the same methods as BeforeDelete, once
+// the transaction has been executed successfully, iff the model existed. If it
+// returns an error, Exec returns the error, but the model has already been
+// deleted.
+type AfterDeleter interface {
+	AfterDelete() error
+}
+
+var (
+	afterFinderType   = reflect.TypeOf((*AfterFinder)(nil)).Elem()
+	beforeDeleterType = reflect.TypeOf((*BeforeDeleter)(nil)).Elem()
+	afterDeleterType  = reflect.TypeOf((*AfterDeleter)(nil)).Elem()
+)
+
+// onSuccess adds f to the functions which are called, in order, after the
+// transaction has been executed successfully and all the reply handlers have
+// been called. If f returns an error, Exec returns it and the remaining
+// functions are not called.
+func (t *Transaction) onSuccess(f func() error) {
+	t.afterExec = append(t.afterExec, f)
+}
+
+// beforeSave calls the BeforeSave method of model (if any) and sets the error
+// of the transaction if it fails. It returns false iff it failed. It also
+// arranges for the AfterSave method of model (if any) to be called once the
+// transaction has been executed.
+func (t *Transaction) beforeSave(model Model) bool {
+	if saver, ok := model.(BeforeSaver); ok {
+		if err := saver.BeforeSave(); err != nil {
+			t.setError(err)
+			return false
+		}
+	}
+	if saver, ok := model.(AfterSaver); ok {
+		t.onSuccess(saver.AfterSave)
+	}
+	return true
+}
+
+// afterFind arranges for the AfterFind method of model (if any) to be called
+// once the transaction has been executed.
+func (t *Transaction) afterFind(model Model) {
+	if finder, ok := model.(AfterFinder); ok {
+		t.onSuccess(finder.AfterFind)
+	}
+}
+
+// afterFindAll arranges for the AfterFind method of each model in models,
+// which must be a pointer to a slice of models, to be called once the
+// transaction has been executed.
+func (t *Transaction) afterFindAll(c *Collection, models interface{}) {
+	if !c.spec.typ.Implements(afterFinderType) {
+		return
+	}
+	t.onSuccess(func() error {
+		return callAfterFind(reflect.ValueOf(models).Elem())
+	})
+}
+
+// callAfterFind calls the AfterFind method of each model in modelsVal, which
+// must be a slice of models which implement AfterFinder. It stops at the first
+// error.
+func callAfterFind(modelsVal reflect.Value) error {
+	for i := 0; i < modelsVal.Len(); i++ {
+		if err := modelsVal.Index(i).Interface().(AfterFinder).AfterFind(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// beforeDelete calls the BeforeDelete method of the model with the given id
+// (if the model type of c has one) and sets the error of the transaction if it
+// fails. It returns false iff it failed. It also arranges for the AfterDelete
+// method (if any) to be called once the transaction has been executed, if
+// *deleted is true at that point.
+func (t *Transaction) beforeDelete(c *Collection, id string, deleted *bool) bool {
+	if !c.spec.typ.Implements(beforeDeleterType) && !c.spec.typ.Implements(afterDeleterType) {
+		return true
+	}
+	model := reflect.New(c.spec.typ.Elem()).Interface().(Model)
+	model.SetModelId(id)
+	if deleter, ok := model.(BeforeDeleter); ok {
+		if err := deleter.BeforeDelete(); err != nil {
+			t.setError(err)
+			return false
+		}
+	}
+	if deleter, ok := model.(AfterDeleter); ok {
+		t.onSuccess(func() error {
+			if !*deleted {
+				return nil
+			}
+			return deleter.AfterDelete()
+		})
+	}
+	return true
+}
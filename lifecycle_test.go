@@ -0,0 +1,117 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File lifecycle_test.go tests the code in lifecycle.go
+
+package zoom
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	// lifecycleCalls records the calls to the lifecycle methods of
+	// lifecycleTestModel in the format "<method> <Int>".
+	lifecycleCalls []string
+	// lifecycleFailOn is the name of the lifecycle method which should fail.
+	lifecycleFailOn string
+	errLifecycle    = errors.New("lifecycle method failed")
+)
+
+// record records a call to the lifecycle method with the given name and returns
+// an error iff it should fail.
+func (m *lifecycleTestModel) record(method string) error {
+	if method == "BeforeDelete" || method == "AfterDelete" {
+		// Only the id is set when a model is deleted.
+		lifecycleCalls = append(lifecycleCalls, method+" "+m.Id)
+	} else {
+		lifecycleCalls = append(lifecycleCalls, fmt.Sprintf("%s %s %d", method, m.Id, m.Int))
+	}
+	if method == lifecycleFailOn {
+		return errLifecycle
+	}
+	return nil
+}
+
+func (m *lifecycleTestModel) BeforeSave() error {
+	// Changes made in BeforeSave should be saved.
+	m.Int++
+	return m.record("BeforeSave")
+}
+
+func (m *lifecycleTestModel) AfterSave() error    { return m.record("AfterSave") }
+func (m *lifecycleTestModel) AfterFind() error    { return m.record("AfterFind") }
+func (m *lifecycleTestModel) BeforeDelete() error { return m.record("BeforeDelete") }
+func (m *lifecycleTestModel) AfterDelete() error  { return m.record("AfterDelete") }
+
+// resetLifecycle forgets the recorded calls and sets the lifecycle method which
+// should fail.
+func resetLifecycle(failOn string) {
+	lifecycleCalls = nil
+	lifecycleFailOn = failOn
+}
+
+func TestLifecycleMethods(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	defer resetLifecycle("")
+
+	resetLifecycle("")
+	model := &lifecycleTestModel{Int: 1}
+	model.SetModelId("a")
+	require.NoError(t, lifecycleTestModels.Save(model))
+	assert.Equal(t, []string{"BeforeSave a 2", "AfterSave a 2"}, lifecycleCalls)
+	expectFieldEquals(t, lifecycleTestModels.ModelKey("a"), "Int", lifecycleTestModels.spec.fallback, 2)
+
+	resetLifecycle("")
+	other := &lifecycleTestModel{Int: 4}
+	other.SetModelId("b")
+	tx := testPool.NewTransaction()
+	tx.Save(lifecycleTestModels, other)
+	tx.Find(lifecycleTestModels, "a", &lifecycleTestModel{})
+	require.NoError(t, tx.Exec())
+	assert.Equal(t, []string{"BeforeSave b 5", "AfterSave b 5", "AfterFind a 2"}, lifecycleCalls)
+
+	resetLifecycle("")
+	models := []*lifecycleTestModel{}
+	require.NoError(t, lifecycleTestModels.NewQuery().Order("Int").Run(&models))
+	require.NoError(t, lifecycleTestModels.NewQuery().Order("-Int").RunOne(&lifecycleTestModel{}))
+	require.NoError(t, lifecycleTestModels.FindAll(&models))
+	_, err := lifecycleTestModels.FindMany([]string{"b", "missing"}, &models)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"AfterFind a 2", "AfterFind b 5", "AfterFind b 5", "AfterFind a 2", "AfterFind b 5", "AfterFind b 5"}, lifecycleCalls)
+
+	// An error in a Before method should abort the whole transaction.
+	resetLifecycle("BeforeSave")
+	tx = testPool.NewTransaction()
+	tx.Delete(lifecycleTestModels, "b", nil)
+	tx.Save(lifecycleTestModels, &lifecycleTestModel{Int: 7})
+	assert.Equal(t, errLifecycle, tx.Exec())
+	expectModelExists(t, lifecycleTestModels, other)
+	resetLifecycle("BeforeDelete")
+	deleted, err := lifecycleTestModels.Delete("a")
+	assert.Equal(t, errLifecycle, err)
+	assert.False(t, deleted)
+	expectModelExists(t, lifecycleTestModels, model)
+
+	// An error in an After method should be returned after the transaction was
+	// executed.
+	resetLifecycle("AfterSave")
+	assert.Equal(t, errLifecycle, lifecycleTestModels.Update(model))
+	expectFieldEquals(t, lifecycleTestModels.ModelKey("a"), "Int", lifecycleTestModels.spec.fallback, 3)
+	resetLifecycle("AfterFind")
+	assert.Equal(t, errLifecycle, lifecycleTestModels.Find("a", &lifecycleTestModel{}))
+
+	// AfterDelete should only be called for models which were deleted.
+	resetLifecycle("")
+	_, err = lifecycleTestModels.DeleteMany([]string{"a", "missing"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"BeforeDelete a", "BeforeDelete missing", "AfterDelete a"}, lifecycleCalls)
+	expectModelDoesNotExist(t, lifecycleTestModels, model)
+}
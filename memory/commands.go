@@ -0,0 +1,986 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File commands.go contains the table of supported commands and the
+// implementations of the commands for keys, strings, hashes, sets and lists.
+
+package memory
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// command is a Redis command which can be run against a db.
+type command struct {
+	// arity is the number of arguments, including the command name. A negative
+	// arity means the command takes at least -arity arguments.
+	arity int
+	run   func(db *db, args [][]byte) interface{}
+}
+
+// arityOK returns true iff n is a valid number of arguments for the command,
+// including the command name.
+func (c command) arityOK(n int) bool {
+	if c.arity >= 0 {
+		return n == c.arity
+	}
+	return n >= -c.arity
+}
+
+// commands maps the name of each supported command to its implementation.
+// MULTI, EXEC, DISCARD, WATCH and UNWATCH are handled by the connection.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		// Keys and server
+		"DBSIZE":    {1, dbsize},
+		"DEL":       {-2, del},
+		"ECHO":      {2, echo},
+		"EXISTS":    {-2, exists},
+		"EXPIRE":    {3, expireCommand(time.Second, false)},
+		"EXPIREAT":  {3, expireCommand(time.Second, true)},
+		"FLUSHALL":  {1, flushdb},
+		"FLUSHDB":   {1, flushdb},
+		"KEYS":      {2, keys},
+		"PERSIST":   {2, persist},
+		"PEXPIRE":   {3, expireCommand(time.Millisecond, false)},
+		"PEXPIREAT": {3, expireCommand(time.Millisecond, true)},
+		"PING":      {-1, ping},
+		"PTTL":      {2, ttlCommand(time.Millisecond)},
+		"SCAN":      {-2, scan},
+		"TIME":      {1, timeCommand},
+		"TTL":       {2, ttlCommand(time.Second)},
+		"TYPE":      {2, typeCommand},
+		// Strings
+		"GET":    {2, get},
+		"INCR":   {2, incr},
+		"INCRBY": {3, incrby},
+		"MGET":   {-2, mget},
+		"SET":    {-3, setString},
+		// Hashes
+		"HDEL":         {-3, hdel},
+		"HEXISTS":      {3, hexists},
+		"HGET":         {3, hget},
+		"HGETALL":      {2, hgetall},
+		"HINCRBY":      {4, hincrby},
+		"HINCRBYFLOAT": {4, hincrbyfloat},
+		"HKEYS":        {2, hkeys},
+		"HLEN":         {2, hlen},
+		"HMGET":        {-3, hmget},
+		"HMSET":        {-4, hmset},
+		"HSET":         {-4, hset},
+		"HSETNX":       {4, hsetnx},
+		"HVALS":        {2, hvals},
+		// Sets
+		"SADD":        {-3, sadd},
+		"SCARD":       {2, scard},
+		"SDIFF":       {-2, sdiff},
+		"SDIFFSTORE":  {-3, sdiffstore},
+		"SINTER":      {-2, sinter},
+		"SINTERSTORE": {-3, sinterstore},
+		"SISMEMBER":   {3, sismember},
+		"SMEMBERS":    {2, smembers},
+		"SREM":        {-3, srem},
+		"SUNION":      {-2, sunion},
+		"SUNIONSTORE": {-3, sunionstore},
+		// Lists
+		"LLEN":   {2, llen},
+		"LPOP":   {2, lpop},
+		"LPUSH":  {-3, lpush},
+		"LRANGE": {4, lrange},
+		"RPOP":   {2, rpop},
+		"RPUSH":  {-3, rpush},
+		// Sorted sets
+		"ZADD":             {-4, zadd},
+		"ZCARD":            {2, zcard},
+		"ZCOUNT":           {4, zcount},
+		"ZINCRBY":          {4, zincrby},
+		"ZINTERSTORE":      {-4, zinterstore},
+		"ZLEXCOUNT":        {4, zlexcount},
+		"ZRANGE":           {-4, zrange},
+		"ZRANGEBYLEX":      {-4, zrangebylex},
+		"ZRANGEBYSCORE":    {-4, zrangebyscore},
+		"ZRANK":            {3, zrank},
+		"ZREM":             {-3, zrem},
+		"ZREMRANGEBYSCORE": {4, zremrangebyscore},
+		"ZREVRANGE":        {-4, zrevrange},
+		"ZREVRANGEBYLEX":   {-4, zrevrangebylex},
+		"ZREVRANGEBYSCORE": {-4, zrevrangebyscore},
+		"ZREVRANK":         {3, zrevrank},
+		"ZSCAN":            {-3, zscan},
+		"ZSCORE":           {3, zscore},
+		"ZUNIONSTORE":      {-4, zunionstore},
+		// Sort
+		"SORT": {-2, sortCommand},
+		// Scripting
+		"EVAL":    {-3, eval},
+		"EVALSHA": {-3, evalsha},
+		"SCRIPT":  {-2, script},
+	}
+}
+
+// bulk returns value as a bulk string reply, or a nil reply if value is nil.
+func bulk(value []byte) interface{} {
+	if value == nil {
+		return nil
+	}
+	return value
+}
+
+// bulkStrings returns values as an array of bulk strings.
+func bulkStrings(values []string) []interface{} {
+	reply := make([]interface{}, len(values))
+	for i, value := range values {
+		reply[i] = []byte(value)
+	}
+	return reply
+}
+
+// parseInt parses arg as a 64-bit integer.
+func parseInt(arg []byte) (int64, error) {
+	i, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return 0, errNotInteger
+	}
+	return i, nil
+}
+
+// parseFloat parses arg as a float. Infinity is allowed but NaN is not.
+func parseFloat(arg []byte) (float64, error) {
+	f, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, errNotFloat
+	}
+	return f, nil
+}
+
+// formatFloat formats f the same way Redis does.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	if abs := math.Abs(f); abs != 0 && (abs >= 1e17 || abs < 1e-4) {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func dbsize(db *db, args [][]byte) interface{} {
+	return int64(len(db.values))
+}
+
+func del(db *db, args [][]byte) interface{} {
+	count := int64(0)
+	for _, key := range args[1:] {
+		if db.del(string(key)) {
+			count++
+		}
+	}
+	return count
+}
+
+func echo(db *db, args [][]byte) interface{} {
+	return args[1]
+}
+
+func exists(db *db, args [][]byte) interface{} {
+	count := int64(0)
+	for _, key := range args[1:] {
+		if _, found := db.values[string(key)]; found {
+			count++
+		}
+	}
+	return count
+}
+
+// expireCommand returns the implementation of a command which sets the
+// expiration time of a key, e.g. PEXPIRE. unit is the unit of the argument,
+// which is a Unix timestamp if absolute is true and a duration otherwise.
+func expireCommand(unit time.Duration, absolute bool) func(*db, [][]byte) interface{} {
+	return func(db *db, args [][]byte) interface{} {
+		n, err := parseInt(args[2])
+		if err != nil {
+			return err
+		}
+		key := string(args[1])
+		if _, found := db.values[key]; !found {
+			return int64(0)
+		}
+		at := time.Now().Add(time.Duration(n) * unit)
+		if absolute {
+			at = time.Unix(0, 0).Add(time.Duration(n) * unit)
+		}
+		if !at.After(time.Now()) {
+			db.del(key)
+			return int64(1)
+		}
+		db.expires[key] = at
+		db.touch(key)
+		return int64(1)
+	}
+}
+
+// ttlCommand returns the implementation of a command which gets the time to
+// live of a key in the given unit, e.g. PTTL.
+func ttlCommand(unit time.Duration) func(*db, [][]byte) interface{} {
+	return func(db *db, args [][]byte) interface{} {
+		key := string(args[1])
+		if _, found := db.values[key]; !found {
+			return int64(-2)
+		}
+		at, found := db.expires[key]
+		if !found {
+			return int64(-1)
+		}
+		return int64((time.Until(at) + unit/2) / unit)
+	}
+}
+
+func flushdb(db *db, args [][]byte) interface{} {
+	db.flush()
+	return "OK"
+}
+
+func keys(db *db, args [][]byte) interface{} {
+	matching := []string{}
+	for _, key := range db.sortedKeys() {
+		if globMatch(string(args[1]), key) {
+			matching = append(matching, key)
+		}
+	}
+	return bulkStrings(matching)
+}
+
+// scan implements SCAN with the MATCH, COUNT and TYPE options. The cursor is
+// the index of the next key in the sorted list of keys. Unlike Redis, keys may
+// be skipped if other keys are deleted during the iteration.
+func scan(db *db, args [][]byte) interface{} {
+	cursor, options, err := parseScanArgs(args[1:], true)
+	if err != nil {
+		return err
+	}
+	all := db.sortedKeys()
+	matching := []string{}
+	next := cursor
+	for ; next < len(all) && next < cursor+options.count; next++ {
+		key := all[next]
+		if !globMatch(options.pattern, key) {
+			continue
+		}
+		if options.typ != "" && typeCommand(db, [][]byte{nil, []byte(key)}) != options.typ {
+			continue
+		}
+		matching = append(matching, key)
+	}
+	if next >= len(all) {
+		next = 0
+	}
+	return []interface{}{[]byte(strconv.Itoa(next)), bulkStrings(matching)}
+}
+
+// scanOptions are the options of SCAN and the related commands.
+type scanOptions struct {
+	pattern string
+	count   int
+	typ     string
+}
+
+// parseScanArgs parses the cursor and the options of SCAN or a related command
+// such as ZSCAN. The TYPE option is only allowed if allowType is true.
+func parseScanArgs(args [][]byte, allowType bool) (int, scanOptions, error) {
+	options := scanOptions{pattern: "*", count: 10}
+	cursor, err := strconv.Atoi(string(args[0]))
+	if err != nil || cursor < 0 {
+		return 0, options, Error("ERR invalid cursor")
+	}
+	args = args[1:]
+	for len(args) > 0 {
+		if len(args) < 2 {
+			return 0, options, errSyntax
+		}
+		switch strings.ToUpper(string(args[0])) {
+		case "MATCH":
+			options.pattern = string(args[1])
+		case "COUNT":
+			count, err := parseInt(args[1])
+			if err != nil {
+				return 0, options, err
+			}
+			if count < 1 {
+				return 0, options, errSyntax
+			}
+			options.count = int(count)
+		case "TYPE":
+			if !allowType {
+				return 0, options, errSyntax
+			}
+			options.typ = strings.ToLower(string(args[1]))
+		default:
+			return 0, options, errSyntax
+		}
+		args = args[2:]
+	}
+	return cursor, options, nil
+}
+
+func persist(db *db, args [][]byte) interface{} {
+	key := string(args[1])
+	if _, found := db.expires[key]; !found {
+		return int64(0)
+	}
+	delete(db.expires, key)
+	db.touch(key)
+	return int64(1)
+}
+
+func ping(db *db, args [][]byte) interface{} {
+	switch len(args) {
+	case 1:
+		return "PONG"
+	case 2:
+		return args[1]
+	}
+	return wrongArity("PING")
+}
+
+func timeCommand(db *db, args [][]byte) interface{} {
+	now := time.Now()
+	return []interface{}{
+		[]byte(strconv.FormatInt(now.Unix(), 10)),
+		[]byte(strconv.Itoa(now.Nanosecond() / 1000)),
+	}
+}
+
+func typeCommand(db *db, args [][]byte) interface{} {
+	switch db.values[string(args[1])].(type) {
+	case []byte:
+		return "string"
+	case hash:
+		return "hash"
+	case set:
+		return "set"
+	case *list:
+		return "list"
+	case sortedSet:
+		return "zset"
+	}
+	return "none"
+}
+
+func get(db *db, args [][]byte) interface{} {
+	value, err := db.getString(string(args[1]))
+	if err != nil {
+		return err
+	}
+	return bulk(value)
+}
+
+func incr(db *db, args [][]byte) interface{} {
+	return incrementString(db, string(args[1]), 1)
+}
+
+func incrby(db *db, args [][]byte) interface{} {
+	delta, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	return incrementString(db, string(args[1]), delta)
+}
+
+// incrementString increments the integer stored as a string at key by delta
+// and returns the new value.
+func incrementString(db *db, key string, delta int64) interface{} {
+	value, err := db.getString(key)
+	if err != nil {
+		return err
+	}
+	current := int64(0)
+	if value != nil {
+		if current, err = parseInt(value); err != nil {
+			return err
+		}
+	}
+	current += delta
+	db.setValue(key, []byte(strconv.FormatInt(current, 10)))
+	return current
+}
+
+func mget(db *db, args [][]byte) interface{} {
+	reply := make([]interface{}, len(args)-1)
+	for i, key := range args[1:] {
+		if value, ok := db.values[string(key)].([]byte); ok {
+			reply[i] = value
+		}
+	}
+	return reply
+}
+
+func setString(db *db, args [][]byte) interface{} {
+	key := string(args[1])
+	nx, xx := false, false
+	var expireAt time.Time
+	options := args[3:]
+	for i := 0; i < len(options); i++ {
+		switch option := strings.ToUpper(string(options[i])); option {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if i+1 == len(options) || !expireAt.IsZero() {
+				return errSyntax
+			}
+			i++
+			n, err := parseInt(options[i])
+			if err != nil {
+				return err
+			}
+			if n <= 0 {
+				return errSyntax
+			}
+			unit := time.Second
+			if option == "PX" {
+				unit = time.Millisecond
+			}
+			expireAt = time.Now().Add(time.Duration(n) * unit)
+		default:
+			return errSyntax
+		}
+	}
+	if nx && xx {
+		return errSyntax
+	}
+	_, found := db.values[key]
+	if (nx && found) || (xx && !found) {
+		return nil
+	}
+	// Like Redis, SET discards the expiration time of the key unless a new
+	// one is given.
+	delete(db.expires, key)
+	db.setValue(key, append([]byte{}, args[2]...))
+	if !expireAt.IsZero() {
+		db.expires[key] = expireAt
+	}
+	return "OK"
+}
+
+func hdel(db *db, args [][]byte) interface{} {
+	h, err := db.getHash(string(args[1]), false)
+	if err != nil || h == nil {
+		return replyOrZero(err)
+	}
+	db.touch(string(args[1]))
+	count := int64(0)
+	for _, field := range args[2:] {
+		if _, found := h[string(field)]; found {
+			delete(h, string(field))
+			count++
+		}
+	}
+	return count
+}
+
+// replyOrZero returns err if it is not nil, or an integer reply of 0
+// otherwise.
+func replyOrZero(err error) interface{} {
+	if err != nil {
+		return err
+	}
+	return int64(0)
+}
+
+// replyOrEmpty returns err if it is not nil, or an empty array otherwise.
+func replyOrEmpty(err error) interface{} {
+	if err != nil {
+		return err
+	}
+	return []interface{}{}
+}
+
+func hexists(db *db, args [][]byte) interface{} {
+	h, err := db.getHash(string(args[1]), false)
+	if err != nil {
+		return err
+	}
+	if _, found := h[string(args[2])]; found {
+		return int64(1)
+	}
+	return int64(0)
+}
+
+func hget(db *db, args [][]byte) interface{} {
+	h, err := db.getHash(string(args[1]), false)
+	if err != nil {
+		return err
+	}
+	return bulk(h[string(args[2])])
+}
+
+// sortedFields returns the fields of h in lexicographical order.
+func (h hash) sortedFields() []string {
+	fields := make([]string, 0, len(h))
+	for field := range h {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func hgetall(db *db, args [][]byte) interface{} {
+	h, err := db.getHash(string(args[1]), false)
+	if err != nil {
+		return err
+	}
+	reply := []interface{}{}
+	for _, field := range h.sortedFields() {
+		reply = append(reply, []byte(field), h[field])
+	}
+	return reply
+}
+
+func hincrby(db *db, args [][]byte) interface{} {
+	delta, err := parseInt(args[3])
+	if err != nil {
+		return err
+	}
+	h, err := db.getHash(string(args[1]), true)
+	if err != nil {
+		return err
+	}
+	current := int64(0)
+	if value, found := h[string(args[2])]; found {
+		if current, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+			return Error("ERR hash value is not an integer")
+		}
+	}
+	current += delta
+	h[string(args[2])] = []byte(strconv.FormatInt(current, 10))
+	return current
+}
+
+func hincrbyfloat(db *db, args [][]byte) interface{} {
+	delta, err := parseFloat(args[3])
+	if err != nil {
+		return err
+	}
+	h, err := db.getHash(string(args[1]), true)
+	if err != nil {
+		return err
+	}
+	current := float64(0)
+	if value, found := h[string(args[2])]; found {
+		if current, err = parseFloat(value); err != nil {
+			return Error("ERR hash value is not a float")
+		}
+	}
+	current += delta
+	formatted := []byte(formatFloat(current))
+	h[string(args[2])] = formatted
+	return formatted
+}
+
+func hkeys(db *db, args [][]byte) interface{} {
+	h, err := db.getHash(string(args[1]), false)
+	if err != nil {
+		return err
+	}
+	return bulkStrings(h.sortedFields())
+}
+
+func hlen(db *db, args [][]byte) interface{} {
+	h, err := db.getHash(string(args[1]), false)
+	if err != nil {
+		return err
+	}
+	return int64(len(h))
+}
+
+func hmget(db *db, args [][]byte) interface{} {
+	h, err := db.getHash(string(args[1]), false)
+	if err != nil {
+		return err
+	}
+	reply := make([]interface{}, len(args)-2)
+	for i, field := range args[2:] {
+		reply[i] = bulk(h[string(field)])
+	}
+	return reply
+}
+
+func hmset(db *db, args [][]byte) interface{} {
+	reply := hset(db, args)
+	if err, ok := reply.(error); ok {
+		return err
+	}
+	return "OK"
+}
+
+func hset(db *db, args [][]byte) interface{} {
+	if len(args)%2 != 0 {
+		return wrongArity(string(args[0]))
+	}
+	h, err := db.getHash(string(args[1]), true)
+	if err != nil {
+		return err
+	}
+	count := int64(0)
+	for i := 2; i < len(args); i += 2 {
+		if _, found := h[string(args[i])]; !found {
+			count++
+		}
+		h[string(args[i])] = append([]byte{}, args[i+1]...)
+	}
+	return count
+}
+
+func hsetnx(db *db, args [][]byte) interface{} {
+	h, err := db.getHash(string(args[1]), false)
+	if err != nil {
+		return err
+	}
+	if _, found := h[string(args[2])]; found {
+		return int64(0)
+	}
+	return hset(db, args)
+}
+
+func hvals(db *db, args [][]byte) interface{} {
+	h, err := db.getHash(string(args[1]), false)
+	if err != nil {
+		return err
+	}
+	reply := []interface{}{}
+	for _, field := range h.sortedFields() {
+		reply = append(reply, h[field])
+	}
+	return reply
+}
+
+// sortedMembers returns the members of s in lexicographical order. Redis does
+// not guarantee any order, but a predictable one makes tests easier to write.
+func (s set) sortedMembers() []string {
+	members := make([]string, 0, len(s))
+	for member := range s {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+func sadd(db *db, args [][]byte) interface{} {
+	s, err := db.getSet(string(args[1]), true)
+	if err != nil {
+		return err
+	}
+	count := int64(0)
+	for _, member := range args[2:] {
+		if _, found := s[string(member)]; !found {
+			s[string(member)] = struct{}{}
+			count++
+		}
+	}
+	return count
+}
+
+func scard(db *db, args [][]byte) interface{} {
+	s, err := db.getSet(string(args[1]), false)
+	if err != nil {
+		return err
+	}
+	return int64(len(s))
+}
+
+func sismember(db *db, args [][]byte) interface{} {
+	s, err := db.getSet(string(args[1]), false)
+	if err != nil {
+		return err
+	}
+	if _, found := s[string(args[2])]; found {
+		return int64(1)
+	}
+	return int64(0)
+}
+
+func smembers(db *db, args [][]byte) interface{} {
+	s, err := db.getSet(string(args[1]), false)
+	if err != nil {
+		return err
+	}
+	return bulkStrings(s.sortedMembers())
+}
+
+func srem(db *db, args [][]byte) interface{} {
+	s, err := db.getSet(string(args[1]), false)
+	if err != nil || s == nil {
+		return replyOrZero(err)
+	}
+	db.touch(string(args[1]))
+	count := int64(0)
+	for _, member := range args[2:] {
+		if _, found := s[string(member)]; found {
+			delete(s, string(member))
+			count++
+		}
+	}
+	return count
+}
+
+// setOperation combines the sets stored at keys using op, which is called with
+// the result so far and the next set.
+func setOperation(db *db, keys [][]byte, op func(result, next set) set) (set, error) {
+	var result set
+	for i, key := range keys {
+		s, err := db.getSet(string(key), false)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			result = set{}
+			for member := range s {
+				result[member] = struct{}{}
+			}
+			continue
+		}
+		result = op(result, s)
+	}
+	return result, nil
+}
+
+func setDiff(result, next set) set {
+	for member := range next {
+		delete(result, member)
+	}
+	return result
+}
+
+func setInter(result, next set) set {
+	for member := range result {
+		if _, found := next[member]; !found {
+			delete(result, member)
+		}
+	}
+	return result
+}
+
+func setUnion(result, next set) set {
+	for member := range next {
+		result[member] = struct{}{}
+	}
+	return result
+}
+
+// setCommand returns the implementation of a command which replies with the
+// result of op, e.g. SINTER.
+func setCommand(op func(result, next set) set) func(*db, [][]byte) interface{} {
+	return func(db *db, args [][]byte) interface{} {
+		result, err := setOperation(db, args[1:], op)
+		if err != nil {
+			return err
+		}
+		return bulkStrings(result.sortedMembers())
+	}
+}
+
+// setStoreCommand returns the implementation of a command which stores the
+// result of op, e.g. SINTERSTORE.
+func setStoreCommand(op func(result, next set) set) func(*db, [][]byte) interface{} {
+	return func(db *db, args [][]byte) interface{} {
+		result, err := setOperation(db, args[2:], op)
+		if err != nil {
+			return err
+		}
+		db.del(string(args[1]))
+		if len(result) > 0 {
+			db.setValue(string(args[1]), result)
+		}
+		return int64(len(result))
+	}
+}
+
+var (
+	sdiff       = setCommand(setDiff)
+	sdiffstore  = setStoreCommand(setDiff)
+	sinter      = setCommand(setInter)
+	sinterstore = setStoreCommand(setInter)
+	sunion      = setCommand(setUnion)
+	sunionstore = setStoreCommand(setUnion)
+)
+
+func llen(db *db, args [][]byte) interface{} {
+	l, err := db.getList(string(args[1]), false)
+	if err != nil || l == nil {
+		return replyOrZero(err)
+	}
+	return int64(len(l.items))
+}
+
+func lpop(db *db, args [][]byte) interface{} {
+	l, err := db.getList(string(args[1]), false)
+	if err != nil || l == nil {
+		return err
+	}
+	db.touch(string(args[1]))
+	item := l.items[0]
+	l.items = l.items[1:]
+	return item
+}
+
+func lpush(db *db, args [][]byte) interface{} {
+	l, err := db.getList(string(args[1]), true)
+	if err != nil {
+		return err
+	}
+	for _, item := range args[2:] {
+		l.items = append([][]byte{append([]byte{}, item...)}, l.items...)
+	}
+	return int64(len(l.items))
+}
+
+func lrange(db *db, args [][]byte) interface{} {
+	l, err := db.getList(string(args[1]), false)
+	if err != nil || l == nil {
+		return replyOrEmpty(err)
+	}
+	start, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	stop, err := parseInt(args[3])
+	if err != nil {
+		return err
+	}
+	from, to := normalizeRange(start, stop, len(l.items))
+	reply := []interface{}{}
+	for _, item := range l.items[from:to] {
+		reply = append(reply, item)
+	}
+	return reply
+}
+
+// normalizeRange converts the inclusive start and stop indexes, which can be
+// negative to indicate an offset from the end, to a half-open range of valid
+// indexes for a sequence with the given length.
+func normalizeRange(start, stop int64, length int) (from, to int) {
+	n := int64(length)
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop || start >= n {
+		return 0, 0
+	}
+	return int(start), int(stop + 1)
+}
+
+func rpop(db *db, args [][]byte) interface{} {
+	l, err := db.getList(string(args[1]), false)
+	if err != nil || l == nil {
+		return err
+	}
+	db.touch(string(args[1]))
+	item := l.items[len(l.items)-1]
+	l.items = l.items[:len(l.items)-1]
+	return item
+}
+
+func rpush(db *db, args [][]byte) interface{} {
+	l, err := db.getList(string(args[1]), true)
+	if err != nil {
+		return err
+	}
+	for _, item := range args[2:] {
+		l.items = append(l.items, append([]byte{}, item...))
+	}
+	return int64(len(l.items))
+}
+
+// globMatch returns true iff s matches the glob-style pattern used by the
+// KEYS command, which supports *, ?, [...] and escaping with \.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end == -1 {
+				return pattern == s
+			}
+			class := pattern[1 : end+1]
+			negate := strings.HasPrefix(class, "^")
+			if negate {
+				class = class[1:]
+			}
+			matched := false
+			for i := 0; i < len(class); i++ {
+				if class[i] == '\\' && i+1 < len(class) {
+					i++
+					matched = matched || class[i] == s[0]
+				} else if i+2 < len(class) && class[i+1] == '-' {
+					lo, hi := class[i], class[i+2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					matched = matched || (lo <= s[0] && s[0] <= hi)
+					i += 2
+				} else {
+					matched = matched || class[i] == s[0]
+				}
+			}
+			if matched == negate {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[end+2:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,276 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File db.go contains the in-memory database, including the types used to
+// store values and the code which runs a single command.
+
+package memory
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Error is an error reply, e.g. "ERR syntax error". It has the same
+// underlying type as redis.Error in the redigo library.
+type Error string
+
+// Error satisfies the error interface.
+func (err Error) Error() string {
+	return string(err)
+}
+
+var (
+	errWrongType   = Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errSyntax      = Error("ERR syntax error")
+	errNotInteger  = Error("ERR value is not an integer or out of range")
+	errNotFloat    = Error("ERR value is not a valid float")
+	errMinMaxFloat = Error("ERR min or max is not a float")
+	errMinMaxLex   = Error("ERR min or max not valid string range item")
+	errNoSuchKey   = Error("ERR no such key")
+)
+
+// hash is the value of a key which holds a hash.
+type hash map[string][]byte
+
+// set is the value of a key which holds a set.
+type set map[string]struct{}
+
+// list is the value of a key which holds a list.
+type list struct {
+	items [][]byte
+}
+
+// sortedSet is the value of a key which holds a sorted set. It maps each
+// member to its score.
+type sortedSet map[string]float64
+
+// db is a single in-memory database. All the fields are protected by mu.
+type db struct {
+	mu sync.Mutex
+	// values maps each key to its value, which is one of []byte, hash, set,
+	// *list or sortedSet.
+	values map[string]interface{}
+	// expires maps each key which has an expiration time (see PEXPIRE) to
+	// that time.
+	expires map[string]time.Time
+	// versions maps each key to the value of version after the last time it
+	// was written to. It is used to implement WATCH.
+	versions map[string]uint64
+	version  uint64
+	// scripts maps the SHA1 hash of each script which has been loaded to its
+	// source.
+	scripts map[string]string
+	// touched holds the keys written to by the command which is currently
+	// running. Keys which hold an empty hash, set, list or sorted set after the
+	// command is done are deleted, as in Redis.
+	touched []string
+}
+
+// newDB returns a new empty database.
+func newDB() *db {
+	return &db{
+		values:   map[string]interface{}{},
+		expires:  map[string]time.Time{},
+		versions: map[string]uint64{},
+		scripts:  map[string]string{},
+	}
+}
+
+// run runs a single command and returns the reply. db.mu must be held.
+func (db *db) run(args [][]byte) interface{} {
+	name := strings.ToUpper(string(args[0]))
+	cmd, found := commands[name]
+	if !found {
+		return Error("ERR unknown command '" + string(args[0]) + "'")
+	}
+	if !cmd.arityOK(len(args)) {
+		return wrongArity(name)
+	}
+	db.expireKeys()
+	reply := cmd.run(db, args)
+	for _, key := range db.touched {
+		if isEmpty(db.values[key]) {
+			delete(db.values, key)
+			delete(db.expires, key)
+		}
+	}
+	db.touched = db.touched[:0]
+	return reply
+}
+
+// wrongArity returns the error reply for a command which was called with the
+// wrong number of arguments.
+func wrongArity(name string) Error {
+	return Error("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+}
+
+// isEmpty returns true iff value is a hash, set, list or sorted set with no
+// elements.
+func isEmpty(value interface{}) bool {
+	switch value := value.(type) {
+	case hash:
+		return len(value) == 0
+	case set:
+		return len(value) == 0
+	case *list:
+		return len(value.items) == 0
+	case sortedSet:
+		return len(value) == 0
+	}
+	return false
+}
+
+// touch records that key was written to. It must be called every time a key
+// is created, modified or deleted.
+func (db *db) touch(key string) {
+	db.version++
+	db.versions[key] = db.version
+	db.touched = append(db.touched, key)
+}
+
+// keyVersion returns the version of key, which changes every time the key is
+// written to.
+func (db *db) keyVersion(key string) uint64 {
+	return db.versions[key]
+}
+
+// del deletes key and returns true iff it existed.
+func (db *db) del(key string) bool {
+	if _, found := db.values[key]; !found {
+		return false
+	}
+	delete(db.values, key)
+	delete(db.expires, key)
+	db.touch(key)
+	return true
+}
+
+// expireKeys deletes all the keys whose expiration time has passed. Redis
+// expires keys lazily when they are accessed and in the background, but the
+// result is the same as long as expireKeys is called before every command.
+func (db *db) expireKeys() {
+	now := time.Now()
+	for key, at := range db.expires {
+		if !now.Before(at) {
+			db.del(key)
+		}
+	}
+}
+
+// setValue sets the value of key, replacing any existing value.
+func (db *db) setValue(key string, value interface{}) {
+	db.values[key] = value
+	db.touch(key)
+}
+
+// getString returns the value of key if it holds a string. The value is nil if
+// the key does not exist.
+func (db *db) getString(key string) ([]byte, error) {
+	switch value := db.values[key].(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return value, nil
+	}
+	return nil, errWrongType
+}
+
+// getHash returns the hash stored at key. If the key does not exist, it
+// returns nil, or a new hash which is stored at key if create is true. The
+// key is marked as written to iff create is true, so create should be true
+// for every command which modifies the hash.
+func (db *db) getHash(key string, create bool) (hash, error) {
+	switch value := db.values[key].(type) {
+	case nil:
+		if !create {
+			return nil, nil
+		}
+		h := hash{}
+		db.setValue(key, h)
+		return h, nil
+	case hash:
+		if create {
+			db.touch(key)
+		}
+		return value, nil
+	}
+	return nil, errWrongType
+}
+
+// getSet is like getHash for sets.
+func (db *db) getSet(key string, create bool) (set, error) {
+	switch value := db.values[key].(type) {
+	case nil:
+		if !create {
+			return nil, nil
+		}
+		s := set{}
+		db.setValue(key, s)
+		return s, nil
+	case set:
+		if create {
+			db.touch(key)
+		}
+		return value, nil
+	}
+	return nil, errWrongType
+}
+
+// getList is like getHash for lists.
+func (db *db) getList(key string, create bool) (*list, error) {
+	switch value := db.values[key].(type) {
+	case nil:
+		if !create {
+			return nil, nil
+		}
+		l := &list{}
+		db.setValue(key, l)
+		return l, nil
+	case *list:
+		if create {
+			db.touch(key)
+		}
+		return value, nil
+	}
+	return nil, errWrongType
+}
+
+// getSortedSet is like getHash for sorted sets.
+func (db *db) getSortedSet(key string, create bool) (sortedSet, error) {
+	switch value := db.values[key].(type) {
+	case nil:
+		if !create {
+			return nil, nil
+		}
+		z := sortedSet{}
+		db.setValue(key, z)
+		return z, nil
+	case sortedSet:
+		if create {
+			db.touch(key)
+		}
+		return value, nil
+	}
+	return nil, errWrongType
+}
+
+// sortedKeys returns all the keys in the database in lexicographical order.
+func (db *db) sortedKeys() []string {
+	keys := make([]string, 0, len(db.values))
+	for key := range db.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// flush deletes all the keys in the database.
+func (db *db) flush() {
+	for _, key := range db.sortedKeys() {
+		db.del(key)
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// Package memory provides a zoom.Driver which keeps all the data in memory
+// instead of connecting to Redis. It is meant for tests: every Driver has its
+// own empty database, so tests which use different drivers can run in
+// parallel without a Redis server.
+//
+//	pool := memory.NewPool()
+//	defer pool.Close()
+//
+// The driver supports the commands Zoom uses (including SORT, ZRANGEBYLEX and
+// the Lua scripts bundled with Zoom) as well as the most common commands for
+// strings, hashes, sets, sorted sets and lists. MULTI, EXEC, WATCH and Lua
+// scripts (via EVAL and EVALSHA) are supported and are atomic. Other commands
+// return an error reply.
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/albrow/zoom"
+)
+
+// Driver is a zoom.Driver which keeps all the data in memory.
+type Driver struct {
+	db *db
+	// active is the number of open connections. It must be accessed
+	// atomically.
+	active int64
+	// closed is 1 if Close has been called. It must be accessed atomically.
+	closed int32
+}
+
+// errDriverClosed is returned by Conn after the driver has been closed.
+var errDriverClosed = errors.New("memory: driver has been closed")
+
+// NewDriver returns a new driver with an empty database.
+func NewDriver() *Driver {
+	return &Driver{db: newDB()}
+}
+
+// NewPool returns a new pool which uses a new driver with an empty database and
+// the default options (see zoom.DefaultPoolOptions).
+func NewPool() *zoom.Pool {
+	return zoom.NewPoolWithDriver(NewDriver(), zoom.DefaultPoolOptions)
+}
+
+// Conn satisfies zoom.Driver.
+func (d *Driver) Conn(ctx context.Context, key string) (zoom.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if atomic.LoadInt32(&d.closed) == 1 {
+		return nil, errDriverClosed
+	}
+	atomic.AddInt64(&d.active, 1)
+	return &conn{driver: d}, nil
+}
+
+// ReplicaConn satisfies zoom.Driver. There are no replicas, so it returns a
+// connection to the same database.
+func (d *Driver) ReplicaConn(ctx context.Context) (zoom.Conn, error) {
+	return d.Conn(ctx, "")
+}
+
+// Cluster satisfies zoom.Driver. It always returns false.
+func (d *Driver) Cluster() bool {
+	return false
+}
+
+// HandleError satisfies zoom.Driver. It always returns false.
+func (d *Driver) HandleError(err error) bool {
+	return false
+}
+
+// Stats satisfies zoom.Driver. Connections are never idle, so IdleCount is
+// always 0.
+func (d *Driver) Stats() zoom.DriverStats {
+	return zoom.DriverStats{
+		ActiveCount: int(atomic.LoadInt64(&d.active)),
+	}
+}
+
+// Close satisfies zoom.Driver. After Close is called, Conn returns an error.
+// Connections which are already open can still be used.
+func (d *Driver) Close() error {
+	atomic.StoreInt32(&d.closed, 1)
+	return nil
+}
+
+var (
+	// errConnClosed is returned by the methods of a conn after it is closed.
+	errConnClosed = errors.New("memory: connection has been closed")
+	// errNoPendingReplies is returned by Receive if no commands were sent.
+	errNoPendingReplies = errors.New("memory: no pending replies")
+)
+
+// conn is a zoom.Conn which runs commands against the database of a Driver.
+// Commands are buffered by Send and run when the buffer is flushed.
+type conn struct {
+	driver *Driver
+	// pending holds the commands buffered by Send which have not been run.
+	pending [][][]byte
+	// replies holds the replies which have been received but not returned by
+	// Receive yet.
+	replies []interface{}
+	// multi is true after MULTI and until EXEC or DISCARD.
+	multi bool
+	// queued holds the commands queued after MULTI.
+	queued [][][]byte
+	// aborted is true if one of the commands queued after MULTI was invalid,
+	// in which case EXEC fails.
+	aborted bool
+	// watched maps each watched key to its version at the time WATCH was
+	// called.
+	watched map[string]uint64
+	closed  bool
+}
+
+// Close satisfies zoom.Conn.
+func (c *conn) Close() error {
+	if !c.closed {
+		c.closed = true
+		atomic.AddInt64(&c.driver.active, -1)
+	}
+	return nil
+}
+
+// Err satisfies zoom.Conn.
+func (c *conn) Err() error {
+	if c.closed {
+		return errConnClosed
+	}
+	return nil
+}
+
+// Send satisfies zoom.Conn.
+func (c *conn) Send(commandName string, args ...interface{}) error {
+	if c.closed {
+		return errConnClosed
+	}
+	cmd := make([][]byte, len(args)+1)
+	cmd[0] = []byte(commandName)
+	for i, arg := range args {
+		cmd[i+1] = formatArg(arg)
+	}
+	c.pending = append(c.pending, cmd)
+	return nil
+}
+
+// Flush satisfies zoom.Conn.
+func (c *conn) Flush() error {
+	if c.closed {
+		return errConnClosed
+	}
+	for _, cmd := range c.pending {
+		c.replies = append(c.replies, c.run(cmd))
+	}
+	c.pending = nil
+	return nil
+}
+
+// Receive satisfies zoom.Conn.
+func (c *conn) Receive() (interface{}, error) {
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+	if len(c.replies) == 0 {
+		return nil, errNoPendingReplies
+	}
+	reply := c.replies[0]
+	c.replies = c.replies[1:]
+	if err, ok := reply.(error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Do satisfies zoom.Conn. Like redigo, it returns the reply to the given
+// command along with the first error reply, if any, to the commands that were
+// buffered by Send. If commandName is empty, Do runs the buffered commands and
+// returns the last reply.
+func (c *conn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if commandName != "" {
+		if err := c.Send(commandName, args...); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+	replies := c.replies
+	c.replies = nil
+	var reply interface{}
+	var firstErr error
+	for _, reply = range replies {
+		if err, ok := reply.(error); ok && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return reply, firstErr
+}
+
+// run runs a single command, taking care of the commands for transactions,
+// and returns the reply.
+func (c *conn) run(cmd [][]byte) interface{} {
+	db := c.driver.db
+	name := strings.ToUpper(string(cmd[0]))
+	switch name {
+	case "MULTI":
+		if c.multi {
+			return Error("ERR MULTI calls can not be nested")
+		}
+		c.multi = true
+		return "OK"
+	case "EXEC":
+		if !c.multi {
+			return Error("ERR EXEC without MULTI")
+		}
+		return c.exec()
+	case "DISCARD":
+		if !c.multi {
+			return Error("ERR DISCARD without MULTI")
+		}
+		c.multi, c.queued, c.aborted, c.watched = false, nil, false, nil
+		return "OK"
+	case "WATCH":
+		if c.multi {
+			return Error("ERR WATCH inside MULTI is not allowed")
+		}
+		if len(cmd) < 2 {
+			return wrongArity(name)
+		}
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		db.expireKeys()
+		if c.watched == nil {
+			c.watched = map[string]uint64{}
+		}
+		for _, key := range cmd[1:] {
+			if _, found := c.watched[string(key)]; !found {
+				c.watched[string(key)] = db.keyVersion(string(key))
+			}
+		}
+		return "OK"
+	case "UNWATCH":
+		c.watched = nil
+		return "OK"
+	}
+	if c.multi {
+		command, found := commands[name]
+		if !found {
+			c.aborted = true
+			return Error("ERR unknown command '" + string(cmd[0]) + "'")
+		}
+		if !command.arityOK(len(cmd)) {
+			c.aborted = true
+			return wrongArity(name)
+		}
+		c.queued = append(c.queued, cmd)
+		return "QUEUED"
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.run(cmd)
+}
+
+// exec runs the commands queued since MULTI as a single atomic operation,
+// unless one of them was invalid or one of the watched keys was modified.
+func (c *conn) exec() interface{} {
+	queued, aborted, watched := c.queued, c.aborted, c.watched
+	c.multi, c.queued, c.aborted, c.watched = false, nil, false, nil
+	if aborted {
+		return Error("EXECABORT Transaction discarded because of previous errors.")
+	}
+	db := c.driver.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// A watched key which expired counts as modified, as in Redis.
+	db.expireKeys()
+	for key, version := range watched {
+		if db.keyVersion(key) != version {
+			return nil
+		}
+	}
+	replies := make([]interface{}, len(queued))
+	for i, cmd := range queued {
+		replies[i] = db.run(cmd)
+	}
+	return replies
+}
+
+// formatArg converts an argument to the bytes that would be sent to Redis,
+// using the same rules as redigo.
+func formatArg(arg interface{}) []byte {
+	switch arg := arg.(type) {
+	case []byte:
+		return append([]byte{}, arg...)
+	case string:
+		return []byte(arg)
+	case int:
+		return []byte(strconv.Itoa(arg))
+	case int64:
+		return []byte(strconv.FormatInt(arg, 10))
+	case float64:
+		return []byte(strconv.FormatFloat(arg, 'g', -1, 64))
+	case bool:
+		if arg {
+			return []byte("1")
+		}
+		return []byte("0")
+	case nil:
+		return []byte{}
+	}
+	return []byte(fmt.Sprint(arg))
+}
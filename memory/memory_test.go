@@ -0,0 +1,256 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File memory_test.go tests the code in memory.go and the commands it
+// supports.
+
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/albrow/zoom"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type person struct {
+	Name string `zoom:"index"`
+	Age  int    `zoom:"index"`
+	zoom.RandomId
+}
+
+// newTestPool returns a pool which uses a new Driver and a collection of
+// persons.
+func newTestPool(t *testing.T) (*zoom.Pool, *zoom.Collection) {
+	pool := NewPool()
+	t.Cleanup(func() {
+		pool.Close()
+	})
+	people, err := pool.NewCollectionWithOptions(&person{}, zoom.DefaultCollectionOptions.WithIndex(true))
+	require.NoError(t, err)
+	return pool, people
+}
+
+func TestDriver(t *testing.T) {
+	t.Parallel()
+	pool, people := newTestPool(t)
+	require.NoError(t, pool.Ping())
+
+	persons := []*person{
+		{Name: "Alice", Age: 32},
+		{Name: "Bob", Age: 27},
+		{Name: "Carol", Age: 41},
+	}
+	tx := pool.NewTransaction()
+	for _, p := range persons {
+		tx.Save(people, p)
+	}
+	require.NoError(t, tx.Exec())
+
+	other := &person{}
+	require.NoError(t, people.Find(persons[0].Id, other))
+	assert.Equal(t, persons[0], other)
+	count, err := people.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	// Queries use SORT, ZRANGEBYSCORE, ZRANGEBYLEX and the bundled scripts.
+	var got []*person
+	require.NoError(t, people.NewQuery().Order("-Age").Run(&got))
+	assert.Equal(t, []*person{persons[2], persons[0], persons[1]}, got)
+	got = nil
+	require.NoError(t, people.NewQuery().Filter("Age >", 30).Order("Name").Run(&got))
+	assert.Equal(t, []*person{persons[0], persons[2]}, got)
+	got = nil
+	require.NoError(t, people.NewQuery().Filter("Name >=", "B").Limit(1).Run(&got))
+	assert.Equal(t, []*person{persons[1]}, got)
+
+	deleted, err := people.DeleteAll()
+	require.NoError(t, err)
+	assert.Equal(t, 3, deleted)
+	count, err = people.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	assert.Equal(t, 0, pool.Stats().ActiveCount)
+}
+
+func TestDriverIsolation(t *testing.T) {
+	t.Parallel()
+	_, people := newTestPool(t)
+	_, otherPeople := newTestPool(t)
+	require.NoError(t, people.Save(&person{Name: "Alice"}))
+	count, err := otherPeople.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestDriverWatch(t *testing.T) {
+	t.Parallel()
+	pool, people := newTestPool(t)
+	alice := &person{Name: "Alice", Age: 32}
+	require.NoError(t, people.Save(alice))
+
+	tx := pool.NewTransaction()
+	require.NoError(t, tx.Watch(alice))
+	alice.Age++
+	require.NoError(t, people.Save(alice))
+	tx.Command("HSET", zoom.Args{people.ModelKey(alice.Id), "Age", 0}, nil)
+	assert.IsType(t, zoom.WatchError{}, tx.Exec())
+
+	other := &person{}
+	require.NoError(t, people.Find(alice.Id, other))
+	assert.Equal(t, 33, other.Age)
+}
+
+func TestDriverClose(t *testing.T) {
+	t.Parallel()
+	driver := NewDriver()
+	conn, err := driver.Conn(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, driver.Stats().ActiveCount)
+	require.NoError(t, driver.Close())
+	_, err = driver.Conn(context.Background(), "")
+	assert.Equal(t, errDriverClosed, err)
+
+	// Connections which are already open can still be used.
+	_, err = conn.Do("PING")
+	assert.NoError(t, err)
+	require.NoError(t, conn.Close())
+	assert.Equal(t, 0, driver.Stats().ActiveCount)
+	_, err = conn.Do("PING")
+	assert.Equal(t, errConnClosed, err)
+}
+
+func TestCommands(t *testing.T) {
+	t.Parallel()
+	conn, err := NewDriver().Conn(context.Background(), "")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	testCases := []struct {
+		args     []interface{}
+		expected interface{}
+	}{
+		{[]interface{}{"SET", "str", "foo"}, "OK"},
+		{[]interface{}{"SET", "str", "bar", "NX"}, nil},
+		{[]interface{}{"GET", "str"}, []byte("foo")},
+		{[]interface{}{"INCRBY", "count", 5}, int64(5)},
+		{[]interface{}{"INCR", "str"}, errNotInteger},
+		{[]interface{}{"HMSET", "h", "a", 1, "b", 2}, "OK"},
+		{[]interface{}{"HINCRBY", "h", "a", 2}, int64(3)},
+		{[]interface{}{"HGETALL", "h"}, []interface{}{[]byte("a"), []byte("3"), []byte("b"), []byte("2")}},
+		{[]interface{}{"SADD", "s1", "a", "b", "c"}, int64(3)},
+		{[]interface{}{"SADD", "s2", "b", "c", "d"}, int64(3)},
+		{[]interface{}{"SINTERSTORE", "s3", "s1", "s2"}, int64(2)},
+		{[]interface{}{"SMEMBERS", "s3"}, []interface{}{[]byte("b"), []byte("c")}},
+		{[]interface{}{"RPUSH", "l", "c", "a", "b"}, int64(3)},
+		{[]interface{}{"SORT", "l", "ALPHA", "DESC"}, []interface{}{[]byte("c"), []byte("b"), []byte("a")}},
+		{[]interface{}{"LRANGE", "l", 1, -1}, []interface{}{[]byte("a"), []byte("b")}},
+		{[]interface{}{"ZADD", "z", 2, "b", 1, "a", 3, "c"}, int64(3)},
+		{[]interface{}{"ZRANGEBYSCORE", "z", "(1", "+inf", "WITHSCORES"}, []interface{}{[]byte("b"), []byte("2"), []byte("c"), []byte("3")}},
+		{[]interface{}{"ZREVRANGE", "z", 0, 0}, []interface{}{[]byte("c")}},
+		{[]interface{}{"ZSCAN", "z", 1, "COUNT", 5}, []interface{}{[]byte("0"), []interface{}{[]byte("b"), []byte("2"), []byte("c"), []byte("3")}}},
+		{[]interface{}{"HGET", "str", "a"}, errWrongType},
+		{[]interface{}{"TTL", "str"}, int64(-1)},
+		{[]interface{}{"EXPIRE", "str", 100}, int64(1)},
+		{[]interface{}{"TTL", "str"}, int64(100)},
+		{[]interface{}{"PERSIST", "str"}, int64(1)},
+		{[]interface{}{"PTTL", "str"}, int64(-1)},
+		{[]interface{}{"PEXPIRE", "missing", 100}, int64(0)},
+		{[]interface{}{"PTTL", "missing"}, int64(-2)},
+		{[]interface{}{"SET", "tmp", "foo", "NX", "EX", 100}, "OK"},
+		{[]interface{}{"TTL", "tmp"}, int64(100)},
+		{[]interface{}{"SET", "tmp", "bar", "PX"}, errSyntax},
+		{[]interface{}{"EVAL", "return redis.call('GET', KEYS[1])", 1, "str"}, []byte("foo")},
+		{[]interface{}{"EVAL", "return {1, 'a', false}", 0}, []interface{}{int64(1), []byte("a"), nil}},
+		{[]interface{}{"EVAL", "return redis.call('INCR', KEYS[1])", 1, "str"}, errNotInteger},
+		{[]interface{}{"SCAN", 0, "MATCH", "s*", "COUNT", 6}, []interface{}{[]byte("6"), []interface{}{[]byte("s1"), []byte("s2"), []byte("s3")}}},
+		{[]interface{}{"SCAN", 6, "MATCH", "s*", "COUNT", 6}, []interface{}{[]byte("0"), []interface{}{[]byte("str")}}},
+		{[]interface{}{"SCAN", 0, "TYPE", "hash"}, []interface{}{[]byte("0"), []interface{}{[]byte("h")}}},
+		{[]interface{}{"DEL", "str", "h", "missing"}, int64(2)},
+		{[]interface{}{"EXISTS", "str"}, int64(0)},
+	}
+	for _, tc := range testCases {
+		reply, err := conn.Do(tc.args[0].(string), tc.args[1:]...)
+		if expectedErr, ok := tc.expected.(error); ok {
+			assert.Equal(t, expectedErr, err, "%v", tc.args)
+			continue
+		}
+		if assert.NoError(t, err, "%v", tc.args) {
+			assert.Equal(t, tc.expected, reply, "%v", tc.args)
+		}
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	t.Parallel()
+	driver := NewDriver()
+	conn, err := driver.Conn(context.Background(), "")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Do("HSET", "h", "a", 1)
+	require.NoError(t, err)
+	_, err = conn.Do("PEXPIRE", "h", 20)
+	require.NoError(t, err)
+	// Modifying a hash should not affect its expiration time.
+	_, err = conn.Do("HSET", "h", "b", 2)
+	require.NoError(t, err)
+	ttl, err := conn.Do("PTTL", "h")
+	require.NoError(t, err)
+	assert.True(t, ttl.(int64) > 0 && ttl.(int64) <= 20, "Unexpected TTL: %v", ttl)
+
+	// A watched key which expires should cause the transaction to fail.
+	watcher, err := driver.Conn(context.Background(), "")
+	require.NoError(t, err)
+	defer watcher.Close()
+	_, err = watcher.Do("WATCH", "h")
+	require.NoError(t, err)
+	time.Sleep(30 * time.Millisecond)
+	require.NoError(t, watcher.Send("MULTI"))
+	require.NoError(t, watcher.Send("SET", "a", 1))
+	reply, err := watcher.Do("EXEC")
+	require.NoError(t, err)
+	assert.Nil(t, reply)
+
+	exists, err := conn.Do("EXISTS", "h")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), exists)
+
+	// An expiration time in the past deletes the key immediately.
+	_, err = conn.Do("SET", "str", "foo")
+	require.NoError(t, err)
+	_, err = conn.Do("PEXPIREAT", "str", 1)
+	require.NoError(t, err)
+	exists, err = conn.Do("EXISTS", "str")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), exists)
+}
+
+func TestMulti(t *testing.T) {
+	t.Parallel()
+	conn, err := NewDriver().Conn(context.Background(), "")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.Send("MULTI"))
+	require.NoError(t, conn.Send("SET", "a", 1))
+	require.NoError(t, conn.Send("INCR", "a"))
+	reply, err := conn.Do("EXEC")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"OK", int64(2)}, reply)
+
+	// A transaction with an invalid command is discarded.
+	require.NoError(t, conn.Send("MULTI"))
+	require.NoError(t, conn.Send("SET", "a"))
+	_, err = conn.Do("EXEC")
+	assert.Error(t, err)
+	reply, err = conn.Do("GET", "a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("2"), reply)
+}
@@ -0,0 +1,267 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File scripting.go contains the implementations of the commands for Lua
+// scripts. Scripts are run with gopher-lua (github.com/yuin/gopher-lua), which
+// implements Lua 5.1 like Redis.
+
+package memory
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// scriptHash returns the SHA1 hash of src as used by EVALSHA.
+func scriptHash(src string) string {
+	hash := sha1.Sum([]byte(src))
+	return hex.EncodeToString(hash[:])
+}
+
+func eval(db *db, args [][]byte) interface{} {
+	src := string(args[1])
+	db.scripts[scriptHash(src)] = src
+	return runScript(db, src, args[2:])
+}
+
+func evalsha(db *db, args [][]byte) interface{} {
+	src, found := db.scripts[strings.ToLower(string(args[1]))]
+	if !found {
+		return Error("NOSCRIPT No matching script. Please use EVAL.")
+	}
+	return runScript(db, src, args[2:])
+}
+
+func script(db *db, args [][]byte) interface{} {
+	switch strings.ToUpper(string(args[1])) {
+	case "LOAD":
+		if len(args) != 3 {
+			return wrongArity("SCRIPT|LOAD")
+		}
+		src := string(args[2])
+		L := lua.NewState(lua.Options{SkipOpenLibs: true})
+		defer L.Close()
+		if _, err := L.LoadString(src); err != nil {
+			return Error("ERR Error compiling script (new function): " + err.Error())
+		}
+		hash := scriptHash(src)
+		db.scripts[hash] = src
+		return []byte(hash)
+	case "EXISTS":
+		reply := []interface{}{}
+		for _, hash := range args[2:] {
+			if _, found := db.scripts[strings.ToLower(string(hash))]; found {
+				reply = append(reply, int64(1))
+			} else {
+				reply = append(reply, int64(0))
+			}
+		}
+		return reply
+	case "FLUSH":
+		db.scripts = map[string]string{}
+		return "OK"
+	}
+	return Error("ERR unknown subcommand '" + string(args[1]) + "'")
+}
+
+// scriptForbiddenCommands are the commands which cannot be called from
+// scripts.
+var scriptForbiddenCommands = map[string]bool{
+	"DISCARD": true,
+	"EVAL":    true,
+	"EVALSHA": true,
+	"EXEC":    true,
+	"MULTI":   true,
+	"SCRIPT":  true,
+	"UNWATCH": true,
+	"WATCH":   true,
+}
+
+// runScript runs the script src. args holds the number of keys followed by the
+// keys and the other arguments.
+func runScript(db *db, src string, args [][]byte) interface{} {
+	numKeys, err := parseInt(args[0])
+	if err != nil {
+		return err
+	}
+	if numKeys < 0 {
+		return Error("ERR Number of keys can't be negative")
+	}
+	if numKeys > int64(len(args)-1) {
+		return Error("ERR Number of keys can't be greater than number of args")
+	}
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	L.SetGlobal("KEYS", stringsTable(L, args[1:1+numKeys]))
+	L.SetGlobal("ARGV", stringsTable(L, args[1+numKeys:]))
+	L.SetGlobal("redis", redisTable(L, db))
+
+	fn, err := L.LoadString(src)
+	if err != nil {
+		return Error("ERR Error compiling script (new function): " + err.Error())
+	}
+	L.Push(fn)
+	if err := L.PCall(0, 1, nil); err != nil {
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			if table, ok := apiErr.Object.(*lua.LTable); ok {
+				if message, ok := L.GetField(table, "err").(lua.LString); ok {
+					return Error(message)
+				}
+			}
+		}
+		return Error("ERR Error running script: " + err.Error())
+	}
+	return luaToReply(L, L.Get(-1))
+}
+
+// stringsTable returns a Lua table containing args as strings.
+func stringsTable(L *lua.LState, args [][]byte) *lua.LTable {
+	table := L.NewTable()
+	for _, arg := range args {
+		table.Append(lua.LString(arg))
+	}
+	return table
+}
+
+// redisTable returns the table which is available to scripts as redis.
+func redisTable(L *lua.LState, db *db) *lua.LTable {
+	table := L.NewTable()
+	L.SetField(table, "call", L.NewFunction(func(L *lua.LState) int {
+		return luaCall(L, db, true)
+	}))
+	L.SetField(table, "pcall", L.NewFunction(func(L *lua.LState) int {
+		return luaCall(L, db, false)
+	}))
+	L.SetField(table, "error_reply", L.NewFunction(func(L *lua.LState) int {
+		reply := L.NewTable()
+		L.SetField(reply, "err", lua.LString(L.CheckString(1)))
+		L.Push(reply)
+		return 1
+	}))
+	L.SetField(table, "status_reply", L.NewFunction(func(L *lua.LState) int {
+		reply := L.NewTable()
+		L.SetField(reply, "ok", lua.LString(L.CheckString(1)))
+		L.Push(reply)
+		return 1
+	}))
+	L.SetField(table, "sha1hex", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(scriptHash(L.CheckString(1))))
+		return 1
+	}))
+	return table
+}
+
+// luaCall implements redis.call and redis.pcall. If raise is true, error
+// replies are raised as Lua errors. Otherwise they are returned as a table
+// with an err field.
+func luaCall(L *lua.LState, db *db, raise bool) int {
+	n := L.GetTop()
+	if n == 0 {
+		L.RaiseError("Please specify at least one argument for redis.call()")
+		return 0
+	}
+	args := make([][]byte, n)
+	for i := 1; i <= n; i++ {
+		switch arg := L.Get(i).(type) {
+		case lua.LString:
+			args[i-1] = []byte(arg)
+		case lua.LNumber:
+			args[i-1] = []byte(arg.String())
+		default:
+			L.RaiseError("Lua redis() command arguments must be strings or integers")
+			return 0
+		}
+	}
+	var reply interface{}
+	if scriptForbiddenCommands[strings.ToUpper(string(args[0]))] {
+		reply = Error("ERR This Redis command is not allowed from scripts")
+	} else {
+		reply = db.run(args)
+	}
+	if err, ok := reply.(error); ok {
+		table := L.NewTable()
+		L.SetField(table, "err", lua.LString(err.Error()))
+		if raise {
+			L.Error(table, 1)
+			return 0
+		}
+		L.Push(table)
+		return 1
+	}
+	L.Push(replyToLua(L, reply))
+	return 1
+}
+
+// replyToLua converts a reply to a Lua value using the same rules as Redis.
+func replyToLua(L *lua.LState, reply interface{}) lua.LValue {
+	switch reply := reply.(type) {
+	case int64:
+		return lua.LNumber(reply)
+	case []byte:
+		return lua.LString(reply)
+	case string:
+		table := L.NewTable()
+		L.SetField(table, "ok", lua.LString(reply))
+		return table
+	case error:
+		table := L.NewTable()
+		L.SetField(table, "err", lua.LString(reply.Error()))
+		return table
+	case []interface{}:
+		table := L.NewTable()
+		for _, value := range reply {
+			table.Append(replyToLua(L, value))
+		}
+		return table
+	}
+	return lua.LFalse
+}
+
+// luaToReply converts a Lua value to a reply using the same rules as Redis.
+func luaToReply(L *lua.LState, value lua.LValue) interface{} {
+	switch value := value.(type) {
+	case lua.LNumber:
+		return int64(value)
+	case lua.LString:
+		return []byte(value)
+	case lua.LBool:
+		if value {
+			return int64(1)
+		}
+		return nil
+	case *lua.LTable:
+		if message, ok := L.GetField(value, "err").(lua.LString); ok {
+			return Error(message)
+		}
+		if status, ok := L.GetField(value, "ok").(lua.LString); ok {
+			return string(status)
+		}
+		reply := []interface{}{}
+		for i := 1; ; i++ {
+			element := value.RawGetInt(i)
+			if element == lua.LNil {
+				break
+			}
+			reply = append(reply, luaToReply(L, element))
+		}
+		return reply
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File sort.go contains the implementation of the SORT command.
+
+package memory
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sortCommand implements SORT key [BY pattern] [LIMIT offset count]
+// [GET pattern [GET pattern ...]] [ASC|DESC] [ALPHA] [STORE destination].
+func sortCommand(db *db, args [][]byte) interface{} {
+	key := string(args[1])
+	var (
+		byPattern  string
+		sortByKey  = true
+		getPattern []string
+		desc       bool
+		alpha      bool
+		store      string
+		limit      = rangeOptions{count: -1}
+	)
+	for i := 2; i < len(args); i++ {
+		option := strings.ToUpper(string(args[i]))
+		remaining := len(args) - i - 1
+		switch {
+		case option == "ASC":
+			desc = false
+		case option == "DESC":
+			desc = true
+		case option == "ALPHA":
+			alpha = true
+		case option == "LIMIT" && remaining >= 2:
+			var err error
+			if limit.offset, err = parseInt(args[i+1]); err != nil {
+				return err
+			}
+			if limit.count, err = parseInt(args[i+2]); err != nil {
+				return err
+			}
+			i += 2
+		case option == "BY" && remaining >= 1:
+			byPattern = string(args[i+1])
+			sortByKey = false
+			i++
+		case option == "GET" && remaining >= 1:
+			getPattern = append(getPattern, string(args[i+1]))
+			i++
+		case option == "STORE" && remaining >= 1:
+			store = string(args[i+1])
+			i++
+		default:
+			return errSyntax
+		}
+	}
+	// Like Redis, don't sort if the BY pattern does not contain "*".
+	dontSort := !sortByKey && !strings.Contains(byPattern, "*")
+
+	var elements []string
+	switch value := db.values[key].(type) {
+	case nil:
+	case *list:
+		for _, item := range value.items {
+			elements = append(elements, string(item))
+		}
+	case set:
+		elements = value.sortedMembers()
+	case sortedSet:
+		for _, m := range value.sorted() {
+			elements = append(elements, m.member)
+		}
+		if dontSort && desc {
+			// Sorted sets keep their order, so DESC reverses it.
+			for i, j := 0, len(elements)-1; i < j; i, j = i+1, j-1 {
+				elements[i], elements[j] = elements[j], elements[i]
+			}
+		}
+	default:
+		return errWrongType
+	}
+
+	if !dontSort {
+		if err := sortElements(db, elements, byPattern, sortByKey, desc, alpha); err != nil {
+			return err
+		}
+	}
+	elements = applyLimit(elements, limit)
+
+	var results []interface{}
+	if len(getPattern) == 0 {
+		for _, element := range elements {
+			results = append(results, []byte(element))
+		}
+	} else {
+		for _, element := range elements {
+			for _, pattern := range getPattern {
+				results = append(results, bulk(lookupByPattern(db, pattern, element)))
+			}
+		}
+	}
+
+	if store != "" {
+		l := &list{}
+		for _, result := range results {
+			item, _ := result.([]byte)
+			l.items = append(l.items, append([]byte{}, item...))
+		}
+		db.del(store)
+		if len(l.items) > 0 {
+			db.setValue(store, l)
+		}
+		return int64(len(l.items))
+	}
+	if results == nil {
+		return []interface{}{}
+	}
+	return results
+}
+
+// sortElements sorts elements in place, either by their own values or by the
+// values found using byPattern.
+func sortElements(db *db, elements []string, byPattern string, sortByKey, desc, alpha bool) error {
+	weights := make([]string, len(elements))
+	for i, element := range elements {
+		if sortByKey {
+			weights[i] = element
+		} else {
+			weights[i] = string(lookupByPattern(db, byPattern, element))
+		}
+	}
+	scores := make([]float64, len(elements))
+	if !alpha {
+		for i, weight := range weights {
+			if weight == "" && !sortByKey {
+				// Missing weights are treated as 0.
+				continue
+			}
+			score, err := strconv.ParseFloat(weight, 64)
+			if err != nil || math.IsNaN(score) {
+				return Error("ERR One or more scores can't be converted into double")
+			}
+			scores[i] = score
+		}
+	}
+	indexes := make([]int, len(elements))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(a, b int) bool {
+		i, j := indexes[a], indexes[b]
+		cmp := 0
+		if alpha {
+			cmp = strings.Compare(weights[i], weights[j])
+		} else if scores[i] < scores[j] {
+			cmp = -1
+		} else if scores[i] > scores[j] {
+			cmp = 1
+		}
+		if cmp == 0 {
+			// Like Redis, compare the elements themselves to break ties.
+			cmp = strings.Compare(elements[i], elements[j])
+		}
+		if desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
+	sorted := make([]string, len(elements))
+	for a, i := range indexes {
+		sorted[a] = elements[i]
+	}
+	copy(elements, sorted)
+	return nil
+}
+
+// applyLimit applies the LIMIT option of SORT to elements.
+func applyLimit(elements []string, limit rangeOptions) []string {
+	start, count := limit.offset, limit.count
+	if start < 0 {
+		start = 0
+	}
+	if start >= int64(len(elements)) {
+		return nil
+	}
+	elements = elements[start:]
+	if count >= 0 && count < int64(len(elements)) {
+		elements = elements[:count]
+	}
+	return elements
+}
+
+// lookupByPattern returns the value that pattern refers to for the given
+// element, as in the BY and GET options of SORT. "#" refers to the element
+// itself. Otherwise, the first "*" in pattern is replaced with the element to
+// get a key. If the pattern contains "->" after the "*", the rest of the
+// pattern is the name of a field in the hash stored at the key. It returns nil
+// if the value does not exist.
+func lookupByPattern(db *db, pattern, element string) []byte {
+	if pattern == "#" {
+		return []byte(element)
+	}
+	star := strings.IndexByte(pattern, '*')
+	if star == -1 {
+		return nil
+	}
+	keyPattern, field := pattern, ""
+	if arrow := strings.Index(pattern[star+1:], "->"); arrow != -1 && star+1+arrow+2 < len(pattern) {
+		keyPattern = pattern[:star+1+arrow]
+		field = pattern[star+1+arrow+2:]
+	}
+	key := keyPattern[:star] + element + keyPattern[star+1:]
+	if field != "" {
+		h, ok := db.values[key].(hash)
+		if !ok {
+			return nil
+		}
+		return h[field]
+	}
+	value, _ := db.values[key].([]byte)
+	return value
+}
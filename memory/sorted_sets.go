@@ -0,0 +1,661 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File sorted_sets.go contains the implementations of the commands for sorted
+// sets.
+
+package memory
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// zmember is a member of a sorted set along with its score.
+type zmember struct {
+	member string
+	score  float64
+}
+
+// sorted returns the members of z ordered by score, then lexicographically.
+func (z sortedSet) sorted() []zmember {
+	members := make([]zmember, 0, len(z))
+	for member, score := range z {
+		members = append(members, zmember{member: member, score: score})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].score != members[j].score {
+			return members[i].score < members[j].score
+		}
+		return members[i].member < members[j].member
+	})
+	return members
+}
+
+// rank returns the 0-based rank of member in z, or -1 if it is not a member.
+func (z sortedSet) rank(member string) int {
+	if _, found := z[member]; !found {
+		return -1
+	}
+	for i, m := range z.sorted() {
+		if m.member == member {
+			return i
+		}
+	}
+	return -1
+}
+
+// zmembersReply returns members as an array reply, with the scores after each
+// member if withScores is true.
+func zmembersReply(members []zmember, withScores bool) []interface{} {
+	reply := []interface{}{}
+	for _, m := range members {
+		reply = append(reply, []byte(m.member))
+		if withScores {
+			reply = append(reply, []byte(formatFloat(m.score)))
+		}
+	}
+	return reply
+}
+
+// reverse reverses the order of members in place and returns it.
+func reverse(members []zmember) []zmember {
+	for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+		members[i], members[j] = members[j], members[i]
+	}
+	return members
+}
+
+// scoreBound is the min or max argument of commands like ZRANGEBYSCORE.
+type scoreBound struct {
+	value     float64
+	exclusive bool
+}
+
+// parseScoreBound parses arg as a score bound, e.g. "1.5", "(1.5" or "-inf".
+func parseScoreBound(arg []byte) (scoreBound, error) {
+	bound := scoreBound{}
+	s := string(arg)
+	if strings.HasPrefix(s, "(") {
+		bound.exclusive = true
+		s = s[1:]
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(value) {
+		return bound, errMinMaxFloat
+	}
+	bound.value = value
+	return bound, nil
+}
+
+// scoreInRange returns true iff score is between min and max.
+func scoreInRange(score float64, min, max scoreBound) bool {
+	if score < min.value || (min.exclusive && score == min.value) {
+		return false
+	}
+	if score > max.value || (max.exclusive && score == max.value) {
+		return false
+	}
+	return true
+}
+
+// lexBound is the min or max argument of commands like ZRANGEBYLEX.
+type lexBound struct {
+	value     string
+	exclusive bool
+	// infinity is -1 for "-", 1 for "+" and 0 otherwise.
+	infinity int
+}
+
+// parseLexBound parses arg as a lexicographical bound, e.g. "[a", "(a", "-"
+// or "+".
+func parseLexBound(arg []byte) (lexBound, error) {
+	s := string(arg)
+	switch {
+	case s == "-":
+		return lexBound{infinity: -1}, nil
+	case s == "+":
+		return lexBound{infinity: 1}, nil
+	case strings.HasPrefix(s, "["):
+		return lexBound{value: s[1:]}, nil
+	case strings.HasPrefix(s, "("):
+		return lexBound{value: s[1:], exclusive: true}, nil
+	}
+	return lexBound{}, errMinMaxLex
+}
+
+// lexInRange returns true iff member is between min and max.
+func lexInRange(member string, min, max lexBound) bool {
+	switch {
+	case min.infinity == 1:
+		return false
+	case min.infinity == 0 && (member < min.value || (min.exclusive && member == min.value)):
+		return false
+	case max.infinity == -1:
+		return false
+	case max.infinity == 0 && (member > max.value || (max.exclusive && member == max.value)):
+		return false
+	}
+	return true
+}
+
+// rangeOptions holds the WITHSCORES and LIMIT options of commands like
+// ZRANGEBYSCORE.
+type rangeOptions struct {
+	withScores bool
+	offset     int64
+	count      int64
+}
+
+// parseRangeOptions parses the options in args. withScoresAllowed is false for
+// the commands which do not support WITHSCORES, e.g. ZRANGEBYLEX.
+func parseRangeOptions(args [][]byte, withScoresAllowed bool) (rangeOptions, error) {
+	options := rangeOptions{count: -1}
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "WITHSCORES":
+			if !withScoresAllowed {
+				return options, errSyntax
+			}
+			options.withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return options, errSyntax
+			}
+			var err error
+			if options.offset, err = parseInt(args[i+1]); err != nil {
+				return options, err
+			}
+			if options.count, err = parseInt(args[i+2]); err != nil {
+				return options, err
+			}
+			i += 2
+		default:
+			return options, errSyntax
+		}
+	}
+	return options, nil
+}
+
+// limit applies the LIMIT option to members.
+func (options rangeOptions) limit(members []zmember) []zmember {
+	if options.offset < 0 || options.offset >= int64(len(members)) {
+		return nil
+	}
+	members = members[options.offset:]
+	if options.count >= 0 && options.count < int64(len(members)) {
+		members = members[:options.count]
+	}
+	return members
+}
+
+func zadd(db *db, args [][]byte) interface{} {
+	nx, xx, ch, incr := false, false, false, false
+	i := 2
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break options
+		}
+	}
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 || (nx && xx) || (incr && len(pairs) != 2) {
+		return errSyntax
+	}
+	scores := make([]float64, len(pairs)/2)
+	for j := range scores {
+		score, err := parseFloat(pairs[2*j])
+		if err != nil {
+			return err
+		}
+		scores[j] = score
+	}
+	z, err := db.getSortedSet(string(args[1]), true)
+	if err != nil {
+		return err
+	}
+	added, changed := int64(0), int64(0)
+	for j, score := range scores {
+		member := string(pairs[2*j+1])
+		current, found := z[member]
+		if (nx && found) || (xx && !found) {
+			if incr {
+				return nil
+			}
+			continue
+		}
+		if incr {
+			score += current
+			if math.IsNaN(score) {
+				return Error("ERR resulting score is not a number (NaN)")
+			}
+			z[member] = score
+			return []byte(formatFloat(score))
+		}
+		if !found {
+			added++
+		} else if current != score {
+			changed++
+		}
+		z[member] = score
+	}
+	if ch {
+		return added + changed
+	}
+	return added
+}
+
+func zcard(db *db, args [][]byte) interface{} {
+	z, err := db.getSortedSet(string(args[1]), false)
+	if err != nil {
+		return err
+	}
+	return int64(len(z))
+}
+
+func zcount(db *db, args [][]byte) interface{} {
+	min, err := parseScoreBound(args[2])
+	if err != nil {
+		return err
+	}
+	max, err := parseScoreBound(args[3])
+	if err != nil {
+		return err
+	}
+	z, err := db.getSortedSet(string(args[1]), false)
+	if err != nil {
+		return err
+	}
+	count := int64(0)
+	for _, score := range z {
+		if scoreInRange(score, min, max) {
+			count++
+		}
+	}
+	return count
+}
+
+func zincrby(db *db, args [][]byte) interface{} {
+	return zadd(db, [][]byte{args[0], args[1], []byte("INCR"), args[2], args[3]})
+}
+
+func zlexcount(db *db, args [][]byte) interface{} {
+	min, err := parseLexBound(args[2])
+	if err != nil {
+		return err
+	}
+	max, err := parseLexBound(args[3])
+	if err != nil {
+		return err
+	}
+	z, err := db.getSortedSet(string(args[1]), false)
+	if err != nil {
+		return err
+	}
+	count := int64(0)
+	for member := range z {
+		if lexInRange(member, min, max) {
+			count++
+		}
+	}
+	return count
+}
+
+// zrangeByRank implements ZRANGE and ZREVRANGE.
+func zrangeByRank(db *db, args [][]byte, rev bool) interface{} {
+	start, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	stop, err := parseInt(args[3])
+	if err != nil {
+		return err
+	}
+	withScores := false
+	switch {
+	case len(args) == 5 && strings.ToUpper(string(args[4])) == "WITHSCORES":
+		withScores = true
+	case len(args) != 4:
+		return errSyntax
+	}
+	z, err := db.getSortedSet(string(args[1]), false)
+	if err != nil {
+		return err
+	}
+	members := z.sorted()
+	if rev {
+		reverse(members)
+	}
+	from, to := normalizeRange(start, stop, len(members))
+	return zmembersReply(members[from:to], withScores)
+}
+
+// zscan implements ZSCAN with the MATCH and COUNT options. Like scan, the
+// cursor is the rank of the next member.
+func zscan(db *db, args [][]byte) interface{} {
+	cursor, options, err := parseScanArgs(args[2:], false)
+	if err != nil {
+		return err
+	}
+	z, err := db.getSortedSet(string(args[1]), false)
+	if err != nil {
+		return err
+	}
+	all := z.sorted()
+	matching := []zmember{}
+	next := cursor
+	for ; next < len(all) && next < cursor+options.count; next++ {
+		if globMatch(options.pattern, all[next].member) {
+			matching = append(matching, all[next])
+		}
+	}
+	if next >= len(all) {
+		next = 0
+	}
+	return []interface{}{[]byte(strconv.Itoa(next)), zmembersReply(matching, true)}
+}
+
+func zrange(db *db, args [][]byte) interface{} {
+	return zrangeByRank(db, args, false)
+}
+
+func zrevrange(db *db, args [][]byte) interface{} {
+	return zrangeByRank(db, args, true)
+}
+
+// zrangeByScore implements ZRANGEBYSCORE and ZREVRANGEBYSCORE.
+func zrangeByScore(db *db, args [][]byte, rev bool) interface{} {
+	minArg, maxArg := args[2], args[3]
+	if rev {
+		minArg, maxArg = maxArg, minArg
+	}
+	min, err := parseScoreBound(minArg)
+	if err != nil {
+		return err
+	}
+	max, err := parseScoreBound(maxArg)
+	if err != nil {
+		return err
+	}
+	options, err := parseRangeOptions(args[4:], true)
+	if err != nil {
+		return err
+	}
+	z, err := db.getSortedSet(string(args[1]), false)
+	if err != nil {
+		return err
+	}
+	members := []zmember{}
+	for _, m := range z.sorted() {
+		if scoreInRange(m.score, min, max) {
+			members = append(members, m)
+		}
+	}
+	if rev {
+		reverse(members)
+	}
+	return zmembersReply(options.limit(members), options.withScores)
+}
+
+func zrangebyscore(db *db, args [][]byte) interface{} {
+	return zrangeByScore(db, args, false)
+}
+
+func zrevrangebyscore(db *db, args [][]byte) interface{} {
+	return zrangeByScore(db, args, true)
+}
+
+// zrangeByLex implements ZRANGEBYLEX and ZREVRANGEBYLEX. Like Redis, it
+// assumes all the members have the same score.
+func zrangeByLex(db *db, args [][]byte, rev bool) interface{} {
+	minArg, maxArg := args[2], args[3]
+	if rev {
+		minArg, maxArg = maxArg, minArg
+	}
+	min, err := parseLexBound(minArg)
+	if err != nil {
+		return err
+	}
+	max, err := parseLexBound(maxArg)
+	if err != nil {
+		return err
+	}
+	options, err := parseRangeOptions(args[4:], false)
+	if err != nil {
+		return err
+	}
+	z, err := db.getSortedSet(string(args[1]), false)
+	if err != nil {
+		return err
+	}
+	members := []zmember{}
+	for _, m := range z.sorted() {
+		if lexInRange(m.member, min, max) {
+			members = append(members, m)
+		}
+	}
+	if rev {
+		reverse(members)
+	}
+	return zmembersReply(options.limit(members), false)
+}
+
+func zrangebylex(db *db, args [][]byte) interface{} {
+	return zrangeByLex(db, args, false)
+}
+
+func zrevrangebylex(db *db, args [][]byte) interface{} {
+	return zrangeByLex(db, args, true)
+}
+
+func zrank(db *db, args [][]byte) interface{} {
+	z, err := db.getSortedSet(string(args[1]), false)
+	if err != nil {
+		return err
+	}
+	if rank := z.rank(string(args[2])); rank != -1 {
+		return int64(rank)
+	}
+	return nil
+}
+
+func zrevrank(db *db, args [][]byte) interface{} {
+	z, err := db.getSortedSet(string(args[1]), false)
+	if err != nil {
+		return err
+	}
+	if rank := z.rank(string(args[2])); rank != -1 {
+		return int64(len(z) - 1 - rank)
+	}
+	return nil
+}
+
+func zrem(db *db, args [][]byte) interface{} {
+	z, err := db.getSortedSet(string(args[1]), false)
+	if err != nil || z == nil {
+		return replyOrZero(err)
+	}
+	db.touch(string(args[1]))
+	count := int64(0)
+	for _, member := range args[2:] {
+		if _, found := z[string(member)]; found {
+			delete(z, string(member))
+			count++
+		}
+	}
+	return count
+}
+
+func zremrangebyscore(db *db, args [][]byte) interface{} {
+	min, err := parseScoreBound(args[2])
+	if err != nil {
+		return err
+	}
+	max, err := parseScoreBound(args[3])
+	if err != nil {
+		return err
+	}
+	z, err := db.getSortedSet(string(args[1]), false)
+	if err != nil || z == nil {
+		return replyOrZero(err)
+	}
+	db.touch(string(args[1]))
+	count := int64(0)
+	for member, score := range z {
+		if scoreInRange(score, min, max) {
+			delete(z, member)
+			count++
+		}
+	}
+	return count
+}
+
+func zscore(db *db, args [][]byte) interface{} {
+	z, err := db.getSortedSet(string(args[1]), false)
+	if err != nil {
+		return err
+	}
+	if score, found := z[string(args[2])]; found {
+		return []byte(formatFloat(score))
+	}
+	return nil
+}
+
+// zstore implements ZINTERSTORE and ZUNIONSTORE.
+func zstore(db *db, args [][]byte, inter bool) interface{} {
+	numKeys, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	if numKeys < 1 {
+		return Error("ERR at least 1 input key is needed for " + strings.ToLower(string(args[0])) + "/store")
+	}
+	if int64(len(args)) < 3+numKeys {
+		return errSyntax
+	}
+	keys := args[3 : 3+numKeys]
+	weights := make([]float64, numKeys)
+	for i := range weights {
+		weights[i] = 1
+	}
+	aggregate := "SUM"
+	options := args[3+numKeys:]
+	for i := 0; i < len(options); i++ {
+		switch strings.ToUpper(string(options[i])) {
+		case "WEIGHTS":
+			if int64(len(options)-i-1) < numKeys {
+				return errSyntax
+			}
+			for j := range weights {
+				weight, err := parseFloat(options[i+1+j])
+				if err != nil {
+					return Error("ERR weight value is not a float")
+				}
+				weights[j] = weight
+			}
+			i += int(numKeys)
+		case "AGGREGATE":
+			if i+1 >= len(options) {
+				return errSyntax
+			}
+			aggregate = strings.ToUpper(string(options[i+1]))
+			if aggregate != "SUM" && aggregate != "MIN" && aggregate != "MAX" {
+				return errSyntax
+			}
+			i++
+		default:
+			return errSyntax
+		}
+	}
+	var result sortedSet
+	for i, key := range keys {
+		source, err := zsetOrSet(db, string(key))
+		if err != nil {
+			return err
+		}
+		weighted := sortedSet{}
+		for member, score := range source {
+			weighted[member] = weightScore(score, weights[i])
+		}
+		if i == 0 {
+			result = weighted
+			continue
+		}
+		for member, score := range weighted {
+			if current, found := result[member]; found {
+				result[member] = aggregateScores(aggregate, current, score)
+			} else if !inter {
+				result[member] = score
+			}
+		}
+		if inter {
+			for member := range result {
+				if _, found := weighted[member]; !found {
+					delete(result, member)
+				}
+			}
+		}
+	}
+	db.del(string(args[1]))
+	if len(result) > 0 {
+		db.setValue(string(args[1]), result)
+	}
+	return int64(len(result))
+}
+
+// zsetOrSet returns the sorted set stored at key. If key holds a set, it
+// returns a sorted set with the same members and a score of 1 for each.
+func zsetOrSet(db *db, key string) (sortedSet, error) {
+	if s, ok := db.values[key].(set); ok {
+		z := sortedSet{}
+		for member := range s {
+			z[member] = 1
+		}
+		return z, nil
+	}
+	return db.getSortedSet(key, false)
+}
+
+// weightScore multiplies score by weight. Like Redis, it treats 0 times
+// infinity as 0.
+func weightScore(score, weight float64) float64 {
+	result := score * weight
+	if math.IsNaN(result) {
+		return 0
+	}
+	return result
+}
+
+// aggregateScores combines two scores using the given AGGREGATE option.
+func aggregateScores(aggregate string, a, b float64) float64 {
+	switch aggregate {
+	case "MIN":
+		return math.Min(a, b)
+	case "MAX":
+		return math.Max(a, b)
+	}
+	if sum := a + b; !math.IsNaN(sum) {
+		return sum
+	}
+	return 0
+}
+
+func zinterstore(db *db, args [][]byte) interface{} {
+	return zstore(db, args, true)
+}
+
+func zunionstore(db *db, args [][]byte) interface{} {
+	return zstore(db, args, false)
+}
@@ -0,0 +1,550 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File migration.go contains code related to registering and running
+// migrations, which change the fields stored for every model in a collection.
+
+package zoom
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// maxMigrationAttempts is the number of times a batch of models is read and
+// migrated before giving up on the models which keep changing concurrently.
+const maxMigrationAttempts = 10
+
+// migrationLockTTL is how long the lock taken by RunMigrations is held unless
+// it is renewed. It is renewed before every batch, so it only expires if the
+// process which holds it stops or a single batch takes longer than this.
+const migrationLockTTL = time.Minute
+
+// cleanupTimeout limits the commands which clean up after an operation, such
+// as releasing a lock. They do not use the context of the operation, which is
+// often done by the time they run.
+const cleanupTimeout = 5 * time.Second
+
+// MigrationFunc is a function which migrates a single model. old maps the
+// names of the fields (as they are stored in Redis) to their values in the main
+// hash of the model. The function returns the new fields of the model, and any
+// field which is missing from the returned map is deleted. If it returns nil,
+// the model is left unchanged. The function receives a copy of the fields, so
+// it may modify and return old.
+type MigrationFunc func(old map[string][]byte) (map[string][]byte, error)
+
+// migration is a migration which was registered with Pool.RegisterMigration.
+type migration struct {
+	id         string
+	collection *Collection
+	migrate    MigrationFunc
+}
+
+// MigrationResult describes a migration which was run by RunMigrations or
+// DryRunMigrations.
+type MigrationResult struct {
+	// Id is the id which the migration was registered with.
+	Id string
+	// Models is the number of models which were passed to the migration.
+	Models int
+	// Changed is the number of models which were changed by the migration, or
+	// which would have been changed in a dry run.
+	Changed int
+}
+
+// RegisterMigration registers a migration identified by id which changes the
+// models in the given collection with migrate. Migrations are run in the
+// order in which they were registered by RunMigrations, and each one only runs
+// once: the ids of the migrations which have been applied are stored in Redis.
+// Like NewCollection, RegisterMigration should be called during
+// initialization, before RunMigrations. It returns an error if id is empty or
+// if another migration was already registered with the same id.
+func (p *Pool) RegisterMigration(id string, collection *Collection, migrate MigrationFunc) error {
+	if collection == nil {
+		return newNilCollectionError("RegisterMigration")
+	}
+	switch {
+	case id == "":
+		return fmt.Errorf("zoom: Error in RegisterMigration: The id cannot be empty")
+	case migrate == nil:
+		return fmt.Errorf("zoom: Error in RegisterMigration: The migration %s does not have a function", id)
+	case collection.pool != p:
+		return fmt.Errorf("zoom: Error in RegisterMigration: The collection %s belongs to another pool", collection.Name())
+	}
+	for _, m := range p.migrations {
+		if m.id == id {
+			return fmt.Errorf("zoom: Error in RegisterMigration: A migration with the id %s has already been registered", id)
+		}
+	}
+	p.migrations = append(p.migrations, &migration{
+		id:         id,
+		collection: collection,
+		migrate:    migrate,
+	})
+	return nil
+}
+
+// PendingMigrations returns the ids of the registered migrations which have
+// not been applied yet, in the order in which they would be run.
+func (p *Pool) PendingMigrations() ([]string, error) {
+	return p.PendingMigrationsContext(context.Background())
+}
+
+// PendingMigrationsContext is like PendingMigrations but uses the given
+// context. See Pool.NewTransactionContext for a description of how the context
+// is used.
+func (p *Pool) PendingMigrationsContext(ctx context.Context) ([]string, error) {
+	pending, err := p.pendingMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(pending))
+	for i, m := range pending {
+		ids[i] = m.id
+	}
+	return ids, nil
+}
+
+// RunMigrations runs the registered migrations which have not been applied
+// yet, in the order in which they were registered, and returns a result for
+// each of them. Each migration is run over every model in its collection
+// (including soft deleted models) in batches of at most PoolOptions.BatchSize
+// models, and is recorded as applied once all the models have been migrated.
+//
+// Each model is migrated atomically, and only if its main hash has not changed
+// since it was read. Models which are changed concurrently are read and
+// migrated again. Migrating a model updates the field indexes and the unique
+// values of the fields which were changed or deleted, and increments the
+// version of the model (if any), so that copies which were found before the
+// migration cannot overwrite it. If a migration fails, RunMigrations returns
+// the results of the migrations which were applied along with the error, and
+// the failed migration is run again from the start next time, so migrations
+// should give the same result when they are run on a model which has already
+// been migrated.
+//
+// Only one process can run migrations at a time. RunMigrations takes a lock in
+// Redis before it reads the pending migrations and renews it before every
+// batch, and returns ErrMigrationsLocked if another process holds the lock.
+func (p *Pool) RunMigrations() ([]MigrationResult, error) {
+	return p.RunMigrationsContext(context.Background())
+}
+
+// RunMigrationsContext is like RunMigrations but uses the given context for
+// every batch. See Pool.NewTransactionContext for a description of how the
+// context is used.
+func (p *Pool) RunMigrationsContext(ctx context.Context) ([]MigrationResult, error) {
+	return p.runMigrations(ctx, false)
+}
+
+// DryRunMigrations is like RunMigrations, but does not change any models or
+// record any migrations as applied. It can be used to check that the pending
+// migrations succeed on every model and to find out how many models they
+// would change. Since the stored models are not changed, the earlier pending
+// migrations for the same collection are applied to each model in memory, in
+// order, before a migration is run on it. DryRunMigrations takes the same lock
+// as RunMigrations.
+func (p *Pool) DryRunMigrations() ([]MigrationResult, error) {
+	return p.DryRunMigrationsContext(context.Background())
+}
+
+// DryRunMigrationsContext is like DryRunMigrations but uses the given context
+// for every batch. See Pool.NewTransactionContext for a description of how the
+// context is used.
+func (p *Pool) DryRunMigrationsContext(ctx context.Context) ([]MigrationResult, error) {
+	return p.runMigrations(ctx, true)
+}
+
+// runMigrations takes the migrations lock and runs the pending migrations. If
+// dryRun is true, nothing is written except for the lock and the temporary
+// lists of ids.
+func (p *Pool) runMigrations(ctx context.Context, dryRun bool) ([]MigrationResult, error) {
+	lock, err := p.lockMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	results, err := p.runLockedMigrations(ctx, lock, dryRun)
+	if releaseErr := lock.release(); err == nil {
+		err = releaseErr
+	}
+	return results, err
+}
+
+// runLockedMigrations runs the pending migrations while lock is held, renewing
+// it before every batch.
+func (p *Pool) runLockedMigrations(ctx context.Context, lock *migrationLock, dryRun bool) ([]MigrationResult, error) {
+	pending, err := p.pendingMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	results := []MigrationResult{}
+	for i, m := range pending {
+		result := MigrationResult{Id: m.id}
+		// A dry run does not change the stored models, so the earlier migrations
+		// are applied to them in memory.
+		var earlier []*migration
+		if dryRun {
+			earlier = pending[:i]
+		}
+		if err := m.collection.forEachIdBatch(ctx, "migrate", func(ids []string) error {
+			if err := lock.renew(ctx); err != nil {
+				return err
+			}
+			return m.migrateModels(ctx, ids, earlier, dryRun, &result)
+		}); err != nil {
+			return results, err
+		}
+		if !dryRun {
+			tx := p.NewTransactionContext(ctx)
+			tx.Command("HSET", Args{p.migrationsKey(), m.id, timeToUnixMicro(time.Now())}, nil)
+			if err := tx.Exec(); err != nil {
+				return results, err
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// migrationLock is the lock which makes sure that only one process runs
+// migrations at a time. The key of the lock holds token, which identifies the
+// holder, so that a lock which expired and was taken by another process is
+// never renewed or released.
+type migrationLock struct {
+	pool  *Pool
+	token string
+}
+
+// lockMigrations takes the migrations lock. It returns ErrMigrationsLocked if
+// the lock is held by another process.
+func (p *Pool) lockMigrations(ctx context.Context) (*migrationLock, error) {
+	lock := &migrationLock{
+		pool:  p,
+		token: generateRandomId(),
+	}
+	locked := false
+	tx := p.NewTransactionContext(ctx)
+	tx.Command("SET", Args{p.migrationsLockKey(), lock.token, "NX", "PX", int64(migrationLockTTL / time.Millisecond)}, func(reply interface{}) error {
+		// SET replies with nil if the key already exists
+		locked = reply != nil
+		return nil
+	})
+	if err := tx.Exec(); err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, ErrMigrationsLocked
+	}
+	return lock, nil
+}
+
+// renew resets the time to live of the lock. It returns an error if the lock
+// has expired since it was taken or last renewed.
+// NOTE: this invokes a lua script which is defined in scripts/renew_lock.lua
+func (lock *migrationLock) renew(ctx context.Context) error {
+	renewed := false
+	tx := lock.pool.NewTransactionContext(ctx)
+	tx.Script(renewLockScript, Args{lock.pool.migrationsLockKey(), lock.token, int64(migrationLockTTL / time.Millisecond)}, NewScanBoolHandler(&renewed))
+	if err := tx.Exec(); err != nil {
+		return err
+	}
+	if !renewed {
+		return fmt.Errorf("zoom: Error in RunMigrations: The migrations lock expired before it could be renewed")
+	}
+	return nil
+}
+
+// release releases the lock, if it is still held. It uses its own context
+// with a timeout of cleanupTimeout.
+// NOTE: this invokes a lua script which is defined in scripts/renew_lock.lua
+func (lock *migrationLock) release() error {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+	tx := lock.pool.NewTransactionContext(ctx)
+	tx.Script(renewLockScript, Args{lock.pool.migrationsLockKey(), lock.token, 0}, nil)
+	return tx.Exec()
+}
+
+// pendingMigrations returns the registered migrations which have not been
+// applied yet.
+func (p *Pool) pendingMigrations(ctx context.Context) ([]*migration, error) {
+	applied := []string{}
+	tx := p.NewTransactionContext(ctx)
+	tx.Command("HKEYS", Args{p.migrationsKey()}, NewScanStringsHandler(&applied))
+	if err := tx.Exec(); err != nil {
+		return nil, err
+	}
+	pending := []*migration{}
+	for _, m := range p.migrations {
+		if !stringSliceContains(applied, m.id) {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// migrateModels runs the migration on the models with the given ids and adds
+// the number of models which were migrated and changed to result. The
+// migrations in earlier which belong to the same collection are applied to
+// each model in memory first.
+// NOTE: this invokes a lua script which is defined in scripts/migrate_model.lua
+func (m *migration) migrateModels(ctx context.Context, ids []string, earlier []*migration, dryRun bool, result *MigrationResult) error {
+	c := m.collection
+	versionField := ""
+	if c.spec.versionField != nil {
+		versionField = c.spec.versionField.redisName
+	}
+	for attempt := 0; len(ids) > 0; attempt++ {
+		if attempt == maxMigrationAttempts {
+			return fmt.Errorf("zoom: Error in migration %s: The models with ids %v kept changing while they were migrated", m.id, ids)
+		}
+		hashes := make([]map[string][]byte, len(ids))
+		tx := c.pool.NewTransactionContext(ctx)
+		for i, id := range ids {
+			i := i
+			modelKey, err := c.spec.modelKey(id)
+			if err != nil {
+				return err
+			}
+			tx.Command("HGETALL", Args{modelKey}, func(reply interface{}) error {
+				var err error
+				hashes[i], err = scanHash(reply)
+				return err
+			})
+		}
+		if err := tx.Exec(); err != nil {
+			return err
+		}
+		retry := []string{}
+		tx = c.pool.NewTransactionContext(ctx)
+		for i, id := range ids {
+			old := hashes[i]
+			if len(old) == 0 {
+				// The model was deleted or has expired since the ids were stored.
+				continue
+			}
+			if attempt == 0 {
+				result.Models++
+			}
+			for _, e := range earlier {
+				if e.collection != c {
+					continue
+				}
+				migrated, err := e.run(id, old)
+				if err != nil {
+					return err
+				}
+				if migrated != nil {
+					old = migrated
+				}
+			}
+			args, err := m.migrationArgs(id, versionField, old)
+			if err != nil {
+				return err
+			}
+			if args == nil {
+				continue
+			}
+			if dryRun {
+				result.Changed++
+				continue
+			}
+			id := id
+			tx.Script(migrateModelScript, args, func(reply interface{}) error {
+				values, err := redis.Values(reply, nil)
+				if err != nil {
+					return err
+				}
+				status, err := redis.Int(values[0], nil)
+				if err != nil {
+					return err
+				}
+				switch status {
+				case 1:
+					result.Changed++
+				case 0:
+					retry = append(retry, id)
+				case -2:
+					fieldName, _ := redis.String(values[1], nil)
+					otherId, _ := redis.String(values[2], nil)
+					return newUniqueConstraintError(c, c.spec.fieldNameForRedisName(fieldName), otherId)
+				}
+				return nil
+			})
+		}
+		if len(tx.actions) > 0 {
+			if err := tx.Exec(); err != nil {
+				return err
+			}
+		}
+		ids = retry
+	}
+	return nil
+}
+
+// run runs the migration on a copy of old, which holds the fields of the model
+// with the given id, and returns the new fields. It returns nil if the
+// migration leaves the model unchanged.
+func (m *migration) run(id string, old map[string][]byte) (map[string][]byte, error) {
+	oldCopy := make(map[string][]byte, len(old))
+	for name, value := range old {
+		oldCopy[name] = value
+	}
+	migrated, err := m.migrate(oldCopy)
+	if err != nil {
+		return nil, fmt.Errorf("zoom: Error in migration %s for the model with id %s: %s", m.id, id, err.Error())
+	}
+	if migrated != nil && len(migrated) == 0 {
+		return nil, fmt.Errorf("zoom: Error in migration %s for the model with id %s: The migration returned no fields", m.id, id)
+	}
+	return migrated, nil
+}
+
+// migrationArgs runs the migration on old, which holds the fields of the
+// model with the given id, and returns the arguments for the migrate_model
+// script. It returns nil if the migration does not change the model.
+func (m *migration) migrationArgs(id string, versionField string, old map[string][]byte) (Args, error) {
+	migrated, err := m.run(id, old)
+	if err != nil || migrated == nil {
+		return nil, err
+	}
+	deletes := []string{}
+	for name := range old {
+		if _, found := migrated[name]; !found {
+			deletes = append(deletes, name)
+		}
+	}
+	sets := []string{}
+	for name, value := range migrated {
+		if oldValue, found := old[name]; !found || !bytes.Equal(oldValue, value) {
+			sets = append(sets, name)
+		}
+	}
+	if len(deletes) == 0 && len(sets) == 0 {
+		return nil, nil
+	}
+	sort.Strings(deletes)
+	sort.Strings(sets)
+	modelKey, err := m.collection.spec.modelKey(id)
+	if err != nil {
+		return nil, err
+	}
+	args := Args{id, versionField, len(old), len(deletes), len(sets), unixMilli(time.Now())}
+	for name, value := range old {
+		args = append(args, name, value)
+	}
+	for _, name := range deletes {
+		args = append(args, name)
+	}
+	for _, name := range sets {
+		args = append(args, name, migrated[name])
+	}
+	mr := m.collection.newModelRef(id)
+	indexArgs := Args{}
+	for _, fs := range m.collection.spec.fields {
+		if fs.indexKind == noIndex && !fs.unique {
+			continue
+		}
+		var fieldArgs Args
+		if stringSliceContains(deletes, fs.redisName) {
+			fieldArgs, err = mr.deletedFieldIndexArgs(fs)
+		} else if stringSliceContains(sets, fs.redisName) {
+			if err := scanModel([]string{fs.name}, []interface{}{migrated[fs.redisName]}, mr); err != nil {
+				return nil, fmt.Errorf("zoom: Error in migration %s for the model with id %s: Could not convert the new value of %s: %s", m.id, id, fs.name, err.Error())
+			}
+			fieldArgs, err = mr.migratedFieldIndexArgs(fs)
+		}
+		if err != nil {
+			return nil, err
+		}
+		indexArgs = append(indexArgs, fieldArgs...)
+	}
+	indexKeys, indexArgs := splitIndexArgs(indexArgs)
+	args = append(args, indexArgs...)
+	keys := Args{modelKey, m.collection.spec.stringValuesKey(), m.collection.spec.expirationsKey()}
+	return variadicScriptArgs(append(keys, indexKeys...), args...), nil
+}
+
+// migratedFieldIndexArgs returns the arguments which describe the indexes on
+// the field fs of the model (if any) to the migrate_model script. There are
+// four arguments for each index: its kind, its key, the name of the field in
+// Redis and either the score or the value of the field. splitIndexArgs
+// separates the keys from the other arguments.
+func (mr *modelRef) migratedFieldIndexArgs(fs *fieldSpec) (Args, error) {
+	args := Args{}
+	if fs.unique {
+		uniqueArgs, err := mr.uniqueArgs(fs)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, uniqueArgs...)
+	}
+	if fs.indexKind != noIndex {
+		indexArgs, err := mr.fieldIndexArgs(fs)
+		if err != nil {
+			return nil, err
+		}
+		args = args.Add(indexArgs[0], indexArgs[1], fs.redisName, indexArgs[2])
+	}
+	return args, nil
+}
+
+// deletedFieldIndexArgs is like migratedFieldIndexArgs, but for a field which
+// is deleted from the main hash, which removes the model from the indexes.
+func (mr *modelRef) deletedFieldIndexArgs(fs *fieldSpec) (Args, error) {
+	args := Args{}
+	if fs.unique {
+		uniqueKey, err := mr.spec.uniqueKey(fs.name)
+		if err != nil {
+			return nil, err
+		}
+		args = args.Add("nullunique", uniqueKey, fs.redisName, "")
+	}
+	if fs.indexKind != noIndex {
+		indexKey, err := mr.spec.fieldIndexKey(fs.name)
+		if err != nil {
+			return nil, err
+		}
+		if fs.indexKind == stringIndex {
+			args = args.Add("nullstring", indexKey, fs.redisName, "")
+		} else {
+			args = args.Add("nullscore", indexKey, fs.redisName, "")
+		}
+	}
+	return args, nil
+}
+
+// scanHash converts the reply of an HGETALL command to a map of field names
+// to values.
+func scanHash(reply interface{}) (map[string][]byte, error) {
+	values, err := redis.ByteSlices(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(values)%2 != 0 {
+		return nil, fmt.Errorf("zoom: Error in scanHash: Expected an even number of values but got %d", len(values))
+	}
+	hash := make(map[string][]byte, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		hash[string(values[i])] = values[i+1]
+	}
+	return hash, nil
+}
+
+// migrationsKey returns the key of the hash which maps the ids of the
+// migrations which have been applied to the time at which they were applied as
+// a Unix timestamp in microseconds. See Pool.RunMigrations.
+func (p *Pool) migrationsKey() string {
+	return p.options.KeyPrefix + "migrations"
+}
+
+// migrationsLockKey returns the key of the lock which is held while migrations
+// are run. See Pool.RunMigrations.
+func (p *Pool) migrationsLockKey() string {
+	return p.options.KeyPrefix + "migrations:lock"
+}
@@ -0,0 +1,198 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File migration_test.go tests the code in migration.go
+
+package zoom
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// migrationTestModel is a model type used for testing migrations. It has the
+// kinds of indexes which need to be maintained when fields are changed.
+type migrationTestModel struct {
+	Name  string `zoom:"index"`
+	First string `zoom:"index"`
+	Age   int    `zoom:"index"`
+	Email string `zoom:"unique"`
+	RandomId
+}
+
+func TestMigrations(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Use a separate pool so that the migrations are not registered on the
+	// pool which is used by the other tests, and a small batch size so that
+	// the models are migrated in more than one batch.
+	pool := NewPoolWithOptions(testPool.options.WithBatchSize(2))
+	defer pool.Close()
+	col, err := pool.NewCollectionWithOptions(&migrationTestModel{}, DefaultCollectionOptions.WithIndex(true))
+	require.NoError(t, err)
+	models := make([]*migrationTestModel, 3)
+	for i := range models {
+		models[i] = &migrationTestModel{Name: fmt.Sprintf("Name%d", i), Age: i + 1, Email: fmt.Sprintf("USER%d@EXAMPLE.COM", i)}
+	}
+	require.NoError(t, col.SaveMany(models))
+	conn := pool.NewConn()
+	defer conn.Close()
+	_, err = conn.Do("HSET", col.ModelKey(models[0].Id), "Nickname", "old")
+	require.NoError(t, err)
+
+	require.NoError(t, pool.RegisterMigration("age-in-months", col, func(old map[string][]byte) (map[string][]byte, error) {
+		age, err := strconv.Atoi(string(old["Age"]))
+		if err != nil {
+			return nil, err
+		}
+		old["Age"] = []byte(strconv.Itoa(age * 12))
+		delete(old, "Nickname")
+		return old, nil
+	}))
+	require.NoError(t, pool.RegisterMigration("lowercase-email", col, func(old map[string][]byte) (map[string][]byte, error) {
+		old["Email"] = bytes.ToLower(old["Email"])
+		return old, nil
+	}))
+	require.NoError(t, pool.RegisterMigration("move-name", col, func(old map[string][]byte) (map[string][]byte, error) {
+		if _, found := old["Name"]; !found {
+			return nil, nil
+		}
+		old["First"] = old["Name"]
+		delete(old, "Name")
+		return old, nil
+	}))
+	assert.Error(t, pool.RegisterMigration("move-name", col, func(old map[string][]byte) (map[string][]byte, error) {
+		return nil, nil
+	}))
+	assert.Error(t, pool.RegisterMigration("", col, func(old map[string][]byte) (map[string][]byte, error) {
+		return nil, nil
+	}))
+	pending, err := pool.PendingMigrations()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"age-in-months", "lowercase-email", "move-name"}, pending)
+
+	// Migrations should not run while another process holds the lock.
+	_, err = conn.Do("SET", pool.migrationsLockKey(), "other", "PX", 60000)
+	require.NoError(t, err)
+	_, err = pool.RunMigrations()
+	assert.Equal(t, ErrMigrationsLocked, err)
+	_, err = pool.DryRunMigrations()
+	assert.Equal(t, ErrMigrationsLocked, err)
+	_, err = conn.Do("DEL", pool.migrationsLockKey())
+	require.NoError(t, err)
+
+	// A dry run should not change anything.
+	results, err := pool.DryRunMigrations()
+	require.NoError(t, err)
+	assert.Equal(t, []MigrationResult{
+		{Id: "age-in-months", Models: 3, Changed: 3},
+		{Id: "lowercase-email", Models: 3, Changed: 3},
+		{Id: "move-name", Models: 3, Changed: 3},
+	}, results)
+	found := []*migrationTestModel{}
+	require.NoError(t, col.FindAll(&found))
+	assert.ElementsMatch(t, models, found)
+	pending, err = pool.PendingMigrations()
+	require.NoError(t, err)
+	assert.Len(t, pending, 3)
+
+	results, err = pool.RunMigrations()
+	require.NoError(t, err)
+	assert.Len(t, results, 3)
+	pending, err = pool.PendingMigrations()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+	expectKeyDoesNotExist(t, pool.migrationsLockKey())
+	for i, model := range models {
+		model.Age *= 12
+		model.Email = fmt.Sprintf("user%d@example.com", i)
+		model.First = model.Name
+		model.Name = ""
+	}
+	found = []*migrationTestModel{}
+	require.NoError(t, col.FindAll(&found))
+	assert.ElementsMatch(t, models, found)
+	exists, err := redis.Bool(conn.Do("HEXISTS", col.ModelKey(models[0].Id), "Nickname"))
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// The indexes on the changed fields should be updated.
+	ids, err := col.NewQuery().Filter("Age >", 12).Order("Age").Ids()
+	require.NoError(t, err)
+	assert.Equal(t, []string{models[1].Id, models[2].Id}, ids)
+	ids, err = col.NewQuery().Filter("First =", "Name0").Ids()
+	require.NoError(t, err)
+	assert.Equal(t, []string{models[0].Id}, ids)
+	nameKey, err := col.spec.fieldIndexKey("Name")
+	require.NoError(t, err)
+	expectKeyDoesNotExist(t, nameKey)
+	foundModel := &migrationTestModel{}
+	require.NoError(t, col.FindBy("Email", "user1@example.com", foundModel))
+	assert.Equal(t, models[1], foundModel)
+	assert.IsType(t, ModelNotFoundError{}, col.FindBy("Email", "USER1@EXAMPLE.COM", foundModel))
+
+	// Applied migrations should not run again, and a migration which fails
+	// should not be recorded.
+	require.NoError(t, pool.RegisterMigration("fail", col, func(old map[string][]byte) (map[string][]byte, error) {
+		return nil, fmt.Errorf("test error")
+	}))
+	results, err = pool.RunMigrations()
+	assert.Error(t, err)
+	assert.Empty(t, results)
+	pending, err = pool.PendingMigrations()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"fail"}, pending)
+}
+
+func TestDryRunMigrationsChained(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	pool := NewPoolWithOptions(testPool.options)
+	defer pool.Close()
+	col, err := pool.NewCollectionWithOptions(&migrationTestModel{}, DefaultCollectionOptions.WithIndex(true))
+	require.NoError(t, err)
+	models := []*migrationTestModel{{Name: "a", Email: "a@example.com"}, {Name: "b", Email: "b@example.com"}}
+	require.NoError(t, col.SaveMany(models))
+	conn := pool.NewConn()
+	defer conn.Close()
+	for _, model := range models {
+		_, err = conn.Do("HSET", col.ModelKey(model.Id), "Nickname", model.Name)
+		require.NoError(t, err)
+	}
+
+	// The second migration only works on models which were changed by the
+	// first one, so the dry run must apply the first one in memory.
+	require.NoError(t, pool.RegisterMigration("rename-nickname", col, func(old map[string][]byte) (map[string][]byte, error) {
+		old["Alias"] = old["Nickname"]
+		delete(old, "Nickname")
+		return old, nil
+	}))
+	require.NoError(t, pool.RegisterMigration("uppercase-alias", col, func(old map[string][]byte) (map[string][]byte, error) {
+		alias, found := old["Alias"]
+		if !found {
+			return nil, fmt.Errorf("missing Alias")
+		}
+		old["Alias"] = bytes.ToUpper(alias)
+		return old, nil
+	}))
+	results, err := pool.DryRunMigrations()
+	require.NoError(t, err)
+	assert.Equal(t, []MigrationResult{
+		{Id: "rename-nickname", Models: 2, Changed: 2},
+		{Id: "uppercase-alias", Models: 2, Changed: 2},
+	}, results)
+	for _, model := range models {
+		exists, err := redis.Bool(conn.Do("HEXISTS", col.ModelKey(model.Id), "Alias"))
+		require.NoError(t, err)
+		assert.False(t, exists)
+	}
+}
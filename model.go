@@ -11,9 +11,8 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"time"
-
-	"github.com/garyburd/redigo/redis"
 )
 
 // RandomId can be embedded in any model struct in order to satisfy
@@ -54,6 +53,29 @@ type modelSpec struct {
 	fieldsByName map[string]*fieldSpec
 	fields       []*fieldSpec
 	fallback     MarshalerUnmarshaler
+	// hashTag is true iff the name should be wrapped in a Redis Cluster hash
+	// tag (e.g. "{User}") in every key. This guarantees that all the keys for
+	// the collection are stored in the same slot.
+	hashTag bool
+	// keyPrefix is prepended to every key for the collection, including
+	// temporary keys. It comes from PoolOptions.KeyPrefix.
+	keyPrefix string
+	// target holds the name which is used in the keys for the collection
+	// instead of name after the collection has been switched to another name
+	// (see Collection.SwitchTo). It may be nil, in which case name is used.
+	target *atomic.Value
+	// versionField is the field with the "version" option in its struct tag,
+	// or nil if there is none. See the documentation for Collection.Save.
+	versionField *fieldSpec
+	// softDeleteField is the field with the "softdelete" option in its struct
+	// tag, or nil if there is none. See the documentation for
+	// Collection.SoftDelete.
+	softDeleteField *fieldSpec
+	// createdField and updatedField are the fields with the "created" and
+	// "updated" options in their struct tags, or nil if there are none. See the
+	// documentation for Collection.Save.
+	createdField *fieldSpec
+	updatedField *fieldSpec
 }
 
 // fieldSpec contains parsed information about a particular field
@@ -63,16 +85,23 @@ type fieldSpec struct {
 	redisName string
 	typ       reflect.Type
 	indexKind indexKind
+	// unique is true iff no two models can have the same value for the field.
+	// See the documentation for Collection.Save.
+	unique bool
+	// rules are the validation rules for the field, in the order in which they
+	// appear in the struct tag
+	rules []*fieldRule
 }
 
 // fieldKind is the kind of a particular field, and is either a primitive,
-// a pointer, or an inconvertible.
+// a pointer, a time, or an inconvertible.
 type fieldKind int
 
 const (
 	primativeField     fieldKind = iota // any primitive type
 	pointerField                        // pointer to any primitive type
 	inconvertibleField                  // all other types
+	timeField                           // time.Time stored as Unix microseconds
 )
 
 // indexKind is the kind of an index, and is either noIndex, numericIndex,
@@ -129,17 +158,45 @@ func compileModelSpec(typ reflect.Type) (*modelSpec, error) {
 			fs.redisName = fs.name
 		}
 
-		// Parse the "zoom" tag (currently only "index" is supported)
+		// Parse the "zoom" tag ("index", "unique", "version", "softdelete",
+		// "created", "updated" and the validation rules in validation.go are
+		// supported)
 		zoomTag := tag.Get("zoom")
 		shouldIndex := false
+		isUnique := false
+		isVersion := false
+		isSoftDelete := false
+		timestampOption := ""
 		if zoomTag != "" {
 			options := strings.Split(zoomTag, ",")
-			for _, op := range options {
+			for i := 0; i < len(options); i++ {
+				op := options[i]
+				if strings.HasPrefix(op, "regex=") {
+					// The regular expression may contain commas, so it takes up the
+					// rest of the tag
+					op = strings.Join(options[i:], ",")
+					i = len(options)
+				}
 				switch op {
 				case "index":
 					shouldIndex = true
+				case "unique":
+					isUnique = true
+				case "version":
+					isVersion = true
+				case "softdelete":
+					isSoftDelete = true
+				case "created", "updated":
+					if timestampOption != "" {
+						return nil, fmt.Errorf("zoom: The field %s cannot have both the %s and %s options", fs.name, timestampOption, op)
+					}
+					timestampOption = op
 				default:
-					return nil, fmt.Errorf("zoom: unrecognized option specified in struct tag: %s", op)
+					rule, err := parseFieldRule(fs, op)
+					if err != nil {
+						return nil, err
+					}
+					fs.rules = append(fs.rules, rule)
 				}
 			}
 		}
@@ -161,6 +218,15 @@ func compileModelSpec(typ reflect.Type) (*modelSpec, error) {
 					return nil, err
 				}
 			}
+		} else if isSoftDelete {
+			// The soft delete field is checked below
+			fs.kind = timeField
+		} else if timestampOption != "" && field.Type == reflect.TypeOf(time.Time{}) {
+			// Timestamps are stored as numbers, so they can be indexed
+			fs.kind = timeField
+			if shouldIndex {
+				fs.indexKind = numericIndex
+			}
 		} else {
 			// All other types are considered inconvertible
 			if shouldIndex {
@@ -168,10 +234,84 @@ func compileModelSpec(typ reflect.Type) (*modelSpec, error) {
 			}
 			fs.kind = inconvertibleField
 		}
+
+		if isUnique {
+			if (fs.kind != primativeField && fs.kind != pointerField) || isVersion {
+				return nil, fmt.Errorf("zoom: The field %s of type %s cannot be unique", fs.name, fs.typ)
+			}
+			fs.unique = true
+		}
+		if isVersion {
+			if err := setVersionField(ms, fs, shouldIndex); err != nil {
+				return nil, err
+			}
+		}
+		if isSoftDelete {
+			if err := setSoftDeleteField(ms, fs, shouldIndex); err != nil {
+				return nil, err
+			}
+		}
+		switch timestampOption {
+		case "created":
+			if err := setTimestampField(&ms.createdField, fs, timestampOption); err != nil {
+				return nil, err
+			}
+		case "updated":
+			if err := setTimestampField(&ms.updatedField, fs, timestampOption); err != nil {
+				return nil, err
+			}
+		}
 	}
 	return ms, nil
 }
 
+// setVersionField makes fs the version field of ms. It returns an error if ms
+// already has a version field or if fs cannot be used as a version field.
+func setVersionField(ms *modelSpec, fs *fieldSpec, shouldIndex bool) error {
+	if ms.versionField != nil {
+		return fmt.Errorf("zoom: Only one field can have the version option but both %s and %s do", ms.versionField.name, fs.name)
+	}
+	if fs.kind != primativeField || !typeIsInteger(fs.typ) {
+		return fmt.Errorf("zoom: The version field %s must be an integer but has type %s", fs.name, fs.typ)
+	}
+	if shouldIndex {
+		return fmt.Errorf("zoom: The version field %s cannot be indexed", fs.name)
+	}
+	ms.versionField = fs
+	return nil
+}
+
+// setSoftDeleteField makes fs the soft delete field of ms. It returns an error
+// if ms already has a soft delete field or if fs cannot be used as a soft
+// delete field.
+func setSoftDeleteField(ms *modelSpec, fs *fieldSpec, shouldIndex bool) error {
+	if ms.softDeleteField != nil {
+		return fmt.Errorf("zoom: Only one field can have the softdelete option but both %s and %s do", ms.softDeleteField.name, fs.name)
+	}
+	if fs.typ != reflect.TypeOf(time.Time{}) {
+		return fmt.Errorf("zoom: The softdelete field %s must be a time.Time but has type %s", fs.name, fs.typ)
+	}
+	if shouldIndex {
+		return fmt.Errorf("zoom: The softdelete field %s cannot be indexed", fs.name)
+	}
+	ms.softDeleteField = fs
+	return nil
+}
+
+// setTimestampField sets *field to fs, which has the given timestamp option
+// ("created" or "updated") in its struct tag. It returns an error if *field is
+// already set or if fs is not a time.Time.
+func setTimestampField(field **fieldSpec, fs *fieldSpec, option string) error {
+	if *field != nil {
+		return fmt.Errorf("zoom: Only one field can have the %s option but both %s and %s do", option, (*field).name, fs.name)
+	}
+	if fs.kind != timeField {
+		return fmt.Errorf("zoom: The %s field %s must be a time.Time but has type %s", option, fs.name, fs.typ)
+	}
+	*field = fs
+	return nil
+}
+
 // getDefaultModelSpecName returns the default name for the given type, which is
 // simply the name of the type without the package prefix or dereference
 // operators.
@@ -200,10 +340,83 @@ func setIndexKind(fs *fieldSpec, fieldType reflect.Type) error {
 	return nil
 }
 
+// keyspace returns the string that every model and index key for the given
+// modelSpec starts with (not including the ":" separator). It is the key prefix
+// followed by the name of the collection, which is wrapped in a hash tag if
+// hashTag is true.
+func (ms *modelSpec) keyspace() string {
+	name := ms.keyName()
+	if ms.hashTag {
+		return ms.keyPrefix + "{" + name + "}"
+	}
+	return ms.keyPrefix + name
+}
+
+// keyName returns the name which is used in the keys for the collection. It is
+// the name of the collection unless the collection has been switched to
+// another name.
+func (ms *modelSpec) keyName() string {
+	if ms.target != nil {
+		if target, ok := ms.target.Load().(string); ok && target != "" {
+			return target
+		}
+	}
+	return ms.name
+}
+
+// withName returns a copy of the spec which uses the given name in its keys.
+func (ms *modelSpec) withName(name string) *modelSpec {
+	renamed := *ms
+	renamed.name = name
+	renamed.target = nil
+	return &renamed
+}
+
+// tmpKey returns a new random key for a temporary set or sorted set with the
+// given name. Temporary keys always start with the key prefix followed by
+// "tmp:". If hashTag is true, the key will include the hash tag for the
+// collection so that it is stored in the same slot as the other keys.
+func (ms *modelSpec) tmpKey(name string) string {
+	if ms.hashTag {
+		return generateRandomKey(ms.keyPrefix + "tmp:{" + ms.keyName() + "}:" + name)
+	}
+	return generateRandomKey(ms.keyPrefix + "tmp:" + name)
+}
+
 // allIndexKey returns a key which is used in redis to store all the ids of every model of a
 // given type
 func (ms *modelSpec) indexKey() string {
-	return ms.name + ":all"
+	return ms.keyspace() + ":all"
+}
+
+// expirationsKey returns the key of the sorted set which holds the ids of the
+// models which have an expiration time, scored by that time in milliseconds.
+func (ms *modelSpec) expirationsKey() string {
+	return ms.keyspace() + ":expirations"
+}
+
+// deletedKey returns the key of the set which holds the ids of the models
+// which have been soft deleted. Soft deleted models are moved from the set
+// identified by indexKey to this set.
+func (ms *modelSpec) deletedKey() string {
+	return ms.keyspace() + ":deleted"
+}
+
+// stringValuesKey returns the key of the hash which holds the value that each
+// model has in each string index and each unique field it owns, so that the
+// member of the index or the unique value can be found without reading the
+// main hash (e.g. once it has expired). The fields of the hash consist of the
+// name of the field (as it is stored in Redis) and the model id, separated by a
+// NULL character (see stringValueField).
+func (ms *modelSpec) stringValuesKey() string {
+	return ms.keyspace() + ":strings"
+}
+
+// stringValueField returns the field of the hash identified by stringValuesKey
+// which holds the value of the field with the given redisName for the model
+// with the given id.
+func stringValueField(redisName, id string) string {
+	return redisName + nullString + id
 }
 
 // modelKey returns the key that identifies a hash in the database
@@ -213,7 +426,7 @@ func (ms *modelSpec) modelKey(id string) (string, error) {
 	if id == "" {
 		return "", fmt.Errorf("zoom: Error in modelKey: id was empty")
 	}
-	return ms.name + ":" + id, nil
+	return ms.keyspace() + ":" + id, nil
 }
 
 // fieldNames returns all the field names for the given modelSpec
@@ -251,6 +464,42 @@ func (ms modelSpec) redisNamesForFieldNames(fieldNames []string) ([]string, erro
 	return redisNames, nil
 }
 
+// fieldNamesToSave returns the names of the fields which should be written when
+// the given fields of a model are saved. The updated field (if any) is always
+// written, and the created and soft delete fields (if any) are never written,
+// because they are set by the conditional_save and soft_delete scripts. It
+// returns a new slice.
+func (ms *modelSpec) fieldNamesToSave(fieldNames []string) []string {
+	names := []string{}
+	for _, name := range fieldNames {
+		if (ms.createdField != nil && name == ms.createdField.name) ||
+			(ms.softDeleteField != nil && name == ms.softDeleteField.name) ||
+			(ms.updatedField != nil && name == ms.updatedField.name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	if ms.updatedField != nil {
+		names = append(names, ms.updatedField.name)
+	}
+	return names
+}
+
+// savesWithScript returns true iff models must be saved with the
+// conditional_save script, because saving them involves checks which cannot be
+// expressed with plain commands in a transaction.
+func (ms *modelSpec) savesWithScript() bool {
+	if ms.versionField != nil || ms.softDeleteField != nil || ms.createdField != nil {
+		return true
+	}
+	for _, fs := range ms.fields {
+		if fs.unique {
+			return true
+		}
+	}
+	return false
+}
+
 // fieldIndexKey returns the key for the sorted set used to index the field identified
 // by fieldName. It returns an error if fieldName does not identify a field in the spec
 // or if the field it identifies is not an indexed field.
@@ -261,7 +510,20 @@ func (ms *modelSpec) fieldIndexKey(fieldName string) (string, error) {
 	} else if fs.indexKind == noIndex {
 		return "", fmt.Errorf("%s.%s is not an indexed field", ms.typ.Name(), fieldName)
 	}
-	return ms.name + ":" + fs.redisName, nil
+	return ms.keyspace() + ":" + fs.redisName, nil
+}
+
+// uniqueKey returns the key for the hash which maps the values of the unique
+// field identified by fieldName to the ids of the models which have them. It
+// returns an error if fieldName does not identify a unique field in the spec.
+func (ms *modelSpec) uniqueKey(fieldName string) (string, error) {
+	fs, found := ms.fieldsByName[fieldName]
+	if !found {
+		return "", fmt.Errorf("Type %s has no field named %s", ms.typ.Name(), fieldName)
+	} else if !fs.unique {
+		return "", fmt.Errorf("%s.%s is not a unique field", ms.typ.Name(), fieldName)
+	}
+	return ms.keyspace() + ":" + fs.redisName + ":unique", nil
 }
 
 // sortArgs returns arguments that can be used to get all the fields in includeFields
@@ -272,10 +534,10 @@ func (ms *modelSpec) fieldIndexKey(fieldName string) (string, error) {
 // be the key of a set or a sorted set which consists of model ids. The arguments
 // use they "BY nosort" option, so if a specific order is required, the setKey should be
 // a sorted set.
-func (ms *modelSpec) sortArgs(idsKey string, redisFieldNames []string, limit int, offset uint, reverse bool) redis.Args {
-	args := redis.Args{idsKey, "BY", "nosort"}
+func (ms *modelSpec) sortArgs(idsKey string, redisFieldNames []string, limit int, offset uint, reverse bool) Args {
+	args := Args{idsKey, "BY", "nosort"}
 	for _, fieldName := range redisFieldNames {
-		args = append(args, "GET", ms.name+":*->"+fieldName)
+		args = append(args, "GET", ms.keyspace()+":*->"+fieldName)
 	}
 	// We always want to get the id
 	args = append(args, "GET", "#")
@@ -352,19 +614,81 @@ func (mr *modelRef) fieldValue(name string) reflect.Value {
 
 // key returns a key which is used in redis to store the model
 func (mr *modelRef) key() string {
-	return mr.spec.name + ":" + mr.model.ModelId()
+	return mr.spec.keyspace() + ":" + mr.model.ModelId()
+}
+
+// version returns the value of the version field of the model. It returns 0 if
+// the model does not have a version field.
+func (mr *modelRef) version() int64 {
+	if mr.spec.versionField == nil {
+		return 0
+	}
+	fieldVal := mr.fieldValue(mr.spec.versionField.name)
+	if typeIsUnsignedInteger(fieldVal.Type()) {
+		return int64(fieldVal.Uint())
+	}
+	return fieldVal.Int()
+}
+
+// setVersion sets the version field of the model to version. It does nothing if
+// the model does not have a version field.
+func (mr *modelRef) setVersion(version int64) {
+	if mr.spec.versionField == nil {
+		return
+	}
+	fieldVal := mr.fieldValue(mr.spec.versionField.name)
+	if typeIsUnsignedInteger(fieldVal.Type()) {
+		fieldVal.SetUint(uint64(version))
+	} else {
+		fieldVal.SetInt(version)
+	}
+}
+
+// setUpdated sets the updated field of the model to t. It does nothing if the
+// model does not have an updated field.
+func (mr *modelRef) setUpdated(t time.Time) {
+	if mr.spec.updatedField == nil {
+		return
+	}
+	mr.fieldValue(mr.spec.updatedField.name).Set(reflect.ValueOf(t))
+}
+
+// stageUpdated sets the updated field of the model to t and returns a function
+// which restores its old value. It is used while the args for saving the model
+// are built, so that the model itself is only changed once the save succeeds.
+// It does nothing if the model does not have an updated field.
+func (mr *modelRef) stageUpdated(t time.Time) (restore func()) {
+	if mr.spec.updatedField == nil {
+		return func() {}
+	}
+	fieldVal := mr.fieldValue(mr.spec.updatedField.name)
+	old := fieldVal.Interface()
+	fieldVal.Set(reflect.ValueOf(t))
+	return func() {
+		fieldVal.Set(reflect.ValueOf(old))
+	}
+}
+
+// setCreated sets the created field of the model to the time represented by
+// micros, which is a Unix timestamp in microseconds. It does nothing if the
+// model does not have a created field.
+func (mr *modelRef) setCreated(micros int64) {
+	if mr.spec.createdField == nil {
+		return
+	}
+	mr.fieldValue(mr.spec.createdField.name).Set(reflect.ValueOf(unixMicroToTime(micros)))
 }
 
 // mainHashArgs returns the args for the main hash for this model. Typically
 // these args should part of an HMSET command.
-func (mr *modelRef) mainHashArgs() (redis.Args, error) {
+func (mr *modelRef) mainHashArgs() (Args, error) {
 	return mr.mainHashArgsForFields(mr.spec.fieldNames())
 }
 
 // mainHashArgsForFields is like mainHashArgs but only returns the hash
 // fields which match the given fieldNames.
-func (mr *modelRef) mainHashArgsForFields(fieldNames []string) (redis.Args, error) {
-	args := redis.Args{mr.key()}
+func (mr *modelRef) mainHashArgsForFields(fieldNames []string) (Args, error) {
+	args := Args{mr.key()}
 	ms := mr.spec
 	for _, fs := range ms.fields {
 		// Skip fields whose names do not appear in fieldNames.
@@ -404,6 +728,8 @@ func (mr *modelRef) mainHashArgsForFields(fieldNames []string) (redis.Args, erro
 				return nil, err
 			}
 			args = args.Add(fs.redisName, valBytes)
+		case timeField:
+			args = args.Add(fs.redisName, timeToUnixMicro(fieldVal.Interface().(time.Time)))
 		}
 	}
 	return args, nil
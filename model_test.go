@@ -61,6 +61,108 @@ func TestCompileModelSpec(t *testing.T) {
 	type EmbeddedPrivate struct {
 		private
 	}
+	type Versioned struct {
+		Version uint `zoom:"version"`
+	}
+	type VersionedString struct {
+		Version string `zoom:"version"`
+	}
+	type VersionedTwice struct {
+		Version      int `zoom:"version"`
+		OtherVersion int `zoom:"version"`
+	}
+	type VersionedIndexed struct {
+		Version int `zoom:"index,version"`
+	}
+	type SoftDeleted struct {
+		DeletedAt time.Time `zoom:"softdelete"`
+	}
+	type SoftDeletedString struct {
+		DeletedAt string `zoom:"softdelete"`
+	}
+	type SoftDeletedTwice struct {
+		DeletedAt      time.Time `zoom:"softdelete"`
+		OtherDeletedAt time.Time `zoom:"softdelete"`
+	}
+	type SoftDeletedIndexed struct {
+		DeletedAt time.Time `zoom:"index,softdelete"`
+	}
+	type Timestamped struct {
+		CreatedAt time.Time `zoom:"index,created"`
+		UpdatedAt time.Time `zoom:"updated"`
+	}
+	type TimestampedString struct {
+		CreatedAt string `zoom:"created"`
+	}
+	type TimestampedTwice struct {
+		UpdatedAt      time.Time `zoom:"updated"`
+		OtherUpdatedAt time.Time `zoom:"updated"`
+	}
+	type TimestampedBoth struct {
+		CreatedAt time.Time `zoom:"created,updated"`
+	}
+	type UniqueSlice struct {
+		Tags []string `zoom:"unique"`
+	}
+	type Validated struct {
+		Name string `zoom:"required,min=2"`
+	}
+	type ValidatedBool struct {
+		Bool bool `zoom:"min=1"`
+	}
+	type ValidatedLenInt struct {
+		Int int `zoom:"len=3"`
+	}
+	type ValidatedOneOfInt struct {
+		Int int `zoom:"oneof=1 two"`
+	}
+	type ValidatedMinString struct {
+		Name string `zoom:"min=two"`
+	}
+	type ValidatedRegex struct {
+		Name string `zoom:"regex=["`
+	}
+	type ValidatedRequired struct {
+		Name string `zoom:"required=true"`
+	}
+	validatedFieldSpec := &fieldSpec{
+		kind:      primativeField,
+		name:      "Name",
+		redisName: "Name",
+		typ:       reflect.TypeOf(""),
+		rules: []*fieldRule{
+			{name: "required", kind: requiredRule},
+			{name: "min=2", kind: minRule, limit: 2},
+		},
+	}
+	createdFieldSpec := &fieldSpec{
+		kind:      timeField,
+		name:      "CreatedAt",
+		redisName: "CreatedAt",
+		typ:       reflect.TypeOf(time.Time{}),
+		indexKind: numericIndex,
+	}
+	updatedFieldSpec := &fieldSpec{
+		kind:      timeField,
+		name:      "UpdatedAt",
+		redisName: "UpdatedAt",
+		typ:       reflect.TypeOf(time.Time{}),
+		indexKind: noIndex,
+	}
+	softDeleteFieldSpec := &fieldSpec{
+		kind:      timeField,
+		name:      "DeletedAt",
+		redisName: "DeletedAt",
+		typ:       reflect.TypeOf(time.Time{}),
+		indexKind: noIndex,
+	}
+	versionFieldSpec := &fieldSpec{
+		kind:      primativeField,
+		name:      "Version",
+		redisName: "Version",
+		typ:       reflect.TypeOf(uint(0)),
+		indexKind: noIndex,
+	}
 	testCases := []struct {
 		model         interface{}
 		expectedSpec  *modelSpec
@@ -357,6 +459,135 @@ func TestCompileModelSpec(t *testing.T) {
 				fieldsByName: map[string]*fieldSpec{},
 			},
 		},
+		{
+			model: &Versioned{},
+			expectedSpec: &modelSpec{
+				typ:  reflect.TypeOf(&Versioned{}),
+				name: "Versioned",
+				fieldsByName: map[string]*fieldSpec{
+					"Version": versionFieldSpec,
+				},
+				fields:       []*fieldSpec{versionFieldSpec},
+				versionField: versionFieldSpec,
+			},
+		},
+		{
+			model:         &VersionedString{},
+			expectedSpec:  nil,
+			expectedError: errors.New("zoom: The version field Version must be an integer but has type string"),
+		},
+		{
+			model:         &VersionedTwice{},
+			expectedSpec:  nil,
+			expectedError: errors.New("zoom: Only one field can have the version option but both Version and OtherVersion do"),
+		},
+		{
+			model:         &VersionedIndexed{},
+			expectedSpec:  nil,
+			expectedError: errors.New("zoom: The version field Version cannot be indexed"),
+		},
+		{
+			model: &SoftDeleted{},
+			expectedSpec: &modelSpec{
+				typ:  reflect.TypeOf(&SoftDeleted{}),
+				name: "SoftDeleted",
+				fieldsByName: map[string]*fieldSpec{
+					"DeletedAt": softDeleteFieldSpec,
+				},
+				fields:          []*fieldSpec{softDeleteFieldSpec},
+				softDeleteField: softDeleteFieldSpec,
+			},
+		},
+		{
+			model:         &SoftDeletedString{},
+			expectedSpec:  nil,
+			expectedError: errors.New("zoom: The softdelete field DeletedAt must be a time.Time but has type string"),
+		},
+		{
+			model:         &SoftDeletedTwice{},
+			expectedSpec:  nil,
+			expectedError: errors.New("zoom: Only one field can have the softdelete option but both DeletedAt and OtherDeletedAt do"),
+		},
+		{
+			model:         &SoftDeletedIndexed{},
+			expectedSpec:  nil,
+			expectedError: errors.New("zoom: The softdelete field DeletedAt cannot be indexed"),
+		},
+		{
+			model:         &UniqueSlice{},
+			expectedSpec:  nil,
+			expectedError: errors.New("zoom: The field Tags of type []string cannot be unique"),
+		},
+		{
+			model: &Validated{},
+			expectedSpec: &modelSpec{
+				typ:  reflect.TypeOf(&Validated{}),
+				name: "Validated",
+				fieldsByName: map[string]*fieldSpec{
+					"Name": validatedFieldSpec,
+				},
+				fields: []*fieldSpec{validatedFieldSpec},
+			},
+		},
+		{
+			model:         &ValidatedBool{},
+			expectedSpec:  nil,
+			expectedError: errors.New("zoom: Invalid validation rule min=1 on field Bool: min cannot be used on type bool"),
+		},
+		{
+			model:         &ValidatedLenInt{},
+			expectedSpec:  nil,
+			expectedError: errors.New("zoom: Invalid validation rule len=3 on field Int: len cannot be used on type int"),
+		},
+		{
+			model:         &ValidatedOneOfInt{},
+			expectedSpec:  nil,
+			expectedError: errors.New("zoom: Invalid validation rule oneof=1 two on field Int: two is not a number"),
+		},
+		{
+			model:         &ValidatedMinString{},
+			expectedSpec:  nil,
+			expectedError: errors.New("zoom: Invalid validation rule min=two on field Name: two is not a number"),
+		},
+		{
+			model:         &ValidatedRegex{},
+			expectedSpec:  nil,
+			expectedError: errors.New("zoom: Invalid validation rule regex=[ on field Name: error parsing regexp: missing closing ]: `[`"),
+		},
+		{
+			model:         &ValidatedRequired{},
+			expectedSpec:  nil,
+			expectedError: errors.New("zoom: Invalid validation rule required=true on field Name: required does not take a parameter"),
+		},
+		{
+			model: &Timestamped{},
+			expectedSpec: &modelSpec{
+				typ:  reflect.TypeOf(&Timestamped{}),
+				name: "Timestamped",
+				fieldsByName: map[string]*fieldSpec{
+					"CreatedAt": createdFieldSpec,
+					"UpdatedAt": updatedFieldSpec,
+				},
+				fields:       []*fieldSpec{createdFieldSpec, updatedFieldSpec},
+				createdField: createdFieldSpec,
+				updatedField: updatedFieldSpec,
+			},
+		},
+		{
+			model:         &TimestampedString{},
+			expectedSpec:  nil,
+			expectedError: errors.New("zoom: The created field CreatedAt must be a time.Time but has type string"),
+		},
+		{
+			model:         &TimestampedTwice{},
+			expectedSpec:  nil,
+			expectedError: errors.New("zoom: Only one field can have the updated option but both UpdatedAt and OtherUpdatedAt do"),
+		},
+		{
+			model:         &TimestampedBoth{},
+			expectedSpec:  nil,
+			expectedError: errors.New("zoom: The field CreatedAt cannot have both the created and updated options"),
+		},
 	}
 	for _, tc := range testCases {
 		gotSpec, err := compileModelSpec(reflect.TypeOf(tc.model))
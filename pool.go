@@ -9,10 +9,17 @@
 package zoom
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/garyburd/redigo/redis"
 )
 
 // Pool represents a pool of connections. Each pool connects
@@ -21,35 +28,98 @@ type Pool struct {
 	// options is the fully parsed conifg, with defaults filling in any
 	// blanks from the poolConfig passed into NewPool.
 	options PoolOptions
-	// redisPool is a redis.Pool
-	redisPool *redis.Pool
+	// driver is used to get connections to Redis.
+	driver Driver
 	// modelTypeToSpec maps a registered model type to a modelSpec
 	modelTypeToSpec map[reflect.Type]*modelSpec
 	// modelNameToSpec maps a registered model name to a modelSpec
 	modelNameToSpec map[string]*modelSpec
+	// aliased holds the specs of the collections for which
+	// CollectionOptions.Alias is true.
+	aliased []*modelSpec
+	// migrations holds the migrations which were registered with
+	// RegisterMigration, in order.
+	migrations []*migration
+	// stats holds the counters reported by Stats which are not kept by the
+	// driver.
+	stats *poolStats
+	// shutdownMu protects shuttingDown and the calls to inFlight.Add.
+	shutdownMu   sync.RWMutex
+	shuttingDown bool
+	// inFlight keeps track of the transactions which are currently executing.
+	inFlight sync.WaitGroup
+	// closing is closed by Close to stop the sweepers (see
+	// CollectionOptions.SweepInterval), and sweepers keeps track of them.
+	closing   chan struct{}
+	closeOnce sync.Once
+	sweepers  sync.WaitGroup
 }
 
 // DefaultPoolOptions is the default set of options for a Pool.
 var DefaultPoolOptions = PoolOptions{
-	Address:     "localhost:6379",
-	Database:    0,
-	IdleTimeout: 240 * time.Second,
-	MaxActive:   1000,
-	MaxIdle:     1000,
-	Network:     "tcp",
-	Password:    "",
-	Wait:        true,
+	Address:           "localhost:6379",
+	BatchSize:         500,
+	ClientName:        "",
+	ClusterAddresses:  nil,
+	Database:          0,
+	Hooks:             nil,
+	IdleTimeout:       240 * time.Second,
+	KeyPrefix:         "",
+	MasterName:        "",
+	MaxActive:         1000,
+	MaxIdle:           1000,
+	Network:           "tcp",
+	Password:          "",
+	ReplicaAddresses:  nil,
+	SentinelAddresses: nil,
+	SentinelPassword:  "",
+	TestOnBorrowAfter: 0,
+	TLSConfig:         nil,
+	Username:          "",
+	Wait:              true,
 }
 
 // PoolOptions contains various options for a pool.
 type PoolOptions struct {
 	// Address to use when connecting to Redis.
 	Address string
+	// BatchSize is the maximum number of models handled by a single
+	// transaction in the batch methods of Collection (e.g. SaveMany). Larger
+	// inputs are split into batches of at most BatchSize models, each of
+	// which is sent in its own transaction. A value of 0 means there is no
+	// limit.
+	BatchSize int
+	// ClientName is the name each connection will be given via the CLIENT
+	// SETNAME command. It is useful for identifying connections in the output
+	// of CLIENT LIST. If empty, the connections will not be named.
+	ClientName string
+	// ClusterAddresses is a list of addresses of nodes in a Redis Cluster. If
+	// not empty, the pool will ignore Address and Database and will instead
+	// discover the rest of the cluster from these nodes. In cluster mode, the
+	// keys for each collection use a hash tag (e.g. "{Person}:id") so that
+	// they are all stored on the same node, and each transaction is sent to
+	// the node which serves the keys it touches. All the keys used in a
+	// single transaction must hash to the same slot.
+	ClusterAddresses []string
 	// Database id to use (using SELECT).
 	Database int
+	// Hooks are notified before and after each transaction and each action in
+	// it (see Hook). They are called in order before and in reverse order
+	// after. Every operation in Zoom (e.g. Collection.Find) uses a transaction.
+	Hooks []Hook
 	// IdleTimeout is the amount of time to wait before timing out (closing) idle
 	// connections.
 	IdleTimeout time.Duration
+	// KeyPrefix is prepended to every key that Zoom uses, including the keys
+	// for models, indexes and temporary keys used in queries. It can be used to
+	// prevent collisions when more than one application shares the same
+	// database. The prefix is used exactly as given, so you will typically want
+	// to include a separator (e.g. "myapp:"). Keys that you provide yourself
+	// (e.g. the destination key for Query.StoreIds) are not prefixed.
+	KeyPrefix string
+	// MasterName is the name of the master to connect to when using Redis
+	// Sentinel. It is required if SentinelAddresses is not empty.
+	MasterName string
 	// MaxActive is the maximum number of active connections the pool will keep.
 	// A value of 0 means unlimited.
 	MaxActive int
@@ -62,6 +132,38 @@ type PoolOptions struct {
 	// every connection will use the AUTH command during initialization
 	// to authenticate with the database.
 	Password string
+	// ReplicaAddresses is a list of addresses of Redis replicas. If not empty,
+	// operations which only read from the database (e.g. Collection.Find and
+	// Query.Run) will be sent to one of the replicas instead of the primary.
+	// Replicas are updated asynchronously, so use WithPrimary or
+	// Transaction.RequirePrimary if you need to read your own writes. The
+	// other connection options (e.g. Database and Password) are the same as
+	// for the primary. ReplicaAddresses is ignored in cluster mode.
+	ReplicaAddresses []string
+	// SentinelAddresses is a list of addresses of Redis Sentinel processes. If
+	// not empty, the pool will ignore Address and will instead ask the sentinels
+	// for the address of the master identified by MasterName. When the master
+	// fails over, transactions that are in flight will fail with an error and
+	// new connections will be made to the promoted master.
+	SentinelAddresses []string
+	// SentinelPassword is the password used to authenticate with the sentinels
+	// (if any).
+	SentinelPassword string
+	// TestOnBorrowAfter is the amount of time a connection must have been idle
+	// before it is tested with the PING command when taken from the pool. If
+	// the test fails, the connection is closed and a different one is used.
+	// This prevents using connections which were closed by the server or by
+	// the network while idle. A value of 0 means connections are never tested.
+	TestOnBorrowAfter time.Duration
+	// TLSConfig is the TLS configuration to use when connecting to Redis. If
+	// TLSConfig is not nil, every connection will use TLS. Client certificates
+	// can be provided via the Certificates property. If ServerName is empty, the
+	// host portion of Address will be used.
+	TLSConfig *tls.Config
+	// Username is the name of a Redis 6 ACL user. If not empty, every
+	// connection will use the AUTH command with both Username and Password
+	// during initialization. Username has no effect if Password is empty.
+	Username string
 	// Wait indicates whether or not the pool should wait for a free connection
 	// if the MaxActive limit has been reached. If Wait is false and the
 	// MaxActive limit is reached, Zoom will return an error indicating that the
@@ -76,6 +178,28 @@ func (options PoolOptions) WithAddress(address string) PoolOptions {
 	return options
 }
 
+// WithBatchSize returns a new copy of the options with the BatchSize property
+// set to the given value. It does not mutate the original options.
+func (options PoolOptions) WithBatchSize(size int) PoolOptions {
+	options.BatchSize = size
+	return options
+}
+
+// WithClientName returns a new copy of the options with the ClientName property
+// set to the given value. It does not mutate the original options.
+func (options PoolOptions) WithClientName(name string) PoolOptions {
+	options.ClientName = name
+	return options
+}
+
+// WithClusterAddresses returns a new copy of the options with the
+// ClusterAddresses property set to the given value. It does not mutate the
+// original options.
+func (options PoolOptions) WithClusterAddresses(addresses ...string) PoolOptions {
+	options.ClusterAddresses = addresses
+	return options
+}
+
 // WithDatabase returns a new copy of the options with the Database property set
 // to the given value. It does not mutate the original options.
 func (options PoolOptions) WithDatabase(database int) PoolOptions {
@@ -83,6 +207,13 @@ func (options PoolOptions) WithDatabase(database int) PoolOptions {
 	return options
 }
 
+// WithHooks returns a new copy of the options with the Hooks property set to
+// the given value. It does not mutate the original options.
+func (options PoolOptions) WithHooks(hooks ...Hook) PoolOptions {
+	options.Hooks = hooks
+	return options
+}
+
 // WithIdleTimeout returns a new copy of the options with the IdleTimeout
 // property set to the given value. It does not mutate the original options.
 func (options PoolOptions) WithIdleTimeout(timeout time.Duration) PoolOptions {
@@ -90,6 +221,20 @@ func (options PoolOptions) WithIdleTimeout(timeout time.Duration) PoolOptions {
 	return options
 }
 
+// WithKeyPrefix returns a new copy of the options with the KeyPrefix property
+// set to the given value. It does not mutate the original options.
+func (options PoolOptions) WithKeyPrefix(prefix string) PoolOptions {
+	options.KeyPrefix = prefix
+	return options
+}
+
+// WithMasterName returns a new copy of the options with the MasterName property
+// set to the given value. It does not mutate the original options.
+func (options PoolOptions) WithMasterName(name string) PoolOptions {
+	options.MasterName = name
+	return options
+}
+
 // WithMaxActive returns a new copy of the options with the MaxActive property
 // set to the given value. It does not mutate the original options.
 func (options PoolOptions) WithMaxActive(maxActive int) PoolOptions {
@@ -118,6 +263,52 @@ func (options PoolOptions) WithPassword(password string) PoolOptions {
 	return options
 }
 
+// WithReplicaAddresses returns a new copy of the options with the
+// ReplicaAddresses property set to the given value. It does not mutate the
+// original options.
+func (options PoolOptions) WithReplicaAddresses(addresses ...string) PoolOptions {
+	options.ReplicaAddresses = addresses
+	return options
+}
+
+// WithSentinelAddresses returns a new copy of the options with the
+// SentinelAddresses property set to the given value. It does not mutate the
+// original options.
+func (options PoolOptions) WithSentinelAddresses(addresses ...string) PoolOptions {
+	options.SentinelAddresses = addresses
+	return options
+}
+
+// WithSentinelPassword returns a new copy of the options with the
+// SentinelPassword property set to the given value. It does not mutate the
+// original options.
+func (options PoolOptions) WithSentinelPassword(password string) PoolOptions {
+	options.SentinelPassword = password
+	return options
+}
+
+// WithTestOnBorrowAfter returns a new copy of the options with the
+// TestOnBorrowAfter property set to the given value. It does not mutate the
+// original options.
+func (options PoolOptions) WithTestOnBorrowAfter(idle time.Duration) PoolOptions {
+	options.TestOnBorrowAfter = idle
+	return options
+}
+
+// WithTLSConfig returns a new copy of the options with the TLSConfig property
+// set to the given value. It does not mutate the original options.
+func (options PoolOptions) WithTLSConfig(config *tls.Config) PoolOptions {
+	options.TLSConfig = config
+	return options
+}
+
+// WithUsername returns a new copy of the options with the Username property
+// set to the given value. It does not mutate the original options.
+func (options PoolOptions) WithUsername(username string) PoolOptions {
+	options.Username = username
+	return options
+}
+
 // WithWait returns a new copy of the options with the Wait property set to the
 // given value. It does not mutate the original options.
 func (options PoolOptions) WithWait(wait bool) PoolOptions {
@@ -136,50 +327,298 @@ func NewPool(address string) *Pool {
 // can pass in DefaultOptions to use all the default options. Or cal the WithX
 // methods of DefaultOptions to change the options you want to change.
 func NewPoolWithOptions(options PoolOptions) *Pool {
-	pool := &Pool{
+	return NewPoolWithDriver(newRedigoDriver(options), options)
+}
+
+// NewPoolWithDriver initializes and returns a pool which uses driver to
+// connect to Redis. The options which control how to connect to Redis (e.g.
+// Address and MaxActive) are ignored, since the driver is responsible for
+// that. The others (e.g. KeyPrefix) still apply. Closing the pool closes the
+// driver.
+func NewPoolWithDriver(driver Driver, options PoolOptions) *Pool {
+	return &Pool{
 		options:         options,
+		driver:          driver,
 		modelTypeToSpec: map[reflect.Type]*modelSpec{},
 		modelNameToSpec: map[string]*modelSpec{},
+		stats:           &poolStats{},
+		closing:         make(chan struct{}),
 	}
-	pool.redisPool = &redis.Pool{
-		MaxIdle:     options.MaxIdle,
-		MaxActive:   options.MaxActive,
-		IdleTimeout: options.IdleTimeout,
-		Wait:        options.Wait,
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial(options.Network, options.Address)
+}
+
+// NewPoolFromURL creates and returns a new pool using the options described by
+// rawurl. All options which cannot be specified in the URL will be set to their
+// default values. See PoolOptions.WithURL for a description of the supported
+// URL formats.
+func NewPoolFromURL(rawurl string) (*Pool, error) {
+	options, err := DefaultPoolOptions.WithURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return NewPoolWithOptions(options), nil
+}
+
+// WithURL returns a new copy of the options with the Network, Address,
+// Username, Password, Database, ClientName and TLSConfig properties set
+// according to rawurl. It does not mutate the original options. The following
+// URL formats are supported:
+//
+//	redis://[[username]:password@]host[:port][/database][?client_name=name]
+//	rediss://[[username]:password@]host[:port][/database][?client_name=name]
+//	unix://[[username]:password@]/path/to/redis.sock[?db=database][&client_name=name]
+//
+// The rediss scheme causes connections to use TLS. If TLSConfig was already
+// set, it will be kept, otherwise a default TLS configuration will be used. If
+// no port is provided, the default port of 6379 will be used.
+func (options PoolOptions) WithURL(rawurl string) (PoolOptions, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return options, fmt.Errorf("zoom: invalid pool URL: %s", err.Error())
+	}
+	query := u.Query()
+	switch u.Scheme {
+	case "redis", "rediss":
+		// Hostname strips the brackets from IPv6 addresses, which JoinHostPort
+		// adds back
+		host, port := u.Hostname(), u.Port()
+		if port == "" {
+			port = "6379"
+		}
+		if host == "" {
+			host = "localhost"
+		}
+		options.Network = "tcp"
+		options.Address = net.JoinHostPort(host, port)
+		if dbString := strings.Trim(u.Path, "/"); dbString != "" {
+			db, err := strconv.Atoi(dbString)
 			if err != nil {
-				return nil, err
+				return options, fmt.Errorf("zoom: invalid database in pool URL: %s", dbString)
 			}
-			// If a options.Password was provided, use the AUTH command to authenticate
-			if options.Password != "" {
-				_, err = c.Do("AUTH", options.Password)
-				if err != nil {
-					return nil, err
-				}
-			}
-			// Select the database number provided by options.Database
-			if _, err := c.Do("Select", options.Database); err != nil {
-				c.Close()
-				return nil, err
+			options.Database = db
+		}
+		if u.Scheme == "rediss" && options.TLSConfig == nil {
+			options.TLSConfig = &tls.Config{}
+		}
+	case "unix":
+		if u.Path == "" {
+			return options, fmt.Errorf("zoom: missing socket path in pool URL: %s", rawurl)
+		}
+		options.Network = "unix"
+		options.Address = u.Path
+		if dbString := query.Get("db"); dbString != "" {
+			db, err := strconv.Atoi(dbString)
+			if err != nil {
+				return options, fmt.Errorf("zoom: invalid database in pool URL: %s", dbString)
 			}
-			return c, err
-		},
+			options.Database = db
+		}
+	default:
+		return options, fmt.Errorf("zoom: invalid pool URL scheme: %s. Expected redis, rediss or unix", u.Scheme)
+	}
+	if u.User != nil {
+		options.Username = u.User.Username()
+		if password, isSet := u.User.Password(); isSet {
+			options.Password = password
+		} else {
+			// Mirror redis-cli, which treats redis://secret@host as a password
+			// with no username.
+			options.Password = options.Username
+			options.Username = ""
+		}
 	}
-	return pool
+	if clientName := query.Get("client_name"); clientName != "" {
+		options.ClientName = clientName
+	}
+	return options, nil
 }
 
 // NewConn gets a connection from the pool and returns it.
-// It can be used for directly interacting with the database. See
+// It can be used for directly interacting with the database. Conn has the same
+// methods as redis.Conn from the redigo library. See
 // http://godoc.org/github.com/garyburd/redigo/redis for full documentation
 // on the redis.Conn type. You must call Close on any connections after you are
-// done using them. Failure to call Close can cause a resource leak.
-func (p *Pool) NewConn() redis.Conn {
-	return p.redisPool.Get()
+// done using them. Failure to call Close can cause a resource leak. In cluster
+// mode, the connection is to one of the nodes given in
+// PoolOptions.ClusterAddresses. Use NewConnForKey to connect to the node which
+// serves a specific key.
+func (p *Pool) NewConn() Conn {
+	return p.NewConnForKey("")
 }
 
+// NewConnForKey is like NewConn but, in cluster mode, returns a connection to
+// the node which serves the given key. Outside of cluster mode, it is the same
+// as NewConn.
+func (p *Pool) NewConnForKey(key string) Conn {
+	if p.isShuttingDown() {
+		return errorConn{err: ErrPoolShutdown}
+	}
+	conn, err := p.getConn(context.Background(), key)
+	if err != nil {
+		return errorConn{err: err}
+	}
+	return conn
+}
+
+// getConn gets a connection which can be used to send commands involving key,
+// waiting for one to become available if needed. It returns an error if ctx is
+// done before a connection is available.
+func (p *Pool) getConn(ctx context.Context, key string) (Conn, error) {
+	return p.stats.get(func() (Conn, error) {
+		return p.driver.Conn(ctx, key)
+	})
+}
+
+// getReplicaConn is like getConn but gets a connection to one of the
+// replicas, if any.
+func (p *Pool) getReplicaConn(ctx context.Context) (Conn, error) {
+	return p.stats.get(func() (Conn, error) {
+		return p.driver.ReplicaConn(ctx)
+	})
+}
+
+// Ping sends the PING command to Redis and returns an error if Redis could not
+// be reached or did not reply as expected. In cluster mode, it pings one of the
+// nodes given in PoolOptions.ClusterAddresses.
+func (p *Pool) Ping() error {
+	return p.PingContext(context.Background())
+}
+
+// PingContext is like Ping but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (p *Pool) PingContext(ctx context.Context) error {
+	t := p.NewTransactionContext(ctx)
+	t.Command("PING", nil, nil)
+	return t.Exec()
+}
+
+// PoolStats contains statistics about a pool. In cluster mode, or if the pool
+// was configured with replicas, the statistics cover the connections to every
+// node.
+type PoolStats struct {
+	// ActiveCount is the number of open connections, including idle
+	// connections.
+	ActiveCount int
+	// IdleCount is the number of idle connections.
+	IdleCount int
+	// InFlight is the number of transactions which are currently executing.
+	InFlight int
+	// Getting is the number of goroutines which are currently getting a
+	// connection, whether they are blocked waiting for one or not.
+	Getting int
+	// GetDuration is the total amount of time spent getting connections since
+	// the pool was created, including the time spent waiting for a connection
+	// to become available and dialing new ones.
+	GetDuration time.Duration
+	// DialErrors is the number of times a new connection could not be made
+	// since the pool was created.
+	DialErrors int64
+}
+
+// Stats returns statistics about the pool.
+func (p *Pool) Stats() PoolStats {
+	driverStats := p.driver.Stats()
+	return PoolStats{
+		ActiveCount: driverStats.ActiveCount,
+		IdleCount:   driverStats.IdleCount,
+		InFlight:    int(atomic.LoadInt64(&p.stats.inFlight)),
+		Getting:     int(atomic.LoadInt64(&p.stats.getting)),
+		GetDuration: time.Duration(atomic.LoadInt64(&p.stats.getDuration)),
+		DialErrors:  driverStats.DialErrors,
+	}
+}
+
+// poolStats holds the counters reported by Pool.Stats which are not kept by
+// the driver. All the fields must be accessed atomically.
+type poolStats struct {
+	inFlight    int64
+	getting     int64
+	getDuration int64
+}
+
+// get calls getConn and records how long it took.
+func (s *poolStats) get(getConn func() (Conn, error)) (Conn, error) {
+	atomic.AddInt64(&s.getting, 1)
+	start := time.Now()
+	conn, err := getConn()
+	atomic.AddInt64(&s.getDuration, int64(time.Since(start)))
+	atomic.AddInt64(&s.getting, -1)
+	return conn, err
+}
+
+// beginExec is called at the start of every call to Transaction.Exec. It
+// returns false if the pool is shutting down, in which case the transaction
+// must not be executed. Otherwise, endExec must be called when the transaction
+// is done.
+func (p *Pool) beginExec() bool {
+	p.shutdownMu.RLock()
+	defer p.shutdownMu.RUnlock()
+	if p.shuttingDown {
+		return false
+	}
+	p.inFlight.Add(1)
+	atomic.AddInt64(&p.stats.inFlight, 1)
+	return true
+}
+
+// isShuttingDown returns true iff Shutdown has been called.
+func (p *Pool) isShuttingDown() bool {
+	p.shutdownMu.RLock()
+	defer p.shutdownMu.RUnlock()
+	return p.shuttingDown
+}
+
+// endExec is called at the end of every call to Transaction.Exec for which
+// beginExec returned true.
+func (p *Pool) endExec() {
+	atomic.AddInt64(&p.stats.inFlight, -1)
+	p.inFlight.Done()
+}
+
+// Shutdown gracefully closes the pool. It causes new transactions to fail with
+// ErrPoolShutdown, stops handing out connections via NewConn, waits for the
+// transactions which are currently executing to finish, and then closes the
+// pool. If ctx is done before all the transactions finish, the pool is closed
+// anyway and Shutdown returns the error from ctx. Transactions which were still
+// executing at that point may fail.
+func (p *Pool) Shutdown(ctx context.Context) error {
+	p.shutdownMu.Lock()
+	p.shuttingDown = true
+	p.shutdownMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		p.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return p.Close()
+	case <-ctx.Done():
+		p.Close()
+		return ctx.Err()
+	}
+}
+
+// errorConn is a Conn which returns err from every method. It is
+// returned by NewConn if a connection could not be made.
+type errorConn struct {
+	err error
+}
+
+func (c errorConn) Close() error                                   { return nil }
+func (c errorConn) Err() error                                     { return c.err }
+func (c errorConn) Do(string, ...interface{}) (interface{}, error) { return nil, c.err }
+func (c errorConn) Send(string, ...interface{}) error              { return c.err }
+func (c errorConn) Flush() error                                   { return c.err }
+func (c errorConn) Receive() (interface{}, error)                  { return nil, c.err }
+
 // Close closes the pool. It should be run whenever the pool is no longer
-// needed. It is often used in conjunction with defer.
+// needed. It is often used in conjunction with defer. Close also stops the
+// background sweepers for the collections which belong to the pool (see
+// CollectionOptions.SweepInterval).
 func (p *Pool) Close() error {
-	return p.redisPool.Close()
+	p.closeOnce.Do(func() {
+		close(p.closing)
+	})
+	p.sweepers.Wait()
+	return p.driver.Close()
 }
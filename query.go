@@ -1,5 +1,7 @@
 package zoom
 
+import "context"
+
 // Query represents a query which will retrieve some models from
 // the database. A Query may consist of one or more query modifiers
 // (e.g. Filter or Order) and may be executed with a query finisher
@@ -13,7 +15,9 @@ type Query struct {
 // executed using the Run, RunOne, Count, or Ids methods. If no query modifiers
 // are used, running the query will return all models of the given type in
 // unspecified order. Queries use delayed execution, so nothing touches the
-// database until you execute them.
+// database until you execute them. If the collection is not indexed, the ids of
+// the models are found by scanning the database when the query is executed,
+// which is much slower (see CollectionOptions.Index).
 func (collection *Collection) NewQuery() *Query {
 	return &Query{
 		query: newQuery(collection),
@@ -95,13 +99,41 @@ func (q *Query) Filter(filterString string, value interface{}) *Query {
 	return q
 }
 
+// WithDeleted causes the query to return models which have been soft deleted
+// (see Collection.SoftDelete) in addition to the models which have not. By
+// default, queries exclude soft deleted models. WithDeleted will set an error
+// on the query if the collection does not have a soft delete field or if
+// OnlyDeleted was already used. The error, same as any other error that occurs
+// during the lifetime of the query, is not returned until the query is
+// executed.
+func (q *Query) WithDeleted() *Query {
+	q.query.WithDeleted()
+	return q
+}
+
+// OnlyDeleted causes the query to return only models which have been soft
+// deleted (see Collection.SoftDelete). OnlyDeleted will set an error on the
+// query if the collection does not have a soft delete field or if WithDeleted
+// was already used. The error, same as any other error that occurs during the
+// lifetime of the query, is not returned until the query is executed.
+func (q *Query) OnlyDeleted() *Query {
+	q.query.OnlyDeleted()
+	return q
+}
+
 // Run executes the query and scans the results into models. The type of models
 // should be a pointer to a slice of Models. If no models fit the criteria, Run
 // will set the length of models to 0 but will *not* return an error. Run will
 // return the first error that occurred during the lifetime of the query (if
 // any), or if models is the wrong type.
 func (q *Query) Run(models interface{}) error {
-	tx := q.pool.NewTransaction()
+	return q.RunContext(context.Background(), models)
+}
+
+// RunContext is like Run but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (q *Query) RunContext(ctx context.Context, models interface{}) error {
+	tx := q.pool.newReadTransaction(ctx)
 	newTransactionalQuery(q.query, tx).Run(models)
 	return tx.Exec()
 }
@@ -110,7 +142,13 @@ func (q *Query) Run(models interface{}) error {
 // criteria and scans the values into model. If no model fits the criteria,
 // RunOne *will* return a ModelNotFoundError.
 func (q *Query) RunOne(model Model) error {
-	tx := q.pool.NewTransaction()
+	return q.RunOneContext(context.Background(), model)
+}
+
+// RunOneContext is like RunOne but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (q *Query) RunOneContext(ctx context.Context, model Model) error {
+	tx := q.pool.newReadTransaction(ctx)
 	newTransactionalQuery(q.query, tx).RunOne(model)
 	return tx.Exec()
 }
@@ -119,7 +157,13 @@ func (q *Query) RunOne(model Model) error {
 // actually retrieving the models themselves. Count will also return the first
 // error that occurred during the lifetime of the query (if any).
 func (q *Query) Count() (int, error) {
-	tx := q.pool.NewTransaction()
+	return q.CountContext(context.Background())
+}
+
+// CountContext is like Count but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (q *Query) CountContext(ctx context.Context) (int, error) {
+	tx := q.pool.newReadTransaction(ctx)
 	var count int
 	newTransactionalQuery(q.query, tx).Count(&count)
 	if err := tx.Exec(); err != nil {
@@ -132,7 +176,13 @@ func (q *Query) Count() (int, error) {
 // models themselves. Ids will return the first error that occurred during the
 // lifetime of the query (if any).
 func (q *Query) Ids() ([]string, error) {
-	tx := q.pool.NewTransaction()
+	return q.IdsContext(context.Background())
+}
+
+// IdsContext is like Ids but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (q *Query) IdsContext(ctx context.Context) ([]string, error) {
+	tx := q.pool.newReadTransaction(ctx)
 	ids := []string{}
 	newTransactionalQuery(q.query, tx).Ids(&ids)
 	if err := tx.Exec(); err != nil {
@@ -147,7 +197,13 @@ func (q *Query) Ids() ([]string, error) {
 // the query includes an Order modifier. StoreIds will return the first error
 // that occurred during the lifetime of the query (if any).
 func (q *Query) StoreIds(destKey string) error {
-	tx := q.pool.NewTransaction()
+	return q.StoreIdsContext(context.Background(), destKey)
+}
+
+// StoreIdsContext is like StoreIds but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (q *Query) StoreIdsContext(ctx context.Context, destKey string) error {
+	tx := q.pool.NewTransactionContext(ctx)
 	newTransactionalQuery(q.query, tx).StoreIds(destKey)
 	return tx.Exec()
 }
@@ -0,0 +1,209 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File redigo.go contains the default Driver, which is built on the redigo
+// library (github.com/garyburd/redigo/redis).
+
+package zoom
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// redigoDriver is a Driver which uses a redis.Pool for each Redis server. It
+// supports everything that can be configured with PoolOptions, including
+// sentinels, replicas and Redis Cluster.
+type redigoDriver struct {
+	// redisPool is the pool for the primary. It is nil in cluster mode.
+	redisPool *redis.Pool
+	// sentinel is used to find the current master if the pool was configured
+	// with sentinel addresses. It is nil otherwise.
+	sentinel *sentinel
+	// cluster is used to route commands to the right node if the pool was
+	// configured with cluster addresses. It is nil otherwise.
+	cluster *cluster
+	// replicas contains a redis.Pool for each of the replica addresses the
+	// pool was configured with.
+	replicas []*redis.Pool
+	// nextReplica is incremented every time a replica is chosen. It is used to
+	// spread the load evenly between replicas.
+	nextReplica uint32
+	// dialErrors is the number of times a new connection could not be made. It
+	// must be accessed atomically.
+	dialErrors int64
+}
+
+// newRedigoDriver returns a new redigoDriver for the given options. It does
+// not connect to Redis until a connection is needed.
+func newRedigoDriver(options PoolOptions) *redigoDriver {
+	d := &redigoDriver{}
+	if len(options.ClusterAddresses) > 0 {
+		d.cluster = newCluster(options, &d.dialErrors)
+		return d
+	}
+	if len(options.SentinelAddresses) > 0 {
+		d.sentinel = newSentinel(options)
+		d.redisPool = options.newRedisPool(&d.dialErrors, d.sentinel.dial, d.sentinel.testOnBorrow)
+		go d.sentinel.watch()
+	} else {
+		d.redisPool = options.newRedisPool(&d.dialErrors, options.dial, nil)
+	}
+	for _, address := range options.ReplicaAddresses {
+		replicaOptions := options.WithAddress(address)
+		d.replicas = append(d.replicas, replicaOptions.newRedisPool(&d.dialErrors, replicaOptions.dial, nil))
+	}
+	return d
+}
+
+// newRedisPool returns a new redis.Pool which uses dial to create new
+// connections. Dial errors are counted in dialErrors. If testOnBorrow is not
+// nil, it is called for every connection taken from the pool, in addition to
+// the PING test configured with TestOnBorrowAfter.
+func (options PoolOptions) newRedisPool(dialErrors *int64, dial func() (redis.Conn, error), testOnBorrow func(redis.Conn, time.Time) error) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     options.MaxIdle,
+		MaxActive:   options.MaxActive,
+		IdleTimeout: options.IdleTimeout,
+		Wait:        options.Wait,
+		Dial: func() (redis.Conn, error) {
+			conn, err := dial()
+			if err != nil {
+				atomic.AddInt64(dialErrors, 1)
+			}
+			return conn, err
+		},
+		TestOnBorrow: func(conn redis.Conn, lastUsed time.Time) error {
+			if testOnBorrow != nil {
+				if err := testOnBorrow(conn, lastUsed); err != nil {
+					return err
+				}
+			}
+			if options.TestOnBorrowAfter > 0 && time.Since(lastUsed) >= options.TestOnBorrowAfter {
+				_, err := conn.Do("PING")
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+// dial creates a new connection to Redis using the given options. It takes
+// care of TLS, authentication, selecting the database, and setting the client
+// name.
+func (options PoolOptions) dial() (redis.Conn, error) {
+	dialOptions := []redis.DialOption{}
+	if options.TLSConfig != nil {
+		dialOptions = append(dialOptions, redis.DialUseTLS(true), redis.DialTLSConfig(options.TLSConfig))
+	}
+	c, err := redis.Dial(options.Network, options.Address, dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	// If a options.Password was provided, use the AUTH command to authenticate
+	if options.Password != "" {
+		args := redis.Args{}
+		if options.Username != "" {
+			args = args.Add(options.Username)
+		}
+		args = args.Add(options.Password)
+		if _, err := c.Do("AUTH", args...); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	// Select the database number provided by options.Database
+	if _, err := c.Do("Select", options.Database); err != nil {
+		c.Close()
+		return nil, err
+	}
+	// Name the connection if options.ClientName was provided
+	if options.ClientName != "" {
+		if _, err := c.Do("CLIENT", "SETNAME", options.ClientName); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Conn satisfies Driver. In cluster mode, the connection is to the node which
+// serves key.
+func (d *redigoDriver) Conn(ctx context.Context, key string) (Conn, error) {
+	if d.cluster != nil {
+		return d.cluster.pool(key).GetContext(ctx)
+	}
+	return d.redisPool.GetContext(ctx)
+}
+
+// ReplicaConn satisfies Driver. The replicas are chosen in turn. If a
+// connection to the chosen replica cannot be made, ReplicaConn falls back to
+// the primary.
+func (d *redigoDriver) ReplicaConn(ctx context.Context) (Conn, error) {
+	if len(d.replicas) == 0 {
+		return d.Conn(ctx, "")
+	}
+	i := atomic.AddUint32(&d.nextReplica, 1)
+	conn, err := d.replicas[int(i%uint32(len(d.replicas)))].GetContext(ctx)
+	if err != nil && ctx.Err() == nil {
+		return d.Conn(ctx, "")
+	}
+	return conn, err
+}
+
+// Cluster satisfies Driver.
+func (d *redigoDriver) Cluster() bool {
+	return d.cluster != nil
+}
+
+// HandleError satisfies Driver. It returns true for MOVED errors in cluster
+// mode, after updating the slot table. In sentinel mode, it checks for errors
+// which indicate a failover.
+func (d *redigoDriver) HandleError(err error) bool {
+	if d.cluster != nil {
+		return d.cluster.handleError(err)
+	}
+	if d.sentinel != nil {
+		d.sentinel.handleError(err)
+	}
+	return false
+}
+
+// Stats satisfies Driver. In cluster mode, or if the pool was configured with
+// replicas, the statistics cover the connections to every node.
+func (d *redigoDriver) Stats() DriverStats {
+	stats := DriverStats{
+		DialErrors: atomic.LoadInt64(&d.dialErrors),
+	}
+	for _, redisPool := range d.redisPools() {
+		stats.ActiveCount += redisPool.ActiveCount()
+		stats.IdleCount += redisPool.IdleCount()
+	}
+	return stats
+}
+
+// redisPools returns all the redis.Pools used by the driver.
+func (d *redigoDriver) redisPools() []*redis.Pool {
+	if d.cluster != nil {
+		return d.cluster.nodePools()
+	}
+	return append([]*redis.Pool{d.redisPool}, d.replicas...)
+}
+
+// Close satisfies Driver.
+func (d *redigoDriver) Close() error {
+	if d.cluster != nil {
+		return d.cluster.close()
+	}
+	if d.sentinel != nil {
+		d.sentinel.close()
+	}
+	for _, replica := range d.replicas {
+		replica.Close()
+	}
+	return d.redisPool.Close()
+}
@@ -0,0 +1,256 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File reindex.go contains code related to rebuilding the field indexes of a
+// collection from the values stored in the main hashes of the models.
+
+package zoom
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Reindex rebuilds the indexes on the fields identified by fieldNames from the
+// values which are stored in the main hashes of the models, including the soft
+// deleted ones. If no field names are given, every indexed field is reindexed.
+// You should call Reindex after adding an index to a field of a collection
+// which already has models, or if an index has become inconsistent. Fields in
+// fieldNames which are not indexed (e.g. because their index has been removed)
+// have their index key deleted, and Reindex without any field names deletes the
+// index keys of all the fields which are not indexed.
+//
+// The models are reindexed in batches of at most PoolOptions.BatchSize models.
+// The application can keep saving models while Reindex runs: each model is
+// reindexed atomically, and only if its field still has the value which was
+// read, since otherwise the index was already updated when the model was saved.
+// Once all the models have been reindexed, Reindex scans each index and removes
+// the entries for models which no longer exist or which have another value.
+// Reindex also records the values of string indexed and unique fields in the
+// hash which is used to remove expired models from string indexes and release
+// their unique values (see SweepExpired). Unique fields are included when no
+// field names are given.
+func (c *Collection) Reindex(fieldNames ...string) error {
+	return c.ReindexContext(context.Background(), fieldNames...)
+}
+
+// ReindexContext is like Reindex but uses the given context for every batch.
+// See Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) ReindexContext(ctx context.Context, fieldNames ...string) error {
+	if c == nil {
+		return newNilCollectionError("Reindex")
+	}
+	if len(fieldNames) == 0 {
+		fieldNames = c.spec.fieldNames()
+	}
+	indexed := []*fieldSpec{}
+	unindexed := []*fieldSpec{}
+	// reindexed holds the fields which are indexed or unique.
+	reindexed := []*fieldSpec{}
+	for _, fieldName := range fieldNames {
+		fs, found := c.spec.fieldsByName[fieldName]
+		if !found {
+			return fmt.Errorf("zoom: Error in Reindex: Collection %s does not have field named %s", c.Name(), fieldName)
+		}
+		if fs.indexKind == noIndex {
+			unindexed = append(unindexed, fs)
+		} else {
+			indexed = append(indexed, fs)
+		}
+		if fs.indexKind != noIndex || fs.unique {
+			reindexed = append(reindexed, fs)
+		}
+	}
+	if err := c.deleteOldFieldIndexes(ctx, unindexed); err != nil {
+		return err
+	}
+	if len(reindexed) == 0 {
+		return nil
+	}
+	if err := c.forEachIdBatch(ctx, "reindex", func(ids []string) error {
+		return c.reindexModels(ctx, reindexed, ids)
+	}); err != nil {
+		return err
+	}
+	for _, fs := range indexed {
+		if err := c.cleanFieldIndex(ctx, fs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reindexModels adds the models with the given ids to the indexes on the given
+// fields and records the values of the unique fields which they own.
+// NOTE: this invokes a lua script which is defined in scripts/reindex_model.lua
+func (c *Collection) reindexModels(ctx context.Context, fields []*fieldSpec, ids []string) error {
+	fieldNames := make([]string, len(fields))
+	for i, fs := range fields {
+		fieldNames[i] = fs.name
+	}
+	refs := make([]*modelRef, len(ids))
+	values := make([][]interface{}, len(ids))
+	tx := c.pool.NewTransactionContext(ctx)
+	for i, id := range ids {
+		i := i
+		refs[i] = c.newModelRef(id)
+		args := Args{refs[i].key()}
+		for _, fs := range fields {
+			args = append(args, fs.redisName)
+		}
+		tx.Command("HMGET", args, func(reply interface{}) error {
+			var err error
+			if values[i], err = redis.Values(reply, nil); err != nil {
+				return err
+			}
+			return scanModel(fieldNames, values[i], refs[i])
+		})
+	}
+	if err := tx.Exec(); err != nil {
+		return err
+	}
+	tx = c.pool.NewTransactionContext(ctx)
+	for i, mr := range refs {
+		keys := Args{mr.key(), c.spec.stringValuesKey()}
+		args := Args{mr.model.ModelId()}
+		for j, fs := range fields {
+			if values[i][j] == nil {
+				// The model was deleted since the ids were stored or it has never
+				// had a value for the field.
+				continue
+			}
+			if fs.indexKind != noIndex {
+				indexArgs, err := mr.fieldIndexArgs(fs)
+				if err != nil {
+					return err
+				}
+				keys = append(keys, indexArgs[1])
+				args = append(args, indexArgs[0], fs.redisName, values[i][j], indexArgs[2])
+			}
+			if fs.unique {
+				uniqueKey, err := c.spec.uniqueKey(fs.name)
+				if err != nil {
+					return err
+				}
+				keys = append(keys, uniqueKey)
+				args = append(args, "unique", fs.redisName, values[i][j], values[i][j])
+			}
+		}
+		if len(keys) > 2 {
+			tx.Script(reindexModelScript, variadicScriptArgs(keys, args...), nil)
+		}
+	}
+	if len(tx.actions) == 0 {
+		return nil
+	}
+	return tx.Exec()
+}
+
+// cleanFieldIndex scans the index on the field fs in batches of
+// PoolOptions.BatchSize members and removes the members for models which do not
+// exist or which no longer have the indexed value. Each batch is scanned and
+// cleaned in its own transactions.
+// NOTE: this invokes a lua script which is defined in scripts/clean_field_index.lua
+func (c *Collection) cleanFieldIndex(ctx context.Context, fs *fieldSpec) error {
+	indexKey, err := c.spec.fieldIndexKey(fs.name)
+	if err != nil {
+		return err
+	}
+	options := Args{}
+	if size := c.pool.options.BatchSize; size > 0 {
+		options = append(options, "COUNT", size)
+	}
+	indexKind := "score"
+	if fs.indexKind == stringIndex {
+		indexKind = "string"
+	}
+	nullValue := ""
+	if fs.kind == pointerField {
+		nullValue = "NULL"
+	}
+	cursor := "0"
+	for {
+		members := []string{}
+		tx := c.pool.NewTransactionContext(ctx)
+		tx.Command("ZSCAN", append(Args{indexKey, cursor}, options...), func(reply interface{}) error {
+			values, err := redis.Values(reply, nil)
+			if err != nil {
+				return err
+			}
+			if len(values) != 2 {
+				return fmt.Errorf("zoom: Error in cleanFieldIndex: Expected 2 values in reply to ZSCAN but got %d", len(values))
+			}
+			if cursor, err = redis.String(values[0], nil); err != nil {
+				return err
+			}
+			membersAndScores, err := redis.Strings(values[1], nil)
+			if err != nil {
+				return err
+			}
+			for i := 0; i < len(membersAndScores); i += 2 {
+				members = append(members, membersAndScores[i])
+			}
+			return nil
+		})
+		if err := tx.Exec(); err != nil {
+			return err
+		}
+		if len(members) > 0 {
+			keys := Args{indexKey, c.spec.stringValuesKey()}
+			args := Args{indexKind, fs.redisName, nullValue}
+			for _, member := range members {
+				id := member
+				if indexKind == "string" {
+					// Members of string indexes end with a NULL character followed by
+					// the id. The script removes members which do not have one.
+					if i := strings.LastIndex(member, nullString); i != -1 {
+						id = member[i+len(nullString):]
+					}
+				}
+				keys = append(keys, c.spec.keyspace()+":"+id)
+				args = append(args, member)
+			}
+			tx = c.pool.NewTransactionContext(ctx)
+			tx.Script(cleanFieldIndexScript, variadicScriptArgs(keys, args...), nil)
+			if err := tx.Exec(); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// deleteOldFieldIndexes deletes the keys which were used for the indexes on the
+// given fields, which are not indexed anymore. Keys which do not hold a sorted
+// set are left alone, since they cannot be field indexes.
+func (c *Collection) deleteOldFieldIndexes(ctx context.Context, fields []*fieldSpec) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	indexKeys := make([]string, len(fields))
+	types := make([]string, len(fields))
+	tx := c.pool.NewTransactionContext(ctx)
+	for i, fs := range fields {
+		indexKeys[i] = c.spec.keyspace() + ":" + fs.redisName
+		tx.Command("TYPE", Args{indexKeys[i]}, NewScanStringHandler(&types[i]))
+	}
+	if err := tx.Exec(); err != nil {
+		return err
+	}
+	tx = c.pool.NewTransactionContext(ctx)
+	for i, indexKey := range indexKeys {
+		if types[i] == "zset" {
+			tx.Command("DEL", Args{indexKey}, nil)
+		}
+	}
+	if len(tx.actions) == 0 {
+		return nil
+	}
+	return tx.Exec()
+}
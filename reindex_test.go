@@ -0,0 +1,109 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File reindex_test.go tests the code in reindex.go
+
+package zoom
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reindexTestModel is a model type used for testing Reindex. It has every kind
+// of index and a field which is not indexed.
+type reindexTestModel struct {
+	Int    int    `zoom:"index"`
+	String string `zoom:"index"`
+	Bool   *bool  `zoom:"index"`
+	Other  string
+	RandomId
+}
+
+func TestReindex(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Use a small batch size so that the models are reindexed in more than one
+	// batch, and a hook to check that every action goes through a transaction.
+	hook := &recordingHook{name: "hook", log: &callLog{}}
+	pool := NewPoolWithOptions(testPool.options.WithBatchSize(2).WithHooks(hook))
+	defer pool.Close()
+	col, err := pool.NewCollectionWithOptions(&reindexTestModel{}, DefaultCollectionOptions.WithIndex(true))
+	require.NoError(t, err)
+	models := make([]*reindexTestModel, 5)
+	for i := range models {
+		models[i] = &reindexTestModel{Int: i, String: fmt.Sprint(4 - i)}
+		if i%2 == 0 {
+			models[i].Bool = new(bool)
+		}
+	}
+	require.NoError(t, col.SaveMany(models))
+
+	// Remove and corrupt the indexes as if they were added after the models
+	// were saved, or left behind by an older version of the model.
+	intKey, err := col.spec.fieldIndexKey("Int")
+	require.NoError(t, err)
+	stringKey, err := col.spec.fieldIndexKey("String")
+	require.NoError(t, err)
+	boolKey, err := col.spec.fieldIndexKey("Bool")
+	require.NoError(t, err)
+	otherKey := col.spec.keyspace() + ":Other"
+	conn := pool.NewConn()
+	defer conn.Close()
+	_, err = conn.Do("DEL", intKey, stringKey)
+	require.NoError(t, err)
+	_, err = conn.Do("ZADD", intKey, 100, "missing", 100, models[0].Id)
+	require.NoError(t, err)
+	_, err = conn.Do("ZADD", stringKey, 0, "stale"+nullString+models[1].Id, 0, "0"+nullString+"missing")
+	require.NoError(t, err)
+	_, err = conn.Do("ZADD", boolKey, 1, models[1].Id)
+	require.NoError(t, err)
+	_, err = conn.Do("ZADD", otherKey, 0, models[0].Id)
+	require.NoError(t, err)
+
+	require.NoError(t, col.Reindex())
+
+	ids, err := col.NewQuery().Order("Int").Ids()
+	require.NoError(t, err)
+	assert.Equal(t, []string{models[0].Id, models[1].Id, models[2].Id, models[3].Id, models[4].Id}, ids)
+	ids, err = col.NewQuery().Filter("String <", "2").Order("String").Ids()
+	require.NoError(t, err)
+	assert.Equal(t, []string{models[4].Id, models[3].Id}, ids)
+	ids, err = col.NewQuery().Filter("Bool =", false).Ids()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{models[0].Id, models[2].Id, models[4].Id}, ids)
+	for key, expected := range map[string]int{intKey: 5, stringKey: 5, boolKey: 3} {
+		count, err := redis.Int(conn.Do("ZCARD", key))
+		require.NoError(t, err)
+		assert.Equal(t, expected, count, "Wrong number of members in %s", key)
+	}
+	expectKeyDoesNotExist(t, otherKey)
+	commands := map[string]bool{}
+	for _, info := range hook.actions {
+		commands[info.Command+info.Script] = true
+	}
+	for _, command := range []string{"EVALSHAreindex_model", "ZSCAN", "EVALSHAclean_field_index"} {
+		assert.True(t, commands[command], "Expected hooks to be called for %s", command)
+	}
+
+	// Reindexing a single field should leave the other indexes alone.
+	_, err = conn.Do("ZADD", boolKey, 1, "missing")
+	require.NoError(t, err)
+	_, err = conn.Do("ZADD", intKey, 100, "missing")
+	require.NoError(t, err)
+	require.NoError(t, col.Reindex("Int"))
+	score, err := conn.Do("ZSCORE", intKey, "missing")
+	require.NoError(t, err)
+	assert.Nil(t, score)
+	score, err = conn.Do("ZSCORE", boolKey, "missing")
+	require.NoError(t, err)
+	assert.NotNil(t, score)
+
+	assert.Error(t, col.Reindex("Missing"))
+}
@@ -0,0 +1,351 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File rename.go contains code related to moving a collection to a new name,
+// including the aliases which switch a collection to another name.
+
+package zoom
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// RenameTo copies all the models in the collection, including the soft deleted
+// ones, to the keys for newName, along with the collection index, the field
+// indexes, the hashes of unique values and the expiration times. The models are
+// copied in batches of at most PoolOptions.BatchSize models, each in its own
+// transaction. The existing keys are not changed, so the collection can keep
+// being used while the models are copied. A batch is copied again if one of its
+// models changes while it is being copied, but changes which are made to a
+// model after it was copied are not copied, so you should stop writing to the
+// collection or run RenameTo again before switching to newName. No other
+// models should be saved under newName, since RenameTo does not remove them.
+// RenameTo cannot be used in cluster mode.
+//
+// RenameTo does not change which keys the collection uses. Once the models
+// have been copied, use SwitchTo to switch the collection to newName. The old
+// keys are kept so that you can switch back if needed.
+func (c *Collection) RenameTo(newName string) error {
+	return c.RenameToContext(context.Background(), newName)
+}
+
+// RenameToContext is like RenameTo but uses the given context for every
+// batch. See Pool.NewTransactionContext for a description of how the context
+// is used.
+func (c *Collection) RenameToContext(ctx context.Context, newName string) error {
+	if c == nil {
+		return newNilCollectionError("RenameTo")
+	}
+	if c.pool.driver.Cluster() {
+		return fmt.Errorf("zoom: Error in RenameTo: Collections cannot be renamed in cluster mode, since the keys for the new name are in another slot")
+	}
+	if err := c.checkNewName("RenameTo", newName); err != nil {
+		return err
+	}
+	src := c.spec.withName(c.KeyName())
+	if newName == src.name {
+		return fmt.Errorf("zoom: Error in RenameTo: The collection already uses the name %s", newName)
+	}
+	dest := c.spec.withName(newName)
+	return c.forEachIdBatch(ctx, "rename", func(ids []string) error {
+		return c.copyModels(ctx, src, dest, ids)
+	})
+}
+
+// modelCopy holds the values which are read from the keys of a model and the
+// indexes while it is copied to a new name by RenameTo.
+type modelCopy struct {
+	id      string
+	hash    map[string]string
+	ttl     int
+	deleted bool
+	// The following map the names of the fields to the score of the model in
+	// the numeric or boolean index, the member of the model in the string
+	// index and the value of the unique field respectively. They only contain
+	// the fields for which the model is actually in the index or the hash of
+	// unique values.
+	scores  map[string]interface{}
+	members map[string]string
+	uniques map[string]string
+	// expiresAt is the score of the model in the sorted set of expiration
+	// times, or nil if it does not expire.
+	expiresAt interface{}
+}
+
+// maxCopyAttempts is the number of times a batch of models is read and copied
+// by RenameTo before giving up on the models which keep changing concurrently.
+const maxCopyAttempts = 10
+
+// copyModels copies the models with the given ids from the keys of src to the
+// keys of dest, along with their entries in the indexes. The batch is copied
+// again if one of the models changes while it is being copied.
+func (c *Collection) copyModels(ctx context.Context, src, dest *modelSpec, ids []string) error {
+	for attempt := 0; attempt < maxCopyAttempts; attempt++ {
+		err := c.tryCopyModels(ctx, src, dest, ids)
+		if _, ok := err.(WatchError); !ok {
+			return err
+		}
+	}
+	return fmt.Errorf("zoom: Error in RenameTo: The models with ids %v kept changing while they were copied", ids)
+}
+
+// tryCopyModels does the work for copyModels. It returns a WatchError if one of
+// the models changed before it was written to dest.
+func (c *Collection) tryCopyModels(ctx context.Context, src, dest *modelSpec, ids []string) error {
+	modelKeys := make([]string, len(ids))
+	for i, id := range ids {
+		var err error
+		if modelKeys[i], err = src.modelKey(id); err != nil {
+			return err
+		}
+	}
+	// The main hashes are watched by the transaction which writes to dest
+	// before anything is read, so that a change which is made to a model in
+	// the meantime is not lost. Every write to a model changes its main hash.
+	write := c.pool.NewTransactionContext(ctx)
+	defer write.closeConn()
+	if err := write.watchKeys(modelKeys...); err != nil {
+		return err
+	}
+	copies := make([]*modelCopy, len(ids))
+	// First read the main hashes and everything that only depends on the ids.
+	tx := c.pool.NewTransactionContext(ctx)
+	for i, id := range ids {
+		mc := &modelCopy{
+			id:      id,
+			scores:  map[string]interface{}{},
+			members: map[string]string{},
+			uniques: map[string]string{},
+		}
+		copies[i] = mc
+		modelKey := modelKeys[i]
+		tx.Command("HGETALL", Args{modelKey}, func(reply interface{}) error {
+			var err error
+			mc.hash, err = redis.StringMap(reply, nil)
+			return err
+		})
+		tx.Command("PTTL", Args{modelKey}, NewScanIntHandler(&mc.ttl))
+		tx.Command("ZSCORE", Args{src.expirationsKey(), id}, func(reply interface{}) error {
+			mc.expiresAt = reply
+			return nil
+		})
+		if src.softDeleteField != nil {
+			tx.Command("SISMEMBER", Args{src.deletedKey(), id}, NewScanBoolHandler(&mc.deleted))
+		}
+		for _, fs := range src.fields {
+			if fs.indexKind != numericIndex && fs.indexKind != booleanIndex {
+				continue
+			}
+			indexKey, err := src.fieldIndexKey(fs.name)
+			if err != nil {
+				return err
+			}
+			fieldName := fs.name
+			tx.Command("ZSCORE", Args{indexKey, id}, func(reply interface{}) error {
+				if reply != nil {
+					mc.scores[fieldName] = reply
+				}
+				return nil
+			})
+		}
+	}
+	if err := tx.Exec(); err != nil {
+		return err
+	}
+	// Then check which values are in the string indexes and the hashes of
+	// unique values, which requires the values of the fields.
+	tx = c.pool.NewTransactionContext(ctx)
+	for _, mc := range copies {
+		mc := mc
+		for _, fs := range src.fields {
+			value, found := mc.hash[fs.redisName]
+			if !found {
+				continue
+			}
+			fieldName := fs.name
+			if fs.indexKind == stringIndex {
+				indexKey, err := src.fieldIndexKey(fs.name)
+				if err != nil {
+					return err
+				}
+				member := value + nullString + mc.id
+				tx.Command("ZSCORE", Args{indexKey, member}, func(reply interface{}) error {
+					if reply != nil {
+						mc.members[fieldName] = member
+					}
+					return nil
+				})
+			}
+			if fs.unique {
+				uniqueKey, err := src.uniqueKey(fs.name)
+				if err != nil {
+					return err
+				}
+				tx.Command("HGET", Args{uniqueKey, value}, func(reply interface{}) error {
+					if owner, err := redis.String(reply, nil); err == nil && owner == mc.id {
+						mc.uniques[fieldName] = value
+					}
+					return nil
+				})
+			}
+		}
+	}
+	if len(tx.actions) > 0 {
+		if err := tx.Exec(); err != nil {
+			return err
+		}
+	}
+	// Finally write everything to the keys of dest.
+	tx = write
+	for _, mc := range copies {
+		if len(mc.hash) == 0 {
+			// The model was deleted or has expired since the ids were stored.
+			continue
+		}
+		modelKey, err := dest.modelKey(mc.id)
+		if err != nil {
+			return err
+		}
+		hashArgs := Args{modelKey}
+		for name, value := range mc.hash {
+			hashArgs = append(hashArgs, name, value)
+		}
+		tx.Command("DEL", Args{modelKey}, nil)
+		tx.Command("HMSET", hashArgs, nil)
+		if mc.ttl > 0 {
+			tx.Command("PEXPIRE", Args{modelKey, mc.ttl}, nil)
+		}
+		if mc.deleted {
+			tx.Command("SADD", Args{dest.deletedKey(), mc.id}, nil)
+		} else if c.index {
+			tx.Command("SADD", Args{dest.indexKey(), mc.id}, nil)
+		}
+		if mc.expiresAt != nil {
+			tx.Command("ZADD", Args{dest.expirationsKey(), mc.expiresAt, mc.id}, nil)
+		}
+		for fieldName, score := range mc.scores {
+			indexKey, _ := dest.fieldIndexKey(fieldName)
+			tx.Command("ZADD", Args{indexKey, score, mc.id}, nil)
+		}
+		for fieldName, member := range mc.members {
+			indexKey, _ := dest.fieldIndexKey(fieldName)
+			tx.Command("ZADD", Args{indexKey, 0, member}, nil)
+			fs := dest.fieldsByName[fieldName]
+			tx.Command("HSET", Args{dest.stringValuesKey(), stringValueField(fs.redisName, mc.id), mc.hash[fs.redisName]}, nil)
+		}
+		for fieldName, value := range mc.uniques {
+			uniqueKey, _ := dest.uniqueKey(fieldName)
+			tx.Command("HSET", Args{uniqueKey, value, mc.id}, nil)
+			fs := dest.fieldsByName[fieldName]
+			tx.Command("HSET", Args{dest.stringValuesKey(), stringValueField(fs.redisName, mc.id), value}, nil)
+		}
+	}
+	if len(tx.actions) == 0 {
+		return nil
+	}
+	return tx.Exec()
+}
+
+// SwitchTo switches the collection to the keys for newName, which usually
+// holds a copy of the models made by RenameTo. Every method of the collection
+// which is called afterwards uses the new keys, while Name stays the same.
+// SwitchTo stores newName as the alias for the collection in Redis, where it
+// is read by every transaction (see CollectionOptions.Alias), so every process
+// switches to the new keys at once. Transactions which were created before the
+// switch and are executed after it fail with a WatchError. Use SwitchTo with
+// the name of the collection to switch back to its original keys. SwitchTo
+// returns an error if CollectionOptions.Alias was not true when the collection
+// was created.
+func (c *Collection) SwitchTo(newName string) error {
+	return c.SwitchToContext(context.Background(), newName)
+}
+
+// SwitchToContext is like SwitchTo but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) SwitchToContext(ctx context.Context, newName string) error {
+	if c == nil {
+		return newNilCollectionError("SwitchTo")
+	}
+	if !c.alias {
+		return fmt.Errorf("zoom: Error in SwitchTo: CollectionOptions.Alias is not true for the collection %s", c.Name())
+	}
+	if err := c.checkNewName("SwitchTo", newName); err != nil {
+		return err
+	}
+	tx := c.pool.NewTransactionContext(ctx)
+	if newName == c.Name() {
+		tx.Command("HDEL", Args{c.pool.aliasesKey(), c.Name()}, nil)
+	} else {
+		tx.Command("HSET", Args{c.pool.aliasesKey(), c.Name(), newName}, nil)
+	}
+	if err := tx.Exec(); err != nil {
+		return err
+	}
+	c.spec.target.Store(newName)
+	return nil
+}
+
+// LoadAlias reads the alias for the collection which was stored in Redis by
+// SwitchTo (possibly in another process) and switches the collection to it. If
+// there is no alias, the collection uses the keys for its own name. Every
+// transaction already does this, so LoadAlias is only needed to update the
+// value returned by KeyName. It returns an error if CollectionOptions.Alias was
+// not true when the collection was created.
+func (c *Collection) LoadAlias() error {
+	return c.LoadAliasContext(context.Background())
+}
+
+// LoadAliasContext is like LoadAlias but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) LoadAliasContext(ctx context.Context) error {
+	if c == nil {
+		return newNilCollectionError("LoadAlias")
+	}
+	if !c.alias {
+		return fmt.Errorf("zoom: Error in LoadAlias: CollectionOptions.Alias is not true for the collection %s", c.Name())
+	}
+	target := c.Name()
+	tx := c.pool.NewTransactionContext(ctx)
+	tx.Command("HGET", Args{c.pool.aliasesKey(), c.Name()}, func(reply interface{}) error {
+		if reply == nil {
+			return nil
+		}
+		var err error
+		target, err = redis.String(reply, nil)
+		return err
+	})
+	if err := tx.Exec(); err != nil {
+		return err
+	}
+	c.spec.target.Store(target)
+	return nil
+}
+
+// checkNewName returns an error if name cannot be used in the keys for the
+// collection. methodName is used in the error message.
+func (c *Collection) checkNewName(methodName string, name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("zoom: Error in %s: The name cannot be empty", methodName)
+	case strings.Contains(name, ":"):
+		return fmt.Errorf("zoom: Error in %s: The name cannot contain a colon. Got: %s", methodName, name)
+	case c.pool.driver.Cluster() && strings.ContainsAny(name, "{}"):
+		return fmt.Errorf("zoom: Error in %s: The name cannot contain curly braces in cluster mode. Got: %s", methodName, name)
+	}
+	if spec, found := c.pool.modelNameToSpec[name]; found && spec != c.spec {
+		return fmt.Errorf("zoom: Error in %s: The name %s is used by another collection", methodName, name)
+	}
+	return nil
+}
+
+// aliasesKey returns the key of the hash which maps the names of the
+// collections which have been switched to another name to that name. See
+// Collection.SwitchTo.
+func (p *Pool) aliasesKey() string {
+	return p.options.KeyPrefix + "aliases"
+}
@@ -0,0 +1,167 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File rename_test.go tests the code in rename.go
+
+package zoom
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// renameTestModel is a model type used for testing RenameTo. It has every kind
+// of index so that all of them are copied.
+type renameTestModel struct {
+	Int       int       `zoom:"index"`
+	String    string    `zoom:"index"`
+	Email     string    `zoom:"unique"`
+	DeletedAt time.Time `zoom:"softdelete"`
+	RandomId
+}
+
+func TestRenameTo(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Use a small batch size so that the models are copied in more than one
+	// batch.
+	pool := NewPoolWithOptions(testPool.options.WithBatchSize(2))
+	defer pool.Close()
+	col, err := pool.NewCollectionWithOptions(&renameTestModel{}, DefaultCollectionOptions.WithAlias(true).WithIndex(true).WithTTL(time.Hour))
+	require.NoError(t, err)
+	models := make([]*renameTestModel, 5)
+	for i := range models {
+		models[i] = &renameTestModel{Int: i, String: fmt.Sprint(4 - i), Email: fmt.Sprintf("%d@example.com", i)}
+	}
+	require.NoError(t, col.SaveMany(models))
+	_, err = col.SoftDelete(models[0].Id)
+	require.NoError(t, err)
+
+	// RenameTo should not change the keys which are used.
+	require.NoError(t, col.RenameTo("renamedTestModel"))
+	assert.Equal(t, "renameTestModel", col.KeyName())
+	expectModelExists(t, col, models[1])
+
+	require.NoError(t, col.SwitchTo("renamedTestModel"))
+	assert.Equal(t, "renameTestModel", col.Name())
+	assert.Equal(t, "renamedTestModel", col.KeyName())
+	found := []*renameTestModel{}
+	require.NoError(t, col.FindAll(&found))
+	assert.ElementsMatch(t, models[1:], found)
+	ids, err := col.NewQuery().Filter("Int >=", 2).Order("String").Ids()
+	require.NoError(t, err)
+	assert.Equal(t, []string{models[4].Id, models[3].Id, models[2].Id}, ids)
+	ids, err = col.NewQuery().OnlyDeleted().Ids()
+	require.NoError(t, err)
+	assert.Equal(t, []string{models[0].Id}, ids)
+	foundModel := &renameTestModel{}
+	require.NoError(t, col.FindBy("Email", "3@example.com", foundModel))
+	assert.Equal(t, models[3], foundModel)
+	err = col.Save(&renameTestModel{Email: "3@example.com"})
+	assert.IsType(t, UniqueConstraintError{}, err)
+	conn := pool.NewConn()
+	defer conn.Close()
+	ttl, err := redis.Int(conn.Do("PTTL", col.ModelKey(models[1].Id)))
+	require.NoError(t, err)
+	assert.True(t, ttl > 0, "The TTL of the main hash should be copied")
+	expiresAt, err := conn.Do("ZSCORE", col.spec.expirationsKey(), models[1].Id)
+	require.NoError(t, err)
+	assert.NotNil(t, expiresAt, "The expiration time should be copied")
+
+	// New models should be saved with the new keys.
+	model := &renameTestModel{Int: 5}
+	require.NoError(t, col.Save(model))
+	assert.Contains(t, col.ModelKey(model.Id), "renamedTestModel:")
+	expectKeyExists(t, col.ModelKey(model.Id))
+
+	// Other processes should switch as soon as they create a transaction.
+	col.spec.target.Store("")
+	count, err := col.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 5, count)
+	assert.Equal(t, "renamedTestModel", col.KeyName())
+	col.spec.target.Store("")
+	require.NoError(t, col.LoadAlias())
+	assert.Equal(t, "renamedTestModel", col.KeyName())
+
+	// Transactions which were created before the switch should fail.
+	tx := pool.NewTransaction()
+	tx.Save(col, &renameTestModel{Int: 6})
+
+	// Switching back to the name of the collection should remove the alias.
+	require.NoError(t, col.SwitchTo(col.Name()))
+	assert.Equal(t, "renameTestModel", col.KeyName())
+	assert.IsType(t, WatchError{}, tx.Exec())
+	count, err = col.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 4, count)
+	require.NoError(t, col.LoadAlias())
+	assert.Equal(t, "renameTestModel", col.KeyName())
+
+	assert.Error(t, col.RenameTo("renameTestModel"))
+	assert.Error(t, col.RenameTo("invalid:name"))
+	assert.Error(t, col.SwitchTo(""))
+	assert.Error(t, testModels.SwitchTo("renamedTestModel"), "Collections without CollectionOptions.Alias cannot be switched")
+}
+
+// concurrentWriteHook changes a field of the main hash at key right before the
+// first transaction which watches key is executed.
+type concurrentWriteHook struct {
+	key   string
+	field string
+	value string
+	done  bool
+}
+
+func (h *concurrentWriteHook) BeforeExec(ctx context.Context, info *ExecInfo) context.Context {
+	if h.done || info.ActionCount == 0 {
+		return ctx
+	}
+	for _, key := range info.Watched {
+		if key == h.key {
+			h.done = true
+			conn := testPool.NewConn()
+			defer conn.Close()
+			if _, err := conn.Do("HSET", h.key, h.field, h.value); err != nil {
+				panic(err)
+			}
+		}
+	}
+	return ctx
+}
+
+func (h *concurrentWriteHook) AfterExec(ctx context.Context, info *ExecInfo)      {}
+func (h *concurrentWriteHook) BeforeAction(ctx context.Context, info *ActionInfo) {}
+func (h *concurrentWriteHook) AfterAction(ctx context.Context, info *ActionInfo)  {}
+
+func TestRenameToConcurrentWrite(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	hook := &concurrentWriteHook{field: "String", value: "changed"}
+	pool := NewPoolWithOptions(testPool.options.WithHooks(hook))
+	defer pool.Close()
+	col, err := pool.NewCollectionWithOptions(&renameTestModel{}, DefaultCollectionOptions.WithIndex(true))
+	require.NoError(t, err)
+	model := &renameTestModel{String: "original"}
+	require.NoError(t, col.Save(model))
+	hook.key = col.ModelKey(model.Id)
+
+	// The model is changed after it was read and before it is written to the
+	// new keys, so the copy should be retried instead of losing the change.
+	require.NoError(t, col.RenameTo("renamedTestModel"))
+	assert.True(t, hook.done, "The hook was not called")
+	conn := pool.NewConn()
+	defer conn.Close()
+	value, err := redis.String(conn.Do("HGET", col.spec.withName("renamedTestModel").keyspace()+":"+model.Id, "String"))
+	require.NoError(t, err)
+	assert.Equal(t, "changed", value)
+}
@@ -0,0 +1,142 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File scan.go contains code related to finding the models in collections
+// which are not indexed by scanning the keyspace.
+
+package zoom
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// scanIdsTTL is how long the temporary set of ids found with SCAN is kept, in
+// case the transaction which should delete it fails.
+const scanIdsTTL = 10 * time.Minute
+
+// scanIds returns the key of a temporary set which will hold the ids of all
+// the models in the unindexed collection c, including the soft deleted ones.
+// The ids are found with SCAN right before the transaction is executed, which
+// takes time proportional to the number of keys in the database, not the
+// number of models in the collection. Models which are created or deleted
+// while the keys are being scanned may or may not be included. The caller is
+// responsible for deleting the set.
+func (t *Transaction) scanIds(c *Collection) string {
+	idsKey := c.spec.tmpKey("scan")
+	t.beforeExec = append(t.beforeExec, func() error {
+		return c.scanIdsInto(t.ctx, idsKey)
+	})
+	return idsKey
+}
+
+// scanIdsInto scans the keyspace of the collection in batches of
+// PoolOptions.BatchSize keys and adds the ids of the models it finds to the
+// set identified by destKey.
+// NOTE: this invokes a lua script which is defined in scripts/add_model_ids.lua
+func (c *Collection) scanIdsInto(ctx context.Context, destKey string) error {
+	conn, err := c.pool.getConn(ctx, destKey)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn = execConn(ctx, conn)
+	options := Args{"MATCH", c.spec.scanPattern()}
+	if size := c.pool.options.BatchSize; size > 0 {
+		options = append(options, "COUNT", size)
+	}
+	prefix := c.spec.keyspace() + ":"
+	cursor := "0"
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		values, err := redis.Values(conn.Do("SCAN", append(Args{cursor}, options...)...))
+		if err != nil {
+			return err
+		}
+		if len(values) != 2 {
+			return fmt.Errorf("zoom: Error in scanIdsInto: Expected 2 values in reply to SCAN but got %d", len(values))
+		}
+		if cursor, err = redis.String(values[0], nil); err != nil {
+			return err
+		}
+		keys, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return err
+		}
+		modelKeys := Args{destKey}
+		ids := Args{}
+		for _, key := range keys {
+			if id := strings.TrimPrefix(key, prefix); !c.spec.isReservedKeyName(id) {
+				modelKeys = append(modelKeys, key)
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) > 0 {
+			if _, err := addModelIdsScript.do(conn, variadicScriptArgs(modelKeys, ids...)); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	_, err = conn.Do("PEXPIRE", destKey, int64(scanIdsTTL/time.Millisecond))
+	return err
+}
+
+// scanPattern returns the pattern which matches all the keys in the keyspace
+// of the collection for the MATCH option of SCAN.
+func (ms *modelSpec) scanPattern() string {
+	return escapeGlob(ms.keyspace()) + ":*"
+}
+
+// isReservedKeyName returns true iff name is the last part of one of the keys
+// in the keyspace of the collection which are used by Zoom and which are not
+// the main hash of a model, e.g. "all" for the index key.
+func (ms *modelSpec) isReservedKeyName(name string) bool {
+	switch name {
+	case "all", "expirations", "deleted", "strings":
+		return true
+	}
+	for _, fs := range ms.fields {
+		if name == fs.redisName+":unique" {
+			return true
+		}
+	}
+	return false
+}
+
+// escapeGlob escapes the characters in s which have a special meaning in the
+// glob-style patterns used by SCAN and KEYS.
+func escapeGlob(s string) string {
+	var result strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			result.WriteRune('\\')
+		}
+		result.WriteRune(r)
+	}
+	return result.String()
+}
+
+// skipMissingModelsHandler returns a handler for the reply of a SORT command
+// with a GET for each of the numFields fields (including the id) which removes
+// the values for models which no longer exist (see skipMissingModels) and then
+// calls handler.
+func skipMissingModelsHandler(numFields int, handler ReplyHandler) ReplyHandler {
+	return func(reply interface{}) error {
+		values, err := redis.Values(reply, nil)
+		if err != nil {
+			return err
+		}
+		return handler(skipMissingModels(values, numFields))
+	}
+}
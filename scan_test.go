@@ -0,0 +1,105 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File scan_test.go tests the code in scan.go
+
+package zoom
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnindexedCollection(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := make([]*unindexedTestModel, 5)
+	for i := range models {
+		models[i] = &unindexedTestModel{Int: i, Email: fmt.Sprintf("%d@example.com", i)}
+	}
+	require.NoError(t, unindexedTestModels.SaveMany(models))
+	expectKeyDoesNotExist(t, unindexedTestModels.IndexKey())
+	// Models in other collections should not be found.
+	_, err := createAndSaveIndexedTestModels(2)
+	require.NoError(t, err)
+
+	found := []*unindexedTestModel{}
+	require.NoError(t, unindexedTestModels.FindAll(&found))
+	assert.ElementsMatch(t, models, found)
+	count, err := unindexedTestModels.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 5, count)
+
+	// Queries should work, including filters and orders on indexed fields.
+	ids, err := unindexedTestModels.NewQuery().Filter("Int >=", 2).Order("-Int").Ids()
+	require.NoError(t, err)
+	assert.Equal(t, []string{models[4].Id, models[3].Id, models[2].Id}, ids)
+	count, err = unindexedTestModels.NewQuery().Filter("Int <", 2).Count()
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// Soft deleted models should be excluded unless the query includes them.
+	_, err = unindexedTestModels.SoftDelete(models[0].Id)
+	require.NoError(t, err)
+	count, err = unindexedTestModels.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 4, count)
+	count, err = unindexedTestModels.NewQuery().WithDeleted().Count()
+	require.NoError(t, err)
+	assert.Equal(t, 5, count)
+	ids, err = unindexedTestModels.NewQuery().OnlyDeleted().Ids()
+	require.NoError(t, err)
+	assert.Equal(t, []string{models[0].Id}, ids)
+
+	// The scan should happen right before the transaction is executed.
+	tx := testPool.NewTransaction()
+	found = []*unindexedTestModel{}
+	tx.FindAll(unindexedTestModels, &found)
+	tx.Count(unindexedTestModels, &count)
+	require.NoError(t, unindexedTestModels.Save(&unindexedTestModel{Int: 5}))
+	require.NoError(t, tx.Exec())
+	assert.Len(t, found, 5)
+	assert.Equal(t, 5, count)
+
+	iterated := 0
+	iter := unindexedTestModels.Iter()
+	for iter.Next() {
+		iterated++
+	}
+	require.NoError(t, iter.Err())
+	require.NoError(t, iter.Close())
+	assert.Equal(t, 5, iterated)
+
+	// The temporary sets of ids should be deleted.
+	conn := testPool.NewConn()
+	defer conn.Close()
+	tmpKeys, err := redis.Strings(conn.Do("KEYS", "*tmp*"))
+	require.NoError(t, err)
+	assert.Empty(t, tmpKeys)
+
+	// DeleteAll should delete the soft deleted models too and leave the other
+	// collections alone.
+	deleted, err := unindexedTestModels.DeleteAll()
+	require.NoError(t, err)
+	assert.Equal(t, 6, deleted)
+	count, err = unindexedTestModels.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+	expectKeyDoesNotExist(t, unindexedTestModels.spec.deletedKey())
+	expectKeyDoesNotExist(t, unindexedTestModels.spec.keyspace()+":Email:unique")
+	count, err = indexedTestModels.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestScanPattern(t *testing.T) {
+	assert.Equal(t, `a\*b\?c\[d\]e\\f`, escapeGlob(`a*b?c[d]e\f`))
+	spec := &modelSpec{name: "Person", keyPrefix: "app:"}
+	assert.Equal(t, "app:Person:*", spec.scanPattern())
+}
@@ -10,83 +10,409 @@
 
 package zoom
 
-import (
-	"github.com/garyburd/redigo/redis"
-)
-
 var (
 	
-	deleteModelsBySetIdsScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+	addModelIdsScript = NewNamedScript("add_model_ids", -1, `-- Copyright 2015 Alex Browne.  All rights reserved.
 -- Use of this source code is governed by the MIT
 -- license, which can be found in the LICENSE file.
 
--- delete_models_by_set_ids is a lua script that takes the following arguments:
--- 	1) The key of a set of model ids
---		2) The name of a registered model
--- The script then deletes all the models corresponding to the ids in the given
--- set. It returns the number of models that were deleted. It does not delete the
--- given set.
+-- add_model_ids is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of a set of model ids
+--		KEYS[2...]) The keys which may be the main hashes of models, one for each id
+--			below
+--		ARGV[1...]) The ids of the models which may exist
+-- The script adds the ids for which the main hash of a model exists to the
+-- set. It is used to filter the keys found with SCAN, which may include keys
+-- other than the main hashes of the models (e.g. the field indexes). It returns
+-- the number of ids that were added to the set.
 
 -- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
 
 -- Assign keys to variables for easy access
-local setKey = ARGV[1]
-local collectionName = ARGV[2]
--- Get all the ids from the set name
-local ids = redis.call('SMEMBERS', setKey)
+local setKey = KEYS[1]
+local firstModelKey = 2
 local count = 0
-if #ids > 0 then
-	-- Iterate over the ids
-	for i, id in ipairs(ids) do
-		-- Delete the main hash for each model
-		local key = collectionName .. ':' .. id
-		count = count + redis.call('DEL', key)
-		-- Remove the model id from the set of all ids
-		-- NOTE: this is not necessarily the same as the
-		-- setName we were given
-		local setKey = collectionName .. ':all'
-		redis.call('SREM', setKey, id)
+for i, id in ipairs(ARGV) do
+	if redis.call('TYPE', KEYS[firstModelKey + i - 1])['ok'] == 'hash' then
+		count = count + redis.call('SADD', setKey, id)
 	end
 end
 return count
 `)
-	deleteStringIndexScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+	cleanFieldIndexScript = NewNamedScript("clean_field_index", -1, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- clean_field_index is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the sorted set for the field index
+--		KEYS[2]) The key of the hash of the values in the string indexes for the
+--			collection
+--		KEYS[3...]) The keys of the main hashes for the models, one for each of the
+--			members in ARGV. For members of a string index which do not contain an
+--			id, the key is ignored.
+--		ARGV[1]) The kind of index: "score" for numeric and boolean indexes or
+--			"string" for string indexes
+--		ARGV[2]) The name of the field (as it is stored in Redis)
+--		ARGV[3]) "NULL" if the field is a pointer, in which case that value means
+--			the field is nil, or an empty string otherwise
+--		ARGV[4...]) The members of the index which should be checked
+-- The script removes the members which do not belong in the index, i.e. the ones
+-- for which the model does not exist, the field is missing or nil or, for string
+-- indexes, the value in the member is not the value of the field. The values of
+-- the removed members are also removed from the hash of string values. It
+-- returns the number of members which were removed.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local indexKey = KEYS[1]
+local stringValuesKey = KEYS[2]
+local indexKind = ARGV[1]
+local fieldName = ARGV[2]
+local nullValue = ARGV[3]
+local count = 0
+for i = 4, #ARGV do
+	local member = ARGV[i]
+	local modelKey = KEYS[i - 1]
+	local indexedValue = false
+	local stringValueField = false
+	if indexKind == "string" then
+		-- The member consists of the value and the id separated by a NULL
+		-- character. Members without one were not written by a string index.
+		local idStart = string.find(member, "%z[^%z]*$")
+		if idStart then
+			indexedValue = string.sub(member, 1, idStart - 1)
+			stringValueField = fieldName .. "\0" .. string.sub(member, idStart + 1)
+		else
+			modelKey = false
+		end
+	end
+	local value = false
+	if modelKey then
+		value = redis.call("HGET", modelKey, fieldName)
+	end
+	if value == false or (nullValue ~= "" and value == nullValue) or (indexKind == "string" and value ~= indexedValue) then
+		count = count + redis.call("ZREM", indexKey, member)
+		if stringValueField and redis.call("HGET", stringValuesKey, stringValueField) == indexedValue then
+			redis.call("HDEL", stringValuesKey, stringValueField)
+		end
+	end
+end
+return count
+`)
+	conditionalSaveScript = NewNamedScript("conditional_save", -1, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- conditional_save is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the main hash for the model
+--		KEYS[2]) The key of the set of all ids for the collection (i.e. the index key)
+--		KEYS[3]) The key of the sorted set of expiration times for the collection
+--		KEYS[4]) The key of the set of ids of soft deleted models
+--		KEYS[5]) The key of the hash of the values in the string indexes and the
+--			unique fields for the collection
+--		KEYS[6]) The key of the sorted set for the created field index, if ARGV[9]
+--			is "1"
+--		The remaining keys are the keys of the field indexes, one for each group
+--			of index arguments below: the key of the sorted set for the field index,
+--			or the key of the hash of values to ids for unique fields
+--		ARGV[1]) Either "save", "create" or "update". If "create", the model is only
+--			saved if the main hash does not exist. If "update", the model is only
+--			saved if the main hash exists.
+--		ARGV[2]) The id of the model
+--		ARGV[3]) "1" if the id should be added to the index key, "0" otherwise. The
+--			id is never added if the model has been soft deleted.
+--		ARGV[4]) The name of the version field (as it is stored in Redis), or an
+--			empty string if the model does not have one
+--		ARGV[5]) The expected version, i.e. the version the model had when it was
+--			found (a missing version is treated as 0)
+--		ARGV[6]) The time at which the model should expire as a Unix timestamp in
+--			milliseconds, or "0" if the expiration time should not be changed
+--		ARGV[7]) The name of the created field (as it is stored in Redis), or an
+--			empty string if the model does not have one
+--		ARGV[8]) The current time as a Unix timestamp in microseconds, which is
+--			used as the created time if the model does not already have one
+--		ARGV[9]) "1" if the created field is indexed, in which case the key of the
+--			sorted set for the created field index is KEYS[6], "0" otherwise
+--		ARGV[10]) The number n of fields to save in the main hash
+--		ARGV[11] to ARGV[10+2n]) The names and values of the fields, in pairs
+--		The remaining arguments come in groups of three, one for each field index:
+--			1) The kind of index: "score" for numeric and boolean indexes, "string"
+--				for string indexes, "nullstring" for string indexes on fields which
+--				are nil, "unique" for unique fields or "nullunique" for unique fields
+--				which are nil
+--			2) The name of the field (as it is stored in Redis)
+--			3) The score for "score" indexes or the value of the field for "string"
+--				and "unique" indexes
+-- The script checks whether the model exists and whether the stored version
+-- matches the expected version. If both conditions are met, it saves the model
+-- and its field indexes in the same way as Transaction.Save, increments the
+-- version, sets the created time if it is not already set and sets the
+-- expiration time (if any). It returns a status, a version and a created time.
+-- The status is 1 if the model was saved (in which case the version is the new
+-- version and the created time is the stored created time, or 0 if the model
+-- does not have a created field), 0 if it was not saved because it existed (or
+-- did not exist) and -1 if it was not saved because the stored version did not
+-- match (in which case the version is the stored version). If the value of a
+-- unique field belongs to another model which still exists, the model is not
+-- saved and the status is -2, followed by the name of the field and the id of
+-- the other model. The other model is treated as gone if its expiration time in
+-- KEYS[3] has passed, since its main hash may have expired before its values
+-- were released by SweepExpired.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local modelKey = KEYS[1]
+local indexKey = KEYS[2]
+local expirationsKey = KEYS[3]
+local deletedKey = KEYS[4]
+local stringValuesKey = KEYS[5]
+local mode = ARGV[1]
+local modelId = ARGV[2]
+local addToIndex = ARGV[3] == "1"
+local versionField = ARGV[4]
+local expectedVersion = tonumber(ARGV[5])
+local expireAt = ARGV[6]
+local createdField = ARGV[7]
+local now = ARGV[8]
+local numFields = tonumber(ARGV[10])
+local createdIndexKey = false
+-- The index of the key for the first group of index arguments
+local firstIndexKey = 6
+if ARGV[9] == "1" then
+	createdIndexKey = KEYS[6]
+	firstIndexKey = 7
+end
+-- Check the conditions before writing anything
+local exists = redis.call("EXISTS", modelKey) == 1
+if (mode == "create" and exists) or (mode == "update" and not exists) then
+	return {0, 0, 0}
+end
+local newVersion = 0
+if versionField ~= "" then
+	local actualVersion = tonumber(redis.call("HGET", modelKey, versionField) or "0")
+	if actualVersion ~= expectedVersion then
+		return {-1, actualVersion, 0}
+	end
+	newVersion = actualVersion + 1
+end
+local firstIndexArg = 11 + 2 * numFields
+-- indexKeyFor returns the key for the group of index arguments which starts at
+-- ARGV[i]
+local function indexKeyFor(i)
+	return KEYS[firstIndexKey + (i - firstIndexArg) / 3]
+end
+-- ownerIsLive returns false iff the model with the given id was due to expire
+-- before now, in which case its unique values are free to be taken
+local function ownerIsLive(owner)
+	local ownerExpireAt = redis.call("ZSCORE", expirationsKey, owner)
+	return not ownerExpireAt or tonumber(ownerExpireAt) * 1000 > tonumber(now)
+end
+for i = firstIndexArg, #ARGV, 3 do
+	if ARGV[i] == "unique" then
+		local owner = redis.call("HGET", indexKeyFor(i), ARGV[i + 2])
+		if owner and owner ~= modelId and ownerIsLive(owner) then
+			return {-2, 0, 0, ARGV[i + 1], owner}
+		end
+	end
+end
+-- Remove the old string indexes and unique values (if any). This must happen
+-- before the main hash is updated, because it relies on the old field values.
+for i = firstIndexArg, #ARGV, 3 do
+	local kind = ARGV[i]
+	if kind == "string" or kind == "nullstring" then
+		local oldValue = redis.call("HGET", modelKey, ARGV[i + 1])
+		if oldValue ~= false then
+			redis.call("ZREM", indexKeyFor(i), oldValue .. "\0" .. modelId)
+		end
+		redis.call("HDEL", stringValuesKey, ARGV[i + 1] .. "\0" .. modelId)
+	elseif kind == "unique" or kind == "nullunique" then
+		local oldValue = redis.call("HGET", modelKey, ARGV[i + 1])
+		if oldValue ~= false and redis.call("HGET", indexKeyFor(i), oldValue) == modelId then
+			redis.call("HDEL", indexKeyFor(i), oldValue)
+		end
+		redis.call("HDEL", stringValuesKey, ARGV[i + 1] .. "\0" .. modelId)
+	end
+end
+-- Save the fields in the main hash
+if numFields > 0 then
+	local hashArgs = {}
+	for i = 11, 10 + 2 * numFields do
+		table.insert(hashArgs, ARGV[i])
+	end
+	redis.call("HMSET", modelKey, unpack(hashArgs))
+end
+if versionField ~= "" then
+	redis.call("HSET", modelKey, versionField, newVersion)
+end
+local createdAt = 0
+if createdField ~= "" then
+	redis.call("HSETNX", modelKey, createdField, now)
+	createdAt = redis.call("HGET", modelKey, createdField)
+	if createdIndexKey then
+		redis.call("ZADD", createdIndexKey, createdAt, modelId)
+	end
+end
+if addToIndex and redis.call("SISMEMBER", deletedKey, modelId) == 0 then
+	redis.call("SADD", indexKey, modelId)
+end
+if expireAt ~= "0" and redis.call("PEXPIREAT", modelKey, expireAt) == 1 then
+	redis.call("ZADD", expirationsKey, expireAt, modelId)
+elseif not exists then
+	-- A model with the same id may have expired, but this one does not expire
+	redis.call("ZREM", expirationsKey, modelId)
+end
+-- Save the new field indexes
+for i = firstIndexArg, #ARGV, 3 do
+	local kind = ARGV[i]
+	if kind == "score" then
+		redis.call("ZADD", indexKeyFor(i), ARGV[i + 2], modelId)
+	elseif kind == "string" then
+		redis.call("ZADD", indexKeyFor(i), 0, ARGV[i + 2] .. "\0" .. modelId)
+		redis.call("HSET", stringValuesKey, ARGV[i + 1] .. "\0" .. modelId, ARGV[i + 2])
+	elseif kind == "unique" then
+		redis.call("HSET", indexKeyFor(i), ARGV[i + 2], modelId)
+		redis.call("HSET", stringValuesKey, ARGV[i + 1] .. "\0" .. modelId, ARGV[i + 2])
+	end
+end
+return {1, newVersion, createdAt}
+`)
+	deleteModelsBySetIdsScript = NewNamedScript("delete_models_by_set_ids", -1, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- delete_models_by_set_ids is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of a set of model ids
+--		KEYS[2]) The key of the set of all ids for the collection (i.e. the index key)
+--		KEYS[3...]) The keys of the main hashes for the models, one for each id
+--			below
+--		ARGV[1...]) The ids in the set, which were read while the set was watched
+-- The script then deletes all the models corresponding to the given ids. It
+-- returns the number of models that were deleted. It does not delete the given
+-- set.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local setKey = KEYS[1]
+local indexKey = KEYS[2]
+local firstModelKey = 3
+local count = 0
+-- Iterate over the ids
+for i, id in ipairs(ARGV) do
+	-- Delete the main hash for each model
+	count = count + redis.call('DEL', KEYS[firstModelKey + i - 1])
+	-- Remove the model id from the set of all ids
+	-- NOTE: this is not necessarily the same as the
+	-- setKey we were given
+	redis.call('SREM', indexKey, id)
+end
+return count
+`)
+	deleteStringIndexScript = NewNamedScript("delete_string_index", 3, `-- Copyright 2015 Alex Browne.  All rights reserved.
 -- Use of this source code is governed by the MIT
 -- license, which can be found in the LICENSE file.
 
 -- delete_string_index is a lua script that takes the following arguments:
--- 	1) The name of a registered model
---		2) The id of the model to be deleted from the index
---		3) The name of the indexed string field
+-- 	KEYS[1]) The key of the main hash for the model
+--		KEYS[2]) The key of the sorted set for the string index
+--		KEYS[3]) The key of the hash of the values in the string indexes for the
+--			collection
+--		ARGV[1]) The id of the model to be deleted from the index
+--		ARGV[2]) The name of the indexed string field (as it is stored in Redis)
 -- The script then checks if there is a value for the given field name stored in the
--- model hash, and if there is, removes the model from the index on the given field.
+-- model hash, and if there is, removes the model from the index on the given field
+-- and forgets the value in the hash of string values.
 -- NOTE: This script *must* be called before the main hash for the model is updated/deleted.
 
 -- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
 
 -- Assign keys to variables for easy access
-local collectionName = ARGV[1]
-local modelId = ARGV[2]
-local fieldName = ARGV[3]
+local modelKey = KEYS[1]
+local indexKey = KEYS[2]
+local stringValuesKey = KEYS[3]
+local modelId = ARGV[1]
+local fieldName = ARGV[2]
 -- Get the old value from the existing model hash (if any)
-local modelKey = collectionName .. ":" .. modelId
 local oldValue = redis.call("HGET", modelKey, fieldName)
-local indexKey = collectionName .. ":" .. fieldName
 if oldValue ~= false then
 	-- Remove the model from the field index
 	local oldMember = oldValue .. "\0" .. modelId
 	redis.call("ZREM", indexKey, oldMember)
 end
+redis.call("HDEL", stringValuesKey, fieldName .. "\0" .. modelId)
 `)
-	extractIdsFromFieldIndexScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+	deleteUniqueValueScript = NewNamedScript("delete_unique_value", 3, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- delete_unique_value is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the main hash for the model
+--		KEYS[2]) The key of the hash which maps the values of a unique field to
+--			model ids
+--		KEYS[3]) The key of the hash of the values in the string indexes and the
+--			unique fields for the collection
+--		ARGV[1]) The id of the model
+--		ARGV[2]) The name of the unique field (as it is stored in Redis)
+-- The script checks if there is a value for the given field name stored in the
+-- model hash, and if there is and it belongs to the model, removes it from the
+-- hash of unique values so that other models can use it. It also removes the
+-- value from KEYS[3].
+-- NOTE: This script *must* be called before the main hash for the model is updated/deleted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local modelKey = KEYS[1]
+local uniqueKey = KEYS[2]
+local stringValuesKey = KEYS[3]
+local modelId = ARGV[1]
+local fieldName = ARGV[2]
+-- Get the old value from the existing model hash (if any)
+local oldValue = redis.call("HGET", modelKey, fieldName)
+if oldValue ~= false and redis.call("HGET", uniqueKey, oldValue) == modelId then
+	redis.call("HDEL", uniqueKey, oldValue)
+end
+redis.call("HDEL", stringValuesKey, fieldName .. "\0" .. modelId)
+`)
+	expireModelScript = NewNamedScript("expire_model", 2, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- expire_model is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the main hash for the model
+--		KEYS[2]) The key of the sorted set of expiration times for the collection
+--		ARGV[1]) The id of the model
+--		ARGV[2]) The expiration time as a Unix timestamp in milliseconds
+-- The script sets the expiration time of the main hash and, if it exists, adds
+-- the model id to the sorted set of expiration times so that the model can
+-- later be removed from the indexes. It returns 1 if the model exists and 0
+-- otherwise.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local modelKey = KEYS[1]
+local expirationsKey = KEYS[2]
+local modelId = ARGV[1]
+local expireAt = ARGV[2]
+if redis.call("PEXPIREAT", modelKey, expireAt) == 0 then
+	-- The model does not exist.
+	return 0
+end
+redis.call("ZADD", expirationsKey, expireAt, modelId)
+return 1
+`)
+	extractIdsFromFieldIndexScript = NewNamedScript("extract_ids_from_field_index", 2, `-- Copyright 2015 Alex Browne.  All rights reserved.
 -- Use of this source code is governed by the MIT
 -- license, which can be found in the LICENSE file.
 
 -- exctract_ids_from_field_index is a lua script that takes the following arguments:
--- 	1) setKey: The key of a sorted set for a field index (either numeric or bool)
--- 	2) destKey: The key of a sorted set where the resulting ids will be stored
---		3) min: The min argument for the ZRANGEBYSCORE command
--- 	4) max: The max argument for the ZRANGEBYSCORE command
+-- 	KEYS[1]) setKey: The key of a sorted set for a field index (either numeric or bool)
+-- 	KEYS[2]) destKey: The key of a sorted set where the resulting ids will be stored
+--		ARGV[1]) min: The min argument for the ZRANGEBYSCORE command
+-- 	ARGV[2]) max: The max argument for the ZRANGEBYSCORE command
 -- The script then calls ZRANGEBYSCORE on setKey with the given min and max arguments,
 -- and then stores the resulting set in destKey. It does not preserve the existing
 -- scores, and instead just replaces scores with sequential numbers to keep the members
@@ -95,10 +421,10 @@ end
 -- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
 
 -- Assign keys to variables for easy access
-local setKey = ARGV[1]
-local destKey = ARGV[2]
-local min = ARGV[3]
-local max = ARGV[4]
+local setKey = KEYS[1]
+local destKey = KEYS[2]
+local min = ARGV[1]
+local max = ARGV[2]
 -- Get all the members (value+id pairs) from the sorted set
 local members = redis.call('ZRANGEBYSCORE', setKey, min, max)
 -- Iterate over the members and add each to the destKey
@@ -106,27 +432,27 @@ for i, member in ipairs(members) do
 	redis.call('ZADD', destKey, i, member)
 end
 `)
-	extractIdsFromStringIndexScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+	extractIdsFromStringIndexScript = NewNamedScript("extract_ids_from_string_index", 2, `-- Copyright 2015 Alex Browne.  All rights reserved.
 -- Use of this source code is governed by the MIT
 -- license, which can be found in the LICENSE file.
 
 -- exctract_ids_from_string_index is a lua script that takes the following arguments:
--- 	1) setKey: The key of a sorted set for a string index, where each member is of the
+-- 	KEYS[1]) setKey: The key of a sorted set for a string index, where each member is of the
 --			form: value + NULL + id, where NULL is the ASCII NULL character which has a codepoint
 --			value of 0.
---		2) destKey: The key of a sorted set where the resulting ids will be stored
--- 	3) min: The min argument for the ZRANGEBYLEX command
--- 	4) max: The max argument for the ZRANGEBYLEX command
+--		KEYS[2]) destKey: The key of a sorted set where the resulting ids will be stored
+-- 	ARGV[1]) min: The min argument for the ZRANGEBYLEX command
+-- 	ARGV[2]) max: The max argument for the ZRANGEBYLEX command
 -- The script then extracts the ids from setKey using the given min and max arguments,
 -- and then stores them destKey with the appropriate scores in ascending order.
 
 -- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
 
 -- Assign keys to variables for easy access
-local setKey = ARGV[1]
-local destKey = ARGV[2]
-local min = ARGV[3]
-local max = ARGV[4]
+local setKey = KEYS[1]
+local destKey = KEYS[2]
+local min = ARGV[1]
+local max = ARGV[2]
 -- Get all the members (value+id pairs) from the sorted set
 local members = redis.call('ZRANGEBYLEX', setKey, min, max)
 if #members > 0 then
@@ -139,5 +465,590 @@ if #members > 0 then
 		redis.call('ZADD', destKey, i, id)
 	end
 end
+`)
+	findByScript = NewNamedScript("find_by", -1, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- find_by is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the hash which maps the values of a unique field to
+--			model ids
+--		KEYS[2]) The key of the set of ids of soft deleted models
+--		KEYS[3]) The key of the main hash of the model which had the value when it
+--			was looked up, or no key if no model had the value
+--		ARGV[1]) The value of the unique field (as it is stored in Redis)
+--		ARGV[2]) The id of the model which had the value when it was looked up, or
+--			an empty string if no model had the value
+--		ARGV[3] and up) The names of the fields to get (as they are stored in Redis)
+-- The script checks that the value still belongs to the model which was found
+-- when it was looked up, since the main hash of the model must be declared in
+-- KEYS. It returns 1 followed by the values of the given fields, in the same
+-- format as HMGET, if the model was found. It returns 0 if no model has the
+-- value, or if the model has expired or been soft deleted, and -1 if the value
+-- was given to another model after it was looked up.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local uniqueKey = KEYS[1]
+local deletedKey = KEYS[2]
+local value = ARGV[1]
+local modelId = ARGV[2]
+local owner = redis.call("HGET", uniqueKey, value) or ""
+if owner ~= modelId then
+	return {-1}
+end
+if #KEYS < 3 then
+	return {0}
+end
+local modelKey = KEYS[3]
+if redis.call("EXISTS", modelKey) == 0 or redis.call("SISMEMBER", deletedKey, modelId) == 1 then
+	return {0}
+end
+local result = {1}
+if #ARGV > 2 then
+	local fieldValues = redis.call("HMGET", modelKey, unpack(ARGV, 3))
+	for _, fieldValue in ipairs(fieldValues) do
+		table.insert(result, fieldValue)
+	end
+end
+return result
+`)
+	migrateModelScript = NewNamedScript("migrate_model", -1, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- migrate_model is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the main hash for the model
+--		KEYS[2]) The key of the hash of the values in the string indexes and the
+--			unique fields for the collection
+--		KEYS[3]) The key of the sorted set of expiration times for the collection
+--		KEYS[4...]) The keys of the indexes, one for each group of index arguments
+--			below: the key of the sorted set for the field index, or the key of the
+--			hash of values to ids for unique fields
+--		ARGV[1]) The id of the model
+--		ARGV[2]) The name of the version field (as it is stored in Redis), or an
+--			empty string if the model does not have one
+--		ARGV[3]) The number n of fields in the main hash which was migrated
+--		ARGV[4]) The number m of fields to delete from the main hash
+--		ARGV[5]) The number k of fields to set in the main hash
+--		ARGV[6]) The current time as a Unix timestamp in milliseconds
+--		ARGV[7] to ARGV[6+2n]) The names and values of the fields in the main hash
+--			which was migrated, in pairs
+--		The next m arguments are the names of the fields to delete
+--		The next 2k arguments are the names and values of the fields to set, in
+--			pairs
+--		The remaining arguments come in groups of three, one for each index on a
+--		field which is deleted or set:
+--			1) The kind of index: "score", "nullscore", "string", "nullstring",
+--				"unique" or "nullunique" (see update_field.lua)
+--			2) The name of the field (as it is stored in Redis)
+--			3) The score for "score" indexes or the value of the field for "string"
+--				and "unique" indexes
+-- The script checks that the main hash still holds exactly the fields which
+-- were migrated. If it does, it deletes and sets the fields, updates their
+-- indexes and increments the version (if any). It returns a status, which is 1
+-- if the model was migrated and 0 if the main hash has changed or no longer
+-- exists. If the new value of a unique field belongs to another model which
+-- still exists, the model is not migrated and the status is -2, followed by the
+-- name of the field and the id of the other model. The other model is treated
+-- as gone if its expiration time has passed, since its main hash may have
+-- expired before its values were released by SweepExpired.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local modelKey = KEYS[1]
+local stringValuesKey = KEYS[2]
+local expirationsKey = KEYS[3]
+local modelId = ARGV[1]
+local versionField = ARGV[2]
+local numOldFields = tonumber(ARGV[3])
+local numDeletes = tonumber(ARGV[4])
+local numSets = tonumber(ARGV[5])
+local now = tonumber(ARGV[6])
+local firstDeleteArg = 7 + 2 * numOldFields
+local firstSetArg = firstDeleteArg + numDeletes
+local firstIndexArg = firstSetArg + 2 * numSets
+local firstIndexKey = 4
+-- indexKeyFor returns the key for the group of index arguments which starts at
+-- ARGV[i]
+local function indexKeyFor(i)
+	return KEYS[firstIndexKey + (i - firstIndexArg) / 3]
+end
+-- Check the conditions before writing anything
+if redis.call("HLEN", modelKey) ~= numOldFields then
+	return {0}
+end
+for i = 7, firstDeleteArg - 1, 2 do
+	if redis.call("HGET", modelKey, ARGV[i]) ~= ARGV[i + 1] then
+		return {0}
+	end
+end
+-- ownerIsLive returns false iff the model with the given id was due to expire
+-- before now, in which case its unique values are free to be taken
+local function ownerIsLive(owner)
+	local ownerExpireAt = redis.call("ZSCORE", expirationsKey, owner)
+	return not ownerExpireAt or tonumber(ownerExpireAt) > now
+end
+for i = firstIndexArg, #ARGV, 3 do
+	if ARGV[i] == "unique" then
+		local owner = redis.call("HGET", indexKeyFor(i), ARGV[i + 2])
+		if owner and owner ~= modelId and ownerIsLive(owner) then
+			return {-2, ARGV[i + 1], owner}
+		end
+	end
+end
+-- Remove the old string indexes and unique values (if any). This must happen
+-- before the main hash is updated, because it relies on the old field values.
+for i = firstIndexArg, #ARGV, 3 do
+	local kind = ARGV[i]
+	if kind == "string" or kind == "nullstring" then
+		local oldValue = redis.call("HGET", modelKey, ARGV[i + 1])
+		if oldValue ~= false then
+			redis.call("ZREM", indexKeyFor(i), oldValue .. "\0" .. modelId)
+		end
+		redis.call("HDEL", stringValuesKey, ARGV[i + 1] .. "\0" .. modelId)
+	elseif kind == "unique" or kind == "nullunique" then
+		local oldValue = redis.call("HGET", modelKey, ARGV[i + 1])
+		if oldValue ~= false and redis.call("HGET", indexKeyFor(i), oldValue) == modelId then
+			redis.call("HDEL", indexKeyFor(i), oldValue)
+		end
+		redis.call("HDEL", stringValuesKey, ARGV[i + 1] .. "\0" .. modelId)
+	end
+end
+-- Update the main hash
+for i = firstDeleteArg, firstSetArg - 1 do
+	redis.call("HDEL", modelKey, ARGV[i])
+end
+if numSets > 0 then
+	local hashArgs = {}
+	for i = firstSetArg, firstIndexArg - 1 do
+		table.insert(hashArgs, ARGV[i])
+	end
+	redis.call("HMSET", modelKey, unpack(hashArgs))
+end
+if versionField ~= "" then
+	redis.call("HINCRBY", modelKey, versionField, 1)
+end
+-- Save the new field indexes
+for i = firstIndexArg, #ARGV, 3 do
+	local kind = ARGV[i]
+	if kind == "score" then
+		redis.call("ZADD", indexKeyFor(i), ARGV[i + 2], modelId)
+	elseif kind == "nullscore" then
+		redis.call("ZREM", indexKeyFor(i), modelId)
+	elseif kind == "string" then
+		redis.call("ZADD", indexKeyFor(i), 0, ARGV[i + 2] .. "\0" .. modelId)
+		redis.call("HSET", stringValuesKey, ARGV[i + 1] .. "\0" .. modelId, ARGV[i + 2])
+	elseif kind == "unique" then
+		redis.call("HSET", indexKeyFor(i), ARGV[i + 2], modelId)
+		redis.call("HSET", stringValuesKey, ARGV[i + 1] .. "\0" .. modelId, ARGV[i + 2])
+	end
+end
+return {1}
+`)
+	reindexModelScript = NewNamedScript("reindex_model", -1, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- reindex_model is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the main hash for the model
+--		KEYS[2]) The key of the hash of the values in the string indexes and the
+--			unique fields for the collection
+--		KEYS[3...]) The keys of the sorted sets for the field indexes or of the
+--			hashes of unique values, one for each group of arguments in ARGV
+--		ARGV[1]) The id of the model
+--		ARGV[2...]) Groups of 4 arguments for each field which should be
+--			reindexed:
+--			1) The kind of index: "score", "nullscore", "string", "nullstring"
+--				(see update_field.lua) or "unique"
+--			2) The name of the field (as it is stored in Redis)
+--			3) The value of the field which was read from the main hash
+--			4) The score for "score" indexes or the value of the field for
+--				"string" and "unique" indexes
+-- The script adds the model to the index on each field, but only if the value
+-- which is stored in the main hash is still the one which was read. Otherwise
+-- the model was saved in the meantime, which already updated the index. For
+-- unique fields, the value is only recorded in KEYS[2] if it belongs to the
+-- model. It returns the number of fields which were reindexed.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local modelKey = KEYS[1]
+local stringValuesKey = KEYS[2]
+local modelId = ARGV[1]
+local count = 0
+local nextIndexKey = 3
+for i = 2, #ARGV, 4 do
+	local indexKind = ARGV[i]
+	local indexKey = KEYS[nextIndexKey]
+	nextIndexKey = nextIndexKey + 1
+	local fieldName = ARGV[i+1]
+	local storedValue = ARGV[i+2]
+	local indexValue = ARGV[i+3]
+	if redis.call("HGET", modelKey, fieldName) == storedValue then
+		if indexKind == "score" then
+			redis.call("ZADD", indexKey, indexValue, modelId)
+		elseif indexKind == "nullscore" then
+			redis.call("ZREM", indexKey, modelId)
+		elseif indexKind == "string" then
+			redis.call("ZADD", indexKey, 0, indexValue .. "\0" .. modelId)
+			redis.call("HSET", stringValuesKey, fieldName .. "\0" .. modelId, indexValue)
+		elseif indexKind == "unique" and redis.call("HGET", indexKey, indexValue) == modelId then
+			redis.call("HSET", stringValuesKey, fieldName .. "\0" .. modelId, indexValue)
+		end
+		count = count + 1
+	end
+end
+return count
+`)
+	renewLockScript = NewNamedScript("renew_lock", 1, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- renew_lock is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the lock
+--		ARGV[1]) The token which was stored in the key when the lock was taken
+--		ARGV[2]) The new time to live of the lock in milliseconds, or 0 to release
+--			the lock
+-- The script renews or releases the lock, but only if it is still held with the
+-- given token, i.e. if it has not expired and been taken by someone else since.
+-- It returns 1 if the lock was renewed or released and 0 otherwise.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local lockKey = KEYS[1]
+local token = ARGV[1]
+local ttl = tonumber(ARGV[2])
+if redis.call("GET", lockKey) ~= token then
+	return 0
+end
+if ttl == 0 then
+	redis.call("DEL", lockKey)
+else
+	redis.call("PEXPIRE", lockKey, ttl)
+end
+return 1
+`)
+	restoreScript = NewNamedScript("restore", 3, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- restore is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the main hash for the model
+--		KEYS[2]) The key of the set of all ids for the collection (i.e. the index key)
+--		KEYS[3]) The key of the set of ids of soft deleted models
+--		ARGV[1]) The id of the model
+--		ARGV[2]) The name of the soft delete field (as it is stored in Redis)
+--		ARGV[3]) "1" if the id should be added to the index key, "0" otherwise
+-- The script undoes soft_delete. It clears the soft delete field of the model
+-- and moves the model id from the set of soft deleted ids back to the set of all
+-- ids. It returns 1 if the model was restored and 0 if it does not exist or has
+-- not been soft deleted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local modelKey = KEYS[1]
+local indexKey = KEYS[2]
+local deletedKey = KEYS[3]
+local modelId = ARGV[1]
+local fieldName = ARGV[2]
+local addToIndex = ARGV[3] == "1"
+if redis.call("SREM", deletedKey, modelId) == 0 or redis.call("EXISTS", modelKey) == 0 then
+	return 0
+end
+redis.call("HSET", modelKey, fieldName, 0)
+if addToIndex then
+	redis.call("SADD", indexKey, modelId)
+end
+return 1
+`)
+	softDeleteScript = NewNamedScript("soft_delete", 3, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- soft_delete is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the main hash for the model
+--		KEYS[2]) The key of the set of all ids for the collection (i.e. the index key)
+--		KEYS[3]) The key of the set of ids of soft deleted models
+--		ARGV[1]) The id of the model
+--		ARGV[2]) The name of the soft delete field (as it is stored in Redis)
+--		ARGV[3]) The time at which the model was deleted as a Unix timestamp in
+--			microseconds
+-- The script sets the soft delete field of the model and moves the model id from
+-- the set of all ids to the set of soft deleted ids. The field indexes are left
+-- alone so that the model can be restored. It returns 1 if the model was soft
+-- deleted and 0 if it does not exist or has already been soft deleted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local modelKey = KEYS[1]
+local indexKey = KEYS[2]
+local deletedKey = KEYS[3]
+local modelId = ARGV[1]
+local fieldName = ARGV[2]
+local deletedAt = ARGV[3]
+if redis.call("EXISTS", modelKey) == 0 or redis.call("SISMEMBER", deletedKey, modelId) == 1 then
+	return 0
+end
+redis.call("HSET", modelKey, fieldName, deletedAt)
+redis.call("SREM", indexKey, modelId)
+redis.call("SADD", deletedKey, modelId)
+return 1
+`)
+	sweepExpiredScript = NewNamedScript("sweep_expired", -1, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- sweep_expired is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the sorted set of expiration times for the collection
+--		KEYS[2]) The key of the set of all ids for the collection (i.e. the index key)
+--		KEYS[3]) The key of the set of ids of soft deleted models
+--		KEYS[4]) The key of the hash of the values in the string indexes and the
+--			unique fields for the collection
+--		The next n keys are the keys of the sorted sets for the field indexes or
+--			of the hashes of unique values, one for each pair of index arguments
+--			below
+--		The remaining keys are the keys of the main hashes for the models, one for
+--			each of the ids below
+--		ARGV[1]) The current time as a Unix timestamp in milliseconds
+--		ARGV[2]) The number n of field indexes
+--		ARGV[3] to ARGV[2+2n]) Pairs of arguments, one for each field index:
+--			1) The kind of index: "score" for numeric and boolean indexes, "string"
+--				for string indexes or "unique" for unique fields
+--			2) The name of the field (as it is stored in Redis)
+--		The remaining arguments are the ids of the models which were due to expire
+--			at or before the given time when they were read
+-- The script checks that each model is still due to expire. If the main hash
+-- for the model no longer exists, the script removes the model id from the set
+-- of all ids, the set of soft deleted ids and all the field indexes, and
+-- releases its unique values. The members of the string indexes and the unique
+-- values are found in KEYS[4], since the values of the fields are gone once the
+-- main hash has expired. If the main
+-- hash still exists, because it was saved again without an expiration time or
+-- its expiration time was extended, the model is either forgotten or
+-- rescheduled. It returns the number of models that were removed.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local expirationsKey = KEYS[1]
+local indexKey = KEYS[2]
+local deletedKey = KEYS[3]
+local stringValuesKey = KEYS[4]
+local now = tonumber(ARGV[1])
+local numIndexes = tonumber(ARGV[2])
+local firstIdArg = 3 + 2 * numIndexes
+local firstModelKey = 5 + numIndexes
+local count = 0
+for i = firstIdArg, #ARGV do
+	local id = ARGV[i]
+	local modelKey = KEYS[firstModelKey + i - firstIdArg]
+	local expireAt = redis.call("ZSCORE", expirationsKey, id)
+	if expireAt and tonumber(expireAt) <= now then
+		local ttl = redis.call("PTTL", modelKey)
+		if ttl == -2 then
+			-- The model has expired
+			count = count + 1
+			redis.call("ZREM", expirationsKey, id)
+			redis.call("SREM", indexKey, id)
+			redis.call("SREM", deletedKey, id)
+			-- The recorded values are only removed once every index has been
+			-- cleaned, since a field can be both string indexed and unique
+			local recorded = {}
+			for j = 1, numIndexes do
+				local fieldIndexKey = KEYS[4 + j]
+				local kind = ARGV[1 + 2 * j]
+				if kind == "score" then
+					redis.call("ZREM", fieldIndexKey, id)
+				else
+					local field = ARGV[2 + 2 * j] .. "\0" .. id
+					local value = redis.call("HGET", stringValuesKey, field)
+					if value then
+						if kind == "string" then
+							redis.call("ZREM", fieldIndexKey, value .. "\0" .. id)
+						elseif redis.call("HGET", fieldIndexKey, value) == id then
+							redis.call("HDEL", fieldIndexKey, value)
+						end
+						table.insert(recorded, field)
+					end
+				end
+			end
+			for _, field in ipairs(recorded) do
+				redis.call("HDEL", stringValuesKey, field)
+			end
+		elseif ttl == -1 then
+			-- The model no longer has an expiration time
+			redis.call("ZREM", expirationsKey, id)
+		else
+			-- The expiration time of the model was extended
+			redis.call("ZADD", expirationsKey, now + ttl, id)
+		end
+	end
+end
+return count
+`)
+	updateFieldScript = NewNamedScript("update_field", -1, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- update_field is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the main hash for the model
+--	KEYS[2]) The key of the set of ids of soft deleted models
+--		The remaining keys are optional and come in the following order:
+--			1) The key of the sorted set for the updated field index, if ARGV[9] is
+--				"1"
+--			2) The key of the sorted set for the field index, if ARGV[10] is not an
+--				empty string
+--			3) The key of the hash of the values in the string indexes and the
+--				unique fields for the collection, if ARGV[10] is "string" or
+--				"nullstring" or ARGV[12] is not an empty string
+--			4) The key of the hash which maps the values of the field to model ids,
+--				if ARGV[12] is not an empty string
+--			5) The key of the sorted set of expiration times for the collection, if
+--				ARGV[12] is not an empty string
+--		ARGV[1]) Either "increment", "incrementfloat", "set" or "compareandset"
+--		ARGV[2]) The id of the model
+--		ARGV[3]) The name of the field (as it is stored in Redis)
+--		ARGV[4]) The amount to increment the field by if ARGV[1] is "increment" or
+--			"incrementfloat", or the new value of the field otherwise
+--		ARGV[5]) The expected old value of the field if ARGV[1] is
+--			"compareandset", or an empty string otherwise
+--		ARGV[6]) The name of the version field (as it is stored in Redis), or an
+--			empty string if the model does not have one
+--		ARGV[7]) The name of the updated field (as it is stored in Redis), or an
+--			empty string if the model does not have one
+--		ARGV[8]) The current time as a Unix timestamp in microseconds, which is
+--			stored in the updated field
+--		ARGV[9]) "1" if the updated field is indexed, "0" otherwise
+--		ARGV[10]) The kind of index for the field: "score" for numeric and boolean
+--			indexes, "nullscore" for numeric and boolean indexes on fields which are
+--			nil, "string" for string indexes, "nullstring" for string indexes on
+--			fields which are nil or an empty string if the field is not indexed
+--		ARGV[11]) The score for "score" indexes (ignored for increments, which use
+--			the new value) or the value of the field for "string" indexes
+--		ARGV[12]) "unique" if the field is unique, "nullunique" if the field is
+--			unique and the new value is nil or an empty string otherwise. Unique
+--			fields cannot be incremented.
+-- The script updates a single field of the model and its field index, but only
+-- if the model exists and has not been soft deleted and, for "compareandset",
+-- the stored value of the field matches the expected old value. It also
+-- increments the version and sets the updated field (if any). It returns a
+-- status and the new value of the field. The status is 1 if the field was
+-- updated, 0 if the model does not exist or has been soft deleted and -1 if the
+-- stored value did not match the expected old value. If the new value of a
+-- unique field belongs to another model which still exists, the field is not
+-- updated and the status is -2, followed by the id of the other model. The
+-- other model is treated as gone if its expiration time has passed, since its
+-- main hash may have expired before its values were released by SweepExpired.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local modelKey = KEYS[1]
+local deletedKey = KEYS[2]
+local mode = ARGV[1]
+local modelId = ARGV[2]
+local fieldName = ARGV[3]
+local value = ARGV[4]
+local oldValue = ARGV[5]
+local versionField = ARGV[6]
+local updatedField = ARGV[7]
+local now = ARGV[8]
+local indexKind = ARGV[10]
+local indexValue = ARGV[11]
+local uniqueKind = ARGV[12]
+local nextKey = 3
+local updatedIndexKey = false
+if ARGV[9] == "1" then
+	updatedIndexKey = KEYS[nextKey]
+	nextKey = nextKey + 1
+end
+local indexKey = false
+if indexKind ~= "" then
+	indexKey = KEYS[nextKey]
+	nextKey = nextKey + 1
+end
+local stringValuesKey = false
+if indexKind == "string" or indexKind == "nullstring" or uniqueKind ~= "" then
+	stringValuesKey = KEYS[nextKey]
+	nextKey = nextKey + 1
+end
+local uniqueKey = false
+local expirationsKey = false
+if uniqueKind ~= "" then
+	uniqueKey = KEYS[nextKey]
+	expirationsKey = KEYS[nextKey + 1]
+end
+-- Check the conditions before writing anything
+if redis.call("EXISTS", modelKey) == 0 or redis.call("SISMEMBER", deletedKey, modelId) == 1 then
+	return {0, ""}
+end
+local storedValue = redis.call("HGET", modelKey, fieldName)
+if mode == "compareandset" and storedValue ~= oldValue then
+	return {-1, storedValue or ""}
+end
+if uniqueKind == "unique" then
+	local owner = redis.call("HGET", uniqueKey, value)
+	if owner and owner ~= modelId then
+		local ownerExpireAt = redis.call("ZSCORE", expirationsKey, owner)
+		if not ownerExpireAt or tonumber(ownerExpireAt) * 1000 > tonumber(now) then
+			return {-2, owner}
+		end
+	end
+end
+-- Remove the old string index and unique value (if any). This must happen
+-- before the main hash is updated, because it relies on the old field value.
+if indexKind == "string" or indexKind == "nullstring" then
+	if storedValue ~= false then
+		redis.call("ZREM", indexKey, storedValue .. "\0" .. modelId)
+	end
+end
+if uniqueKind ~= "" and storedValue ~= false and redis.call("HGET", uniqueKey, storedValue) == modelId then
+	redis.call("HDEL", uniqueKey, storedValue)
+end
+if stringValuesKey then
+	redis.call("HDEL", stringValuesKey, fieldName .. "\0" .. modelId)
+end
+-- Update the field in the main hash
+local newValue = value
+if mode == "increment" then
+	newValue = redis.call("HINCRBY", modelKey, fieldName, value)
+elseif mode == "incrementfloat" then
+	newValue = redis.call("HINCRBYFLOAT", modelKey, fieldName, value)
+else
+	redis.call("HSET", modelKey, fieldName, value)
+end
+if versionField ~= "" then
+	redis.call("HINCRBY", modelKey, versionField, 1)
+end
+if updatedField ~= "" then
+	redis.call("HSET", modelKey, updatedField, now)
+	if updatedIndexKey then
+		redis.call("ZADD", updatedIndexKey, now, modelId)
+	end
+end
+-- Save the new field index (if any)
+if indexKind == "score" then
+	if mode == "increment" or mode == "incrementfloat" then
+		indexValue = newValue
+	end
+	redis.call("ZADD", indexKey, indexValue, modelId)
+elseif indexKind == "nullscore" then
+	redis.call("ZREM", indexKey, modelId)
+elseif indexKind == "string" then
+	redis.call("ZADD", indexKey, 0, indexValue .. "\0" .. modelId)
+	redis.call("HSET", stringValuesKey, fieldName .. "\0" .. modelId, indexValue)
+end
+if uniqueKind == "unique" then
+	redis.call("HSET", uniqueKey, value, modelId)
+	redis.call("HSET", stringValuesKey, fieldName .. "\0" .. modelId, value)
+end
+return {1, newValue}
 `)
 )
\ No newline at end of file
@@ -0,0 +1,26 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- add_model_ids is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of a set of model ids
+--		KEYS[2...]) The keys which may be the main hashes of models, one for each id
+--			below
+--		ARGV[1...]) The ids of the models which may exist
+-- The script adds the ids for which the main hash of a model exists to the
+-- set. It is used to filter the keys found with SCAN, which may include keys
+-- other than the main hashes of the models (e.g. the field indexes). It returns
+-- the number of ids that were added to the set.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local setKey = KEYS[1]
+local firstModelKey = 2
+local count = 0
+for i, id in ipairs(ARGV) do
+	if redis.call('TYPE', KEYS[firstModelKey + i - 1])['ok'] == 'hash' then
+		count = count + redis.call('SADD', setKey, id)
+	end
+end
+return count
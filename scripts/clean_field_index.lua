@@ -0,0 +1,60 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- clean_field_index is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the sorted set for the field index
+--		KEYS[2]) The key of the hash of the values in the string indexes for the
+--			collection
+--		KEYS[3...]) The keys of the main hashes for the models, one for each of the
+--			members in ARGV. For members of a string index which do not contain an
+--			id, the key is ignored.
+--		ARGV[1]) The kind of index: "score" for numeric and boolean indexes or
+--			"string" for string indexes
+--		ARGV[2]) The name of the field (as it is stored in Redis)
+--		ARGV[3]) "NULL" if the field is a pointer, in which case that value means
+--			the field is nil, or an empty string otherwise
+--		ARGV[4...]) The members of the index which should be checked
+-- The script removes the members which do not belong in the index, i.e. the ones
+-- for which the model does not exist, the field is missing or nil or, for string
+-- indexes, the value in the member is not the value of the field. The values of
+-- the removed members are also removed from the hash of string values. It
+-- returns the number of members which were removed.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local indexKey = KEYS[1]
+local stringValuesKey = KEYS[2]
+local indexKind = ARGV[1]
+local fieldName = ARGV[2]
+local nullValue = ARGV[3]
+local count = 0
+for i = 4, #ARGV do
+	local member = ARGV[i]
+	local modelKey = KEYS[i - 1]
+	local indexedValue = false
+	local stringValueField = false
+	if indexKind == "string" then
+		-- The member consists of the value and the id separated by a NULL
+		-- character. Members without one were not written by a string index.
+		local idStart = string.find(member, "%z[^%z]*$")
+		if idStart then
+			indexedValue = string.sub(member, 1, idStart - 1)
+			stringValueField = fieldName .. "\0" .. string.sub(member, idStart + 1)
+		else
+			modelKey = false
+		end
+	end
+	local value = false
+	if modelKey then
+		value = redis.call("HGET", modelKey, fieldName)
+	end
+	if value == false or (nullValue ~= "" and value == nullValue) or (indexKind == "string" and value ~= indexedValue) then
+		count = count + redis.call("ZREM", indexKey, member)
+		if stringValueField and redis.call("HGET", stringValuesKey, stringValueField) == indexedValue then
+			redis.call("HDEL", stringValuesKey, stringValueField)
+		end
+	end
+end
+return count
@@ -0,0 +1,177 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- conditional_save is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the main hash for the model
+--		KEYS[2]) The key of the set of all ids for the collection (i.e. the index key)
+--		KEYS[3]) The key of the sorted set of expiration times for the collection
+--		KEYS[4]) The key of the set of ids of soft deleted models
+--		KEYS[5]) The key of the hash of the values in the string indexes and the
+--			unique fields for the collection
+--		KEYS[6]) The key of the sorted set for the created field index, if ARGV[9]
+--			is "1"
+--		The remaining keys are the keys of the field indexes, one for each group
+--			of index arguments below: the key of the sorted set for the field index,
+--			or the key of the hash of values to ids for unique fields
+--		ARGV[1]) Either "save", "create" or "update". If "create", the model is only
+--			saved if the main hash does not exist. If "update", the model is only
+--			saved if the main hash exists.
+--		ARGV[2]) The id of the model
+--		ARGV[3]) "1" if the id should be added to the index key, "0" otherwise. The
+--			id is never added if the model has been soft deleted.
+--		ARGV[4]) The name of the version field (as it is stored in Redis), or an
+--			empty string if the model does not have one
+--		ARGV[5]) The expected version, i.e. the version the model had when it was
+--			found (a missing version is treated as 0)
+--		ARGV[6]) The time at which the model should expire as a Unix timestamp in
+--			milliseconds, or "0" if the expiration time should not be changed
+--		ARGV[7]) The name of the created field (as it is stored in Redis), or an
+--			empty string if the model does not have one
+--		ARGV[8]) The current time as a Unix timestamp in microseconds, which is
+--			used as the created time if the model does not already have one
+--		ARGV[9]) "1" if the created field is indexed, in which case the key of the
+--			sorted set for the created field index is KEYS[6], "0" otherwise
+--		ARGV[10]) The number n of fields to save in the main hash
+--		ARGV[11] to ARGV[10+2n]) The names and values of the fields, in pairs
+--		The remaining arguments come in groups of three, one for each field index:
+--			1) The kind of index: "score" for numeric and boolean indexes, "string"
+--				for string indexes, "nullstring" for string indexes on fields which
+--				are nil, "unique" for unique fields or "nullunique" for unique fields
+--				which are nil
+--			2) The name of the field (as it is stored in Redis)
+--			3) The score for "score" indexes or the value of the field for "string"
+--				and "unique" indexes
+-- The script checks whether the model exists and whether the stored version
+-- matches the expected version. If both conditions are met, it saves the model
+-- and its field indexes in the same way as Transaction.Save, increments the
+-- version, sets the created time if it is not already set and sets the
+-- expiration time (if any). It returns a status, a version and a created time.
+-- The status is 1 if the model was saved (in which case the version is the new
+-- version and the created time is the stored created time, or 0 if the model
+-- does not have a created field), 0 if it was not saved because it existed (or
+-- did not exist) and -1 if it was not saved because the stored version did not
+-- match (in which case the version is the stored version). If the value of a
+-- unique field belongs to another model which still exists, the model is not
+-- saved and the status is -2, followed by the name of the field and the id of
+-- the other model. The other model is treated as gone if its expiration time in
+-- KEYS[3] has passed, since its main hash may have expired before its values
+-- were released by SweepExpired.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local modelKey = KEYS[1]
+local indexKey = KEYS[2]
+local expirationsKey = KEYS[3]
+local deletedKey = KEYS[4]
+local stringValuesKey = KEYS[5]
+local mode = ARGV[1]
+local modelId = ARGV[2]
+local addToIndex = ARGV[3] == "1"
+local versionField = ARGV[4]
+local expectedVersion = tonumber(ARGV[5])
+local expireAt = ARGV[6]
+local createdField = ARGV[7]
+local now = ARGV[8]
+local numFields = tonumber(ARGV[10])
+local createdIndexKey = false
+-- The index of the key for the first group of index arguments
+local firstIndexKey = 6
+if ARGV[9] == "1" then
+	createdIndexKey = KEYS[6]
+	firstIndexKey = 7
+end
+-- Check the conditions before writing anything
+local exists = redis.call("EXISTS", modelKey) == 1
+if (mode == "create" and exists) or (mode == "update" and not exists) then
+	return {0, 0, 0}
+end
+local newVersion = 0
+if versionField ~= "" then
+	local actualVersion = tonumber(redis.call("HGET", modelKey, versionField) or "0")
+	if actualVersion ~= expectedVersion then
+		return {-1, actualVersion, 0}
+	end
+	newVersion = actualVersion + 1
+end
+local firstIndexArg = 11 + 2 * numFields
+-- indexKeyFor returns the key for the group of index arguments which starts at
+-- ARGV[i]
+local function indexKeyFor(i)
+	return KEYS[firstIndexKey + (i - firstIndexArg) / 3]
+end
+-- ownerIsLive returns false iff the model with the given id was due to expire
+-- before now, in which case its unique values are free to be taken
+local function ownerIsLive(owner)
+	local ownerExpireAt = redis.call("ZSCORE", expirationsKey, owner)
+	return not ownerExpireAt or tonumber(ownerExpireAt) * 1000 > tonumber(now)
+end
+for i = firstIndexArg, #ARGV, 3 do
+	if ARGV[i] == "unique" then
+		local owner = redis.call("HGET", indexKeyFor(i), ARGV[i + 2])
+		if owner and owner ~= modelId and ownerIsLive(owner) then
+			return {-2, 0, 0, ARGV[i + 1], owner}
+		end
+	end
+end
+-- Remove the old string indexes and unique values (if any). This must happen
+-- before the main hash is updated, because it relies on the old field values.
+for i = firstIndexArg, #ARGV, 3 do
+	local kind = ARGV[i]
+	if kind == "string" or kind == "nullstring" then
+		local oldValue = redis.call("HGET", modelKey, ARGV[i + 1])
+		if oldValue ~= false then
+			redis.call("ZREM", indexKeyFor(i), oldValue .. "\0" .. modelId)
+		end
+		redis.call("HDEL", stringValuesKey, ARGV[i + 1] .. "\0" .. modelId)
+	elseif kind == "unique" or kind == "nullunique" then
+		local oldValue = redis.call("HGET", modelKey, ARGV[i + 1])
+		if oldValue ~= false and redis.call("HGET", indexKeyFor(i), oldValue) == modelId then
+			redis.call("HDEL", indexKeyFor(i), oldValue)
+		end
+		redis.call("HDEL", stringValuesKey, ARGV[i + 1] .. "\0" .. modelId)
+	end
+end
+-- Save the fields in the main hash
+if numFields > 0 then
+	local hashArgs = {}
+	for i = 11, 10 + 2 * numFields do
+		table.insert(hashArgs, ARGV[i])
+	end
+	redis.call("HMSET", modelKey, unpack(hashArgs))
+end
+if versionField ~= "" then
+	redis.call("HSET", modelKey, versionField, newVersion)
+end
+local createdAt = 0
+if createdField ~= "" then
+	redis.call("HSETNX", modelKey, createdField, now)
+	createdAt = redis.call("HGET", modelKey, createdField)
+	if createdIndexKey then
+		redis.call("ZADD", createdIndexKey, createdAt, modelId)
+	end
+end
+if addToIndex and redis.call("SISMEMBER", deletedKey, modelId) == 0 then
+	redis.call("SADD", indexKey, modelId)
+end
+if expireAt ~= "0" and redis.call("PEXPIREAT", modelKey, expireAt) == 1 then
+	redis.call("ZADD", expirationsKey, expireAt, modelId)
+elseif not exists then
+	-- A model with the same id may have expired, but this one does not expire
+	redis.call("ZREM", expirationsKey, modelId)
+end
+-- Save the new field indexes
+for i = firstIndexArg, #ARGV, 3 do
+	local kind = ARGV[i]
+	if kind == "score" then
+		redis.call("ZADD", indexKeyFor(i), ARGV[i + 2], modelId)
+	elseif kind == "string" then
+		redis.call("ZADD", indexKeyFor(i), 0, ARGV[i + 2] .. "\0" .. modelId)
+		redis.call("HSET", stringValuesKey, ARGV[i + 1] .. "\0" .. modelId, ARGV[i + 2])
+	elseif kind == "unique" then
+		redis.call("HSET", indexKeyFor(i), ARGV[i + 2], modelId)
+		redis.call("HSET", stringValuesKey, ARGV[i + 1] .. "\0" .. modelId, ARGV[i + 2])
+	end
+end
+return {1, newVersion, createdAt}
@@ -3,31 +3,29 @@
 -- license, which can be found in the LICENSE file.
 
 -- delete_models_by_set_ids is a lua script that takes the following arguments:
--- 	1) The key of a set of model ids
---		2) The name of a registered model
--- The script then deletes all the models corresponding to the ids in the given
--- set. It returns the number of models that were deleted. It does not delete the
--- given set.
+-- 	KEYS[1]) The key of a set of model ids
+--		KEYS[2]) The key of the set of all ids for the collection (i.e. the index key)
+--		KEYS[3...]) The keys of the main hashes for the models, one for each id
+--			below
+--		ARGV[1...]) The ids in the set, which were read while the set was watched
+-- The script then deletes all the models corresponding to the given ids. It
+-- returns the number of models that were deleted. It does not delete the given
+-- set.
 
 -- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
 
 -- Assign keys to variables for easy access
-local setKey = ARGV[1]
-local collectionName = ARGV[2]
--- Get all the ids from the set name
-local ids = redis.call('SMEMBERS', setKey)
+local setKey = KEYS[1]
+local indexKey = KEYS[2]
+local firstModelKey = 3
 local count = 0
-if #ids > 0 then
-	-- Iterate over the ids
-	for i, id in ipairs(ids) do
-		-- Delete the main hash for each model
-		local key = collectionName .. ':' .. id
-		count = count + redis.call('DEL', key)
-		-- Remove the model id from the set of all ids
-		-- NOTE: this is not necessarily the same as the
-		-- setName we were given
-		local setKey = collectionName .. ':all'
-		redis.call('SREM', setKey, id)
-	end
+-- Iterate over the ids
+for i, id in ipairs(ARGV) do
+	-- Delete the main hash for each model
+	count = count + redis.call('DEL', KEYS[firstModelKey + i - 1])
+	-- Remove the model id from the set of all ids
+	-- NOTE: this is not necessarily the same as the
+	-- setKey we were given
+	redis.call('SREM', indexKey, id)
 end
 return count
@@ -0,0 +1,32 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- delete_unique_value is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the main hash for the model
+--		KEYS[2]) The key of the hash which maps the values of a unique field to
+--			model ids
+--		KEYS[3]) The key of the hash of the values in the string indexes and the
+--			unique fields for the collection
+--		ARGV[1]) The id of the model
+--		ARGV[2]) The name of the unique field (as it is stored in Redis)
+-- The script checks if there is a value for the given field name stored in the
+-- model hash, and if there is and it belongs to the model, removes it from the
+-- hash of unique values so that other models can use it. It also removes the
+-- value from KEYS[3].
+-- NOTE: This script *must* be called before the main hash for the model is updated/deleted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local modelKey = KEYS[1]
+local uniqueKey = KEYS[2]
+local stringValuesKey = KEYS[3]
+local modelId = ARGV[1]
+local fieldName = ARGV[2]
+-- Get the old value from the existing model hash (if any)
+local oldValue = redis.call("HGET", modelKey, fieldName)
+if oldValue ~= false and redis.call("HGET", uniqueKey, oldValue) == modelId then
+	redis.call("HDEL", uniqueKey, oldValue)
+end
+redis.call("HDEL", stringValuesKey, fieldName .. "\0" .. modelId)
@@ -0,0 +1,27 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- expire_model is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the main hash for the model
+--		KEYS[2]) The key of the sorted set of expiration times for the collection
+--		ARGV[1]) The id of the model
+--		ARGV[2]) The expiration time as a Unix timestamp in milliseconds
+-- The script sets the expiration time of the main hash and, if it exists, adds
+-- the model id to the sorted set of expiration times so that the model can
+-- later be removed from the indexes. It returns 1 if the model exists and 0
+-- otherwise.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local modelKey = KEYS[1]
+local expirationsKey = KEYS[2]
+local modelId = ARGV[1]
+local expireAt = ARGV[2]
+if redis.call("PEXPIREAT", modelKey, expireAt) == 0 then
+	-- The model does not exist.
+	return 0
+end
+redis.call("ZADD", expirationsKey, expireAt, modelId)
+return 1
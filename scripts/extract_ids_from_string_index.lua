@@ -3,22 +3,22 @@
 -- license, which can be found in the LICENSE file.
 
 -- exctract_ids_from_string_index is a lua script that takes the following arguments:
--- 	1) setKey: The key of a sorted set for a string index, where each member is of the
+-- 	KEYS[1]) setKey: The key of a sorted set for a string index, where each member is of the
 --			form: value + NULL + id, where NULL is the ASCII NULL character which has a codepoint
 --			value of 0.
---		2) destKey: The key of a sorted set where the resulting ids will be stored
--- 	3) min: The min argument for the ZRANGEBYLEX command
--- 	4) max: The max argument for the ZRANGEBYLEX command
+--		KEYS[2]) destKey: The key of a sorted set where the resulting ids will be stored
+-- 	ARGV[1]) min: The min argument for the ZRANGEBYLEX command
+-- 	ARGV[2]) max: The max argument for the ZRANGEBYLEX command
 -- The script then extracts the ids from setKey using the given min and max arguments,
 -- and then stores them destKey with the appropriate scores in ascending order.
 
 -- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
 
 -- Assign keys to variables for easy access
-local setKey = ARGV[1]
-local destKey = ARGV[2]
-local min = ARGV[3]
-local max = ARGV[4]
+local setKey = KEYS[1]
+local destKey = KEYS[2]
+local min = ARGV[1]
+local max = ARGV[2]
 -- Get all the members (value+id pairs) from the sorted set
 local members = redis.call('ZRANGEBYLEX', setKey, min, max)
 if #members > 0 then
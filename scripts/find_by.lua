@@ -0,0 +1,47 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- find_by is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the hash which maps the values of a unique field to
+--			model ids
+--		KEYS[2]) The key of the set of ids of soft deleted models
+--		KEYS[3]) The key of the main hash of the model which had the value when it
+--			was looked up, or no key if no model had the value
+--		ARGV[1]) The value of the unique field (as it is stored in Redis)
+--		ARGV[2]) The id of the model which had the value when it was looked up, or
+--			an empty string if no model had the value
+--		ARGV[3] and up) The names of the fields to get (as they are stored in Redis)
+-- The script checks that the value still belongs to the model which was found
+-- when it was looked up, since the main hash of the model must be declared in
+-- KEYS. It returns 1 followed by the values of the given fields, in the same
+-- format as HMGET, if the model was found. It returns 0 if no model has the
+-- value, or if the model has expired or been soft deleted, and -1 if the value
+-- was given to another model after it was looked up.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local uniqueKey = KEYS[1]
+local deletedKey = KEYS[2]
+local value = ARGV[1]
+local modelId = ARGV[2]
+local owner = redis.call("HGET", uniqueKey, value) or ""
+if owner ~= modelId then
+	return {-1}
+end
+if #KEYS < 3 then
+	return {0}
+end
+local modelKey = KEYS[3]
+if redis.call("EXISTS", modelKey) == 0 or redis.call("SISMEMBER", deletedKey, modelId) == 1 then
+	return {0}
+end
+local result = {1}
+if #ARGV > 2 then
+	local fieldValues = redis.call("HMGET", modelKey, unpack(ARGV, 3))
+	for _, fieldValue in ipairs(fieldValues) do
+		table.insert(result, fieldValue)
+	end
+end
+return result
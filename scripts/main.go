@@ -15,6 +15,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"text/template"
 )
@@ -32,10 +34,25 @@ var (
 type script struct {
 	// VarName is the variable name that the script will be assigned to in the generated go code.
 	VarName string
+	// Name is the name of the script, i.e. the name of the file without the
+	// .lua extension.
+	Name string
 	// Src is the contents of the original .lua file.
 	Src string
+	// KeyCount is the number of keys the script expects. It is the highest n
+	// for which KEYS[n] appears in Src, or -1 if the number of keys varies,
+	// i.e. if KEYS is indexed with a variable or its length is used.
+	KeyCount int
 }
 
+// keysRegexp matches any usage of the KEYS table in a lua script and captures
+// the index.
+var keysRegexp = regexp.MustCompile(`KEYS\[(\d+)\]`)
+
+// variableKeysRegexp matches any usage of the KEYS table in a lua script which
+// means that the number of keys varies.
+var variableKeysRegexp = regexp.MustCompile(`#KEYS|KEYS\[[^\]\d]`)
+
 func init() {
 	// Use build to find the directory where this file lives. This always works as
 	// long as you have go installed, even if you have multiple GOPATHs or are using
@@ -70,19 +87,42 @@ func findScripts(path string) ([]script, error) {
 	}
 	scripts := []script{}
 	for _, filename := range filenames {
+		name := strings.TrimSuffix(filepath.Base(filename), ".lua")
 		script := script{
-			VarName: convertUnderscoresToCamelCase(strings.TrimSuffix(filepath.Base(filename), ".lua")) + "Script",
+			VarName: convertUnderscoresToCamelCase(name) + "Script",
+			Name:    name,
 		}
 		src, err := ioutil.ReadFile(filename)
 		if err != nil {
 			return nil, err
 		}
 		script.Src = string(src)
+		script.KeyCount = countKeys(script.Src)
 		scripts = append(scripts, script)
 	}
 	return scripts, nil
 }
 
+// countKeys returns the number of keys expected by the lua script src, i.e.
+// the highest n for which KEYS[n] appears in src, or -1 if the number of keys
+// varies.
+func countKeys(src string) int {
+	if variableKeysRegexp.MatchString(src) {
+		return -1
+	}
+	count := 0
+	for _, match := range keysRegexp.FindAllStringSubmatch(src, -1) {
+		n, err := strconv.Atoi(match[1])
+		if err != nil {
+			panic(err)
+		}
+		if n > count {
+			count = n
+		}
+	}
+	return count
+}
+
 // convertUnderscoresToCamelCase converts a string of the form
 // foo_bar_baz to fooBarBaz.
 func convertUnderscoresToCamelCase(s string) string {
@@ -0,0 +1,133 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- migrate_model is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the main hash for the model
+--		KEYS[2]) The key of the hash of the values in the string indexes and the
+--			unique fields for the collection
+--		KEYS[3]) The key of the sorted set of expiration times for the collection
+--		KEYS[4...]) The keys of the indexes, one for each group of index arguments
+--			below: the key of the sorted set for the field index, or the key of the
+--			hash of values to ids for unique fields
+--		ARGV[1]) The id of the model
+--		ARGV[2]) The name of the version field (as it is stored in Redis), or an
+--			empty string if the model does not have one
+--		ARGV[3]) The number n of fields in the main hash which was migrated
+--		ARGV[4]) The number m of fields to delete from the main hash
+--		ARGV[5]) The number k of fields to set in the main hash
+--		ARGV[6]) The current time as a Unix timestamp in milliseconds
+--		ARGV[7] to ARGV[6+2n]) The names and values of the fields in the main hash
+--			which was migrated, in pairs
+--		The next m arguments are the names of the fields to delete
+--		The next 2k arguments are the names and values of the fields to set, in
+--			pairs
+--		The remaining arguments come in groups of three, one for each index on a
+--		field which is deleted or set:
+--			1) The kind of index: "score", "nullscore", "string", "nullstring",
+--				"unique" or "nullunique" (see update_field.lua)
+--			2) The name of the field (as it is stored in Redis)
+--			3) The score for "score" indexes or the value of the field for "string"
+--				and "unique" indexes
+-- The script checks that the main hash still holds exactly the fields which
+-- were migrated. If it does, it deletes and sets the fields, updates their
+-- indexes and increments the version (if any). It returns a status, which is 1
+-- if the model was migrated and 0 if the main hash has changed or no longer
+-- exists. If the new value of a unique field belongs to another model which
+-- still exists, the model is not migrated and the status is -2, followed by the
+-- name of the field and the id of the other model. The other model is treated
+-- as gone if its expiration time has passed, since its main hash may have
+-- expired before its values were released by SweepExpired.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local modelKey = KEYS[1]
+local stringValuesKey = KEYS[2]
+local expirationsKey = KEYS[3]
+local modelId = ARGV[1]
+local versionField = ARGV[2]
+local numOldFields = tonumber(ARGV[3])
+local numDeletes = tonumber(ARGV[4])
+local numSets = tonumber(ARGV[5])
+local now = tonumber(ARGV[6])
+local firstDeleteArg = 7 + 2 * numOldFields
+local firstSetArg = firstDeleteArg + numDeletes
+local firstIndexArg = firstSetArg + 2 * numSets
+local firstIndexKey = 4
+-- indexKeyFor returns the key for the group of index arguments which starts at
+-- ARGV[i]
+local function indexKeyFor(i)
+	return KEYS[firstIndexKey + (i - firstIndexArg) / 3]
+end
+-- Check the conditions before writing anything
+if redis.call("HLEN", modelKey) ~= numOldFields then
+	return {0}
+end
+for i = 7, firstDeleteArg - 1, 2 do
+	if redis.call("HGET", modelKey, ARGV[i]) ~= ARGV[i + 1] then
+		return {0}
+	end
+end
+-- ownerIsLive returns false iff the model with the given id was due to expire
+-- before now, in which case its unique values are free to be taken
+local function ownerIsLive(owner)
+	local ownerExpireAt = redis.call("ZSCORE", expirationsKey, owner)
+	return not ownerExpireAt or tonumber(ownerExpireAt) > now
+end
+for i = firstIndexArg, #ARGV, 3 do
+	if ARGV[i] == "unique" then
+		local owner = redis.call("HGET", indexKeyFor(i), ARGV[i + 2])
+		if owner and owner ~= modelId and ownerIsLive(owner) then
+			return {-2, ARGV[i + 1], owner}
+		end
+	end
+end
+-- Remove the old string indexes and unique values (if any). This must happen
+-- before the main hash is updated, because it relies on the old field values.
+for i = firstIndexArg, #ARGV, 3 do
+	local kind = ARGV[i]
+	if kind == "string" or kind == "nullstring" then
+		local oldValue = redis.call("HGET", modelKey, ARGV[i + 1])
+		if oldValue ~= false then
+			redis.call("ZREM", indexKeyFor(i), oldValue .. "\0" .. modelId)
+		end
+		redis.call("HDEL", stringValuesKey, ARGV[i + 1] .. "\0" .. modelId)
+	elseif kind == "unique" or kind == "nullunique" then
+		local oldValue = redis.call("HGET", modelKey, ARGV[i + 1])
+		if oldValue ~= false and redis.call("HGET", indexKeyFor(i), oldValue) == modelId then
+			redis.call("HDEL", indexKeyFor(i), oldValue)
+		end
+		redis.call("HDEL", stringValuesKey, ARGV[i + 1] .. "\0" .. modelId)
+	end
+end
+-- Update the main hash
+for i = firstDeleteArg, firstSetArg - 1 do
+	redis.call("HDEL", modelKey, ARGV[i])
+end
+if numSets > 0 then
+	local hashArgs = {}
+	for i = firstSetArg, firstIndexArg - 1 do
+		table.insert(hashArgs, ARGV[i])
+	end
+	redis.call("HMSET", modelKey, unpack(hashArgs))
+end
+if versionField ~= "" then
+	redis.call("HINCRBY", modelKey, versionField, 1)
+end
+-- Save the new field indexes
+for i = firstIndexArg, #ARGV, 3 do
+	local kind = ARGV[i]
+	if kind == "score" then
+		redis.call("ZADD", indexKeyFor(i), ARGV[i + 2], modelId)
+	elseif kind == "nullscore" then
+		redis.call("ZREM", indexKeyFor(i), modelId)
+	elseif kind == "string" then
+		redis.call("ZADD", indexKeyFor(i), 0, ARGV[i + 2] .. "\0" .. modelId)
+		redis.call("HSET", stringValuesKey, ARGV[i + 1] .. "\0" .. modelId, ARGV[i + 2])
+	elseif kind == "unique" then
+		redis.call("HSET", indexKeyFor(i), ARGV[i + 2], modelId)
+		redis.call("HSET", stringValuesKey, ARGV[i + 1] .. "\0" .. modelId, ARGV[i + 2])
+	end
+end
+return {1}
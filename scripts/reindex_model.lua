@@ -0,0 +1,55 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- reindex_model is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the main hash for the model
+--		KEYS[2]) The key of the hash of the values in the string indexes and the
+--			unique fields for the collection
+--		KEYS[3...]) The keys of the sorted sets for the field indexes or of the
+--			hashes of unique values, one for each group of arguments in ARGV
+--		ARGV[1]) The id of the model
+--		ARGV[2...]) Groups of 4 arguments for each field which should be
+--			reindexed:
+--			1) The kind of index: "score", "nullscore", "string", "nullstring"
+--				(see update_field.lua) or "unique"
+--			2) The name of the field (as it is stored in Redis)
+--			3) The value of the field which was read from the main hash
+--			4) The score for "score" indexes or the value of the field for
+--				"string" and "unique" indexes
+-- The script adds the model to the index on each field, but only if the value
+-- which is stored in the main hash is still the one which was read. Otherwise
+-- the model was saved in the meantime, which already updated the index. For
+-- unique fields, the value is only recorded in KEYS[2] if it belongs to the
+-- model. It returns the number of fields which were reindexed.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local modelKey = KEYS[1]
+local stringValuesKey = KEYS[2]
+local modelId = ARGV[1]
+local count = 0
+local nextIndexKey = 3
+for i = 2, #ARGV, 4 do
+	local indexKind = ARGV[i]
+	local indexKey = KEYS[nextIndexKey]
+	nextIndexKey = nextIndexKey + 1
+	local fieldName = ARGV[i+1]
+	local storedValue = ARGV[i+2]
+	local indexValue = ARGV[i+3]
+	if redis.call("HGET", modelKey, fieldName) == storedValue then
+		if indexKind == "score" then
+			redis.call("ZADD", indexKey, indexValue, modelId)
+		elseif indexKind == "nullscore" then
+			redis.call("ZREM", indexKey, modelId)
+		elseif indexKind == "string" then
+			redis.call("ZADD", indexKey, 0, indexValue .. "\0" .. modelId)
+			redis.call("HSET", stringValuesKey, fieldName .. "\0" .. modelId, indexValue)
+		elseif indexKind == "unique" and redis.call("HGET", indexKey, indexValue) == modelId then
+			redis.call("HSET", stringValuesKey, fieldName .. "\0" .. modelId, indexValue)
+		end
+		count = count + 1
+	end
+end
+return count
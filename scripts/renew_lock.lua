@@ -0,0 +1,28 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- renew_lock is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the lock
+--		ARGV[1]) The token which was stored in the key when the lock was taken
+--		ARGV[2]) The new time to live of the lock in milliseconds, or 0 to release
+--			the lock
+-- The script renews or releases the lock, but only if it is still held with the
+-- given token, i.e. if it has not expired and been taken by someone else since.
+-- It returns 1 if the lock was renewed or released and 0 otherwise.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local lockKey = KEYS[1]
+local token = ARGV[1]
+local ttl = tonumber(ARGV[2])
+if redis.call("GET", lockKey) ~= token then
+	return 0
+end
+if ttl == 0 then
+	redis.call("DEL", lockKey)
+else
+	redis.call("PEXPIRE", lockKey, ttl)
+end
+return 1
@@ -0,0 +1,33 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- restore is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the main hash for the model
+--		KEYS[2]) The key of the set of all ids for the collection (i.e. the index key)
+--		KEYS[3]) The key of the set of ids of soft deleted models
+--		ARGV[1]) The id of the model
+--		ARGV[2]) The name of the soft delete field (as it is stored in Redis)
+--		ARGV[3]) "1" if the id should be added to the index key, "0" otherwise
+-- The script undoes soft_delete. It clears the soft delete field of the model
+-- and moves the model id from the set of soft deleted ids back to the set of all
+-- ids. It returns 1 if the model was restored and 0 if it does not exist or has
+-- not been soft deleted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local modelKey = KEYS[1]
+local indexKey = KEYS[2]
+local deletedKey = KEYS[3]
+local modelId = ARGV[1]
+local fieldName = ARGV[2]
+local addToIndex = ARGV[3] == "1"
+if redis.call("SREM", deletedKey, modelId) == 0 or redis.call("EXISTS", modelKey) == 0 then
+	return 0
+end
+redis.call("HSET", modelKey, fieldName, 0)
+if addToIndex then
+	redis.call("SADD", indexKey, modelId)
+end
+return 1
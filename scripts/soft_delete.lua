@@ -0,0 +1,33 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- soft_delete is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the main hash for the model
+--		KEYS[2]) The key of the set of all ids for the collection (i.e. the index key)
+--		KEYS[3]) The key of the set of ids of soft deleted models
+--		ARGV[1]) The id of the model
+--		ARGV[2]) The name of the soft delete field (as it is stored in Redis)
+--		ARGV[3]) The time at which the model was deleted as a Unix timestamp in
+--			microseconds
+-- The script sets the soft delete field of the model and moves the model id from
+-- the set of all ids to the set of soft deleted ids. The field indexes are left
+-- alone so that the model can be restored. It returns 1 if the model was soft
+-- deleted and 0 if it does not exist or has already been soft deleted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local modelKey = KEYS[1]
+local indexKey = KEYS[2]
+local deletedKey = KEYS[3]
+local modelId = ARGV[1]
+local fieldName = ARGV[2]
+local deletedAt = ARGV[3]
+if redis.call("EXISTS", modelKey) == 0 or redis.call("SISMEMBER", deletedKey, modelId) == 1 then
+	return 0
+end
+redis.call("HSET", modelKey, fieldName, deletedAt)
+redis.call("SREM", indexKey, modelId)
+redis.call("SADD", deletedKey, modelId)
+return 1
@@ -0,0 +1,91 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- sweep_expired is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the sorted set of expiration times for the collection
+--		KEYS[2]) The key of the set of all ids for the collection (i.e. the index key)
+--		KEYS[3]) The key of the set of ids of soft deleted models
+--		KEYS[4]) The key of the hash of the values in the string indexes and the
+--			unique fields for the collection
+--		The next n keys are the keys of the sorted sets for the field indexes or
+--			of the hashes of unique values, one for each pair of index arguments
+--			below
+--		The remaining keys are the keys of the main hashes for the models, one for
+--			each of the ids below
+--		ARGV[1]) The current time as a Unix timestamp in milliseconds
+--		ARGV[2]) The number n of field indexes
+--		ARGV[3] to ARGV[2+2n]) Pairs of arguments, one for each field index:
+--			1) The kind of index: "score" for numeric and boolean indexes, "string"
+--				for string indexes or "unique" for unique fields
+--			2) The name of the field (as it is stored in Redis)
+--		The remaining arguments are the ids of the models which were due to expire
+--			at or before the given time when they were read
+-- The script checks that each model is still due to expire. If the main hash
+-- for the model no longer exists, the script removes the model id from the set
+-- of all ids, the set of soft deleted ids and all the field indexes, and
+-- releases its unique values. The members of the string indexes and the unique
+-- values are found in KEYS[4], since the values of the fields are gone once the
+-- main hash has expired. If the main
+-- hash still exists, because it was saved again without an expiration time or
+-- its expiration time was extended, the model is either forgotten or
+-- rescheduled. It returns the number of models that were removed.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local expirationsKey = KEYS[1]
+local indexKey = KEYS[2]
+local deletedKey = KEYS[3]
+local stringValuesKey = KEYS[4]
+local now = tonumber(ARGV[1])
+local numIndexes = tonumber(ARGV[2])
+local firstIdArg = 3 + 2 * numIndexes
+local firstModelKey = 5 + numIndexes
+local count = 0
+for i = firstIdArg, #ARGV do
+	local id = ARGV[i]
+	local modelKey = KEYS[firstModelKey + i - firstIdArg]
+	local expireAt = redis.call("ZSCORE", expirationsKey, id)
+	if expireAt and tonumber(expireAt) <= now then
+		local ttl = redis.call("PTTL", modelKey)
+		if ttl == -2 then
+			-- The model has expired
+			count = count + 1
+			redis.call("ZREM", expirationsKey, id)
+			redis.call("SREM", indexKey, id)
+			redis.call("SREM", deletedKey, id)
+			-- The recorded values are only removed once every index has been
+			-- cleaned, since a field can be both string indexed and unique
+			local recorded = {}
+			for j = 1, numIndexes do
+				local fieldIndexKey = KEYS[4 + j]
+				local kind = ARGV[1 + 2 * j]
+				if kind == "score" then
+					redis.call("ZREM", fieldIndexKey, id)
+				else
+					local field = ARGV[2 + 2 * j] .. "\0" .. id
+					local value = redis.call("HGET", stringValuesKey, field)
+					if value then
+						if kind == "string" then
+							redis.call("ZREM", fieldIndexKey, value .. "\0" .. id)
+						elseif redis.call("HGET", fieldIndexKey, value) == id then
+							redis.call("HDEL", fieldIndexKey, value)
+						end
+						table.insert(recorded, field)
+					end
+				end
+			end
+			for _, field in ipairs(recorded) do
+				redis.call("HDEL", stringValuesKey, field)
+			end
+		elseif ttl == -1 then
+			-- The model no longer has an expiration time
+			redis.call("ZREM", expirationsKey, id)
+		else
+			-- The expiration time of the model was extended
+			redis.call("ZADD", expirationsKey, now + ttl, id)
+		end
+	end
+end
+return count
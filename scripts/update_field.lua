@@ -0,0 +1,157 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- update_field is a lua script that takes the following arguments:
+-- 	KEYS[1]) The key of the main hash for the model
+--	KEYS[2]) The key of the set of ids of soft deleted models
+--		The remaining keys are optional and come in the following order:
+--			1) The key of the sorted set for the updated field index, if ARGV[9] is
+--				"1"
+--			2) The key of the sorted set for the field index, if ARGV[10] is not an
+--				empty string
+--			3) The key of the hash of the values in the string indexes and the
+--				unique fields for the collection, if ARGV[10] is "string" or
+--				"nullstring" or ARGV[12] is not an empty string
+--			4) The key of the hash which maps the values of the field to model ids,
+--				if ARGV[12] is not an empty string
+--			5) The key of the sorted set of expiration times for the collection, if
+--				ARGV[12] is not an empty string
+--		ARGV[1]) Either "increment", "incrementfloat", "set" or "compareandset"
+--		ARGV[2]) The id of the model
+--		ARGV[3]) The name of the field (as it is stored in Redis)
+--		ARGV[4]) The amount to increment the field by if ARGV[1] is "increment" or
+--			"incrementfloat", or the new value of the field otherwise
+--		ARGV[5]) The expected old value of the field if ARGV[1] is
+--			"compareandset", or an empty string otherwise
+--		ARGV[6]) The name of the version field (as it is stored in Redis), or an
+--			empty string if the model does not have one
+--		ARGV[7]) The name of the updated field (as it is stored in Redis), or an
+--			empty string if the model does not have one
+--		ARGV[8]) The current time as a Unix timestamp in microseconds, which is
+--			stored in the updated field
+--		ARGV[9]) "1" if the updated field is indexed, "0" otherwise
+--		ARGV[10]) The kind of index for the field: "score" for numeric and boolean
+--			indexes, "nullscore" for numeric and boolean indexes on fields which are
+--			nil, "string" for string indexes, "nullstring" for string indexes on
+--			fields which are nil or an empty string if the field is not indexed
+--		ARGV[11]) The score for "score" indexes (ignored for increments, which use
+--			the new value) or the value of the field for "string" indexes
+--		ARGV[12]) "unique" if the field is unique, "nullunique" if the field is
+--			unique and the new value is nil or an empty string otherwise. Unique
+--			fields cannot be incremented.
+-- The script updates a single field of the model and its field index, but only
+-- if the model exists and has not been soft deleted and, for "compareandset",
+-- the stored value of the field matches the expected old value. It also
+-- increments the version and sets the updated field (if any). It returns a
+-- status and the new value of the field. The status is 1 if the field was
+-- updated, 0 if the model does not exist or has been soft deleted and -1 if the
+-- stored value did not match the expected old value. If the new value of a
+-- unique field belongs to another model which still exists, the field is not
+-- updated and the status is -2, followed by the id of the other model. The
+-- other model is treated as gone if its expiration time has passed, since its
+-- main hash may have expired before its values were released by SweepExpired.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local modelKey = KEYS[1]
+local deletedKey = KEYS[2]
+local mode = ARGV[1]
+local modelId = ARGV[2]
+local fieldName = ARGV[3]
+local value = ARGV[4]
+local oldValue = ARGV[5]
+local versionField = ARGV[6]
+local updatedField = ARGV[7]
+local now = ARGV[8]
+local indexKind = ARGV[10]
+local indexValue = ARGV[11]
+local uniqueKind = ARGV[12]
+local nextKey = 3
+local updatedIndexKey = false
+if ARGV[9] == "1" then
+	updatedIndexKey = KEYS[nextKey]
+	nextKey = nextKey + 1
+end
+local indexKey = false
+if indexKind ~= "" then
+	indexKey = KEYS[nextKey]
+	nextKey = nextKey + 1
+end
+local stringValuesKey = false
+if indexKind == "string" or indexKind == "nullstring" or uniqueKind ~= "" then
+	stringValuesKey = KEYS[nextKey]
+	nextKey = nextKey + 1
+end
+local uniqueKey = false
+local expirationsKey = false
+if uniqueKind ~= "" then
+	uniqueKey = KEYS[nextKey]
+	expirationsKey = KEYS[nextKey + 1]
+end
+-- Check the conditions before writing anything
+if redis.call("EXISTS", modelKey) == 0 or redis.call("SISMEMBER", deletedKey, modelId) == 1 then
+	return {0, ""}
+end
+local storedValue = redis.call("HGET", modelKey, fieldName)
+if mode == "compareandset" and storedValue ~= oldValue then
+	return {-1, storedValue or ""}
+end
+if uniqueKind == "unique" then
+	local owner = redis.call("HGET", uniqueKey, value)
+	if owner and owner ~= modelId then
+		local ownerExpireAt = redis.call("ZSCORE", expirationsKey, owner)
+		if not ownerExpireAt or tonumber(ownerExpireAt) * 1000 > tonumber(now) then
+			return {-2, owner}
+		end
+	end
+end
+-- Remove the old string index and unique value (if any). This must happen
+-- before the main hash is updated, because it relies on the old field value.
+if indexKind == "string" or indexKind == "nullstring" then
+	if storedValue ~= false then
+		redis.call("ZREM", indexKey, storedValue .. "\0" .. modelId)
+	end
+end
+if uniqueKind ~= "" and storedValue ~= false and redis.call("HGET", uniqueKey, storedValue) == modelId then
+	redis.call("HDEL", uniqueKey, storedValue)
+end
+if stringValuesKey then
+	redis.call("HDEL", stringValuesKey, fieldName .. "\0" .. modelId)
+end
+-- Update the field in the main hash
+local newValue = value
+if mode == "increment" then
+	newValue = redis.call("HINCRBY", modelKey, fieldName, value)
+elseif mode == "incrementfloat" then
+	newValue = redis.call("HINCRBYFLOAT", modelKey, fieldName, value)
+else
+	redis.call("HSET", modelKey, fieldName, value)
+end
+if versionField ~= "" then
+	redis.call("HINCRBY", modelKey, versionField, 1)
+end
+if updatedField ~= "" then
+	redis.call("HSET", modelKey, updatedField, now)
+	if updatedIndexKey then
+		redis.call("ZADD", updatedIndexKey, now, modelId)
+	end
+end
+-- Save the new field index (if any)
+if indexKind == "score" then
+	if mode == "increment" or mode == "incrementfloat" then
+		indexValue = newValue
+	end
+	redis.call("ZADD", indexKey, indexValue, modelId)
+elseif indexKind == "nullscore" then
+	redis.call("ZREM", indexKey, modelId)
+elseif indexKind == "string" then
+	redis.call("ZADD", indexKey, 0, indexValue .. "\0" .. modelId)
+	redis.call("HSET", stringValuesKey, fieldName .. "\0" .. modelId, indexValue)
+end
+if uniqueKind == "unique" then
+	redis.call("HSET", uniqueKey, value, modelId)
+	redis.call("HSET", stringValuesKey, fieldName .. "\0" .. modelId, value)
+end
+return {1, newValue}
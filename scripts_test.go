@@ -7,11 +7,10 @@
 package zoom
 
 import (
+	"context"
 	"reflect"
 	"strconv"
 	"testing"
-
-	"github.com/garyburd/redigo/redis"
 )
 
 func TestDeleteModelsBySetIdsScript(t *testing.T) {
@@ -33,7 +32,7 @@ func TestDeleteModelsBySetIdsScript(t *testing.T) {
 	tempSetKey := "testModelIds"
 	conn := testPool.NewConn()
 	defer conn.Close()
-	saddArgs := redis.Args{tempSetKey}
+	saddArgs := Args{tempSetKey}
 	saddArgs = saddArgs.Add(Interfaces(ids)...)
 	if _, err = conn.Do("SADD", saddArgs...); err != nil {
 		t.Errorf("Unexpected error in SADD: %s", err.Error())
@@ -64,8 +63,48 @@ func TestDeleteModelsBySetIdsScript(t *testing.T) {
 		expectKeyExists(t, modelKey)
 		expectSetContains(t, testModels.IndexKey(), model.ModelId())
 	}
+
+	// The transaction should fail if the set changes after the ids were read
+	hook := &beforeActionHook{f: func() {
+		if _, err := conn.Do("SADD", tempSetKey, models[3].ModelId()); err != nil {
+			t.Errorf("Unexpected error in SADD: %s", err.Error())
+		}
+	}}
+	pool := NewPoolWithOptions(testPool.options.WithHooks(hook))
+	defer pool.Close()
+	col, err := pool.NewCollectionWithOptions(&testModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatalf("Unexpected error registering testModel: %s", err.Error())
+	}
+	tx = pool.NewTransaction()
+	tx.DeleteModelsBySetIds(tempSetKey, col.Name(), nil)
+	if err := tx.Exec(); reflect.TypeOf(err) != reflect.TypeOf(WatchError{}) {
+		t.Errorf("Expected a WatchError but got %v", err)
+	}
+	expectKeyExists(t, testModels.ModelKey(models[3].ModelId()))
+}
+
+// beforeActionHook calls f before the first action which is sent to Redis.
+type beforeActionHook struct {
+	f    func()
+	done bool
 }
 
+func (h *beforeActionHook) BeforeExec(ctx context.Context, info *ExecInfo) context.Context {
+	return ctx
+}
+
+func (h *beforeActionHook) AfterExec(ctx context.Context, info *ExecInfo) {}
+
+func (h *beforeActionHook) BeforeAction(ctx context.Context, info *ActionInfo) {
+	if !h.done {
+		h.done = true
+		h.f()
+	}
+}
+
+func (h *beforeActionHook) AfterAction(ctx context.Context, info *ActionInfo) {}
+
 func TestDeleteStringIndexScript(t *testing.T) {
 	testingSetUp()
 	defer testingTearDown()
@@ -89,7 +128,7 @@ func TestDeleteStringIndexScript(t *testing.T) {
 
 	// Run the script before saving the hash, to make sure it does not cause an error
 	tx := testPool.NewTransaction()
-	tx.deleteStringIndex(stringIndexModels.Name(), model.ModelId(), "String")
+	tx.deleteStringIndex(stringIndexModels.spec, model.ModelId(), "String")
 	if err := tx.Exec(); err != nil {
 		t.Fatalf("Unexected error in tx.Exec: %s", err.Error())
 	}
@@ -114,7 +153,7 @@ func TestDeleteStringIndexScript(t *testing.T) {
 
 	// Run the script again. This time we expect the index to be removed
 	tx = testPool.NewTransaction()
-	tx.deleteStringIndex(stringIndexModels.Name(), model.ModelId(), "String")
+	tx.deleteStringIndex(stringIndexModels.spec, model.ModelId(), "String")
 	if err := tx.Exec(); err != nil {
 		t.Fatalf("Unexected error in tx.Exec: %s", err.Error())
 	}
@@ -168,7 +207,7 @@ func TestExtractIdsFromFieldIndexScript(t *testing.T) {
 		destKey := "TestExtractIdsFromFieldIndexScript:" + strconv.Itoa(i)
 		tx = testPool.NewTransaction()
 		tx.ExtractIdsFromFieldIndex(fieldIndexKey, destKey, tc.min, tc.max)
-		tx.Command("ZRANGE", redis.Args{destKey, 0, -1}, NewScanStringsHandler(&gotIds))
+		tx.Command("ZRANGE", Args{destKey, 0, -1}, NewScanStringsHandler(&gotIds))
 		if err := tx.Exec(); err != nil {
 			t.Errorf("Unexpected error in tx.Exec: %s", err.Error())
 		}
@@ -224,7 +263,7 @@ func TestExtractIdsFromStringIndexScript(t *testing.T) {
 		destKey := "ExtractIdsFromStringIndexScript:" + strconv.Itoa(i)
 		tx = testPool.NewTransaction()
 		tx.ExtractIdsFromStringIndex(fieldIndexKey, destKey, tc.min, tc.max)
-		tx.Command("ZRANGE", redis.Args{destKey, 0, -1}, NewScanStringsHandler(&gotIds))
+		tx.Command("ZRANGE", Args{destKey, 0, -1}, NewScanStringsHandler(&gotIds))
 		if err := tx.Exec(); err != nil {
 			t.Errorf("Unexpected error in tx.Exec: %s", err.Error())
 		}
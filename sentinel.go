@@ -0,0 +1,314 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File sentinel.go contains code related to Redis Sentinel, including
+// resolving the address of the current master and detecting failovers.
+
+package zoom
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// sentinelRetryInterval is the amount of time to wait before trying to
+// reconnect to the sentinels after the connection used to watch for failovers
+// is lost.
+var sentinelRetryInterval = time.Second
+
+// errSentinelClosed is returned by dial after the pool has been closed.
+var errSentinelClosed = errors.New("zoom: pool has been closed")
+
+// sentinel keeps track of the current master for a pool configured with
+// sentinel addresses. Every time a failover is detected, the generation is
+// incremented so that connections to the old master can be discarded.
+type sentinel struct {
+	options   PoolOptions
+	mu        sync.Mutex
+	addresses []string
+	// master is the last known address of the master. It is empty if the
+	// master needs to be resolved.
+	master     string
+	generation uint64
+	// watchConn is the connection currently used to watch for failovers. It is
+	// closed by close in order to interrupt the watch goroutine.
+	watchConn redis.Conn
+	closed    bool
+}
+
+// sentinelConn is a connection to the master which remembers the generation
+// in which it was created.
+type sentinelConn struct {
+	redis.Conn
+	generation uint64
+}
+
+// DoWithTimeout satisfies redis.ConnWithTimeout. The redis.Pool requires it of
+// the connections it wraps in order to send commands with a read timeout,
+// which happens for every transaction with a deadline.
+func (c sentinelConn) DoWithTimeout(timeout time.Duration, commandName string, args ...interface{}) (interface{}, error) {
+	return redis.DoWithTimeout(c.Conn, timeout, commandName, args...)
+}
+
+// ReceiveWithTimeout satisfies redis.ConnWithTimeout.
+func (c sentinelConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	return redis.ReceiveWithTimeout(c.Conn, timeout)
+}
+
+// newSentinel returns a new sentinel for the given options.
+func newSentinel(options PoolOptions) *sentinel {
+	addresses := make([]string, len(options.SentinelAddresses))
+	copy(addresses, options.SentinelAddresses)
+	return &sentinel{
+		options:   options,
+		addresses: addresses,
+	}
+}
+
+// dial resolves the current master and returns a new connection to it. It
+// returns an error if the server at the resolved address is not a master, which
+// can happen during a failover.
+func (s *sentinel) dial() (redis.Conn, error) {
+	if s.options.MasterName == "" {
+		return nil, errors.New("zoom: PoolOptions.MasterName is required when using SentinelAddresses")
+	}
+	master, generation, err := s.currentMaster()
+	if err != nil {
+		return nil, err
+	}
+	options := s.options
+	options.Network = "tcp"
+	options.Address = master
+	c, err := options.dial()
+	if err != nil {
+		s.failover(generation)
+		return nil, err
+	}
+	role, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if len(role) == 0 {
+		c.Close()
+		return nil, fmt.Errorf("zoom: unexpected reply to ROLE from %s", master)
+	}
+	if kind, _ := redis.String(role[0], nil); kind != "master" {
+		c.Close()
+		s.failover(generation)
+		return nil, fmt.Errorf("zoom: expected %s to be a master but it was a %s", master, kind)
+	}
+	return sentinelConn{Conn: c, generation: generation}, nil
+}
+
+// testOnBorrow returns an error if c was created before the latest failover,
+// which will cause the underlying redis.Pool to discard it.
+func (s *sentinel) testOnBorrow(c redis.Conn, _ time.Time) error {
+	sc, ok := c.(sentinelConn)
+	if !ok {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sc.generation != s.generation {
+		return fmt.Errorf("zoom: connection was made to a previous master")
+	}
+	return nil
+}
+
+// currentMaster returns the address of the current master and the current
+// generation, asking the sentinels if needed.
+func (s *sentinel) currentMaster() (string, uint64, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return "", 0, errSentinelClosed
+	}
+	if s.master != "" {
+		defer s.mu.Unlock()
+		return s.master, s.generation, nil
+	}
+	addresses := make([]string, len(s.addresses))
+	copy(addresses, s.addresses)
+	generation := s.generation
+	s.mu.Unlock()
+
+	var lastErr error
+	for i, address := range addresses {
+		master, err := s.queryMaster(address)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.generation != generation && s.master != "" {
+			// A +switch-master message arrived while we were asking the sentinel.
+			// Trust the newer information.
+			return s.master, s.generation, nil
+		}
+		s.master = master
+		if i != 0 {
+			// Move the sentinel that answered to the front so we try it first
+			// next time.
+			s.addresses[0], s.addresses[i] = s.addresses[i], s.addresses[0]
+		}
+		return master, s.generation, nil
+	}
+	return "", 0, fmt.Errorf("zoom: could not get address of master %s from any sentinel: %v", s.options.MasterName, lastErr)
+}
+
+// queryMaster asks the sentinel at address for the address of the master.
+func (s *sentinel) queryMaster(address string) (string, error) {
+	c, err := s.dialSentinel(address)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	reply, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", s.options.MasterName))
+	if err != nil {
+		if err == redis.ErrNil {
+			return "", fmt.Errorf("zoom: sentinel at %s does not know about master %s", address, s.options.MasterName)
+		}
+		return "", err
+	}
+	if len(reply) != 2 {
+		return "", fmt.Errorf("zoom: unexpected reply from sentinel at %s: %v", address, reply)
+	}
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+// dialSentinel returns a new connection to the sentinel at address.
+func (s *sentinel) dialSentinel(address string) (redis.Conn, error) {
+	dialOptions := []redis.DialOption{
+		redis.DialConnectTimeout(time.Second),
+	}
+	if s.options.TLSConfig != nil {
+		dialOptions = append(dialOptions, redis.DialUseTLS(true), redis.DialTLSConfig(s.options.TLSConfig))
+	}
+	if s.options.SentinelPassword != "" {
+		dialOptions = append(dialOptions, redis.DialPassword(s.options.SentinelPassword))
+	}
+	return redis.Dial("tcp", address, dialOptions...)
+}
+
+// failover forgets the address of the master and starts a new generation,
+// unless that already happened since generation started.
+func (s *sentinel) failover(generation uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.generation == generation {
+		s.master = ""
+		s.generation++
+	}
+}
+
+// switchMaster handles a +switch-master message from a sentinel. The message
+// has the format: <master name> <old ip> <old port> <new ip> <new port>.
+func (s *sentinel) switchMaster(message string) {
+	fields := strings.Fields(message)
+	if len(fields) != 5 || fields[0] != s.options.MasterName {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.master = net.JoinHostPort(fields[3], fields[4])
+	s.generation++
+}
+
+// handleError checks if err indicates that the server we are talking to is no
+// longer a master (e.g. a READONLY error) and if so, starts a new generation.
+func (s *sentinel) handleError(err error) {
+	if isReadOnlyError(err) {
+		s.mu.Lock()
+		generation := s.generation
+		s.mu.Unlock()
+		s.failover(generation)
+	}
+}
+
+// isReadOnlyError returns true iff err is an error returned by a Redis replica
+// in response to a write command.
+func isReadOnlyError(err error) bool {
+	redisErr, ok := err.(redis.Error)
+	return ok && strings.HasPrefix(string(redisErr), "READONLY ")
+}
+
+// watch subscribes to +switch-master messages from the sentinels and updates
+// the master whenever a failover occurs. It runs until close is called.
+func (s *sentinel) watch() {
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		addresses := make([]string, len(s.addresses))
+		copy(addresses, s.addresses)
+		s.mu.Unlock()
+		for _, address := range addresses {
+			if err := s.watchSentinel(address); err == errSentinelClosed {
+				return
+			}
+		}
+		time.Sleep(sentinelRetryInterval)
+	}
+}
+
+// watchSentinel subscribes to +switch-master messages from the sentinel at
+// address. It returns when the connection is lost or close is called.
+func (s *sentinel) watchSentinel(address string) error {
+	c, err := s.dialSentinel(address)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		c.Close()
+		return errSentinelClosed
+	}
+	s.watchConn = c
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.watchConn = nil
+		s.mu.Unlock()
+		c.Close()
+	}()
+	psc := redis.PubSubConn{Conn: c}
+	if err := psc.Subscribe("+switch-master"); err != nil {
+		return err
+	}
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			s.switchMaster(string(v.Data))
+		case error:
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return errSentinelClosed
+			}
+			return v
+		}
+	}
+}
+
+// close stops watching for failovers and causes dial to return an error.
+func (s *sentinel) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.watchConn != nil {
+		s.watchConn.Close()
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File sentinel_test.go tests the code in sentinel.go
+
+package zoom
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSentinelSwitchMaster(t *testing.T) {
+	s := newSentinel(DefaultPoolOptions.WithMasterName("mymaster").WithSentinelAddresses("localhost:26379"))
+	s.master = "10.0.0.1:6379"
+	// A message for a different master should be ignored.
+	s.switchMaster("othermaster 10.0.0.1 6379 10.0.0.2 6379")
+	master, generation, err := s.currentMaster()
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:6379", master)
+	assert.Equal(t, uint64(0), generation)
+	// A message for our master should update the address and start a new
+	// generation.
+	s.switchMaster("mymaster 10.0.0.1 6379 10.0.0.2 6380")
+	master, generation, err = s.currentMaster()
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.2:6380", master)
+	assert.Equal(t, uint64(1), generation)
+}
+
+func TestSentinelTestOnBorrow(t *testing.T) {
+	s := newSentinel(DefaultPoolOptions.WithMasterName("mymaster").WithSentinelAddresses("localhost:26379"))
+	s.master = "10.0.0.1:6379"
+	conn := sentinelConn{generation: s.generation}
+	assert.NoError(t, s.testOnBorrow(conn, time.Now()))
+	// After a READONLY error, connections from the previous generation should
+	// be rejected and the master should be resolved again.
+	s.handleError(redis.Error("READONLY You can't write against a read only replica."))
+	assert.Error(t, s.testOnBorrow(conn, time.Now()))
+	assert.Equal(t, "", s.master)
+	// Other errors should not cause a new generation.
+	s.handleError(redis.Error("ERR unknown command"))
+	assert.Equal(t, uint64(1), s.generation)
+}
+
+func TestSentinelClose(t *testing.T) {
+	s := newSentinel(DefaultPoolOptions.WithMasterName("mymaster").WithSentinelAddresses("localhost:26379"))
+	s.close()
+	_, err := s.dial()
+	assert.Equal(t, errSentinelClosed, err)
+}
+
+func TestSentinelExecWithDeadline(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// The fake sentinel points to the Redis server used by the other tests.
+	host, port, err := net.SplitHostPort(testPool.options.Address)
+	require.NoError(t, err)
+	address := startFakeSentinel(t, host, port)
+	pool := NewPoolWithOptions(testPool.options.WithMasterName("mymaster").WithSentinelAddresses(address))
+	defer pool.Close()
+
+	// Transactions with a deadline read the replies with a timeout, which the
+	// connections to the master must support.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pong := ""
+	tx := pool.NewTransactionContext(ctx)
+	tx.Command("PING", nil, NewScanStringHandler(&pong))
+	require.NoError(t, tx.Exec())
+	assert.Equal(t, "PONG", pong)
+}
+
+// startFakeSentinel starts a server which answers the commands that Zoom sends
+// to a sentinel, reporting the master at host:port, and returns its address.
+// The server is closed when the test finishes.
+func startFakeSentinel(t *testing.T, host string, port string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSentinel(conn, host, port)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// serveFakeSentinel reads commands from conn and replies to them until the
+// connection is closed.
+func serveFakeSentinel(conn net.Conn, host string, port string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readFakeCommand(r)
+		if err != nil {
+			return
+		}
+		switch strings.ToUpper(args[0]) {
+		case "SENTINEL":
+			fmt.Fprintf(conn, "*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(host), host, len(port), port)
+		case "SUBSCRIBE":
+			fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])
+		default:
+			fmt.Fprint(conn, "+OK\r\n")
+		}
+	}
+}
+
+// readFakeCommand reads a command in the Redis protocol from r.
+func readFakeCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid command: %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
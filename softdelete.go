@@ -0,0 +1,135 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File softdelete.go contains code related to soft deleting models, including
+// the SoftDelete and Restore methods.
+
+package zoom
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// SoftDelete marks the model with the given id as deleted without removing it
+// from the database. It requires a field of type time.Time with the
+// `zoom:"softdelete"` struct tag, which is set to the time at which the model
+// was deleted. Soft deleted models are moved from the collection index to a
+// separate set, so Find, FindAll, Count, Exists and queries treat them as if
+// they did not exist, unless the query uses WithDeleted or OnlyDeleted. Saving
+// a soft deleted model does not restore it. Use Restore to undo SoftDelete and
+// Delete to remove the model permanently. SoftDelete returns true iff the model
+// exists and had not already been soft deleted.
+func (c *Collection) SoftDelete(id string) (bool, error) {
+	return c.SoftDeleteContext(context.Background(), id)
+}
+
+// SoftDeleteContext is like SoftDelete but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) SoftDeleteContext(ctx context.Context, id string) (bool, error) {
+	t := c.pool.NewTransactionContext(ctx)
+	deleted := false
+	t.SoftDelete(c, id, &deleted)
+	if err := t.Exec(); err != nil {
+		return false, err
+	}
+	return deleted, nil
+}
+
+// SoftDelete soft deletes the model with the given id in an existing
+// transaction. deleted will be set to true iff the model exists and had not
+// already been soft deleted when the transaction is executed. You may pass in
+// nil for deleted if you do not care whether or not the model was soft
+// deleted. Any errors encountered will be added to the transaction and
+// returned as an error when the transaction is executed.
+// NOTE: this invokes a lua script which is defined in scripts/soft_delete.lua
+func (t *Transaction) SoftDelete(c *Collection, id string, deleted *bool) {
+	if err := c.checkSoftDelete("SoftDelete"); err != nil {
+		t.setError(err)
+		return
+	}
+	modelKey, err := c.spec.modelKey(id)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	var handler ReplyHandler
+	if deleted != nil {
+		handler = NewScanBoolHandler(deleted)
+	}
+	deletedAt := timeToUnixMicro(time.Now())
+	t.Script(softDeleteScript, Args{modelKey, c.IndexKey(), c.spec.deletedKey(), id, c.spec.softDeleteField.redisName, deletedAt}, handler)
+}
+
+// Restore undoes SoftDelete for the model with the given id. It clears the
+// soft delete field and moves the model back to the collection index, so that
+// it can be found again. Restore returns true iff the model exists and had
+// been soft deleted.
+func (c *Collection) Restore(id string) (bool, error) {
+	return c.RestoreContext(context.Background(), id)
+}
+
+// RestoreContext is like Restore but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) RestoreContext(ctx context.Context, id string) (bool, error) {
+	t := c.pool.NewTransactionContext(ctx)
+	restored := false
+	t.Restore(c, id, &restored)
+	if err := t.Exec(); err != nil {
+		return false, err
+	}
+	return restored, nil
+}
+
+// Restore restores the soft deleted model with the given id in an existing
+// transaction. restored will be set to true iff the model exists and had been
+// soft deleted when the transaction is executed. You may pass in nil for
+// restored if you do not care whether or not the model was restored. Any
+// errors encountered will be added to the transaction and returned as an error
+// when the transaction is executed.
+// NOTE: this invokes a lua script which is defined in scripts/restore.lua
+func (t *Transaction) Restore(c *Collection, id string, restored *bool) {
+	if err := c.checkSoftDelete("Restore"); err != nil {
+		t.setError(err)
+		return
+	}
+	modelKey, err := c.spec.modelKey(id)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	var handler ReplyHandler
+	if restored != nil {
+		handler = NewScanBoolHandler(restored)
+	}
+	addToIndex := 0
+	if c.index {
+		addToIndex = 1
+	}
+	t.Script(restoreScript, Args{modelKey, c.IndexKey(), c.spec.deletedKey(), id, c.spec.softDeleteField.redisName, addToIndex}, handler)
+}
+
+// checkSoftDelete returns an error if c is nil or does not have a soft delete
+// field. methodName is used in the error message.
+func (c *Collection) checkSoftDelete(methodName string) error {
+	if c == nil {
+		return newNilCollectionError(methodName)
+	}
+	if c.spec.softDeleteField == nil {
+		return fmt.Errorf("zoom: Error in %s or Transaction.%s: %s does not have a soft delete field. You can add one with the `zoom:\"softdelete\"` struct tag.", methodName, methodName, c.spec.typ.String())
+	}
+	return nil
+}
+
+// checkNotSoftDeleted adds a command to the transaction which causes it to
+// return a ModelNotFoundError if the model with the given id has been soft
+// deleted. It does nothing if the collection does not have a soft delete
+// field.
+func (t *Transaction) checkNotSoftDeleted(c *Collection, id string) {
+	if c.spec.softDeleteField == nil {
+		return
+	}
+	t.Command("SISMEMBER", Args{c.spec.deletedKey(), id}, newModelNotSoftDeletedHandler(c, id))
+}
@@ -0,0 +1,202 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File softdelete_test.go tests the code in softdelete.go
+
+package zoom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createSoftDeleteTestModels creates and saves n softDeleteTestModels with the
+// Int values 1 to n.
+func createSoftDeleteTestModels(t *testing.T, n int) []*softDeleteTestModel {
+	models := make([]*softDeleteTestModel, n)
+	for i := range models {
+		models[i] = &softDeleteTestModel{
+			Int:    i + 1,
+			String: randomString(),
+		}
+	}
+	require.NoError(t, softDeleteTestModels.SaveMany(models))
+	return models
+}
+
+func TestSoftDelete(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := createSoftDeleteTestModels(t, 3)
+	before := time.Now()
+	deleted, err := softDeleteTestModels.SoftDelete(models[0].Id)
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	deleted, err = softDeleteTestModels.SoftDelete(models[0].Id)
+	require.NoError(t, err)
+	assert.False(t, deleted, "A model should not be soft deleted twice")
+	deleted, err = softDeleteTestModels.SoftDelete("missing")
+	require.NoError(t, err)
+	assert.False(t, deleted)
+
+	// The model should still exist in the database, but not in the index.
+	expectKeyExists(t, softDeleteTestModels.ModelKey(models[0].Id))
+	expectSetDoesNotContain(t, softDeleteTestModels.IndexKey(), models[0].Id)
+	expectSetContains(t, softDeleteTestModels.spec.deletedKey(), models[0].Id)
+
+	// Find, FindMany, Exists, FindAll and Count should not see it.
+	err = softDeleteTestModels.Find(models[0].Id, &softDeleteTestModel{})
+	assert.IsType(t, ModelNotFoundError{}, err)
+	err = softDeleteTestModels.FindFields(models[0].Id, []string{"Int"}, &softDeleteTestModel{})
+	assert.IsType(t, ModelNotFoundError{}, err)
+	found := []*softDeleteTestModel{}
+	missing, err := softDeleteTestModels.FindMany([]string{models[0].Id, models[1].Id}, &found)
+	require.NoError(t, err)
+	assert.Equal(t, []string{models[0].Id}, missing)
+	exists, err := softDeleteTestModels.Exists(models[0].Id)
+	require.NoError(t, err)
+	assert.False(t, exists)
+	require.NoError(t, softDeleteTestModels.FindAll(&found))
+	assert.Len(t, found, 2)
+	count, err := softDeleteTestModels.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// Saving a soft deleted model should not restore it or change the soft
+	// delete field.
+	models[0].Int = 10
+	require.NoError(t, softDeleteTestModels.Save(models[0]))
+	expectSetDoesNotContain(t, softDeleteTestModels.IndexKey(), models[0].Id)
+	restored, err := softDeleteTestModels.Restore(models[1].Id)
+	require.NoError(t, err)
+	assert.False(t, restored, "A model which was not soft deleted should not be restored")
+
+	// Updating a single field of a soft deleted model should fail.
+	_, err = softDeleteTestModels.Increment(models[0].Id, "Int", 1)
+	assert.IsType(t, ModelNotFoundError{}, err)
+	err = softDeleteTestModels.SetField(models[0].Id, "Int", 20)
+	assert.IsType(t, ModelNotFoundError{}, err)
+	_, err = softDeleteTestModels.CompareAndSetField(models[0].Id, "Int", 10, 20)
+	assert.IsType(t, ModelNotFoundError{}, err)
+	expectSetDoesNotContain(t, softDeleteTestModels.IndexKey(), models[0].Id)
+
+	// The soft delete field should be set when the deleted models are queried.
+	deletedModels := []*softDeleteTestModel{}
+	require.NoError(t, softDeleteTestModels.NewQuery().OnlyDeleted().Run(&deletedModels))
+	require.Len(t, deletedModels, 1)
+	assert.Equal(t, 10, deletedModels[0].Int)
+	assert.False(t, deletedModels[0].DeletedAt.Before(before.Truncate(time.Millisecond)), "DeletedAt was not set: %s", deletedModels[0].DeletedAt)
+
+	restored, err = softDeleteTestModels.Restore(models[0].Id)
+	require.NoError(t, err)
+	assert.True(t, restored)
+	foundModel := &softDeleteTestModel{}
+	require.NoError(t, softDeleteTestModels.Find(models[0].Id, foundModel))
+	assert.True(t, foundModel.DeletedAt.IsZero())
+	assert.Equal(t, 10, foundModel.Int)
+	expectModelExists(t, softDeleteTestModels, models[0])
+	expectSetDoesNotContain(t, softDeleteTestModels.spec.deletedKey(), models[0].Id)
+
+	// Delete and DeleteAll should remove soft deleted models permanently.
+	_, err = softDeleteTestModels.SoftDelete(models[1].Id)
+	require.NoError(t, err)
+	_, err = softDeleteTestModels.SoftDelete(models[2].Id)
+	require.NoError(t, err)
+	deleted, err = softDeleteTestModels.Delete(models[1].Id)
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	expectSetDoesNotContain(t, softDeleteTestModels.spec.deletedKey(), models[1].Id)
+	count, err = softDeleteTestModels.DeleteAll()
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	expectKeyDoesNotExist(t, softDeleteTestModels.ModelKey(models[2].Id))
+	expectKeyDoesNotExist(t, softDeleteTestModels.spec.deletedKey())
+
+	// Collections without a soft delete field should return an error.
+	_, err = indexedTestModels.SoftDelete("foo")
+	assert.Error(t, err)
+	_, err = indexedTestModels.Restore("foo")
+	assert.Error(t, err)
+}
+
+func TestSoftDeleteQueries(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := createSoftDeleteTestModels(t, 5)
+	for _, model := range models[1:3] {
+		_, err := softDeleteTestModels.SoftDelete(model.Id)
+		require.NoError(t, err)
+	}
+	ids := func(models ...*softDeleteTestModel) []string {
+		result := []string{}
+		for _, model := range models {
+			result = append(result, model.Id)
+		}
+		return result
+	}
+	testCases := []struct {
+		query    *Query
+		expected []string
+	}{
+		{
+			query:    softDeleteTestModels.NewQuery().Order("Int"),
+			expected: ids(models[0], models[3], models[4]),
+		},
+		{
+			query:    softDeleteTestModels.NewQuery().WithDeleted().Order("-Int"),
+			expected: ids(models[4], models[3], models[2], models[1], models[0]),
+		},
+		{
+			query:    softDeleteTestModels.NewQuery().OnlyDeleted().Order("String").Limit(5),
+			expected: nil,
+		},
+		{
+			query:    softDeleteTestModels.NewQuery().Filter("Int >=", 2).Order("Int"),
+			expected: ids(models[3], models[4]),
+		},
+		{
+			query:    softDeleteTestModels.NewQuery().OnlyDeleted().Filter("Int <=", 4).Order("Int"),
+			expected: ids(models[1], models[2]),
+		},
+		{
+			query:    softDeleteTestModels.NewQuery().WithDeleted().Filter("Int >", 1).Order("Int").Offset(1).Limit(2),
+			expected: ids(models[2], models[3]),
+		},
+	}
+	for _, tc := range testCases {
+		gotIds, err := tc.query.Ids()
+		require.NoError(t, err, tc.query.String())
+		if tc.expected == nil {
+			// The order of string indexes is random here, so only the set of ids
+			// is checked.
+			assert.ElementsMatch(t, ids(models[1], models[2]), gotIds, tc.query.String())
+		} else {
+			assert.Equal(t, tc.expected, gotIds, tc.query.String())
+		}
+		count, err := tc.query.Count()
+		require.NoError(t, err, tc.query.String())
+		assert.Equal(t, len(gotIds), count, tc.query.String())
+	}
+
+	count, err := softDeleteTestModels.NewQuery().OnlyDeleted().Count()
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	count, err = softDeleteTestModels.NewQuery().WithDeleted().Count()
+	require.NoError(t, err)
+	assert.Equal(t, 5, count)
+	found := &softDeleteTestModel{}
+	require.NoError(t, softDeleteTestModels.NewQuery().OnlyDeleted().Order("-Int").RunOne(found))
+	assert.Equal(t, models[2].Id, found.Id)
+	assert.Equal(t, `softDeleteTestModel.NewQuery().WithDeleted().Order("Int")`, softDeleteTestModels.NewQuery().WithDeleted().Order("Int").String())
+
+	_, err = softDeleteTestModels.NewQuery().WithDeleted().OnlyDeleted().Ids()
+	assert.Error(t, err)
+	_, err = indexedTestModels.NewQuery().WithDeleted().Ids()
+	assert.Error(t, err)
+}
@@ -13,6 +13,7 @@ import (
 	"sort"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -129,6 +130,67 @@ func createAndSaveIndexedTestModels(n int) ([]*indexedTestModel, error) {
 	return models, nil
 }
 
+// versionedTestModel is a model type used for testing version fields.
+type versionedTestModel struct {
+	String  string `zoom:"index"`
+	Version int    `zoom:"version"`
+	RandomId
+}
+
+// softDeleteTestModel is a model type used for testing soft deletes.
+type softDeleteTestModel struct {
+	Int       int       `zoom:"index"`
+	String    string    `zoom:"index"`
+	DeletedAt time.Time `zoom:"softdelete"`
+	RandomId
+}
+
+// timestampedTestModel is a model type used for testing created and updated
+// fields.
+type timestampedTestModel struct {
+	Int       int       `zoom:"index"`
+	CreatedAt time.Time `zoom:"index,created"`
+	UpdatedAt time.Time `zoom:"index,updated"`
+	RandomId
+}
+
+// lifecycleTestModel is a model type used for testing the lifecycle methods.
+// The methods are defined in lifecycle_test.go.
+type lifecycleTestModel struct {
+	Int int `zoom:"index"`
+	RandomId
+}
+
+// validatedTestModel is a model type used for testing validation. Its Validate
+// method is defined in validation_test.go.
+type validatedTestModel struct {
+	Name  string   `zoom:"required,min=2,max=8"`
+	Age   int      `zoom:"index,min=18,max=130"`
+	Code  *string  `zoom:"len=3"`
+	Color string   `zoom:"oneof=red green blue"`
+	Level int      `zoom:"oneof=1 2 3"`
+	Email string   `zoom:"regex=^[a-z]+@[a-z]+\\.(com|org)$"`
+	Tags  []string `zoom:"max=2"`
+	RandomId
+}
+
+// uniqueTestModel is a model type used for testing unique fields.
+type uniqueTestModel struct {
+	Email    string  `zoom:"unique"`
+	Nickname *string `zoom:"index,unique"`
+	Int      int     `zoom:"index"`
+	RandomId
+}
+
+// unindexedTestModel is a model type used for testing collections which are
+// not indexed.
+type unindexedTestModel struct {
+	Int       int       `zoom:"index"`
+	Email     string    `zoom:"unique"`
+	DeletedAt time.Time `zoom:"softdelete"`
+	RandomId
+}
+
 type indexedPrimativesModel struct {
 	Uint    uint    `zoom:"index"`
 	Uint8   uint8   `zoom:"index"`
@@ -236,6 +298,13 @@ var (
 	indexedTestModels       *Collection
 	indexedPrimativesModels *Collection
 	indexedPointersModels   *Collection
+	versionedTestModels     *Collection
+	softDeleteTestModels    *Collection
+	timestampedTestModels   *Collection
+	lifecycleTestModels     *Collection
+	validatedTestModels     *Collection
+	uniqueTestModels        *Collection
+	unindexedTestModels     *Collection
 )
 
 // registerTestingTypes registers the common types used for testing
@@ -265,9 +334,44 @@ func registerTestingTypes() {
 			model:      &indexedPointersModel{},
 			index:      true,
 		},
+		{
+			collection: &versionedTestModels,
+			model:      &versionedTestModel{},
+			index:      true,
+		},
+		{
+			collection: &softDeleteTestModels,
+			model:      &softDeleteTestModel{},
+			index:      true,
+		},
+		{
+			collection: &timestampedTestModels,
+			model:      &timestampedTestModel{},
+			index:      true,
+		},
+		{
+			collection: &lifecycleTestModels,
+			model:      &lifecycleTestModel{},
+			index:      true,
+		},
+		{
+			collection: &validatedTestModels,
+			model:      &validatedTestModel{},
+			index:      true,
+		},
+		{
+			collection: &uniqueTestModels,
+			model:      &uniqueTestModel{},
+			index:      true,
+		},
+		{
+			collection: &unindexedTestModels,
+			model:      &unindexedTestModel{},
+			index:      false,
+		},
 	}
 	for _, m := range testModelTypes {
-		options := DefaultCollectionOptions.WithIndex(true)
+		options := DefaultCollectionOptions.WithIndex(m.index)
 		collection, err := testPool.NewCollectionWithOptions(m.model, options)
 		if err != nil {
 			panic(err)
@@ -444,7 +548,7 @@ func indexExists(collection *Collection, model Model, fieldName string) (bool, e
 		typ = typ.Elem()
 	}
 	switch {
-	case typeIsNumeric(typ):
+	case typeIsNumeric(typ), fs.kind == timeField:
 		return numericIndexExists(collection, model, fieldName)
 	case typeIsString(typ):
 		return stringIndexExists(collection, model, fieldName)
@@ -0,0 +1,176 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// Package tracing provides a zoom.Hook which traces transactions in the style
+// of OpenTelemetry. Each call to Transaction.Exec creates a span, and each
+// action in the transaction adds an event to that span.
+//
+// To avoid depending on a particular tracing library, the hook uses the small
+// Tracer and Span interfaces defined here. Adapting an OpenTelemetry tracer
+// only takes a few lines:
+//
+//	type otelTracer struct{ trace.Tracer }
+//
+//	func (t otelTracer) Start(ctx context.Context, name string) (context.Context, tracing.Span) {
+//		ctx, span := t.Tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+//		return ctx, otelSpan{span}
+//	}
+//
+//	type otelSpan struct{ trace.Span }
+//
+//	func (s otelSpan) SetAttributes(attrs ...tracing.Attribute) { s.Span.SetAttributes(convert(attrs)...) }
+//	func (s otelSpan) AddEvent(name string, attrs ...tracing.Attribute) { s.Span.AddEvent(name, trace.WithAttributes(convert(attrs)...)) }
+//	func (s otelSpan) RecordError(err error) { s.Span.RecordError(err); s.Span.SetStatus(codes.Error, err.Error()) }
+//	func (s otelSpan) End() { s.Span.End() }
+//
+// where convert turns each Attribute into an attribute.KeyValue. Then:
+//
+//	options := zoom.DefaultPoolOptions.WithHooks(tracing.NewHook(otelTracer{otel.Tracer("zoom")}))
+//	pool := zoom.NewPoolWithOptions(options)
+package tracing
+
+import (
+	"context"
+
+	"github.com/albrow/zoom"
+)
+
+// SpanName is the name of the span created for each transaction.
+const SpanName = "zoom.Exec"
+
+// The keys of the attributes added to spans and events. Where possible, they
+// follow the OpenTelemetry semantic conventions for databases.
+const (
+	// DBSystemKey is set to "redis" on every span.
+	DBSystemKey = "db.system"
+	// DBOperationKey is the name of the command of an action, e.g. "HMSET".
+	DBOperationKey = "db.operation"
+	// ActionCountKey is the number of actions in a transaction.
+	ActionCountKey = "zoom.action_count"
+	// WatchedKeysKey is the number of keys watched by a transaction. It is
+	// only set if the transaction watches at least one key.
+	WatchedKeysKey = "zoom.watched_keys"
+	// ScriptKey is the name of the script of an action. It is only set for
+	// scripts.
+	ScriptKey = "zoom.script"
+	// ArgCountKey is the number of arguments of an action.
+	ArgCountKey = "zoom.arg_count"
+	// CollectionKey is the name of the collection an action touches. It is
+	// only set if the action touches a collection.
+	CollectionKey = "zoom.collection"
+	// ReplySizeKey is the approximate size of the reply to an action in bytes.
+	ReplySizeKey = "zoom.reply_size"
+	// DurationKey is the duration of an action, as a time.Duration.
+	DurationKey = "zoom.duration"
+	// ErrorKey is the error message for an action which failed.
+	ErrorKey = "error"
+)
+
+// Tracer starts spans. It is modeled after the Tracer interface of
+// OpenTelemetry.
+type Tracer interface {
+	// Start starts a new span with the given name as a child of the span in ctx
+	// (if any), and returns a context which holds the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single operation in a trace. It is modeled after the Span
+// interface of OpenTelemetry.
+type Span interface {
+	// SetAttributes sets attributes on the span.
+	SetAttributes(attrs ...Attribute)
+	// AddEvent adds an event with the given name and attributes to the span.
+	AddEvent(name string, attrs ...Attribute)
+	// RecordError records that the operation failed with err.
+	RecordError(err error)
+	// End completes the span.
+	End()
+}
+
+// Attribute is a key-value pair which describes a span or an event. Value is a
+// string, an int, a bool or a time.Duration.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Hook is a zoom.Hook which creates a span for each transaction. Use NewHook
+// to create one.
+type Hook struct {
+	tracer Tracer
+}
+
+var _ zoom.Hook = &Hook{}
+
+// NewHook returns a hook which uses tracer to create a span for each
+// transaction.
+func NewHook(tracer Tracer) *Hook {
+	return &Hook{tracer: tracer}
+}
+
+// spanKey is the key used to store the span for a transaction in its context.
+type spanKey struct{}
+
+// spanFromContext returns the span created by BeforeExec, or nil if there is
+// none.
+func spanFromContext(ctx context.Context) Span {
+	span, _ := ctx.Value(spanKey{}).(Span)
+	return span
+}
+
+// BeforeExec satisfies zoom.Hook. It starts a span for the transaction.
+func (h *Hook) BeforeExec(ctx context.Context, info *zoom.ExecInfo) context.Context {
+	ctx, span := h.tracer.Start(ctx, SpanName)
+	attrs := []Attribute{
+		{Key: DBSystemKey, Value: "redis"},
+		{Key: ActionCountKey, Value: info.ActionCount},
+	}
+	if len(info.Watched) > 0 {
+		attrs = append(attrs, Attribute{Key: WatchedKeysKey, Value: len(info.Watched)})
+	}
+	span.SetAttributes(attrs...)
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// AfterExec satisfies zoom.Hook. It records the error, if any, and ends the
+// span.
+func (h *Hook) AfterExec(ctx context.Context, info *zoom.ExecInfo) {
+	span := spanFromContext(ctx)
+	if span == nil {
+		return
+	}
+	if info.Err != nil {
+		span.RecordError(info.Err)
+	}
+	span.End()
+}
+
+// BeforeAction satisfies zoom.Hook. It does nothing, since events are added
+// once the action is complete.
+func (h *Hook) BeforeAction(ctx context.Context, info *zoom.ActionInfo) {}
+
+// AfterAction satisfies zoom.Hook. It adds an event named after the command to
+// the span for the transaction.
+func (h *Hook) AfterAction(ctx context.Context, info *zoom.ActionInfo) {
+	span := spanFromContext(ctx)
+	if span == nil {
+		return
+	}
+	attrs := []Attribute{
+		{Key: DBOperationKey, Value: info.Command},
+		{Key: ArgCountKey, Value: info.ArgCount},
+		{Key: ReplySizeKey, Value: info.ReplySize},
+		{Key: DurationKey, Value: info.Duration},
+	}
+	if info.Script != "" {
+		attrs = append(attrs, Attribute{Key: ScriptKey, Value: info.Script})
+	}
+	if info.Collection != "" {
+		attrs = append(attrs, Attribute{Key: CollectionKey, Value: info.Collection})
+	}
+	if info.Err != nil {
+		attrs = append(attrs, Attribute{Key: ErrorKey, Value: info.Err.Error()})
+	}
+	span.AddEvent(info.Command, attrs...)
+}
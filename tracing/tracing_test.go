@@ -0,0 +1,120 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File tracing_test.go tests the code in tracing.go
+
+package tracing
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/albrow/zoom"
+	"github.com/albrow/zoom/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type person struct {
+	Name string `zoom:"index"`
+	zoom.RandomId
+}
+
+// testTracer is a Tracer which records the spans it creates.
+type testTracer struct {
+	sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.Lock()
+	defer t.Unlock()
+	span := &testSpan{name: name, attrs: map[string]interface{}{}}
+	t.spans = append(t.spans, span)
+	return ctx, span
+}
+
+type testEvent struct {
+	name  string
+	attrs map[string]interface{}
+}
+
+type testSpan struct {
+	name   string
+	attrs  map[string]interface{}
+	events []testEvent
+	err    error
+	ended  bool
+}
+
+func attrMap(attrs []Attribute) map[string]interface{} {
+	m := map[string]interface{}{}
+	for _, attr := range attrs {
+		m[attr.Key] = attr.Value
+	}
+	return m
+}
+
+func (s *testSpan) SetAttributes(attrs ...Attribute) {
+	for key, value := range attrMap(attrs) {
+		s.attrs[key] = value
+	}
+}
+
+func (s *testSpan) AddEvent(name string, attrs ...Attribute) {
+	s.events = append(s.events, testEvent{name: name, attrs: attrMap(attrs)})
+}
+
+func (s *testSpan) RecordError(err error) {
+	s.err = err
+}
+
+func (s *testSpan) End() {
+	s.ended = true
+}
+
+func TestHook(t *testing.T) {
+	tracer := &testTracer{}
+	options := zoom.DefaultPoolOptions.WithHooks(NewHook(tracer))
+	pool := zoom.NewPoolWithDriver(memory.NewDriver(), options)
+	defer pool.Close()
+	people, err := pool.NewCollectionWithOptions(&person{}, zoom.DefaultCollectionOptions.WithIndex(true))
+	require.NoError(t, err)
+
+	require.NoError(t, people.Save(&person{Name: "Alice"}))
+	require.Len(t, tracer.spans, 1)
+	span := tracer.spans[0]
+	assert.Equal(t, SpanName, span.name)
+	assert.True(t, span.ended)
+	assert.NoError(t, span.err)
+	assert.Equal(t, "redis", span.attrs[DBSystemKey])
+	assert.Equal(t, len(span.events), span.attrs[ActionCountKey])
+	require.NotEmpty(t, span.events)
+	for _, event := range span.events {
+		assert.Equal(t, event.name, event.attrs[DBOperationKey])
+		assert.Equal(t, "person", event.attrs[CollectionKey])
+		assert.NotContains(t, event.attrs, ErrorKey)
+	}
+
+	// Scripts should be reported by name.
+	_, err = people.DeleteAll()
+	require.NoError(t, err)
+	span = tracer.spans[len(tracer.spans)-1]
+	require.Len(t, span.events, 2)
+	assert.Equal(t, "EVALSHA", span.events[0].name)
+	assert.Equal(t, "delete_models_by_set_ids", span.events[0].attrs[ScriptKey])
+
+	// Errors should be recorded on both the event and the span.
+	tx := pool.NewTransaction()
+	tx.Command("SET", zoom.Args{"foo", "bar"}, nil)
+	tx.Command("INCR", zoom.Args{"foo"}, nil)
+	assert.Error(t, tx.Exec())
+	span = tracer.spans[len(tracer.spans)-1]
+	assert.Error(t, span.err)
+	require.Len(t, span.events, 2)
+	assert.NotContains(t, span.events[0].attrs, ErrorKey)
+	assert.Contains(t, span.events[1].attrs, ErrorKey)
+	assert.NotContains(t, span.events[1].attrs, CollectionKey)
+}
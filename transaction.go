@@ -8,7 +8,10 @@
 package zoom
 
 import (
+	"context"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -18,10 +21,29 @@ import (
 // commands or lua scripts. Transactions feature delayed execution,
 // so nothing touches the database until you call Exec.
 type Transaction struct {
-	conn     redis.Conn
+	pool *Pool
+	// conn is the connection used to send commands to Redis. It is nil until
+	// the transaction needs to send something so that, in cluster mode, the
+	// connection can be made to the node which serves the keys involved.
+	conn     Conn
+	ctx      context.Context
 	actions  []*Action
 	err      error
 	watching []string
+	// preferReplica is true if the transaction may be sent to a replica. See
+	// PreferReplica.
+	preferReplica bool
+	// requirePrimary is true if the transaction must be sent to the primary,
+	// even if preferReplica is true.
+	requirePrimary bool
+	// afterExec holds the functions which are called after the transaction has
+	// been executed successfully, e.g. to call the AfterSave methods of the
+	// models. See onSuccess.
+	afterExec []func() error
+	// beforeExec holds the functions which are called right before the
+	// transaction is sent, e.g. to find the ids of the models in an unindexed
+	// collection with SCAN.
+	beforeExec []func() error
 }
 
 // Action is a single step in a transaction and must be either a command
@@ -29,9 +51,15 @@ type Transaction struct {
 type Action struct {
 	kind    actionKind
 	name    string
-	script  *redis.Script
-	args    redis.Args
+	script  *Script
+	args    Args
 	handler ReplyHandler
+	// optionalWrite is true for actions which write to the database but which
+	// the rest of the transaction does not depend on (e.g. removing expired
+	// models from the indexes). They do not prevent the transaction from being
+	// sent to a replica, in which case they are sent to the primary in a
+	// separate transaction first.
+	optionalWrite bool
 }
 
 // actionKind is either a command or a script
@@ -44,12 +72,156 @@ const (
 
 // NewTransaction instantiates and returns a new transaction.
 func (p *Pool) NewTransaction() *Transaction {
+	return p.NewTransactionContext(context.Background())
+}
+
+// NewTransactionContext instantiates and returns a new transaction which is
+// bound to ctx. If ctx is canceled or its deadline passes while waiting for a
+// connection from the pool, Exec will return the error from ctx without sending
+// anything to Redis. If ctx is canceled or its deadline passes while the
+// transaction is executing, Exec stops waiting for the reply and returns the
+// error from ctx. In that case, the commands in the transaction may or may not
+// have been executed by Redis.
+//
+// If the pool has collections for which CollectionOptions.Alias is true,
+// NewTransactionContext reads their aliases from Redis and watches them before
+// returning, so the transaction uses the keys the collections are currently
+// switched to. If one of them is switched before the transaction is executed,
+// Exec returns a WatchError. As with WatchKey, the transaction then holds a
+// connection until Exec is called.
+func (p *Pool) NewTransactionContext(ctx context.Context) *Transaction {
 	t := &Transaction{
-		conn: p.NewConn(),
+		pool:           p,
+		ctx:            ctx,
+		requirePrimary: primaryIsRequired(ctx),
+	}
+	if len(p.aliased) > 0 {
+		if err := t.loadAliases(); err != nil {
+			t.setError(err)
+		}
+	}
+	return t
+}
+
+// loadAliases watches the hash of aliases, then reads the aliases of the
+// collections in p.aliased and switches them to the names it finds.
+func (t *Transaction) loadAliases() error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	key := t.pool.aliasesKey()
+	conn, err := t.getConn(key)
+	if err != nil {
+		return err
 	}
+	args := Args{key}
+	for _, spec := range t.pool.aliased {
+		args = append(args, spec.name)
+	}
+	if err := conn.Send("WATCH", key); err != nil {
+		return err
+	}
+	t.watching = append(t.watching, key)
+	targets, err := redis.Strings(execConn(t.ctx, conn).Do("HMGET", args...))
+	if err != nil {
+		return err
+	}
+	for i, spec := range t.pool.aliased {
+		if targets[i] == "" {
+			targets[i] = spec.name
+		}
+		spec.target.Store(targets[i])
+	}
+	return nil
+}
+
+// newReadTransaction is like NewTransactionContext but returns a transaction
+// which may be sent to a replica. It is used by methods which only read from
+// the database.
+func (p *Pool) newReadTransaction(ctx context.Context) *Transaction {
+	t := p.NewTransactionContext(ctx)
+	t.PreferReplica()
 	return t
 }
 
+// primaryContextKey is the key for the value set by WithPrimary.
+type primaryContextKey struct{}
+
+// WithPrimary returns a copy of parent which causes any transaction bound to
+// it to be sent to the primary instead of a replica. Use it with the Context
+// variants of methods which would otherwise read from a replica (e.g.
+// Collection.FindContext) when you need to read your own writes. It has no
+// effect if the pool was not configured with replica addresses.
+func WithPrimary(parent context.Context) context.Context {
+	return context.WithValue(parent, primaryContextKey{}, true)
+}
+
+// primaryIsRequired returns true iff ctx was created by WithPrimary.
+func primaryIsRequired(ctx context.Context) bool {
+	required, _ := ctx.Value(primaryContextKey{}).(bool)
+	return required
+}
+
+// PreferReplica allows the transaction to be sent to one of the replicas in
+// PoolOptions.ReplicaAddresses. The transaction will only be sent to a replica
+// if every action in it is a command which only reads from the database and no
+// keys are being watched. Otherwise it will be sent to the primary. Methods
+// which only read from the database (e.g. Collection.Find and Query.Run) call
+// PreferReplica automatically. Replicas are updated asynchronously, so a
+// transaction which is sent to a replica might not see the most recent writes.
+func (t *Transaction) PreferReplica() {
+	t.preferReplica = true
+}
+
+// RequirePrimary causes the transaction to be sent to the primary, even if
+// PreferReplica has been called.
+func (t *Transaction) RequirePrimary() {
+	t.requirePrimary = true
+}
+
+// useReplica returns true iff the transaction should be sent to a replica.
+func (t *Transaction) useReplica() bool {
+	if !t.preferReplica || t.requirePrimary || t.conn != nil || len(t.watching) > 0 {
+		return false
+	}
+	for _, a := range t.actions {
+		if !a.readOnly() && !a.optionalWrite {
+			return false
+		}
+	}
+	return true
+}
+
+// execOptionalWrites removes the actions for which optionalWrite is true from
+// the transaction and executes them in a separate transaction which is sent to
+// the primary.
+func (t *Transaction) execOptionalWrites() error {
+	writes := &Transaction{
+		pool:           t.pool,
+		ctx:            t.ctx,
+		requirePrimary: true,
+	}
+	actions := t.actions[:0]
+	for _, a := range t.actions {
+		if a.optionalWrite {
+			writes.actions = append(writes.actions, a)
+		} else {
+			actions = append(actions, a)
+		}
+	}
+	t.actions = actions
+	if len(writes.actions) == 0 {
+		return nil
+	}
+	return writes.Exec()
+}
+
+// Context returns the context the transaction is bound to. For transactions
+// created with NewTransaction, it is context.Background().
+func (t *Transaction) Context() context.Context {
+	return t.ctx
+}
+
 // SetError sets the err property of the transaction iff it was not already
 // set. This will cause exec to fail immediately.
 func (t *Transaction) setError(err error) {
@@ -84,20 +256,51 @@ func (t *Transaction) Watch(model Model) error {
 // the WATCH command works, WatchKey must send a command to Redis immediately.
 // You must call Watch or WatchKey before any other transaction methods.
 func (t *Transaction) WatchKey(key string) error {
+	return t.watchKeys(key)
+}
+
+// watchKeys is like WatchKey but watches all the given keys with a single
+// WATCH command.
+func (t *Transaction) watchKeys(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
 	if len(t.actions) != 0 {
 		return fmt.Errorf("Cannot call WatchKey after other commands have been added to the transaction")
 	}
-	if _, err := t.conn.Do("WATCH", key); err != nil {
+	if t.err != nil {
+		return t.err
+	}
+	if err := t.ctx.Err(); err != nil {
 		return err
 	}
-	t.watching = append(t.watching, key)
+	watching := append(append([]string{}, t.watching...), keys...)
+	if t.pool.driver.Cluster() {
+		for _, key := range watching[1:] {
+			if keySlot(key) != keySlot(watching[0]) {
+				return newCrossSlotError(watching[0], key)
+			}
+		}
+	}
+	conn, err := t.getConn(keys[0])
+	if err != nil {
+		return err
+	}
+	args := make(Args, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	if _, err := execConn(t.ctx, conn).Do("WATCH", args...); err != nil {
+		return err
+	}
+	t.watching = watching
 	return nil
 }
 
 // Command adds a command action to the transaction with the given args.
 // handler will be called with the reply from this specific command when
 // the transaction is executed.
-func (t *Transaction) Command(name string, args redis.Args, handler ReplyHandler) {
+func (t *Transaction) Command(name string, args Args, handler ReplyHandler) {
 	t.actions = append(t.actions, &Action{
 		kind:    commandAction,
 		name:    name,
@@ -109,7 +312,7 @@ func (t *Transaction) Command(name string, args redis.Args, handler ReplyHandler
 // Script adds a script action to the transaction with the given args.
 // handler will be called with the reply from this specific script when
 // the transaction is executed.
-func (t *Transaction) Script(script *redis.Script, args redis.Args, handler ReplyHandler) {
+func (t *Transaction) Script(script *Script, args Args, handler ReplyHandler) {
 	t.actions = append(t.actions, &Action{
 		kind:    scriptAction,
 		script:  script,
@@ -118,86 +321,402 @@ func (t *Transaction) Script(script *redis.Script, args redis.Args, handler Repl
 	})
 }
 
+// removeAction removes the given action from the transaction, if it is part of
+// it. It is used by the functions in beforeExec, which may find that an action
+// is not needed after all.
+func (t *Transaction) removeAction(action *Action) {
+	actions := t.actions[:0]
+	for _, a := range t.actions {
+		if a != action {
+			actions = append(actions, a)
+		}
+	}
+	t.actions = actions
+}
+
+// key returns the first key that the action touches, or an empty string if
+// the action does not touch any keys (or the key cannot be determined). It is
+// used to route the transaction to the right node in cluster mode.
+func (a *Action) key() string {
+	switch a.kind {
+	case commandAction:
+		if len(a.args) == 0 || keylessCommands[strings.ToUpper(a.name)] {
+			return ""
+		}
+		return keyString(a.args[0])
+	case scriptAction:
+		return a.script.firstKey(a.args)
+	}
+	return ""
+}
+
+// readOnly returns true iff the action is a command which does not write to the
+// database. Scripts are never considered read-only.
+func (a *Action) readOnly() bool {
+	if a.kind != commandAction {
+		return false
+	}
+	name := strings.ToUpper(a.name)
+	if name == "SORT" {
+		// SORT writes to the database iff the STORE option is used.
+		for _, arg := range a.args {
+			if strings.ToUpper(keyString(arg)) == "STORE" {
+				return false
+			}
+		}
+		return true
+	}
+	return readOnlyCommands[name]
+}
+
+// readOnlyCommands is the set of commands which do not write to the database
+// and may be sent to a replica.
+var readOnlyCommands = map[string]bool{
+	"EXISTS":           true,
+	"GET":              true,
+	"HEXISTS":          true,
+	"HGET":             true,
+	"HGETALL":          true,
+	"HKEYS":            true,
+	"HLEN":             true,
+	"HMGET":            true,
+	"HSCAN":            true,
+	"HVALS":            true,
+	"MGET":             true,
+	"PTTL":             true,
+	"SCAN":             true,
+	"SCARD":            true,
+	"SISMEMBER":        true,
+	"SMEMBERS":         true,
+	"SSCAN":            true,
+	"TTL":              true,
+	"TYPE":             true,
+	"ZCARD":            true,
+	"ZCOUNT":           true,
+	"ZLEXCOUNT":        true,
+	"ZRANGE":           true,
+	"ZRANGEBYLEX":      true,
+	"ZRANGEBYSCORE":    true,
+	"ZRANK":            true,
+	"ZREVRANGE":        true,
+	"ZREVRANGEBYLEX":   true,
+	"ZREVRANGEBYSCORE": true,
+	"ZREVRANK":         true,
+	"ZSCAN":            true,
+	"ZSCORE":           true,
+}
+
+// keylessCommands is the set of commands for which the first argument is not a
+// key.
+var keylessCommands = map[string]bool{
+	"CLIENT":   true,
+	"CLUSTER":  true,
+	"CONFIG":   true,
+	"DBSIZE":   true,
+	"ECHO":     true,
+	"EVAL":     true,
+	"EVALSHA":  true,
+	"FLUSHALL": true,
+	"FLUSHDB":  true,
+	"INFO":     true,
+	"KEYS":     true,
+	"PING":     true,
+	"PUBLISH":  true,
+	"SCAN":     true,
+	"SCRIPT":   true,
+	"TIME":     true,
+}
+
+// keyString returns arg as a string if it is a string or a slice of bytes. It
+// returns an empty string otherwise.
+func keyString(arg interface{}) string {
+	switch key := arg.(type) {
+	case string:
+		return key
+	case []byte:
+		return string(key)
+	}
+	return ""
+}
+
 // sendAction writes a to a connection buffer using conn.Send()
-func (t *Transaction) sendAction(a *Action) error {
+func sendAction(conn Conn, a *Action) error {
 	switch a.kind {
 	case commandAction:
-		return t.conn.Send(a.name, a.args...)
+		return conn.Send(a.name, a.args...)
 	case scriptAction:
-		return a.script.Send(t.conn, a.args...)
+		return a.script.send(conn, a.args)
 	}
 	return nil
 }
 
 // doAction writes a to the connection buffer and then immediately
 // flushes the buffer and reads the reply via conn.Do()
-func (t *Transaction) doAction(a *Action) (interface{}, error) {
+func doAction(conn Conn, a *Action) (interface{}, error) {
 	switch a.kind {
 	case commandAction:
-		return t.conn.Do(a.name, a.args...)
+		return conn.Do(a.name, a.args...)
 	case scriptAction:
-		return a.script.Do(t.conn, a.args...)
+		return a.script.do(conn, a.args)
 	}
 	return nil, nil
 }
 
 // Exec executes the transaction, sequentially sending each action and
-// calling all the action handlers with the corresponding replies.
+// calling all the action handlers with the corresponding replies. If the
+// transaction is bound to a context (see Pool.NewTransactionContext), Exec will
+// return early with the error from the context if it is canceled or its
+// deadline passes. If Pool.Shutdown has been called, Exec returns
+// ErrPoolShutdown without sending anything to Redis. If the pool has any hooks
+// (see PoolOptions.Hooks), they are called before and after the transaction
+// and each of its actions.
 func (t *Transaction) Exec() error {
-	// Return the connection to the pool when we are done
-	defer t.conn.Close()
+	if hooks := t.pool.options.Hooks; len(hooks) > 0 {
+		return t.runExecHooks(hooks, t.exec)
+	}
+	return t.exec(t.ctx)
+}
 
+// exec does the work for Exec. hookCtx is the context which is passed to the
+// hooks for the actions (see Hook.BeforeExec).
+func (t *Transaction) exec(hookCtx context.Context) error {
+	if !t.pool.beginExec() {
+		t.closeConn()
+		return ErrPoolShutdown
+	}
+	defer t.pool.endExec()
 	// If the transaction had an error from a previous command, return it
 	// and don't continue
 	if t.err != nil {
+		t.closeConn()
 		return t.err
 	}
-
-	if len(t.actions) == 1 && len(t.watching) == 0 {
-		// If there is only one command and no keys being watched, no need to use
-		// MULTI/EXEC
-		a := t.actions[0]
-		reply, err := t.doAction(a)
+	if err := t.ctx.Err(); err != nil {
+		t.closeConn()
+		return err
+	}
+	for _, f := range t.beforeExec {
+		if err := f(); err != nil {
+			t.closeConn()
+			return err
+		}
+	}
+	key, err := t.routingKey()
+	if err != nil {
+		t.closeConn()
+		return err
+	}
+	if t.useReplica() {
+		// Replicas cannot be written to, so the optional writes (if any) are
+		// sent to the primary first.
+		if err := t.execOptionalWrites(); err != nil {
+			return err
+		}
+		conn, err := t.pool.getReplicaConn(t.ctx)
 		if err != nil {
 			return err
 		}
+		t.conn = conn
+	}
+	infos := t.beforeActions(hookCtx)
+	start := time.Now()
+	replies, err := t.roundTripContext(key)
+	if err != nil && t.pool.driver.HandleError(err) && len(t.watching) == 0 {
+		// The driver recovered from the error (e.g. a MOVED error in cluster
+		// mode) and nothing was watched, so it is safe to try again.
+		if replies, err = t.roundTripContext(key); err != nil {
+			t.handleError(err)
+		}
+	}
+	t.afterActions(hookCtx, infos, start, replies, err)
+	if err != nil {
+		return err
+	}
+	// Iterate through the replies, calling the corresponding handler functions
+	for i, reply := range replies {
+		a := t.actions[i]
+		if err, ok := reply.(error); ok {
+			return t.handleError(err)
+		}
 		if a.handler != nil {
 			if err := a.handler(reply); err != nil {
 				return err
 			}
 		}
-	} else {
-		// Send all the commands and scripts at once using MULTI/EXEC
-		if err := t.conn.Send("MULTI"); err != nil {
+	}
+	for _, f := range t.afterExec {
+		if err := f(); err != nil {
 			return err
 		}
-		for _, a := range t.actions {
-			if err := t.sendAction(a); err != nil {
-				return err
-			}
-		}
-		// Invoke redis driver to execute the transaction
-		replies, err := redis.Values(t.conn.Do("EXEC"))
+	}
+	return nil
+}
+
+// handleError gives the driver a chance to react to an error returned by Redis
+// (e.g. a READONLY error after a failover) and then returns err.
+func (t *Transaction) handleError(err error) error {
+	t.pool.driver.HandleError(err)
+	return err
+}
+
+// getConn returns the connection used by the transaction, getting one from
+// the pool if needed. In cluster mode, the connection is to the node which
+// serves key.
+func (t *Transaction) getConn(key string) (Conn, error) {
+	if t.conn == nil {
+		conn, err := t.pool.getConn(t.ctx, key)
 		if err != nil {
-			if err == redis.ErrNil && len(t.watching) > 0 {
-				return WatchError{keys: t.watching}
+			return nil, err
+		}
+		t.conn = conn
+	}
+	return t.conn, nil
+}
+
+// closeConn closes the connection used by the transaction, if any.
+func (t *Transaction) closeConn() {
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+}
+
+// routingKey returns the first key touched by the transaction (including
+// watched keys), or an empty string if there are none. In cluster mode, it
+// returns an error if the keys do not all hash to the same slot.
+func (t *Transaction) routingKey() (string, error) {
+	keys := append([]string{}, t.watching...)
+	for _, a := range t.actions {
+		if key := a.key(); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return "", nil
+	}
+	if t.pool.driver.Cluster() {
+		slot := keySlot(keys[0])
+		for _, key := range keys[1:] {
+			if keySlot(key) != slot {
+				return "", newCrossSlotError(keys[0], key)
 			}
-			return err
 		}
-		// Iterate through the replies, calling the corresponding handler functions
-		for i, reply := range replies {
-			a := t.actions[i]
-			if err, ok := reply.(error); ok {
-				return err
+	}
+	return keys[0], nil
+}
+
+// newCrossSlotError returns an error indicating that key1 and key2 cannot be
+// used in the same transaction because they hash to different slots.
+func newCrossSlotError(key1, key2 string) error {
+	return fmt.Errorf("zoom: Error in Transaction: keys %s and %s hash to different slots. In cluster mode, all the keys in a transaction must hash to the same slot", key1, key2)
+}
+
+// roundTripContext gets a connection for key (if the transaction does not
+// already have one), calls roundTrip and closes the connection when it is done.
+// If t.ctx can be canceled, the round trip happens in a separate goroutine so
+// that we can stop waiting for it as soon as t.ctx is done. The goroutine
+// always runs to completion (bounded by the deadline of t.ctx, if any) so the
+// connection is not returned to the pool while it is still in use.
+func (t *Transaction) roundTripContext(key string) ([]interface{}, error) {
+	conn, err := t.getConn(key)
+	if err != nil {
+		return nil, err
+	}
+	// From now on, the connection is owned by the round trip.
+	t.conn = nil
+	if t.ctx.Done() == nil {
+		defer conn.Close()
+		return t.roundTrip(conn)
+	}
+	type result struct {
+		replies []interface{}
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer conn.Close()
+		replies, err := t.roundTrip(conn)
+		done <- result{replies: replies, err: err}
+	}()
+	select {
+	case res := <-done:
+		if res.err != nil {
+			// The error was most likely caused by the read timeout we set from
+			// the deadline of t.ctx. Report the context error instead. The read
+			// timeout can fire slightly before t.ctx is marked as done, so also
+			// check the deadline directly.
+			if err := t.ctx.Err(); err != nil {
+				return nil, err
 			}
-			if a.handler != nil {
-				if err := a.handler(reply); err != nil {
-					return err
-				}
+			if deadline, ok := t.ctx.Deadline(); ok && !time.Now().Before(deadline) {
+				return nil, context.DeadlineExceeded
 			}
 		}
+		return res.replies, res.err
+	case <-t.ctx.Done():
+		return nil, t.ctx.Err()
 	}
-	return nil
+}
+
+// roundTrip sends all the actions in the transaction to Redis using conn and
+// returns the replies in the same order. It does not call any reply handlers.
+func (t *Transaction) roundTrip(conn Conn) ([]interface{}, error) {
+	conn = execConn(t.ctx, conn)
+	if len(t.actions) == 1 && len(t.watching) == 0 {
+		// If there is only one command and no keys being watched, no need to use
+		// MULTI/EXEC
+		reply, err := doAction(conn, t.actions[0])
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{reply}, nil
+	}
+	// Send all the commands and scripts at once using MULTI/EXEC
+	if err := conn.Send("MULTI"); err != nil {
+		return nil, err
+	}
+	for _, a := range t.actions {
+		if err := sendAction(conn, a); err != nil {
+			return nil, err
+		}
+	}
+	// Invoke redis driver to execute the transaction
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		if err == redis.ErrNil && len(t.watching) > 0 {
+			return nil, WatchError{keys: t.watching}
+		}
+		return nil, err
+	}
+	return replies, nil
+}
+
+// execConn returns the connection that should be used to send commands to
+// Redis. If ctx has a deadline and conn supports read timeouts, every reply
+// will be read with a timeout that expires at the deadline.
+func execConn(ctx context.Context, conn Conn) Conn {
+	if deadline, ok := ctx.Deadline(); ok {
+		if timeoutConn, ok := conn.(ConnWithTimeout); ok {
+			return deadlineConn{ConnWithTimeout: timeoutConn, deadline: deadline}
+		}
+	}
+	return conn
+}
+
+// deadlineConn wraps a ConnWithTimeout and uses a read timeout which expires
+// at deadline for every call to Do.
+type deadlineConn struct {
+	ConnWithTimeout
+	deadline time.Time
+}
+
+// Do satisfies Conn.
+func (c deadlineConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	timeout := time.Until(c.deadline)
+	if timeout <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+	return c.DoWithTimeout(timeout, commandName, args...)
 }
 
 //go:generate go run scripts/main.go
@@ -207,18 +726,66 @@ func (t *Transaction) Exec() error {
 // (not sorted set) identified by setKey and return the number of models that
 // were deleted. You can pass in a handler (e.g. NewScanIntHandler) to capture
 // the return value of the script. You can use the Name method of a Collection
-// to get the name.
+// to get the name. The collection must have been registered with the same pool
+// as the transaction. The ids are read right before the transaction is
+// executed, so that the keys of the models can be passed to the script, and the
+// set is watched from then on. If the set changes before the transaction is
+// executed, Exec returns a WatchError.
 func (t *Transaction) DeleteModelsBySetIds(setKey string, collectionName string, handler ReplyHandler) {
-	t.Script(deleteModelsBySetIdsScript, redis.Args{setKey, collectionName}, handler)
+	spec, found := t.pool.modelNameToSpec[collectionName]
+	if !found {
+		t.setError(fmt.Errorf("zoom: Error in DeleteModelsBySetIds: Could not find collection with name %s", collectionName))
+		return
+	}
+	action := &Action{
+		kind:    scriptAction,
+		script:  deleteModelsBySetIdsScript,
+		handler: handler,
+	}
+	t.actions = append(t.actions, action)
+	t.beforeExec = append(t.beforeExec, func() error {
+		conn, err := t.getConn(setKey)
+		if err != nil {
+			return err
+		}
+		conn = execConn(t.ctx, conn)
+		if err := conn.Send("WATCH", setKey); err != nil {
+			return err
+		}
+		ids, err := redis.Strings(conn.Do("SMEMBERS", setKey))
+		if err != nil {
+			return err
+		}
+		t.watching = append(t.watching, setKey)
+		keys := Args{setKey, spec.indexKey()}
+		args := Args{}
+		for _, id := range ids {
+			keys = append(keys, spec.keyspace()+":"+id)
+			args = append(args, id)
+		}
+		action.args = variadicScriptArgs(keys, args...)
+		return nil
+	})
 }
 
 // deleteStringIndex is a small function wrapper around a Lua script. The script
-// will atomically remove the existing string index, if any, on the given
-// fieldName for the model with the given modelId. You can use the Name method
-// of a Collection to get its name. fieldName should be the name as it is stored
-// in Redis.
-func (t *Transaction) deleteStringIndex(collectionName, modelId, fieldName string) {
-	t.Script(deleteStringIndexScript, redis.Args{collectionName, modelId, fieldName}, nil)
+// will atomically remove the existing string index, if any, on the field
+// identified by fieldName for the model with the given modelId. fieldName
+// should be the name of the field in the struct definition, not the name as it
+// is stored in Redis.
+func (t *Transaction) deleteStringIndex(spec *modelSpec, modelId, fieldName string) {
+	modelKey, err := spec.modelKey(modelId)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	indexKey, err := spec.fieldIndexKey(fieldName)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	redisName := spec.fieldsByName[fieldName].redisName
+	t.Script(deleteStringIndexScript, Args{modelKey, indexKey, spec.stringValuesKey(), modelId, redisName}, nil)
 }
 
 // ExtractIdsFromFieldIndex is a small function wrapper around a Lua script. The
@@ -228,7 +795,7 @@ func (t *Transaction) deleteStringIndex(collectionName, modelId, fieldName strin
 // Note that this method will not work on sorted sets that represents string
 // indexes because they are stored differently.
 func (t *Transaction) ExtractIdsFromFieldIndex(setKey string, destKey string, min interface{}, max interface{}) {
-	t.Script(extractIdsFromFieldIndexScript, redis.Args{setKey, destKey, min, max}, nil)
+	t.Script(extractIdsFromFieldIndexScript, Args{setKey, destKey, min, max}, nil)
 }
 
 // ExtractIdsFromStringIndex is a small function wrapper around a Lua script.
@@ -242,5 +809,5 @@ func (t *Transaction) ExtractIdsFromFieldIndex(setKey string, destKey string, mi
 // respectively). Note that the stored ids are sorted in ASCII order according
 // to their corresponding string values.
 func (t *Transaction) ExtractIdsFromStringIndex(setKey, destKey, min, max string) {
-	t.Script(extractIdsFromStringIndexScript, redis.Args{setKey, destKey, min, max}, nil)
+	t.Script(extractIdsFromStringIndexScript, Args{setKey, destKey, min, max}, nil)
 }
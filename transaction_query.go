@@ -85,6 +85,20 @@ func (q *TransactionQuery) Filter(filterString string, value interface{}) *Trans
 	return q
 }
 
+// WithDeleted works exactly like Query.WithDeleted. See the documentation for
+// Query.WithDeleted for more information.
+func (q *TransactionQuery) WithDeleted() *TransactionQuery {
+	q.query.WithDeleted()
+	return q
+}
+
+// OnlyDeleted works exactly like Query.OnlyDeleted. See the documentation for
+// Query.OnlyDeleted for more information.
+func (q *TransactionQuery) OnlyDeleted() *TransactionQuery {
+	q.query.OnlyDeleted()
+	return q
+}
+
 // Run will run the query and scan the results into models when the Transaction
 // is executed. It works very similarly to Query.Run, so you can check the
 // documentation for Query.Run for more information. The first error encountered
@@ -99,6 +113,7 @@ func (q *TransactionQuery) Run(models interface{}) {
 		q.tx.setError(err)
 		return
 	}
+	q.tx.sweepExpiredLazily(q.collection)
 	idsKey, tmpKeys, err := generateIdsSet(q.query, q.tx)
 	if err != nil {
 		q.tx.setError(err)
@@ -111,9 +126,17 @@ func (q *TransactionQuery) Run(models interface{}) {
 		limit = -1
 	}
 	sortArgs := q.collection.spec.sortArgs(idsKey, q.redisFieldNames(), limit, q.offset, q.order.kind == descendingOrder)
-	q.tx.Command("SORT", sortArgs, newScanModelsHandler(q.collection.spec, append(q.fieldNames(), "-"), models))
+	fieldNames := append(q.fieldNames(), "-")
+	handler := newScanModelsHandler(q.collection.spec, fieldNames, models)
+	if !q.collection.index {
+		// The models in an unindexed collection may have been deleted after
+		// their ids were scanned.
+		handler = skipMissingModelsHandler(len(fieldNames), handler)
+	}
+	q.tx.Command("SORT", sortArgs, handler)
+	q.tx.afterFindAll(q.collection, models)
 	if len(tmpKeys) > 0 {
-		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
+		q.tx.Command("DEL", (Args{}).Add(tmpKeys...), nil)
 	}
 }
 
@@ -133,6 +156,7 @@ func (q *TransactionQuery) RunOne(model Model) {
 		q.tx.setError(err)
 		return
 	}
+	q.tx.sweepExpiredLazily(q.collection)
 	idsKey, tmpKeys, err := generateIdsSet(q.query, q.tx)
 	if err != nil {
 		q.tx.setError(err)
@@ -140,8 +164,9 @@ func (q *TransactionQuery) RunOne(model Model) {
 	}
 	sortArgs := q.collection.spec.sortArgs(idsKey, q.redisFieldNames(), 1, q.offset, q.order.kind == descendingOrder)
 	q.tx.Command("SORT", sortArgs, newScanOneModelHandler(q.query, q.collection.spec, append(q.fieldNames(), "-"), model))
+	q.tx.afterFind(model)
 	if len(tmpKeys) > 0 {
-		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
+		q.tx.Command("DEL", (Args{}).Add(tmpKeys...), nil)
 	}
 }
 
@@ -156,9 +181,15 @@ func (q *TransactionQuery) Count(count *int) {
 		q.tx.setError(q.err)
 		return
 	}
-	if !q.hasFilters() {
-		// Start by getting the number of models in the all index set
-		q.tx.Command("SCARD", redis.Args{q.collection.spec.indexKey()}, func(reply interface{}) error {
+	if q.collection.index && !q.hasFilters() && q.scope != includeDeleted {
+		// Start by getting the number of models in the all index set (or the
+		// set of soft deleted models)
+		q.tx.sweepExpiredLazily(q.collection)
+		setKey := q.collection.spec.indexKey()
+		if q.scope == onlyDeleted {
+			setKey = q.collection.spec.deletedKey()
+		}
+		q.tx.Command("SCARD", Args{setKey}, func(reply interface{}) error {
 			gotCount, err := redis.Int(reply, nil)
 			if err != nil {
 				return err
@@ -179,11 +210,11 @@ func (q *TransactionQuery) Count(count *int) {
 		// Instead we'll just count the number of ids that match the query
 		// criteria. To do in a single transaction, we use the StoreIds method and
 		// then add a LLEN command.
-		destKey := generateRandomKey("tmp:countDestKey")
+		destKey := q.collection.spec.tmpKey("countDestKey")
 		q.StoreIds(destKey)
-		q.tx.Command("LLEN", redis.Args{destKey}, NewScanIntHandler(count))
+		q.tx.Command("LLEN", Args{destKey}, NewScanIntHandler(count))
 		// Delete the temporary destKey when we're done.
-		q.tx.Command("DEL", redis.Args{destKey}, nil)
+		q.tx.Command("DEL", Args{destKey}, nil)
 	}
 }
 
@@ -197,6 +228,7 @@ func (q *TransactionQuery) Ids(ids *[]string) {
 		q.tx.setError(q.err)
 		return
 	}
+	q.tx.sweepExpiredLazily(q.collection)
 	idsKey, tmpKeys, err := generateIdsSet(q.query, q.tx)
 	if err != nil {
 		q.tx.setError(err)
@@ -210,7 +242,7 @@ func (q *TransactionQuery) Ids(ids *[]string) {
 	sortArgs := q.collection.spec.sortArgs(idsKey, nil, limit, q.offset, q.order.kind == descendingOrder)
 	q.tx.Command("SORT", sortArgs, NewScanStringsHandler(ids))
 	if len(tmpKeys) > 0 {
-		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
+		q.tx.Command("DEL", (Args{}).Add(tmpKeys...), nil)
 	}
 }
 
@@ -225,6 +257,7 @@ func (q *TransactionQuery) StoreIds(destKey string) {
 		q.tx.setError(q.err)
 		return
 	}
+	q.tx.sweepExpiredLazily(q.collection)
 	idsKey, tmpKeys, err := generateIdsSet(q.query, q.tx)
 	if err != nil {
 		q.tx.setError(err)
@@ -240,6 +273,6 @@ func (q *TransactionQuery) StoreIds(destKey string) {
 	sortAndStoreArgs := append(sortArgs, "STORE", destKey)
 	q.tx.Command("SORT", sortAndStoreArgs, nil)
 	if len(tmpKeys) > 0 {
-		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
+		q.tx.Command("DEL", (Args{}).Add(tmpKeys...), nil)
 	}
 }
@@ -1,6 +1,9 @@
 package zoom
 
 import (
+	"context"
+	"time"
+
 	"github.com/garyburd/redigo/redis"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -27,7 +30,7 @@ func TestWatch(t *testing.T) {
 	require.NoError(t, testModels.Save(model))
 	// Try to update the model using the transaction. We expect this to fail
 	// and return a WatchError
-	tx.Command("HSET", redis.Args{testModels.ModelKey(model.Id), "Int", 35}, nil)
+	tx.Command("HSET", Args{testModels.ModelKey(model.Id), "Int", 35}, nil)
 	err := tx.Exec()
 	assert.Error(t, err)
 	assert.IsType(t, WatchError{}, err)
@@ -59,7 +62,7 @@ func TestWatchKey(t *testing.T) {
 	require.NoError(t, err)
 	// Try to update the key using the transaction. We expect this to fail
 	// and return a WatchError
-	tx.Command("SET", redis.Args{key, "should_not_be_set"}, nil)
+	tx.Command("SET", Args{key, "should_not_be_set"}, nil)
 	err = tx.Exec()
 	assert.Error(t, err)
 	assert.IsType(t, WatchError{}, err)
@@ -71,3 +74,109 @@ func TestWatchKey(t *testing.T) {
 	require.NoError(t, err)
 	require.Exactly(t, expectedVal, got)
 }
+
+func TestTransactionContextCanceled(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	ctx, cancel := context.WithCancel(context.Background())
+	tx := testPool.NewTransactionContext(ctx)
+	model := &testModel{
+		Int:    42,
+		String: "foo",
+		Bool:   true,
+	}
+	tx.Save(testModels, model)
+	// Cancel the context before executing the transaction. We expect Exec to
+	// return context.Canceled and the model should not be saved.
+	cancel()
+	assert.Equal(t, context.Canceled, tx.Exec())
+	expectModelDoesNotExist(t, testModels, model)
+}
+
+func TestTransactionContextDeadline(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	// The deadline is far enough in the future that the transaction should
+	// succeed.
+	model := &testModel{
+		Int:    42,
+		String: "foo",
+		Bool:   true,
+	}
+	require.NoError(t, testModels.SaveContext(ctx, model))
+	other := &testModel{}
+	require.NoError(t, testModels.FindContext(ctx, model.Id, other))
+	assert.Equal(t, model, other)
+	// Block the server with a script that runs for longer than the deadline
+	// of a new context. We expect Exec to stop waiting and return
+	// context.DeadlineExceeded.
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	tx := testPool.NewTransactionContext(ctx)
+	tx.Script(NewScript(0, `
+		local start = redis.call("TIME")
+		while true do
+			local now = redis.call("TIME")
+			if tonumber(now[1]) - tonumber(start[1]) >= 1 then
+				return 1
+			end
+		end`), nil, nil)
+	assert.Equal(t, context.DeadlineExceeded, tx.Exec())
+}
+
+func TestTransactionUseReplica(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	// Use the test database as a replica of itself so that we can check which
+	// pool each transaction uses.
+	driver := testPool.driver.(*redigoDriver)
+	replica := testPool.options.newRedisPool(&driver.dialErrors, testPool.options.dial, nil)
+	defer replica.Close()
+	driver.replicas = []*redis.Pool{replica}
+	defer func() {
+		driver.replicas = nil
+	}()
+
+	// Writes should always go to the primary.
+	model := &testModel{
+		Int:    42,
+		String: "foo",
+		Bool:   true,
+	}
+	require.NoError(t, testModels.Save(model))
+	assert.Equal(t, 0, replica.IdleCount())
+
+	// Reads should go to the replica by default.
+	other := &testModel{}
+	require.NoError(t, testModels.Find(model.Id, other))
+	assert.Equal(t, model, other)
+	assert.Equal(t, 1, replica.IdleCount())
+
+	// A transaction which contains a write should go to the primary even if
+	// PreferReplica was called.
+	tx := testPool.NewTransaction()
+	tx.PreferReplica()
+	tx.Find(testModels, model.Id, other)
+	tx.Command("SORT", Args{testModels.IndexKey(), "STORE", "foo"}, nil)
+	assert.False(t, tx.useReplica())
+	tx.Exec()
+
+	// Transactions created with NewTransaction should go to the primary by
+	// default.
+	tx = testPool.NewTransaction()
+	tx.Find(testModels, model.Id, other)
+	assert.False(t, tx.useReplica())
+
+	// RequirePrimary and WithPrimary should override PreferReplica.
+	tx = testPool.NewTransaction()
+	tx.PreferReplica()
+	tx.Find(testModels, model.Id, other)
+	assert.True(t, tx.useReplica())
+	tx.RequirePrimary()
+	assert.False(t, tx.useReplica())
+	tx = testPool.newReadTransaction(WithPrimary(context.Background()))
+	tx.Find(testModels, model.Id, other)
+	assert.False(t, tx.useReplica())
+}
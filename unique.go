@@ -0,0 +1,185 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File unique.go contains code related to unique fields, including the FindBy
+// method.
+
+package zoom
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// FindBy finds the model whose unique field identified by fieldName has the
+// given value and scans its values into model. The field must have the
+// `zoom:"unique"` struct tag (see Collection.Save), and value must be
+// assignable to it in the same way as for SetField. The lookup uses the hash of
+// unique values, so it does not require the collection to be indexed. FindBy
+// returns a ModelNotFoundError if no model has the value, or if the model has
+// been soft deleted.
+func (c *Collection) FindBy(fieldName string, value interface{}, model Model) error {
+	return c.FindByContext(context.Background(), fieldName, value, model)
+}
+
+// FindByContext is like FindBy but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) FindByContext(ctx context.Context, fieldName string, value interface{}, model Model) error {
+	for attempt := 0; attempt < maxFindByAttempts; attempt++ {
+		t := c.pool.NewTransactionContext(ctx)
+		t.FindBy(c, fieldName, value, model)
+		err := t.Exec()
+		if _, ok := err.(WatchError); !ok {
+			return err
+		}
+	}
+	return fmt.Errorf("zoom: Error in FindBy: The value %v of %s kept moving to other models while it was looked up", value, fieldName)
+}
+
+// maxFindByAttempts is the number of times FindBy looks up a unique value
+// before giving up if the value keeps moving to other models concurrently.
+const maxFindByAttempts = 10
+
+// FindBy finds the model whose unique field identified by fieldName has the
+// given value and scans its values into model in an existing transaction. Any
+// errors encountered, including a ModelNotFoundError if no model has the value,
+// will be added to the transaction and returned as an error when the
+// transaction is executed. The id of the model is looked up right before the
+// transaction is executed, so that the key of the model can be passed to the
+// script which reads it. If the value is given to another model in the
+// meantime, Exec returns a WatchError.
+// NOTE: this invokes a lua script which is defined in scripts/find_by.lua
+func (t *Transaction) FindBy(c *Collection, fieldName string, value interface{}, model Model) {
+	if c == nil {
+		t.setError(newNilCollectionError("FindBy"))
+		return
+	}
+	if err := c.checkModelType(model); err != nil {
+		t.setError(fmt.Errorf("zoom: Error in FindBy or Transaction.FindBy: %s", err.Error()))
+		return
+	}
+	uniqueKey, err := c.spec.uniqueKey(fieldName)
+	if err != nil {
+		t.setError(fmt.Errorf("zoom: Error in FindBy or Transaction.FindBy: %s", err.Error()))
+		return
+	}
+	hashValue, err := c.newModelRef("").setFieldValue("FindBy", c.spec.fieldsByName[fieldName], value)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	mr := &modelRef{
+		collection: c,
+		model:      model,
+		spec:       c.spec,
+	}
+	// id is the id of the model which has the value, which is looked up
+	// right before the transaction is executed.
+	id := ""
+	action := &Action{
+		kind:   scriptAction,
+		script: findByScript,
+		handler: func(reply interface{}) error {
+			// The reply consists of a status followed by the values of the fields
+			// if the model was found. See the script for details.
+			fieldValues, err := redis.Values(reply, nil)
+			if err != nil {
+				return err
+			}
+			if len(fieldValues) == 0 {
+				return fmt.Errorf("zoom: Error in FindBy: Unexpected reply from Redis: %v", fieldValues)
+			}
+			switch status, _ := redis.Int64(fieldValues[0], nil); status {
+			case 0:
+				return newModelNotFoundError(c.newModelRef(""))
+			case -1:
+				return WatchError{keys: []string{uniqueKey}}
+			}
+			fieldValues[0] = id
+			return scanModel(append([]string{"-"}, c.spec.fieldNames()...), fieldValues, mr)
+		},
+	}
+	t.actions = append(t.actions, action)
+	t.beforeExec = append(t.beforeExec, func() error {
+		tx := t.pool.NewTransactionContext(t.ctx)
+		tx.Command("HGET", Args{uniqueKey, hashValue}, func(reply interface{}) error {
+			if reply == nil {
+				return nil
+			}
+			var err error
+			id, err = redis.String(reply, nil)
+			return err
+		})
+		if err := tx.Exec(); err != nil {
+			return err
+		}
+		keys := Args{uniqueKey, c.spec.deletedKey()}
+		if id != "" {
+			modelKey, err := c.spec.modelKey(id)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, modelKey)
+		}
+		args := variadicScriptArgs(keys, hashValue, id)
+		for _, redisName := range c.spec.fieldRedisNames() {
+			args = append(args, redisName)
+		}
+		action.args = args
+		return nil
+	})
+	t.afterFind(model)
+}
+
+// uniqueArgs returns the arguments which describe the unique field fs of the
+// model to the conditional_save script: its kind ("unique", or "nullunique" if
+// the field is nil), the key of the hash of unique values, the name of the
+// field in Redis and the value of the field as it is stored in Redis.
+func (mr *modelRef) uniqueArgs(fs *fieldSpec) (Args, error) {
+	uniqueKey, err := mr.spec.uniqueKey(fs.name)
+	if err != nil {
+		return nil, err
+	}
+	if fieldValue := mr.fieldValue(fs.name); fieldValue.Kind() == reflect.Ptr && fieldValue.IsNil() {
+		return Args{"nullunique", uniqueKey, fs.redisName, ""}, nil
+	}
+	hashArgs, err := mr.mainHashArgsForFields([]string{fs.name})
+	if err != nil {
+		return nil, err
+	}
+	// The args consist of the key followed by the name and value of the field
+	return Args{"unique", uniqueKey, fs.redisName, hashArgs[2]}, nil
+}
+
+// deleteUniqueValues adds scripts to the transaction which release the values
+// of the unique fields of the model with the given id, so that other models can
+// use them.
+// NOTE: this invokes a lua script which is defined in scripts/delete_unique_value.lua
+func (t *Transaction) deleteUniqueValues(c *Collection, id string) {
+	for _, fs := range c.spec.fields {
+		if !fs.unique {
+			continue
+		}
+		uniqueKey, err := c.spec.uniqueKey(fs.name)
+		if err != nil {
+			t.setError(err)
+			return
+		}
+		t.Script(deleteUniqueValueScript, Args{c.ModelKey(id), uniqueKey, c.spec.stringValuesKey(), id, fs.redisName}, nil)
+	}
+}
+
+// fieldNameForRedisName returns the name of the field which is stored in Redis
+// under redisName, or redisName itself if there is no such field.
+func (ms *modelSpec) fieldNameForRedisName(redisName string) string {
+	for _, fs := range ms.fields {
+		if fs.redisName == redisName {
+			return fs.name
+		}
+	}
+	return redisName
+}
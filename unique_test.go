@@ -0,0 +1,188 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File unique_test.go tests the code in unique.go
+
+package zoom
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUniqueFields(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	nickname := "bobby"
+	bob := &uniqueTestModel{Email: "bob@example.com", Nickname: &nickname, Int: 1}
+	require.NoError(t, uniqueTestModels.Save(bob))
+	// Saving the same model again should not conflict with itself.
+	bob.Int = 2
+	require.NoError(t, uniqueTestModels.Save(bob))
+
+	// Another model with the same value should not be saved.
+	other := &uniqueTestModel{Email: "bob@example.com"}
+	err := uniqueTestModels.Save(other)
+	require.IsType(t, UniqueConstraintError{}, err)
+	assert.Equal(t, "Email", err.(UniqueConstraintError).Field)
+	assert.Equal(t, bob.Id, err.(UniqueConstraintError).OtherId)
+	expectKeyDoesNotExist(t, uniqueTestModels.ModelKey(other.Id))
+	other.Email = "other@example.com"
+	other.Nickname = &nickname
+	err = uniqueTestModels.Save(other)
+	require.IsType(t, UniqueConstraintError{}, err)
+	assert.Equal(t, "Nickname", err.(UniqueConstraintError).Field)
+	// Nil pointers do not count as values.
+	other.Nickname = nil
+	require.NoError(t, uniqueTestModels.Save(other))
+	require.NoError(t, uniqueTestModels.Save(&uniqueTestModel{Email: "third@example.com"}))
+
+	// FindBy should find models by their unique values.
+	found := &uniqueTestModel{}
+	require.NoError(t, uniqueTestModels.FindBy("Email", "bob@example.com", found))
+	assert.Equal(t, bob, found)
+	found = &uniqueTestModel{}
+	require.NoError(t, uniqueTestModels.FindBy("Nickname", "bobby", found))
+	assert.Equal(t, bob.Id, found.Id)
+	err = uniqueTestModels.FindBy("Email", "missing@example.com", &uniqueTestModel{})
+	assert.IsType(t, ModelNotFoundError{}, err)
+	assert.Error(t, uniqueTestModels.FindBy("Int", 2, &uniqueTestModel{}))
+
+	// Changing the value should release the old one.
+	bob.Email = "robert@example.com"
+	require.NoError(t, uniqueTestModels.Save(bob))
+	err = uniqueTestModels.FindBy("Email", "bob@example.com", &uniqueTestModel{})
+	assert.IsType(t, ModelNotFoundError{}, err)
+	require.NoError(t, uniqueTestModels.SaveFields([]string{"Email"}, &uniqueTestModel{Email: "bob@example.com", RandomId: other.RandomId}))
+
+	// SetField and CompareAndSetField should enforce unique values too.
+	err = uniqueTestModels.SetField(other.Id, "Email", "robert@example.com")
+	require.IsType(t, UniqueConstraintError{}, err)
+	assert.Equal(t, bob.Id, err.(UniqueConstraintError).OtherId)
+	require.NoError(t, uniqueTestModels.SetField(other.Id, "Nickname", "otto"))
+	require.NoError(t, uniqueTestModels.FindBy("Nickname", "otto", found))
+	assert.Equal(t, other.Id, found.Id)
+	_, err = uniqueTestModels.CompareAndSetField(bob.Id, "Nickname", "bobby", "otto")
+	assert.IsType(t, UniqueConstraintError{}, err)
+	_, err = uniqueTestModels.Increment(bob.Id, "Int", 1)
+	assert.NoError(t, err)
+
+	// Deleting a model should release its values.
+	_, err = uniqueTestModels.Delete(bob.Id)
+	require.NoError(t, err)
+	require.NoError(t, uniqueTestModels.Save(&uniqueTestModel{Email: "robert@example.com", Nickname: &nickname}))
+	_, err = uniqueTestModels.DeleteAll()
+	require.NoError(t, err)
+	expectKeyDoesNotExist(t, uniqueTestModels.spec.keyspace()+":Email:unique")
+	require.NoError(t, uniqueTestModels.Save(&uniqueTestModel{Email: "bob@example.com"}))
+}
+
+func TestUniqueFieldExpired(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	model := &uniqueTestModel{Email: "expired@example.com"}
+	other := &uniqueTestModel{Email: "other@example.com"}
+	require.NoError(t, uniqueTestModels.SaveMany([]*uniqueTestModel{model, other}))
+	// Expire the models right away. The value should be free to use even though
+	// it is still in the hash of values until the models are swept.
+	for _, id := range []string{model.Id, other.Id} {
+		_, err := uniqueTestModels.ExpireAt(id, time.Now().Add(-time.Second))
+		require.NoError(t, err)
+	}
+	err := uniqueTestModels.FindBy("Email", "expired@example.com", &uniqueTestModel{})
+	assert.IsType(t, ModelNotFoundError{}, err)
+	newModel := &uniqueTestModel{Email: "expired@example.com"}
+	require.NoError(t, uniqueTestModels.Save(newModel))
+
+	// Sweeping the expired models should release the values they still own.
+	count, err := uniqueTestModels.SweepExpired()
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	conn := testPool.NewConn()
+	defer conn.Close()
+	owners, err := redis.StringMap(conn.Do("HGETALL", uniqueTestModels.spec.keyspace()+":Email:unique"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"expired@example.com": newModel.Id}, owners)
+	values, err := redis.StringMap(conn.Do("HGETALL", uniqueTestModels.spec.stringValuesKey()))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{stringValueField("Email", newModel.Id): "expired@example.com"}, values)
+
+	// Reindex should record the values of models which were saved by older
+	// versions.
+	_, err = conn.Do("DEL", uniqueTestModels.spec.stringValuesKey())
+	require.NoError(t, err)
+	require.NoError(t, uniqueTestModels.Reindex())
+	values, err = redis.StringMap(conn.Do("HGETALL", uniqueTestModels.spec.stringValuesKey()))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{stringValueField("Email", newModel.Id): "expired@example.com"}, values)
+}
+
+// moveValueHook calls move right after the first HGET which is sent while it
+// is enabled, i.e. after FindBy has looked up the id of a model.
+type moveValueHook struct {
+	move    func()
+	enabled bool
+}
+
+func (h *moveValueHook) BeforeExec(ctx context.Context, info *ExecInfo) context.Context {
+	return ctx
+}
+
+func (h *moveValueHook) AfterExec(ctx context.Context, info *ExecInfo)      {}
+func (h *moveValueHook) BeforeAction(ctx context.Context, info *ActionInfo) {}
+
+func (h *moveValueHook) AfterAction(ctx context.Context, info *ActionInfo) {
+	if h.enabled && info.Command == "HGET" {
+		h.enabled = false
+		h.move()
+	}
+}
+
+func TestFindByValueMoved(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	hook := &moveValueHook{}
+	pool := NewPoolWithOptions(testPool.options.WithHooks(hook))
+	defer pool.Close()
+	col, err := pool.NewCollectionWithOptions(&uniqueTestModel{}, DefaultCollectionOptions)
+	require.NoError(t, err)
+	first := &uniqueTestModel{Email: "first@example.com"}
+	second := &uniqueTestModel{Email: "second@example.com"}
+	require.NoError(t, col.SaveMany([]*uniqueTestModel{first, second}))
+	// swap swaps the emails of the models, using another pool so that the hook
+	// is not called again.
+	swap := func() {
+		firstEmail, secondEmail := first.Email, second.Email
+		first.Email = "tmp@example.com"
+		require.NoError(t, uniqueTestModels.Save(first))
+		second.Email = firstEmail
+		require.NoError(t, uniqueTestModels.Save(second))
+		first.Email = secondEmail
+		require.NoError(t, uniqueTestModels.Save(first))
+	}
+	hook.move = swap
+
+	// A transaction should fail if the value is given to another model after
+	// it was looked up.
+	hook.enabled = true
+	tx := pool.NewTransaction()
+	tx.FindBy(col, "Email", "first@example.com", &uniqueTestModel{})
+	assert.IsType(t, WatchError{}, tx.Exec())
+
+	// FindBy should look the value up again.
+	hook.enabled = true
+	found := &uniqueTestModel{}
+	require.NoError(t, col.FindBy("Email", "first@example.com", found))
+	assert.False(t, hook.enabled, "The hook was not called")
+	assert.Equal(t, first.Id, found.Id)
+	assert.Equal(t, "first@example.com", found.Email)
+}
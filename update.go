@@ -0,0 +1,416 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File update.go contains code related to atomically updating a single field
+// of a model, including the Increment, SetField and CompareAndSetField methods.
+
+package zoom
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Increment atomically adds delta (which may be negative) to the integer field
+// identified by fieldName of the model with the given id, and returns the new
+// value. Unlike Find followed by Save, Increment does not need to read the
+// model first, so concurrent increments are never lost. The field index (if
+// any) is kept in sync, the version field (if any) is incremented and the
+// updated field (if any) is set to the current time. Increment returns a
+// ModelNotFoundError if the model does not exist or has been soft deleted.
+// Validation rules are not checked, and unique fields cannot be incremented.
+func (c *Collection) Increment(id string, fieldName string, delta int64) (int64, error) {
+	return c.IncrementContext(context.Background(), id, fieldName, delta)
+}
+
+// IncrementContext is like Increment but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) IncrementContext(ctx context.Context, id string, fieldName string, delta int64) (int64, error) {
+	t := c.pool.NewTransactionContext(ctx)
+	newValue := int64(0)
+	t.Increment(c, id, fieldName, delta, &newValue)
+	if err := t.Exec(); err != nil {
+		return 0, err
+	}
+	return newValue, nil
+}
+
+// Increment atomically adds delta to the integer field identified by fieldName
+// of the model with the given id in an existing transaction. newValue will be
+// set to the new value of the field when the transaction is executed. You may
+// pass in nil for newValue if you do not care about the new value. Any errors
+// encountered, including a ModelNotFoundError if the model does not exist, will
+// be added to the transaction and returned as an error when the transaction is
+// executed.
+func (t *Transaction) Increment(c *Collection, id string, fieldName string, delta int64, newValue *int64) {
+	if c == nil {
+		t.setError(newNilCollectionError("Increment"))
+		return
+	}
+	fs, err := c.updatableField("Increment", fieldName)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	if fs.kind != primativeField || !typeIsInteger(fs.typ) || fs.unique {
+		t.setError(fmt.Errorf("zoom: Error in Increment or Transaction.Increment: Field %s must be an integer which is not unique but has type %s", fs.name, fs.typ))
+		return
+	}
+	mr := c.newModelRef(id)
+	t.updateField(mr, fs, "increment", delta, "", func(reply interface{}) error {
+		if newValue == nil {
+			return nil
+		}
+		value, err := redis.Int64(reply, nil)
+		if err != nil {
+			return err
+		}
+		*newValue = value
+		return nil
+	})
+}
+
+// IncrementFloat is like Increment but for floating point fields.
+func (c *Collection) IncrementFloat(id string, fieldName string, delta float64) (float64, error) {
+	return c.IncrementFloatContext(context.Background(), id, fieldName, delta)
+}
+
+// IncrementFloatContext is like IncrementFloat but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) IncrementFloatContext(ctx context.Context, id string, fieldName string, delta float64) (float64, error) {
+	t := c.pool.NewTransactionContext(ctx)
+	newValue := float64(0)
+	t.IncrementFloat(c, id, fieldName, delta, &newValue)
+	if err := t.Exec(); err != nil {
+		return 0, err
+	}
+	return newValue, nil
+}
+
+// IncrementFloat is like Increment but for floating point fields.
+func (t *Transaction) IncrementFloat(c *Collection, id string, fieldName string, delta float64, newValue *float64) {
+	if c == nil {
+		t.setError(newNilCollectionError("IncrementFloat"))
+		return
+	}
+	fs, err := c.updatableField("IncrementFloat", fieldName)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	if k := fs.typ.Kind(); fs.kind != primativeField || (k != reflect.Float32 && k != reflect.Float64) || fs.unique {
+		t.setError(fmt.Errorf("zoom: Error in IncrementFloat or Transaction.IncrementFloat: Field %s must be a float which is not unique but has type %s", fs.name, fs.typ))
+		return
+	}
+	mr := c.newModelRef(id)
+	t.updateField(mr, fs, "incrementfloat", delta, "", func(reply interface{}) error {
+		if newValue == nil {
+			return nil
+		}
+		value, err := redis.Float64(reply, nil)
+		if err != nil {
+			return err
+		}
+		*newValue = value
+		return nil
+	})
+}
+
+// SetField atomically sets the field identified by fieldName of the model with
+// the given id to value, without reading or writing any of the other fields.
+// value must be assignable to the field, or to the type it points to if the
+// field is a pointer, or nil if the field can be nil. The validation rules for
+// the field are checked, the field index (if any) is kept in sync, the version
+// field (if any) is incremented and the updated field (if any) is set to the
+// current time. SetField returns a ModelNotFoundError if the model does not
+// exist or has been soft deleted, or a UniqueConstraintError if the field is unique and another model
+// already has the value.
+func (c *Collection) SetField(id string, fieldName string, value interface{}) error {
+	return c.SetFieldContext(context.Background(), id, fieldName, value)
+}
+
+// SetFieldContext is like SetField but uses the given context. See
+// Pool.NewTransactionContext for a description of how the context is used.
+func (c *Collection) SetFieldContext(ctx context.Context, id string, fieldName string, value interface{}) error {
+	t := c.pool.NewTransactionContext(ctx)
+	t.SetField(c, id, fieldName, value)
+	return t.Exec()
+}
+
+// SetField atomically sets the field identified by fieldName of the model with
+// the given id to value in an existing transaction. Any errors encountered,
+// including a ModelNotFoundError if the model does not exist, will be added to
+// the transaction and returned as an error when the transaction is executed.
+func (t *Transaction) SetField(c *Collection, id string, fieldName string, value interface{}) {
+	if c == nil {
+		t.setError(newNilCollectionError("SetField"))
+		return
+	}
+	fs, err := c.updatableField("SetField", fieldName)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	mr := c.newModelRef(id)
+	hashValue, err := mr.setFieldValue("SetField", fs, value)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	if !t.validateField(mr, fs) {
+		return
+	}
+	t.updateField(mr, fs, "set", hashValue, "", nil)
+}
+
+// CompareAndSetField is like SetField, but only sets the field to newValue if
+// its stored value is equal to oldValue. The values are compared in the form in
+// which they are stored in Redis, so oldValue must be assignable to the field
+// in the same way as newValue, and fields which are encoded with the fallback
+// MarshalerUnmarshaler are not supported. CompareAndSetField returns true iff
+// the field was set.
+func (c *Collection) CompareAndSetField(id string, fieldName string, oldValue interface{}, newValue interface{}) (bool, error) {
+	return c.CompareAndSetFieldContext(context.Background(), id, fieldName, oldValue, newValue)
+}
+
+// CompareAndSetFieldContext is like CompareAndSetField but uses the given
+// context. See Pool.NewTransactionContext for a description of how the context
+// is used.
+func (c *Collection) CompareAndSetFieldContext(ctx context.Context, id string, fieldName string, oldValue interface{}, newValue interface{}) (bool, error) {
+	t := c.pool.NewTransactionContext(ctx)
+	swapped := false
+	t.CompareAndSetField(c, id, fieldName, oldValue, newValue, &swapped)
+	if err := t.Exec(); err != nil {
+		return false, err
+	}
+	return swapped, nil
+}
+
+// CompareAndSetField is like SetField, but only sets the field to newValue if
+// its stored value is equal to oldValue. swapped will be set to true iff the
+// field was set when the transaction is executed. You may pass in nil for
+// swapped if you do not care whether or not the field was set. Any errors
+// encountered, including a ModelNotFoundError if the model does not exist, will
+// be added to the transaction and returned as an error when the transaction is
+// executed.
+func (t *Transaction) CompareAndSetField(c *Collection, id string, fieldName string, oldValue interface{}, newValue interface{}, swapped *bool) {
+	if c == nil {
+		t.setError(newNilCollectionError("CompareAndSetField"))
+		return
+	}
+	fs, err := c.updatableField("CompareAndSetField", fieldName)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	if fs.kind == inconvertibleField {
+		t.setError(fmt.Errorf("zoom: Error in CompareAndSetField or Transaction.CompareAndSetField: Field %s has type %s, which cannot be compared", fs.name, fs.typ))
+		return
+	}
+	oldHashValue, err := c.newModelRef(id).setFieldValue("CompareAndSetField", fs, oldValue)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	mr := c.newModelRef(id)
+	hashValue, err := mr.setFieldValue("CompareAndSetField", fs, newValue)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	if !t.validateField(mr, fs) {
+		return
+	}
+	t.updateField(mr, fs, "compareandset", hashValue, oldHashValue, func(reply interface{}) error {
+		if swapped != nil {
+			*swapped = reply != nil
+		}
+		return nil
+	})
+}
+
+// updatableField returns the spec for the field identified by fieldName. It
+// returns an error if the collection does not have the field or if the field is
+// managed by zoom (i.e. the version, soft delete, created or updated field).
+func (c *Collection) updatableField(methodName string, fieldName string) (*fieldSpec, error) {
+	fs, found := c.spec.fieldsByName[fieldName]
+	if !found {
+		return nil, fmt.Errorf("zoom: Error in %s or Transaction.%s: Collection %s does not have field named %s", methodName, methodName, c.Name(), fieldName)
+	}
+	for _, managed := range []*fieldSpec{c.spec.versionField, c.spec.softDeleteField, c.spec.createdField, c.spec.updatedField} {
+		if fs == managed {
+			return nil, fmt.Errorf("zoom: Error in %s or Transaction.%s: Field %s is managed by zoom and cannot be updated directly", methodName, methodName, fieldName)
+		}
+	}
+	return fs, nil
+}
+
+// newModelRef returns a modelRef for a new model of the type of the collection
+// which has nothing but the given id set.
+func (c *Collection) newModelRef(id string) *modelRef {
+	model := reflect.New(c.spec.typ.Elem()).Interface().(Model)
+	model.SetModelId(id)
+	return &modelRef{
+		collection: c,
+		model:      model,
+		spec:       c.spec,
+	}
+}
+
+// setFieldValue sets the field fs of the model to value and returns the value
+// as it would be stored in the main hash. It returns an error if value cannot
+// be assigned to the field.
+func (mr *modelRef) setFieldValue(methodName string, fs *fieldSpec, value interface{}) (interface{}, error) {
+	fieldVal := mr.fieldValue(fs.name)
+	if value == nil {
+		switch fs.typ.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+			// The field is already nil
+		default:
+			return nil, fmt.Errorf("zoom: Error in %s or Transaction.%s: Field %s of type %s cannot be nil", methodName, methodName, fs.name, fs.typ)
+		}
+	} else if val := reflect.ValueOf(value); val.Type().AssignableTo(fs.typ) {
+		fieldVal.Set(val)
+	} else if fs.kind == pointerField && val.Type().AssignableTo(fs.typ.Elem()) {
+		fieldVal.Set(reflect.New(fs.typ.Elem()))
+		fieldVal.Elem().Set(val)
+	} else {
+		return nil, fmt.Errorf("zoom: Error in %s or Transaction.%s: Cannot assign value of type %T to field %s of type %s", methodName, methodName, value, fs.name, fs.typ)
+	}
+	hashArgs, err := mr.mainHashArgsForFields([]string{fs.name})
+	if err != nil {
+		return nil, err
+	}
+	// The args consist of the key followed by the name and value of the field
+	return hashArgs[2], nil
+}
+
+// validateField checks the validation rules for the field fs of the model and
+// sets the error of the transaction to a ValidationError if any of them fail. It
+// returns false iff the field is invalid.
+func (t *Transaction) validateField(mr *modelRef, fs *fieldSpec) bool {
+	if fieldErrors := fs.validate(mr.fieldValue(fs.name)); len(fieldErrors) > 0 {
+		t.setError(ValidationError{Fields: fieldErrors})
+		return false
+	}
+	return true
+}
+
+// updateField adds a script to the transaction which atomically updates the
+// field fs of the model and its field index, if the model exists and has not
+// been soft deleted. mode and value have the meaning described in the script,
+// and oldValue is the expected old value for "compareandset". handler (if not
+// nil) is called with the new value of the field if it was updated, or with nil
+// if the stored value did not match oldValue. If the model does not exist (or
+// has been soft deleted) or the new value of a unique field belongs to another
+// model, the handler is not called and Exec returns a ModelNotFoundError or a
+// UniqueConstraintError.
+// NOTE: this invokes a lua script which is defined in scripts/update_field.lua
+func (t *Transaction) updateField(mr *modelRef, fs *fieldSpec, mode string, value interface{}, oldValue interface{}, handler ReplyHandler) {
+	modelKey, err := mr.spec.modelKey(mr.model.ModelId())
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	keys := Args{modelKey, mr.spec.deletedKey()}
+	versionField, updatedField, updatedIndexed := "", "", 0
+	if mr.spec.versionField != nil {
+		versionField = mr.spec.versionField.redisName
+	}
+	if mr.spec.updatedField != nil {
+		updatedField = mr.spec.updatedField.redisName
+		if mr.spec.updatedField.indexKind != noIndex {
+			updatedIndexKey, _ := mr.spec.fieldIndexKey(mr.spec.updatedField.name)
+			keys = append(keys, updatedIndexKey)
+			updatedIndexed = 1
+		}
+	}
+	indexArgs, err := mr.fieldIndexArgs(fs)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	if fs.indexKind != noIndex {
+		keys = append(keys, indexArgs[1])
+	}
+	if fs.indexKind == stringIndex || fs.unique {
+		keys = append(keys, mr.spec.stringValuesKey())
+	}
+	uniqueKind := ""
+	if fs.unique {
+		uniqueArgs, err := mr.uniqueArgs(fs)
+		if err != nil {
+			t.setError(err)
+			return
+		}
+		// The script already has the value, so only the kind and key are needed
+		uniqueKind = keyString(uniqueArgs[0])
+		keys = append(keys, uniqueArgs[1], mr.spec.expirationsKey())
+	}
+	args := variadicScriptArgs(keys, mode, mr.model.ModelId(), fs.redisName, value, oldValue, versionField, updatedField, timeToUnixMicro(time.Now()), updatedIndexed, indexArgs[0], indexArgs[2], uniqueKind)
+	t.Script(updateFieldScript, args, func(reply interface{}) error {
+		// The reply consists of a status and the new value. See the script for
+		// details.
+		values, err := redis.Values(reply, nil)
+		if err != nil {
+			return err
+		}
+		if len(values) != 2 {
+			return fmt.Errorf("zoom: Error in updateField: Unexpected reply from Redis: %v", values)
+		}
+		status, err := redis.Int64(values[0], nil)
+		if err != nil {
+			return err
+		}
+		switch status {
+		case 0:
+			return newModelNotFoundError(mr)
+		case -2:
+			otherId, err := redis.String(values[1], nil)
+			if err != nil {
+				return err
+			}
+			return newUniqueConstraintError(mr.collection, fs.name, otherId)
+		case -1:
+			values[1] = nil
+		}
+		if handler == nil {
+			return nil
+		}
+		return handler(values[1])
+	})
+}
+
+// fieldIndexArgs returns the arguments which describe the field index for the
+// field fs of the model: its kind, its key and either the score or the value of
+// the field. All three are empty strings if the field is not indexed.
+func (mr *modelRef) fieldIndexArgs(fs *fieldSpec) (Args, error) {
+	if fs.indexKind == noIndex {
+		return Args{"", "", ""}, nil
+	}
+	indexKey, err := mr.spec.fieldIndexKey(fs.name)
+	if err != nil {
+		return nil, err
+	}
+	fieldValue := mr.fieldValue(fs.name)
+	for fieldValue.Kind() == reflect.Ptr && !fieldValue.IsNil() {
+		fieldValue = fieldValue.Elem()
+	}
+	isNil := fieldValue.Kind() == reflect.Ptr
+	switch {
+	case fs.indexKind == stringIndex && isNil:
+		return Args{"nullstring", indexKey, ""}, nil
+	case fs.indexKind == stringIndex:
+		return Args{"string", indexKey, fieldValue.String()}, nil
+	case isNil:
+		return Args{"nullscore", indexKey, ""}, nil
+	case fs.indexKind == booleanIndex:
+		return Args{"score", indexKey, boolScore(fieldValue)}, nil
+	}
+	return Args{"score", indexKey, numericScore(fieldValue)}, nil
+}
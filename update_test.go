@@ -0,0 +1,164 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File update_test.go tests the code in update.go
+
+package zoom
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIncrement(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	model := createIndexedPrimativesModel()
+	model.Int = 5
+	model.Float64 = 1.5
+	require.NoError(t, indexedPrimativesModels.Save(model))
+
+	newInt, err := indexedPrimativesModels.Increment(model.Id, "Int", 3)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), newInt)
+	newInt, err = indexedPrimativesModels.Increment(model.Id, "Int", -10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-2), newInt)
+	newFloat, err := indexedPrimativesModels.IncrementFloat(model.Id, "Float64", 0.25)
+	require.NoError(t, err)
+	assert.Equal(t, 1.75, newFloat)
+
+	// The stored values and the field indexes should be updated.
+	model.Int = -2
+	model.Float64 = 1.75
+	found := &indexedPrimativesModel{}
+	require.NoError(t, indexedPrimativesModels.Find(model.Id, found))
+	assert.Equal(t, model, found)
+	expectIndexExists(t, indexedPrimativesModels, model, "Int")
+	expectIndexExists(t, indexedPrimativesModels, model, "Float64")
+
+	// Concurrent increments should not be lost.
+	tx := testPool.NewTransaction()
+	for i := 0; i < 10; i++ {
+		tx.Increment(indexedPrimativesModels, model.Id, "Int", 1, nil)
+	}
+	tx.Increment(indexedPrimativesModels, model.Id, "Int", 1, &newInt)
+	require.NoError(t, tx.Exec())
+	assert.Equal(t, int64(9), newInt)
+
+	_, err = indexedPrimativesModels.Increment("missing", "Int", 1)
+	assert.IsType(t, ModelNotFoundError{}, err)
+	_, err = indexedPrimativesModels.Increment(model.Id, "String", 1)
+	assert.Error(t, err)
+	_, err = indexedPrimativesModels.IncrementFloat(model.Id, "Int", 1)
+	assert.Error(t, err)
+	_, err = indexedPrimativesModels.Increment(model.Id, "Missing", 1)
+	assert.Error(t, err)
+}
+
+func TestSetField(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	model := createIndexedPrimativesModel()
+	require.NoError(t, indexedPrimativesModels.Save(model))
+	oldModel := *model
+
+	require.NoError(t, indexedPrimativesModels.SetField(model.Id, "String", "updated"))
+	require.NoError(t, indexedPrimativesModels.SetField(model.Id, "Bool", !model.Bool))
+	require.NoError(t, indexedPrimativesModels.SetField(model.Id, "Uint8", uint8(42)))
+	model.String = "updated"
+	model.Bool = !model.Bool
+	model.Uint8 = 42
+	found := &indexedPrimativesModel{}
+	require.NoError(t, indexedPrimativesModels.Find(model.Id, found))
+	assert.Equal(t, model, found)
+	for _, fieldName := range []string{"String", "Bool", "Uint8"} {
+		expectIndexExists(t, indexedPrimativesModels, model, fieldName)
+		expectIndexDoesNotExist(t, indexedPrimativesModels, &oldModel, fieldName)
+	}
+
+	// Pointer fields can be set to a value or to nil.
+	pointers := createIndexedPointersModel()
+	require.NoError(t, indexedPointersModels.Save(pointers))
+	require.NoError(t, indexedPointersModels.SetField(pointers.Id, "Int", 7))
+	foundPointers := &indexedPointersModel{}
+	require.NoError(t, indexedPointersModels.Find(pointers.Id, foundPointers))
+	require.NotNil(t, foundPointers.Int)
+	assert.Equal(t, 7, *foundPointers.Int)
+	expectIndexExists(t, indexedPointersModels, foundPointers, "Int")
+	require.NoError(t, indexedPointersModels.SetField(pointers.Id, "String", nil))
+	foundPointers = &indexedPointersModel{}
+	require.NoError(t, indexedPointersModels.Find(pointers.Id, foundPointers))
+	assert.Nil(t, foundPointers.String)
+	expectIndexDoesNotExist(t, indexedPointersModels, pointers, "String")
+
+	err := indexedPrimativesModels.SetField("missing", "String", "foo")
+	assert.IsType(t, ModelNotFoundError{}, err)
+	expectKeyDoesNotExist(t, indexedPrimativesModels.ModelKey("missing"))
+	assert.Error(t, indexedPrimativesModels.SetField(model.Id, "String", 1))
+	assert.Error(t, indexedPrimativesModels.SetField(model.Id, "Int", nil))
+
+	// The validation rules for the field should be checked.
+	valid := newValidTestModel()
+	require.NoError(t, validatedTestModels.Save(valid))
+	err = validatedTestModels.SetField(valid.Id, "Color", "pink")
+	require.IsType(t, ValidationError{}, err)
+	assert.Equal(t, "oneof=red green blue", err.(ValidationError).Fields[0].Rule)
+}
+
+func TestCompareAndSetField(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	model := &indexedTestModel{Int: 1, String: "a"}
+	require.NoError(t, indexedTestModels.Save(model))
+	swapped, err := indexedTestModels.CompareAndSetField(model.Id, "String", "b", "c")
+	require.NoError(t, err)
+	assert.False(t, swapped)
+	swapped, err = indexedTestModels.CompareAndSetField(model.Id, "String", "a", "c")
+	require.NoError(t, err)
+	assert.True(t, swapped)
+	swapped, err = indexedTestModels.CompareAndSetField(model.Id, "Int", 1, 2)
+	require.NoError(t, err)
+	assert.True(t, swapped)
+	model.String = "c"
+	model.Int = 2
+	found := &indexedTestModel{}
+	require.NoError(t, indexedTestModels.Find(model.Id, found))
+	assert.Equal(t, model, found)
+	expectIndexExists(t, indexedTestModels, model, "String")
+	expectIndexExists(t, indexedTestModels, model, "Int")
+	_, err = indexedTestModels.CompareAndSetField("missing", "Int", 1, 2)
+	assert.IsType(t, ModelNotFoundError{}, err)
+}
+
+func TestUpdateFieldManagedFields(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// The version and updated fields should change with every update.
+	versioned := &versionedTestModel{String: "a"}
+	require.NoError(t, versionedTestModels.Save(versioned))
+	require.NoError(t, versionedTestModels.SetField(versioned.Id, "String", "b"))
+	versioned.String = "c"
+	err := versionedTestModels.Save(versioned)
+	assert.IsType(t, VersionConflictError{}, err, "A stale model should not overwrite an atomic update")
+	_, err = versionedTestModels.Increment(versioned.Id, "Version", 1)
+	assert.Error(t, err)
+
+	timestamped := &timestampedTestModel{Int: 1}
+	require.NoError(t, timestampedTestModels.Save(timestamped))
+	_, err = timestampedTestModels.Increment(timestamped.Id, "Int", 1)
+	require.NoError(t, err)
+	found := &timestampedTestModel{}
+	require.NoError(t, timestampedTestModels.Find(timestamped.Id, found))
+	assert.Equal(t, 2, found.Int)
+	assert.True(t, found.UpdatedAt.After(timestamped.UpdatedAt))
+	expectIndexExists(t, timestampedTestModels, found, "UpdatedAt")
+	assert.Error(t, timestampedTestModels.SetField(timestamped.Id, "CreatedAt", timestamped.CreatedAt))
+}
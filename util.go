@@ -163,6 +163,26 @@ func typeIsNumeric(typ reflect.Type) bool {
 	}
 }
 
+// typeIsInteger returns true iff typ is one of the signed or unsigned integer
+// types.
+func typeIsInteger(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return typeIsUnsignedInteger(typ)
+}
+
+// typeIsUnsignedInteger returns true iff typ is one of the unsigned integer
+// types.
+func typeIsUnsignedInteger(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
 // typeIsBool returns true iff typ is a bool
 func typeIsBool(typ reflect.Type) bool {
 	k := typ.Kind()
@@ -177,11 +197,15 @@ func typeIsPrimative(typ reflect.Type) bool {
 
 // numericScore returns a float64 which is the score for val in a sorted set.
 // If val is a pointer, it will keep dereferencing until it reaches the underlying
-// value. It panics if val is not a numeric type or a pointer to a numeric type.
+// value. The score for a time.Time is the Unix timestamp in microseconds. It
+// panics if val is not a numeric type, a time.Time or a pointer to either.
 func numericScore(val reflect.Value) float64 {
 	for val.Kind() == reflect.Ptr {
 		val = val.Elem()
 	}
+	if val.Type() == reflect.TypeOf(time.Time{}) {
+		return float64(timeToUnixMicro(val.Interface().(time.Time)))
+	}
 	switch val.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		integer := val.Int()
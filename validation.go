@@ -0,0 +1,276 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File validation.go contains code related to validating models before they
+// are saved, including the validation rules in struct tags.
+
+package zoom
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Validator is implemented by models which need to check that they are valid
+// before they are saved. Validate is called by Save, SaveFields, Create, Update
+// and SaveMany (and the corresponding Transaction methods) after the rules in
+// the struct tags have been checked. If it returns a ValidationError, its
+// Fields are added to the fields which failed those rules. Any other error is
+// added as a FieldError without a Field. If there are any failing fields, the
+// transaction is aborted before anything is sent to Redis and Exec returns a
+// ValidationError.
+type Validator interface {
+	Validate() error
+}
+
+// ValidationError is returned by Save and the other methods which save models
+// if a model is invalid. It lists every field which failed validation.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		msgs[i] = field.Error()
+	}
+	return "zoom: ValidationError: " + strings.Join(msgs, "; ")
+}
+
+// FieldError describes a field which failed validation.
+type FieldError struct {
+	// Field is the name of the field in the struct, or an empty string if the
+	// error does not belong to a single field.
+	Field string
+	// Rule is the rule which failed as written in the struct tag (e.g. "min=3"),
+	// or an empty string if the error was returned by a Validator.
+	Rule string
+	// Msg describes the error, e.g. "must be at least 3".
+	Msg string
+}
+
+func (e FieldError) Error() string {
+	if e.Field == "" {
+		return e.Msg
+	}
+	return e.Field + " " + e.Msg
+}
+
+// ruleKind is the kind of a validation rule.
+type ruleKind int
+
+const (
+	requiredRule ruleKind = iota
+	minRule
+	maxRule
+	lenRule
+	oneOfRule
+	regexRule
+)
+
+// fieldRule is a validation rule for a field, which is specified in the "zoom"
+// struct tag and compiled by compileModelSpec.
+type fieldRule struct {
+	// name is the rule as written in the struct tag, e.g. "min=3"
+	name string
+	kind ruleKind
+	// limit is the parameter of min, max and len rules
+	limit float64
+	// values holds the allowed values for oneof rules
+	values []string
+	// regexp is the regular expression for regex rules
+	regexp *regexp.Regexp
+}
+
+// ruleNames maps the names of the validation rules to their kinds.
+var ruleNames = map[string]ruleKind{
+	"required": requiredRule,
+	"min":      minRule,
+	"max":      maxRule,
+	"len":      lenRule,
+	"oneof":    oneOfRule,
+	"regex":    regexRule,
+}
+
+// parseFieldRule parses op, which is an option in the "zoom" struct tag of the
+// field fs, as a validation rule. It returns an error if op is not a valid rule
+// for the type of the field.
+func parseFieldRule(fs *fieldSpec, op string) (*fieldRule, error) {
+	name, param := op, ""
+	if i := strings.Index(op, "="); i != -1 {
+		name, param = op[:i], op[i+1:]
+	}
+	kind, found := ruleNames[name]
+	if !found {
+		return nil, fmt.Errorf("zoom: unrecognized option specified in struct tag: %s", op)
+	}
+	if kind == requiredRule && param != "" {
+		return nil, fmt.Errorf("zoom: Invalid validation rule %s on field %s: required does not take a parameter", op, fs.name)
+	} else if kind != requiredRule && param == "" {
+		return nil, fmt.Errorf("zoom: Invalid validation rule %s on field %s: %s requires a parameter", op, fs.name, name)
+	}
+	typ := fs.typ
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	rule := &fieldRule{name: op, kind: kind}
+	switch kind {
+	case minRule, maxRule, lenRule:
+		limit, err := strconv.ParseFloat(param, 64)
+		if err != nil {
+			return nil, fmt.Errorf("zoom: Invalid validation rule %s on field %s: %s is not a number", op, fs.name, param)
+		}
+		rule.limit = limit
+		if !typeHasLength(typ) && (kind == lenRule || !typeIsNumeric(typ)) {
+			return nil, fmt.Errorf("zoom: Invalid validation rule %s on field %s: %s cannot be used on type %s", op, fs.name, name, fs.typ)
+		}
+	case oneOfRule:
+		rule.values = strings.Fields(param)
+		if typ.Kind() != reflect.String && !typeIsNumeric(typ) {
+			return nil, fmt.Errorf("zoom: Invalid validation rule %s on field %s: %s cannot be used on type %s", op, fs.name, name, fs.typ)
+		}
+		if typeIsNumeric(typ) {
+			for _, value := range rule.values {
+				if _, err := strconv.ParseFloat(value, 64); err != nil {
+					return nil, fmt.Errorf("zoom: Invalid validation rule %s on field %s: %s is not a number", op, fs.name, value)
+				}
+			}
+		}
+	case regexRule:
+		if typ.Kind() != reflect.String {
+			return nil, fmt.Errorf("zoom: Invalid validation rule %s on field %s: %s cannot be used on type %s", op, fs.name, name, fs.typ)
+		}
+		re, err := regexp.Compile(param)
+		if err != nil {
+			return nil, fmt.Errorf("zoom: Invalid validation rule %s on field %s: %s", op, fs.name, err.Error())
+		}
+		rule.regexp = re
+	}
+	return rule, nil
+}
+
+// typeHasLength returns true iff the length of values of type typ can be
+// checked by validation rules.
+func typeHasLength(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return true
+	}
+	return false
+}
+
+// check returns a message describing why val does not satisfy the rule, or an
+// empty string if it does. val is the value of the field, which may be a
+// pointer.
+func (rule *fieldRule) check(val reflect.Value) string {
+	if rule.kind == requiredRule {
+		if val.IsZero() {
+			return "is required"
+		}
+		return ""
+	}
+	for val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			// Only required applies to nil pointers
+			return ""
+		}
+		val = val.Elem()
+	}
+	switch rule.kind {
+	case minRule, maxRule, lenRule:
+		number, isLength := 0.0, typeHasLength(val.Type())
+		if isLength {
+			if val.Kind() == reflect.String {
+				number = float64(utf8.RuneCountInString(val.String()))
+			} else {
+				number = float64(val.Len())
+			}
+		} else {
+			number = numericScore(val)
+		}
+		limit := strconv.FormatFloat(rule.limit, 'f', -1, 64)
+		switch {
+		case rule.kind == lenRule && number != rule.limit:
+			return "must have a length of " + limit
+		case rule.kind == minRule && number < rule.limit && isLength:
+			return "must have a length of at least " + limit
+		case rule.kind == minRule && number < rule.limit:
+			return "must be at least " + limit
+		case rule.kind == maxRule && number > rule.limit && isLength:
+			return "must have a length of at most " + limit
+		case rule.kind == maxRule && number > rule.limit:
+			return "must be at most " + limit
+		}
+	case oneOfRule:
+		for _, value := range rule.values {
+			if val.Kind() == reflect.String && val.String() == value {
+				return ""
+			}
+			if val.Kind() != reflect.String {
+				if number, _ := strconv.ParseFloat(value, 64); number == numericScore(val) {
+					return ""
+				}
+			}
+		}
+		return "must be one of " + strings.Join(rule.values, ", ")
+	case regexRule:
+		if !rule.regexp.MatchString(val.String()) {
+			return "must match " + rule.regexp.String()
+		}
+	}
+	return ""
+}
+
+// validate checks the validation rules for the field against val, which is the
+// value of the field, and returns the rules which failed.
+func (fs *fieldSpec) validate(val reflect.Value) []FieldError {
+	var fieldErrors []FieldError
+	for _, rule := range fs.rules {
+		if msg := rule.check(val); msg != "" {
+			fieldErrors = append(fieldErrors, FieldError{Field: fs.name, Rule: rule.name, Msg: msg})
+		}
+	}
+	return fieldErrors
+}
+
+// validate checks the validation rules for the given fields of model and calls
+// its Validate method (if any). It returns a ValidationError if model is
+// invalid and nil otherwise.
+func (ms *modelSpec) validate(model Model, fieldNames []string) error {
+	var fieldErrors []FieldError
+	modelVal := reflect.ValueOf(model).Elem()
+	for _, fs := range ms.fields {
+		if len(fs.rules) == 0 || !stringSliceContains(fieldNames, fs.name) {
+			continue
+		}
+		fieldErrors = append(fieldErrors, fs.validate(modelVal.FieldByName(fs.name))...)
+	}
+	if validator, ok := model.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			if validationErr, ok := err.(ValidationError); ok {
+				fieldErrors = append(fieldErrors, validationErr.Fields...)
+			} else {
+				fieldErrors = append(fieldErrors, FieldError{Msg: err.Error()})
+			}
+		}
+	}
+	if len(fieldErrors) > 0 {
+		return ValidationError{Fields: fieldErrors}
+	}
+	return nil
+}
+
+// validate sets the error of the transaction to a ValidationError if the given
+// fields of model are invalid. It returns false iff model is invalid.
+func (t *Transaction) validate(c *Collection, model Model, fieldNames []string) bool {
+	if err := c.spec.validate(model, fieldNames); err != nil {
+		t.setError(err)
+		return false
+	}
+	return true
+}
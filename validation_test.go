@@ -0,0 +1,140 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File validation_test.go tests the code in validation.go
+
+package zoom
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (m *validatedTestModel) Validate() error {
+	if m.Name == "admin" {
+		return ValidationError{Fields: []FieldError{{Field: "Name", Msg: "is reserved"}}}
+	}
+	if m.Color == "blue" && m.Level == 3 {
+		return errors.New("blue models cannot be level 3")
+	}
+	return nil
+}
+
+// newValidTestModel returns a validatedTestModel which satisfies all of the
+// validation rules.
+func newValidTestModel() *validatedTestModel {
+	code := "abc"
+	return &validatedTestModel{
+		Name:  "Bob",
+		Age:   30,
+		Code:  &code,
+		Color: "red",
+		Level: 2,
+		Email: "bob@example.com",
+		Tags:  []string{"a", "b"},
+	}
+}
+
+func TestValidation(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	valid := newValidTestModel()
+	require.NoError(t, validatedTestModels.Save(valid))
+	expectModelExists(t, validatedTestModels, valid)
+	// Rules other than required do not apply to nil pointers.
+	valid.Code = nil
+	require.NoError(t, validatedTestModels.Save(valid))
+
+	invalid := &validatedTestModel{
+		Age:   10,
+		Code:  new(string),
+		Color: "pink",
+		Level: 4,
+		Email: "bob@example",
+		Tags:  []string{"a", "b", "c"},
+	}
+	err := validatedTestModels.Save(invalid)
+	require.IsType(t, ValidationError{}, err)
+	assert.Equal(t, []FieldError{
+		{Field: "Name", Rule: "required", Msg: "is required"},
+		{Field: "Name", Rule: "min=2", Msg: "must have a length of at least 2"},
+		{Field: "Age", Rule: "min=18", Msg: "must be at least 18"},
+		{Field: "Code", Rule: "len=3", Msg: "must have a length of 3"},
+		{Field: "Color", Rule: "oneof=red green blue", Msg: "must be one of red, green, blue"},
+		{Field: "Level", Rule: "oneof=1 2 3", Msg: "must be one of 1, 2, 3"},
+		{Field: "Email", Rule: `regex=^[a-z]+@[a-z]+\.(com|org)$`, Msg: `must match ^[a-z]+@[a-z]+\.(com|org)$`},
+		{Field: "Tags", Rule: "max=2", Msg: "must have a length of at most 2"},
+	}, err.(ValidationError).Fields)
+	assert.Contains(t, err.Error(), "Name is required; Name must have a length of at least 2; Age must be at least 18")
+	count, err := validatedTestModels.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 1, count, "An invalid model should not be saved")
+
+	// Max uses the number of characters in a string, not the number of bytes.
+	longName := newValidTestModel()
+	longName.Name = "ééééééééé"
+	longName.Age = 131
+	err = validatedTestModels.Save(longName)
+	require.IsType(t, ValidationError{}, err)
+	assert.Equal(t, []FieldError{
+		{Field: "Name", Rule: "max=8", Msg: "must have a length of at most 8"},
+		{Field: "Age", Rule: "max=130", Msg: "must be at most 130"},
+	}, err.(ValidationError).Fields)
+	longName.Name = "éééééééé"
+	longName.Age = 130
+	require.NoError(t, validatedTestModels.Save(longName))
+
+	// SaveFields only checks the fields which are saved.
+	invalid.Age = 40
+	require.NoError(t, validatedTestModels.SaveFields([]string{"Age"}, invalid))
+	err = validatedTestModels.SaveFields([]string{"Age", "Color"}, invalid)
+	require.IsType(t, ValidationError{}, err)
+	assert.Len(t, err.(ValidationError).Fields, 1)
+
+	// The errors returned by Validate are added to the failing fields.
+	reserved := newValidTestModel()
+	reserved.Name = "admin"
+	reserved.Age = 0
+	err = validatedTestModels.Save(reserved)
+	require.IsType(t, ValidationError{}, err)
+	assert.Equal(t, []FieldError{
+		{Field: "Age", Rule: "min=18", Msg: "must be at least 18"},
+		{Field: "Name", Msg: "is reserved"},
+	}, err.(ValidationError).Fields)
+	blue := newValidTestModel()
+	blue.Color = "blue"
+	blue.Level = 3
+	err = validatedTestModels.Create(blue)
+	require.IsType(t, ValidationError{}, err)
+	assert.Equal(t, "zoom: ValidationError: blue models cannot be level 3", err.Error())
+	expectModelDoesNotExist(t, validatedTestModels, blue)
+
+	// A transaction with an invalid model should not save anything.
+	tx := testPool.NewTransaction()
+	other := newValidTestModel()
+	tx.Save(validatedTestModels, other)
+	tx.Save(validatedTestModels, invalid)
+	require.IsType(t, ValidationError{}, tx.Exec())
+	expectModelDoesNotExist(t, validatedTestModels, other)
+}
+
+func TestValidationRegexWithComma(t *testing.T) {
+	type regexModel struct {
+		Code string `zoom:"index,regex=^[a-z]{1,3}$"`
+		RandomId
+	}
+	spec, err := compileModelSpec(reflect.TypeOf(&regexModel{}))
+	require.NoError(t, err)
+	fs := spec.fieldsByName["Code"]
+	assert.Equal(t, stringIndex, fs.indexKind)
+	require.Len(t, fs.rules, 1)
+	assert.Equal(t, "^[a-z]{1,3}$", fs.rules[0].regexp.String())
+	assert.NoError(t, spec.validate(&regexModel{Code: "abc"}, spec.fieldNames()))
+	assert.Error(t, spec.validate(&regexModel{Code: "abcd"}, spec.fieldNames()))
+}